@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/joho/godotenv"
+
+	"github.com/nacorid/x402-feed/internal/consumer"
+	db "github.com/nacorid/x402-feed/internal/database"
+	"github.com/nacorid/x402-feed/internal/export"
+	"github.com/nacorid/x402-feed/internal/retention"
+	srv "github.com/nacorid/x402-feed/internal/server"
+)
+
+const usage = `usage: feed-admin <command> [flags]
+
+commands:
+  pin [-feed name] [-expires duration] <post at-uri>   pin a post to the top of a feed
+  unpin [-feed name] <post at-uri>                     remove a pin
+  pins                                                 list every pin
+  import <archive file>                                store the posts in an archive of pruned posts
+  backup <file>                                        copy the sqlite database to file while it's in use
+  restore <backup file>                                replace the sqlite database with a backup, the feed
+                                                       generator must be stopped first
+  export [-format csv|jsonl|parquet] [-since date]     write posts to stdout or the -o file, optionally
+         [-until date] [-feed name] [-o file]          only those in a date range or feed
+`
+
+func main() {
+	err := run(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(args []string) error {
+	err := godotenv.Load()
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error loading .env file")
+	}
+
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+
+	// restoring replaces the database file so it mustn't be open
+	if args[0] == "restore" {
+		return restore(ctx, args[1:])
+	}
+
+	database, err := openDatabase()
+	if err != nil {
+		return fmt.Errorf("open store: %w", err)
+	}
+	defer database.Close()
+
+	switch args[0] {
+	case "pin":
+		return pin(ctx, database, args[1:])
+	case "unpin":
+		return unpin(ctx, database, args[1:])
+	case "pins":
+		return listPins(ctx, database)
+	case "import":
+		return importArchive(ctx, database, args[1:])
+	case "backup":
+		return backup(ctx, database, args[1:])
+	case "export":
+		return exportPosts(ctx, database, args[1:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// openDatabase connects to postgres if DATABASE_URL is set and otherwise opens the sqlite database in
+// DATABASE_PATH
+func openDatabase() (*db.Database, error) {
+	if dsn := os.Getenv("DATABASE_URL"); dsn != "" {
+		return db.NewPostgresDatabase(dsn)
+	}
+
+	return db.NewDatabase(sqlitePath())
+}
+
+// sqlitePath returns the path of the sqlite database in DATABASE_PATH
+func sqlitePath() string {
+	dbPath := os.Getenv("DATABASE_PATH")
+	if dbPath == "" {
+		dbPath = "./"
+	}
+	return path.Join(dbPath, "database.db")
+}
+
+func pin(ctx context.Context, database *db.Database, args []string) error {
+	flags := flag.NewFlagSet("pin", flag.ContinueOnError)
+	feed := flags.String("feed", "", "the feed to pin the post to. If not set the post is pinned to every feed")
+	expires := flags.Duration("expires", 0, "how long the post stays pinned for, for example 72h. If not set it stays pinned until unpinned")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("pin needs the at-uri of the post to pin")
+	}
+
+	uri, err := syntax.ParseATURI(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("parse post uri: %w", err)
+	}
+	if uri.Collection().String() != "app.bsky.feed.post" || uri.RecordKey() == "" {
+		return fmt.Errorf("%s is not the uri of a post", uri)
+	}
+
+	now := time.Now()
+	p := srv.Pin{
+		PostURI:   uri.String(),
+		UserDID:   uri.Authority().String(),
+		Feed:      *feed,
+		CreatedAt: now.UnixMilli(),
+	}
+	if *expires > 0 {
+		p.ExpiresAt = now.Add(*expires).UnixMilli()
+	}
+
+	err = database.CreatePin(ctx, p)
+	if err != nil {
+		return fmt.Errorf("create pin: %w", err)
+	}
+	audit(ctx, database, "pin", p.PostURI, fmt.Sprintf("feed=%s expiresIn=%s", *feed, *expires))
+	fmt.Printf("pinned %s\n", p.PostURI)
+	return nil
+}
+
+func unpin(ctx context.Context, database *db.Database, args []string) error {
+	flags := flag.NewFlagSet("unpin", flag.ContinueOnError)
+	feed := flags.String("feed", "", "the feed the post was pinned to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("unpin needs the at-uri of the pinned post")
+	}
+
+	err := database.DeletePin(ctx, flags.Arg(0), *feed)
+	if err != nil {
+		return fmt.Errorf("delete pin: %w", err)
+	}
+	audit(ctx, database, "unpin", flags.Arg(0), fmt.Sprintf("feed=%s", *feed))
+	fmt.Printf("unpinned %s\n", flags.Arg(0))
+	return nil
+}
+
+// audit records an action in the audit log along with the user that ran the command
+func audit(ctx context.Context, database *db.Database, action, subject, detail string) {
+	actor := "feed-admin"
+	if user := os.Getenv("USER"); user != "" {
+		actor += ":" + user
+	}
+	err := database.CreateAuditEntry(ctx, srv.AuditEntry{
+		Actor:     actor,
+		Action:    action,
+		Subject:   subject,
+		Detail:    detail,
+		CreatedAt: time.Now().UnixMilli(),
+	})
+	if err != nil {
+		log.Printf("failed to record audit entry: %s", err)
+	}
+}
+
+func listPins(ctx context.Context, database *db.Database) error {
+	pins, err := database.GetAllPins(ctx)
+	if err != nil {
+		return fmt.Errorf("get pins: %w", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "POST\tFEED\tPINNED\tEXPIRES")
+	for _, p := range pins {
+		feed := p.Feed
+		if feed == "" {
+			feed = "(all)"
+		}
+		expires := "never"
+		if p.ExpiresAt > 0 {
+			expires = time.UnixMilli(p.ExpiresAt).Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.PostURI, feed, time.UnixMilli(p.CreatedAt).Format(time.RFC3339), expires)
+	}
+	return w.Flush()
+}
+
+func importArchive(ctx context.Context, database *db.Database, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: feed-admin import <archive file>")
+	}
+
+	count, err := retention.ImportArchive(ctx, database, args[0])
+	if err != nil {
+		return fmt.Errorf("import archive after %d posts: %w", count, err)
+	}
+	audit(ctx, database, "import_archive", args[0], fmt.Sprintf("%d posts", count))
+	fmt.Printf("imported %d posts from %s\n", count, args[0])
+	return nil
+}
+
+func backup(ctx context.Context, database *db.Database, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: feed-admin backup <file>")
+	}
+
+	err := database.Backup(ctx, args[0])
+	if err != nil {
+		return fmt.Errorf("backup database: %w", err)
+	}
+	fmt.Printf("backed up the database to %s\n", args[0])
+	return nil
+}
+
+func restore(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: feed-admin restore <backup file>")
+	}
+	if os.Getenv("DATABASE_URL") != "" {
+		return db.ErrBackupUnsupported
+	}
+
+	dbPath := sqlitePath()
+	previous, err := db.Restore(ctx, args[0], dbPath)
+	if err != nil {
+		return fmt.Errorf("restore database: %w", err)
+	}
+
+	// opening the restored database brings its schema up to date
+	database, err := db.NewDatabase(dbPath)
+	if err != nil {
+		return fmt.Errorf("open restored database: %w", err)
+	}
+	defer database.Close()
+	audit(ctx, database, "restore", args[0], fmt.Sprintf("previous=%s", previous))
+
+	fmt.Printf("restored %s from %s\n", dbPath, args[0])
+	if previous != "" {
+		fmt.Printf("the database it replaced was moved to %s\n", previous)
+	}
+	return nil
+}
+
+func exportPosts(ctx context.Context, database *db.Database, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	formatName := flags.String("format", string(export.FormatCSV), "the format to export as: csv, jsonl or parquet")
+	since := flags.String("since", "", "only export posts created at or after this date or RFC 3339 time")
+	until := flags.String("until", "", "only export posts created before this date or RFC 3339 time")
+	feedName := flags.String("feed", "", "only export the posts in this feed from FEEDS_CONFIG")
+	output := flags.String("o", "", "the file to write to. If not set the posts are written to stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	format, err := export.ParseFormat(*formatName)
+	if err != nil {
+		return err
+	}
+
+	query := srv.ExportQuery{}
+	if *feedName != "" {
+		query, err = feedExportQuery(ctx, database, *feedName)
+		if err != nil {
+			return err
+		}
+	}
+	if *since != "" {
+		t, err := export.ParseTime(*since)
+		if err != nil {
+			return fmt.Errorf("parse since: %w", err)
+		}
+		query.Since = t.UnixMilli()
+	}
+	if *until != "" {
+		t, err := export.ParseTime(*until)
+		if err != nil {
+			return fmt.Errorf("parse until: %w", err)
+		}
+		query.Until = t.UnixMilli()
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		out, err = os.Create(*output)
+		if err != nil {
+			return fmt.Errorf("create output file: %w", err)
+		}
+	}
+	// stdout is buffered so that writing a row at a time doesn't make a syscall for each one
+	w := bufio.NewWriter(out)
+
+	count, err := export.Export(ctx, database, w, format, query)
+	if err == nil {
+		err = w.Flush()
+	}
+	if out != os.Stdout {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("export posts after %d posts: %w", count, err)
+	}
+	fmt.Fprintf(os.Stderr, "exported %d posts\n", count)
+	return nil
+}
+
+// feedExportQuery returns the query for the posts in a feed in FEEDS_CONFIG, using the members its lists
+// and the BLOCKLIST_KEY list had when the feed generator last stored them
+func feedExportQuery(ctx context.Context, database *db.Database, name string) (srv.ExportQuery, error) {
+	var cfg struct {
+		Feeds []srv.FeedConfig      `json:"feeds"`
+		Lists []consumer.ListConfig `json:"lists"`
+	}
+	filename := os.Getenv("FEEDS_CONFIG")
+	if filename == "" {
+		return srv.ExportQuery{}, fmt.Errorf("FEEDS_CONFIG must be set to export a feed")
+	}
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return srv.ExportQuery{}, fmt.Errorf("read feeds config: %w", err)
+	}
+	err = json.Unmarshal(b, &cfg)
+	if err != nil {
+		return srv.ExportQuery{}, fmt.Errorf("parse feeds config: %w", err)
+	}
+
+	idx := slices.IndexFunc(cfg.Feeds, func(feed srv.FeedConfig) bool { return feed.Name == name })
+	if idx == -1 {
+		return srv.ExportQuery{}, fmt.Errorf("feed %q isn't in %s", name, filename)
+	}
+
+	// the feed generator denies the blocklist's members in every feed so the export does too
+	if blocklistKey := os.Getenv("BLOCKLIST_KEY"); blocklistKey != "" {
+		cfg.Lists = append(cfg.Lists, consumer.ListConfig{URI: blocklistKey, Action: consumer.ListActionDeny})
+	}
+
+	var authorLists srv.AuthorLists
+	if len(cfg.Lists) > 0 {
+		lists, err := consumer.LoadStoredLists(ctx, cfg.Lists, database)
+		if err != nil {
+			return srv.ExportQuery{}, fmt.Errorf("load lists: %w", err)
+		}
+		authorLists = lists
+	}
+	return export.FeedQuery(cfg.Feeds[idx], authorLists), nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
@@ -9,11 +10,18 @@ import (
 	"os"
 	"os/signal"
 	"path"
+	"regexp"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/nacorid/x402-feed/internal/admin"
+	"github.com/nacorid/x402-feed/internal/backup"
 	"github.com/nacorid/x402-feed/internal/consumer"
 	db "github.com/nacorid/x402-feed/internal/database"
+	"github.com/nacorid/x402-feed/internal/pds"
+	"github.com/nacorid/x402-feed/internal/retention"
 	srv "github.com/nacorid/x402-feed/internal/server"
 
 	"github.com/avast/retry-go/v4"
@@ -22,6 +30,7 @@ import (
 
 const (
 	defaultJetstreamAddr = "wss://jetstream2.us-east.bsky.network/subscribe"
+	defaultAdminAddr     = "127.0.0.1:11012"
 	serverPort           = 11011 // this must be the port value used. See https://docs.bsky.app/docs/starter-templates/custom-feeds#deploying-your-feed
 )
 
@@ -45,9 +54,16 @@ func run() error {
 	if feedHost == "" {
 		return fmt.Errorf("FEED_HOST_NAME not set")
 	}
-	feedName := os.Getenv("FEED_NAME")
-	if feedName == "" {
-		return fmt.Errorf("FEED_NAME not set")
+	feedsCfg, err := loadFeedsConfig(os.Getenv("FEEDS_CONFIG"))
+	if err != nil {
+		return fmt.Errorf("load feeds config: %w", err)
+	}
+	if len(feedsCfg.Feeds) == 0 {
+		feedName := os.Getenv("FEED_NAME")
+		if feedName == "" {
+			return fmt.Errorf("FEED_NAME not set")
+		}
+		feedsCfg.Feeds = []srv.FeedConfig{{Name: feedName}}
 	}
 	handle := os.Getenv("BSKY_HANDLE")
 	if handle == "" {
@@ -58,54 +74,188 @@ func run() error {
 		return fmt.Errorf("BSKY_PASS not set")
 	}
 
-	blocklistKey := os.Getenv("BLOCKLIST_KEY")
+	if blocklistKey := os.Getenv("BLOCKLIST_KEY"); blocklistKey != "" {
+		feedsCfg.Lists = append(feedsCfg.Lists, consumer.ListConfig{URI: blocklistKey, Action: consumer.ListActionDeny})
+	}
 
 	host := os.Getenv("BSKY_HOST")
 	if host == "" {
 		host = "https://bsky.social"
 	}
 
-	dbPath := os.Getenv("DATABASE_PATH")
-	if dbPath == "" {
-		dbPath = "./"
-	}
-
-	dbFilename := path.Join(dbPath, "database.db")
-	database, err := db.NewDatabase(dbFilename)
+	database, err := openDatabase()
 	if err != nil {
 		return fmt.Errorf("create new store: %w", err)
 	}
 	defer database.Close()
 
+	readTimeout, err := envDuration("DB_READ_TIMEOUT", db.DefaultReadTimeout)
+	if err != nil {
+		return err
+	}
+	writeTimeout, err := envDuration("DB_WRITE_TIMEOUT", db.DefaultWriteTimeout)
+	if err != nil {
+		return err
+	}
+	database.SetTimeouts(readTimeout, writeTimeout)
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	var blocklist *consumer.Blocklist
-	if blocklistKey != "" {
-		blocklist, err = consumer.NewBlocklist(ctx, handle, appPass, host, blocklistKey)
+	// the PDS client is shared by everything that needs to make authenticated calls to the PDS
+	pdsClient := pds.NewClient(host, handle, appPass)
+
+	var lists *consumer.Lists
+	var authorLists srv.AuthorLists
+	if len(feedsCfg.Lists) > 0 {
+		lists, err = consumer.NewLists(ctx, pdsClient, feedsCfg.Lists, database)
 		if err != nil {
-			return fmt.Errorf("create blocklist: %w", err)
+			return fmt.Errorf("create lists: %w", err)
 		}
+		authorLists = lists
 	}
 
-	go consumeLoop(ctx, database, blocklist)
+	var spamFilter *consumer.SpamFilter
+	if os.Getenv("SPAM_FILTER_DISABLED") != "true" {
+		spamCfg, err := spamConfigFromEnv()
+		if err != nil {
+			return fmt.Errorf("spam filter config: %w", err)
+		}
+		spamFilter = consumer.NewSpamFilter(spamCfg)
+	}
 
-	server, err := srv.NewServer(serverPort, feedHost, feedName, database)
+	labelPolicy := consumer.DefaultLabelPolicy()
+	if hideLabels, ok := os.LookupEnv("HIDE_LABELS"); ok {
+		labelPolicy.Hide = splitList(hideLabels)
+	}
+	labelPolicy.Remove = splitList(os.Getenv("REMOVE_LABELS"))
+
+	handlerOpts := consumer.HandlerOptions{
+		Lists:       lists,
+		SpamFilter:  spamFilter,
+		LabelPolicy: labelPolicy,
+		Threads: consumer.ThreadConfig{
+			IncludeAuthorReplies: os.Getenv("THREAD_AUTHOR_REPLIES") == "true",
+			Experts:              splitList(os.Getenv("THREAD_EXPERTS")),
+		},
+		IncludeQuotes: os.Getenv("INCLUDE_QUOTES") == "true",
+	}
+	handlerOpts.Queue, err = queueConfigFromEnv()
+	if err != nil {
+		return fmt.Errorf("moderation queue config: %w", err)
+	}
+
+	writeCfg, err := writeBufferConfigFromEnv()
+	if err != nil {
+		return fmt.Errorf("write buffer config: %w", err)
+	}
+	handlerOpts.Writes = consumer.NewWriteBuffer(database, writeCfg)
+	writesDone := make(chan struct{})
+	go func() {
+		defer close(writesDone)
+		handlerOpts.Writes.Run(ctx)
+	}()
+
+	go consumeLoop(ctx, database, handlerOpts)
+
+	retentionCfg, err := retentionConfigFromEnv()
+	if err != nil {
+		return fmt.Errorf("retention config: %w", err)
+	}
+	if retentionCfg.Enabled() {
+		retentionCfg.Feeds = feedsCfg.Feeds
+		retentionCfg.AuthorLists = authorLists
+		go retention.NewPruner(database, retentionCfg).Run(ctx)
+	}
+
+	backupCfg, err := backupConfigFromEnv()
+	if err != nil {
+		return fmt.Errorf("backup config: %w", err)
+	}
+	if backupCfg.Enabled() {
+		if os.Getenv("DATABASE_URL") != "" {
+			return fmt.Errorf("BACKUP_DIR: %w", db.ErrBackupUnsupported)
+		}
+		go backup.NewSnapshotter(database, backupCfg).Run(ctx)
+	}
+
+	curatorCfg := consumer.CuratorConfig{
+		DIDs:          splitList(os.Getenv("CURATOR_DIDS")),
+		RemoveCommand: os.Getenv("CURATOR_REMOVE_COMMAND"),
+		HiddenList:    os.Getenv("CURATOR_HIDDEN_LIST"),
+		RepostDIDs:    splitList(os.Getenv("REPOST_CURATORS")),
+	}
+	if len(curatorCfg.DIDs) > 0 || len(curatorCfg.RepostDIDs) > 0 {
+		// the write buffer is used so that reposts of posts that haven't been flushed yet are found
+		go curatorLoop(ctx, consumer.NewCuratorHandler(handlerOpts.Writes, curatorCfg))
+	}
+
+	if labelerAddr := os.Getenv("LABELER_URL"); labelerAddr != "" {
+		// the write buffer is used so that labels for posts that haven't been flushed yet are kept
+		labeler, err := consumer.NewLabelerConsumer(labelerAddr, os.Getenv("LABELER_DID"), labelPolicy, handlerOpts.Writes, slog.Default())
+		if err != nil {
+			return fmt.Errorf("create labeler consumer: %w", err)
+		}
+		go labelerLoop(ctx, labeler)
+	}
+
+	server, err := srv.NewServer(serverPort, feedHost, feedsCfg.Feeds, database, authorLists)
 	if err != nil {
 		return fmt.Errorf("create new server: %w", err)
 	}
+
+	adminServer, err := newAdminServer(feedHost, feedsCfg.Feeds, database, lists, authorLists)
+	if err != nil {
+		return fmt.Errorf("create admin server: %w", err)
+	}
+	if adminServer != nil {
+		go adminServer.Run()
+	}
+
 	go func() {
 		<-signals
 		cancel()
 		_ = server.Stop(context.Background())
+		if adminServer != nil {
+			_ = adminServer.Stop(context.Background())
+		}
 	}()
 
 	server.Run()
+
+	// wait for the last of the buffered writes to be flushed before exiting
+	cancel()
+	<-writesDone
 	return nil
 }
 
-func consumeLoop(ctx context.Context, database *db.Database, blocklist *consumer.Blocklist) {
-	handler := consumer.NewFeedHandler(database, blocklist)
+// newAdminServer returns the admin API server or nil if no admin token or DIDs are configured
+func newAdminServer(feedHost string, feeds []srv.FeedConfig, database *db.Database, lists *consumer.Lists, authorLists srv.AuthorLists) (*admin.Server, error) {
+	cfg := admin.Config{
+		Token:       os.Getenv("ADMIN_TOKEN"),
+		DIDs:        splitList(os.Getenv("ADMIN_DIDS")),
+		ServiceDID:  fmt.Sprintf("did:web:%s", feedHost),
+		Feeds:       feeds,
+		AuthorLists: authorLists,
+	}
+	if cfg.Token == "" && len(cfg.DIDs) == 0 {
+		return nil, nil
+	}
+
+	addr := os.Getenv("ADMIN_ADDR")
+	if addr == "" {
+		addr = defaultAdminAddr
+	}
+
+	var refresher admin.ListRefresher
+	if lists != nil {
+		refresher = lists
+	}
+	return admin.NewServer(addr, cfg, database, refresher)
+}
+
+func consumeLoop(ctx context.Context, database *db.Database, handlerOpts consumer.HandlerOptions) {
+	handler := consumer.NewFeedHandler(database, handlerOpts)
 
 	go func() {
 		ticker := time.NewTicker(15 * time.Minute)
@@ -114,9 +264,9 @@ func consumeLoop(ctx context.Context, database *db.Database, blocklist *consumer
 		for {
 			select {
 			case <-ticker.C:
-				err := handler.DeleteBlockedPosts(ctx)
+				err := handler.DeleteDeniedPosts(ctx)
 				if err != nil {
-					slog.Error("delete blocked posts", "error", err)
+					slog.Error("delete denied posts", "error", err)
 				}
 			case <-ctx.Done():
 				return
@@ -146,3 +296,231 @@ func consumeLoop(ctx context.Context, database *db.Database, blocklist *consumer
 
 	slog.Warn("exiting consume loop")
 }
+
+// feedsConfig is the format of the JSON file that FEEDS_CONFIG points to
+type feedsConfig struct {
+	Feeds []srv.FeedConfig      `json:"feeds"`
+	Lists []consumer.ListConfig `json:"lists"`
+}
+
+func loadFeedsConfig(filename string) (feedsConfig, error) {
+	var cfg feedsConfig
+	if filename == "" {
+		return cfg, nil
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return cfg, fmt.Errorf("read file: %w", err)
+	}
+	err = json.Unmarshal(b, &cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("decode file: %w", err)
+	}
+	return cfg, nil
+}
+
+// curatorLoop consumes events from the curators' accounts on a separate Jetstream subscription to the
+// one consuming every post
+func curatorLoop(ctx context.Context, handler *consumer.CuratorHandler) {
+	jsServerAddr := os.Getenv("JS_SERVER_ADDR")
+	if jsServerAddr == "" {
+		jsServerAddr = defaultJetstreamAddr
+	}
+
+	consumer := consumer.NewJetstreamConsumer(jsServerAddr, slog.Default(), handler)
+
+	_ = retry.Do(func() error {
+		err := consumer.Consume(ctx)
+		if err != nil {
+			// if the context has been cancelled then it's time to exit
+			if errors.Is(err, context.Canceled) {
+				return nil
+			}
+			slog.Error("curator consume loop", "error", err)
+			return err
+		}
+		return nil
+	}, retry.Attempts(0)) // retry indefinitly until context canceled
+
+	slog.Warn("exiting curator consume loop")
+}
+
+func labelerLoop(ctx context.Context, labeler *consumer.LabelerConsumer) {
+	_ = retry.Do(func() error {
+		err := labeler.Consume(ctx)
+		if err != nil {
+			// if the context has been cancelled then it's time to exit
+			if errors.Is(err, context.Canceled) {
+				return nil
+			}
+			slog.Error("labeler consume loop", "error", err)
+			return err
+		}
+		return nil
+	}, retry.Attempts(0)) // retry indefinitly until context canceled
+
+	slog.Warn("exiting labeler consume loop")
+}
+
+func spamConfigFromEnv() (consumer.SpamConfig, error) {
+	cfg := consumer.DefaultSpamConfig()
+
+	var err error
+	cfg.MaxPostsPerAuthor, err = envInt("SPAM_MAX_POSTS_PER_AUTHOR", cfg.MaxPostsPerAuthor)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.AuthorWindow, err = envDuration("SPAM_AUTHOR_WINDOW", cfg.AuthorWindow)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.DuplicateWindow, err = envDuration("SPAM_DUPLICATE_WINDOW", cfg.DuplicateWindow)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.DuplicateDistance, err = envInt("SPAM_DUPLICATE_DISTANCE", cfg.DuplicateDistance)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.MaxLinks, err = envInt("SPAM_MAX_LINKS", cfg.MaxLinks)
+	if err != nil {
+		return cfg, err
+	}
+	if domains := os.Getenv("SPAM_SUSPICIOUS_DOMAINS"); domains != "" {
+		cfg.SuspiciousDomains = splitList(domains)
+	}
+
+	return cfg, nil
+}
+
+func queueConfigFromEnv() (consumer.QueueConfig, error) {
+	cfg := consumer.QueueConfig{
+		HoldNewAuthors: os.Getenv("HOLD_NEW_AUTHORS") == "true",
+	}
+
+	var err error
+	cfg.AutoApproveAfter, err = envInt("AUTO_APPROVE_AFTER", consumer.DefaultAutoApproveAfter)
+	if err != nil {
+		return cfg, err
+	}
+
+	patternsFile := os.Getenv("SPAM_PATTERNS_FILE")
+	if patternsFile == "" {
+		return cfg, nil
+	}
+	b, err := os.ReadFile(patternsFile)
+	if err != nil {
+		return cfg, fmt.Errorf("read spam patterns: %w", err)
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern, err := regexp.Compile(line)
+		if err != nil {
+			return cfg, fmt.Errorf("parse spam pattern %q: %w", line, err)
+		}
+		cfg.RejectPatterns = append(cfg.RejectPatterns, pattern)
+	}
+	return cfg, nil
+}
+
+func writeBufferConfigFromEnv() (consumer.WriteBufferConfig, error) {
+	cfg := consumer.WriteBufferConfig{
+		CursorName: os.Getenv("JETSTREAM_CURSOR_NAME"),
+	}
+	var err error
+	cfg.BatchSize, err = envInt("WRITE_BATCH_SIZE", consumer.DefaultWriteBatchSize)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.FlushInterval, err = envDuration("WRITE_FLUSH_INTERVAL", consumer.DefaultWriteFlushInterval)
+	if err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+func retentionConfigFromEnv() (retention.Config, error) {
+	cfg := retention.Config{
+		ArchiveDir: os.Getenv("RETENTION_ARCHIVE_DIR"),
+	}
+	var err error
+	cfg.MaxAge, err = envDuration("RETENTION_MAX_AGE", 0)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.MaxPosts, err = envInt("RETENTION_MAX_POSTS", 0)
+	if err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+func backupConfigFromEnv() (backup.Config, error) {
+	cfg := backup.Config{
+		Dir: os.Getenv("BACKUP_DIR"),
+	}
+	var err error
+	cfg.Interval, err = envDuration("BACKUP_INTERVAL", backup.DefaultInterval)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Keep, err = envInt("BACKUP_KEEP", backup.DefaultKeep)
+	if err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// openDatabase connects to postgres if DATABASE_URL is set and otherwise opens the sqlite database in
+// DATABASE_PATH
+func openDatabase() (*db.Database, error) {
+	if dsn := os.Getenv("DATABASE_URL"); dsn != "" {
+		return db.NewPostgresDatabase(dsn)
+	}
+
+	dbPath := os.Getenv("DATABASE_PATH")
+	if dbPath == "" {
+		dbPath = "./"
+	}
+	return db.NewDatabase(path.Join(dbPath, "database.db"))
+}
+
+func envInt(key string, defaultValue int) (int, error) {
+	val := os.Getenv(key)
+	if val == "" {
+		return defaultValue, nil
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, fmt.Errorf("parsing %s: %w", key, err)
+	}
+	return i, nil
+}
+
+func envDuration(key string, defaultValue time.Duration) (time.Duration, error) {
+	val := os.Getenv(key)
+	if val == "" {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, fmt.Errorf("parsing %s: %w", key, err)
+	}
+	return d, nil
+}
+
+// splitList splits a comma separated environment variable, ignoring empty entries
+func splitList(val string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(val, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,147 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+
+	"github.com/nacorid/x402-feed/internal/auth"
+	"github.com/nacorid/x402-feed/internal/server"
+)
+
+// ListRefresher can be asked to fetch its lists straight away
+type ListRefresher interface {
+	Refresh(ctx context.Context) error
+}
+
+// Config configures who can use the admin API and the feeds it can export
+type Config struct {
+	// Token is a shared secret that can be sent as a bearer token
+	Token string
+	// DIDs are the accounts that can use the admin API with a service auth token issued for ServiceDID
+	DIDs       []string
+	ServiceDID string
+	// Directory resolves the signing keys of admin DIDs. identity.DefaultDirectory() is used if it's nil
+	Directory identity.Directory
+	// Feeds are the feeds whose posts can be exported, filtered by AuthorLists if it's set
+	Feeds       []server.FeedConfig
+	AuthorLists server.AuthorLists
+}
+
+// Server is the admin API. It runs on its own listener so that it's never exposed alongside the feed
+type Server struct {
+	httpsrv *http.Server
+	cfg     Config
+	store   server.PostStore
+	lists   ListRefresher
+}
+
+// NewServer builds an admin server - call the Run function to start the server. The list refresher is
+// optional and can be nil
+func NewServer(addr string, cfg Config, store server.PostStore, lists ListRefresher) (*Server, error) {
+	if cfg.Token == "" && len(cfg.DIDs) == 0 {
+		return nil, fmt.Errorf("an admin token or admin DIDs are required")
+	}
+
+	srv := &Server{
+		cfg:   cfg,
+		store: store,
+		lists: lists,
+	}
+
+	mux := http.NewServeMux()
+	for _, route := range []struct {
+		pattern string
+		method  string
+		handler http.HandlerFunc
+	}{
+		{"POST /admin/posts", "addPost", srv.HandleAddPost},
+		{"DELETE /admin/posts", "removePost", srv.HandleRemovePost},
+		{"POST /admin/authors/ban", "banAuthor", srv.HandleBanAuthor},
+		{"POST /admin/authors/unban", "unbanAuthor", srv.HandleUnbanAuthor},
+		{"GET /admin/pins", "getPins", srv.HandleGetPins},
+		{"POST /admin/pins", "pin", srv.HandlePin},
+		{"DELETE /admin/pins", "unpin", srv.HandleUnpin},
+		{"GET /admin/rejections", "getRejections", srv.HandleGetRejections},
+		{"GET /admin/pending", "getPending", srv.HandleGetPending},
+		{"POST /admin/pending/approve", "approvePending", srv.HandleApprovePending},
+		{"POST /admin/pending/reject", "rejectPending", srv.HandleRejectPending},
+		{"POST /admin/lists/refresh", "refreshLists", srv.HandleRefreshLists},
+		{"GET /admin/audit", "getAuditLog", srv.HandleGetAuditLog},
+		{"GET /admin/export", "export", srv.HandleExport},
+	} {
+		mux.Handle(route.pattern, srv.authenticate(MethodPrefix+route.method, route.handler))
+	}
+
+	srv.httpsrv = &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+	return srv, nil
+}
+
+// Run will start the server and block until it's stopped
+func (s *Server) Run() {
+	err := s.httpsrv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		slog.Error("admin listen and serve", "error", err)
+	}
+}
+
+// Stop will shutdown the server
+func (s *Server) Stop(ctx context.Context) error {
+	return s.httpsrv.Shutdown(ctx)
+}
+
+// MethodPrefix is the start of the lxm that service auth tokens for the admin API must be issued for. Each
+// route has its own method, such as net.x402feed.admin.addPost, so a token can only be used for one action
+const MethodPrefix = "net.x402feed.admin."
+
+type actorKey struct{}
+
+// actor returns who made the request so that it can be recorded in the audit log
+func actor(r *http.Request) string {
+	actor, _ := r.Context().Value(actorKey{}).(string)
+	return actor
+}
+
+// authenticate only lets requests through that have either the admin token or a service auth token
+// from one of the admin DIDs that was issued for the route's method
+func (s *Server) authenticate(method string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if token == "" {
+			http.Error(w, "missing authorization", http.StatusUnauthorized)
+			return
+		}
+
+		if s.cfg.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.Token)) == 1 {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), actorKey{}, "token")))
+			return
+		}
+
+		if len(s.cfg.DIDs) > 0 {
+			did, err := auth.GetServiceAuthDID(r, auth.ServiceAuth{
+				Audience:  s.cfg.ServiceDID,
+				Method:    method,
+				Directory: s.cfg.Directory,
+			})
+			if err == nil && slices.Contains(s.cfg.DIDs, did) {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), actorKey{}, did)))
+				return
+			}
+			if err != nil {
+				slog.Debug("validate admin service auth", "error", err)
+			}
+		}
+
+		slog.Warn("unauthorized admin request", "path", r.URL.Path, "host", r.RemoteAddr)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
@@ -0,0 +1,409 @@
+package admin
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+
+	"github.com/nacorid/x402-feed/internal/memstore"
+	"github.com/nacorid/x402-feed/internal/server"
+)
+
+const (
+	adminToken = "s3cret"
+	adminDID   = "did:plc:admin"
+	otherDID   = "did:plc:other"
+	serviceDID = "did:web:feed.example"
+)
+
+// signJWT signs a token the way a PDS signs service auth tokens
+func signJWT(t *testing.T, key crypto.PrivateKey, alg string, claims map[string]any) string {
+	t.Helper()
+	encode := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("marshal token: %v", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signingString := encode(map[string]string{"alg": alg, "typ": "JWT"}) + "." + encode(claims)
+	sig, err := key.HashAndSign([]byte(signingString))
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+	return signingString + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func newKey(t *testing.T) (*crypto.PrivateKeyP256, string) {
+	t.Helper()
+	key, err := crypto.GeneratePrivateKeyP256()
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	pub, err := key.PublicKey()
+	if err != nil {
+		t.Fatalf("public key: %v", err)
+	}
+	return key, pub.Multibase()
+}
+
+func TestAuthenticate(t *testing.T) {
+	adminKey, adminPub := newKey(t)
+	otherKey, otherPub := newKey(t)
+	dir := identity.NewMockDirectory()
+	for did, pub := range map[string]string{adminDID: adminPub, otherDID: otherPub} {
+		dir.Insert(identity.Identity{
+			DID:  syntax.DID(did),
+			Keys: map[string]identity.VerificationMethod{"atproto": {Type: "Multikey", PublicKeyMultibase: pub}},
+		})
+	}
+
+	srv, err := NewServer("127.0.0.1:0", Config{
+		Token:      adminToken,
+		DIDs:       []string{adminDID},
+		ServiceDID: serviceDID,
+		Directory:  &dir,
+	}, memstore.New(), nil)
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+
+	exp := time.Now().Add(time.Minute).Unix()
+	claims := func(changes map[string]any) map[string]any {
+		c := map[string]any{"iss": adminDID, "aud": serviceDID, "lxm": MethodPrefix + "getAuditLog", "exp": exp}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+
+	tests := map[string]struct {
+		// authorization is the whole Authorization header, it's left out if empty
+		authorization string
+		method, path  string
+		want          int
+	}{
+		"no authorization": {
+			want: http.StatusUnauthorized,
+		},
+		"token": {
+			authorization: "Bearer " + adminToken,
+			want:          http.StatusOK,
+		},
+		"wrong token": {
+			authorization: "Bearer nope",
+			want:          http.StatusUnauthorized,
+		},
+		"service auth": {
+			authorization: "Bearer " + signJWT(t, adminKey, "ES256", claims(nil)),
+			want:          http.StatusOK,
+		},
+		"service auth for another route": {
+			authorization: "Bearer " + signJWT(t, adminKey, "ES256", claims(nil)),
+			method:        http.MethodPost,
+			path:          "/admin/authors/ban",
+			want:          http.StatusUnauthorized,
+		},
+		"service auth for the route": {
+			authorization: "Bearer " + signJWT(t, adminKey, "ES256", claims(map[string]any{"lxm": MethodPrefix + "getPins"})),
+			path:          "/admin/pins",
+			want:          http.StatusOK,
+		},
+		"missing lxm": {
+			authorization: "Bearer " + signJWT(t, adminKey, "ES256", claims(map[string]any{"lxm": nil})),
+			want:          http.StatusUnauthorized,
+		},
+		"lxm of another service": {
+			authorization: "Bearer " + signJWT(t, adminKey, "ES256", claims(map[string]any{"lxm": "app.bsky.feed.getFeedSkeleton"})),
+			want:          http.StatusUnauthorized,
+		},
+		"missing exp": {
+			authorization: "Bearer " + signJWT(t, adminKey, "ES256", claims(map[string]any{"exp": nil})),
+			want:          http.StatusUnauthorized,
+		},
+		"expired": {
+			authorization: "Bearer " + signJWT(t, adminKey, "ES256", claims(map[string]any{"exp": time.Now().Add(-time.Minute).Unix()})),
+			want:          http.StatusUnauthorized,
+		},
+		"wrong audience": {
+			authorization: "Bearer " + signJWT(t, adminKey, "ES256", claims(map[string]any{"aud": "did:web:other.example"})),
+			want:          http.StatusUnauthorized,
+		},
+		"not an admin": {
+			authorization: "Bearer " + signJWT(t, otherKey, "ES256", claims(map[string]any{"iss": otherDID})),
+			want:          http.StatusUnauthorized,
+		},
+		"signed by another key": {
+			authorization: "Bearer " + signJWT(t, otherKey, "ES256", claims(nil)),
+			want:          http.StatusUnauthorized,
+		},
+		"unknown issuer": {
+			authorization: "Bearer " + signJWT(t, adminKey, "ES256", claims(map[string]any{"iss": "did:plc:unknown"})),
+			want:          http.StatusUnauthorized,
+		},
+		"missing iss": {
+			authorization: "Bearer " + signJWT(t, adminKey, "ES256", claims(map[string]any{"iss": nil})),
+			want:          http.StatusUnauthorized,
+		},
+		"iss that isn't a string": {
+			authorization: "Bearer " + signJWT(t, adminKey, "ES256", claims(map[string]any{"iss": 42})),
+			want:          http.StatusUnauthorized,
+		},
+		"iss that isn't a DID": {
+			authorization: "Bearer " + signJWT(t, adminKey, "ES256", claims(map[string]any{"iss": "admin"})),
+			want:          http.StatusUnauthorized,
+		},
+		"unsupported algorithm": {
+			authorization: "Bearer " + signJWT(t, adminKey, "HS256", claims(nil)),
+			want:          http.StatusUnauthorized,
+		},
+		"not a token": {
+			authorization: "Bearer a.b.c",
+			want:          http.StatusUnauthorized,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			method, path := tc.method, tc.path
+			if method == "" {
+				method = http.MethodGet
+			}
+			if path == "" {
+				path = "/admin/audit"
+			}
+
+			req := httptest.NewRequest(method, path, strings.NewReader(`{"did": "did:plc:spammer"}`))
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			rec := httptest.NewRecorder()
+			srv.httpsrv.Handler.ServeHTTP(rec, req)
+
+			if rec.Code != tc.want {
+				t.Errorf("got status %d, want %d: %s", rec.Code, tc.want, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestAuditLogRecordsActor(t *testing.T) {
+	adminKey, adminPub := newKey(t)
+	dir := identity.NewMockDirectory()
+	dir.Insert(identity.Identity{
+		DID:  adminDID,
+		Keys: map[string]identity.VerificationMethod{"atproto": {Type: "Multikey", PublicKeyMultibase: adminPub}},
+	})
+	store := memstore.New()
+	srv, err := NewServer("127.0.0.1:0", Config{Token: adminToken, DIDs: []string{adminDID}, ServiceDID: serviceDID, Directory: &dir}, store, nil)
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+
+	tests := map[string]struct {
+		authorization string
+		actor         string
+	}{
+		"token": {
+			authorization: "Bearer " + adminToken,
+			actor:         "token",
+		},
+		"service auth": {
+			authorization: "Bearer " + signJWT(t, adminKey, "ES256", map[string]any{
+				"iss": adminDID, "aud": serviceDID, "lxm": MethodPrefix + "banAuthor", "exp": time.Now().Add(time.Minute).Unix(),
+			}),
+			actor: adminDID,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/admin/authors/ban", strings.NewReader(`{"did": "did:plc:spammer"}`))
+			req.Header.Set("Authorization", tc.authorization)
+			rec := httptest.NewRecorder()
+			srv.httpsrv.Handler.ServeHTTP(rec, req)
+			if rec.Code != http.StatusNoContent {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusNoContent, rec.Body.String())
+			}
+
+			entries, err := store.GetAuditLog(t.Context(), 1)
+			if err != nil {
+				t.Fatalf("get audit log: %v", err)
+			}
+			if len(entries) != 1 || entries[0].Actor != tc.actor || entries[0].Action != "ban_author" {
+				t.Errorf("got audit log %+v, want a ban by %s", entries, tc.actor)
+			}
+		})
+	}
+}
+
+func TestPendingActions(t *testing.T) {
+	const (
+		pendingPost  = "at://did:plc:author/app.bsky.feed.post/pending"
+		bufferedPost = "at://did:plc:author/app.bsky.feed.post/buffered"
+		shownPost    = "at://did:plc:author/app.bsky.feed.post/shown"
+		missingPost  = "at://did:plc:author/app.bsky.feed.post/missing"
+	)
+
+	tests := map[string]struct {
+		path string
+		uri  string
+		want int
+		// stored and pending are whether the post is still stored and pending afterwards
+		stored, pending bool
+		// hidden is whether the post is kept out of the feed when it's written afterwards, as it is when
+		// it's flushed from the write buffer or edited
+		hidden bool
+	}{
+		"approve pending post": {
+			path:   "/admin/pending/approve",
+			uri:    pendingPost,
+			want:   http.StatusNoContent,
+			stored: true,
+		},
+		"approve pending post that hasn't been written yet": {
+			path: "/admin/pending/approve",
+			uri:  bufferedPost,
+			want: http.StatusNoContent,
+		},
+		"approve post that isn't pending": {
+			path:   "/admin/pending/approve",
+			uri:    shownPost,
+			want:   http.StatusConflict,
+			stored: true,
+		},
+		"approve post that isn't stored": {
+			path: "/admin/pending/approve",
+			uri:  missingPost,
+			want: http.StatusNotFound,
+		},
+		"reject pending post": {
+			path:   "/admin/pending/reject",
+			uri:    pendingPost,
+			want:   http.StatusNoContent,
+			hidden: true,
+		},
+		"reject pending post that hasn't been written yet": {
+			path:   "/admin/pending/reject",
+			uri:    bufferedPost,
+			want:   http.StatusNoContent,
+			hidden: true,
+		},
+		"reject post that isn't pending": {
+			path:   "/admin/pending/reject",
+			uri:    shownPost,
+			want:   http.StatusConflict,
+			stored: true,
+		},
+		"reject post that isn't stored": {
+			path: "/admin/pending/reject",
+			uri:  missingPost,
+			want: http.StatusNotFound,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			store := memstore.New()
+			for _, uri := range []string{pendingPost, bufferedPost} {
+				if err := store.HideSubject(t.Context(), uri, server.HiddenReasonPending); err != nil {
+					t.Fatalf("hide post: %v", err)
+				}
+			}
+			for _, uri := range []string{pendingPost, shownPost} {
+				err := store.CreatePost(t.Context(), server.Post{RKey: path.Base(uri), PostURI: uri, UserDID: "did:plc:author", CreatedAt: 100})
+				if err != nil {
+					t.Fatalf("create post: %v", err)
+				}
+			}
+			srv, err := NewServer("127.0.0.1:0", Config{Token: adminToken}, store, nil)
+			if err != nil {
+				t.Fatalf("new server: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(`{"uri": "`+tc.uri+`"}`))
+			req.Header.Set("Authorization", "Bearer "+adminToken)
+			rec := httptest.NewRecorder()
+			srv.httpsrv.Handler.ServeHTTP(rec, req)
+			if rec.Code != tc.want {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tc.want, rec.Body.String())
+			}
+
+			stored, err := store.IsPostStored(t.Context(), tc.uri)
+			if err != nil {
+				t.Fatalf("is post stored: %v", err)
+			}
+			pending, err := store.IsHidden(t.Context(), tc.uri, server.HiddenReasonPending)
+			if err != nil {
+				t.Fatalf("is hidden: %v", err)
+			}
+			if stored != tc.stored || pending != tc.pending {
+				t.Errorf("got stored %v and pending %v, want %v and %v", stored, pending, tc.stored, tc.pending)
+			}
+
+			rejections, err := store.GetRejections(t.Context(), server.RejectionQuery{Limit: 10})
+			if err != nil {
+				t.Fatalf("get rejections: %v", err)
+			}
+			if rejected := len(rejections) > 0; rejected != (tc.path == "/admin/pending/reject" && tc.want == http.StatusNoContent) {
+				t.Errorf("got rejections %+v", rejections)
+			}
+
+			err = store.CreatePost(t.Context(), server.Post{RKey: path.Base(tc.uri), PostURI: tc.uri, UserDID: "did:plc:author", CreatedAt: 200})
+			if err != nil {
+				t.Fatalf("create post: %v", err)
+			}
+			posts, err := store.GetFeedPosts(t.Context(), server.FeedQuery{Cursor: 1000, Limit: 10})
+			if err != nil {
+				t.Fatalf("get feed posts: %v", err)
+			}
+			shown := slices.ContainsFunc(posts, func(p server.Post) bool { return p.PostURI == tc.uri })
+			if shown == tc.hidden {
+				t.Errorf("got post shown %v once it's written, want hidden %v", shown, tc.hidden)
+			}
+		})
+	}
+}
+
+func TestExportIsAudited(t *testing.T) {
+	store := memstore.New()
+	err := store.CreatePost(t.Context(), server.Post{RKey: "1", PostURI: "at://did:plc:author/app.bsky.feed.post/1", UserDID: "did:plc:author", CreatedAt: 100})
+	if err != nil {
+		t.Fatalf("create post: %v", err)
+	}
+	srv, err := NewServer("127.0.0.1:0", Config{Token: adminToken, Feeds: []server.FeedConfig{{Name: "x402"}}}, store, nil)
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/export?format=jsonl&feed=x402&since=2026-01-01", nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	rec := httptest.NewRecorder()
+	srv.httpsrv.Handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+
+	entries, err := store.GetAuditLog(t.Context(), 1)
+	if err != nil {
+		t.Fatalf("get audit log: %v", err)
+	}
+	want := server.AuditEntry{Actor: "token", Action: "export", Subject: "x402", Detail: "format=jsonl since=2026-01-01 until="}
+	if len(entries) != 1 || entries[0].Actor != want.Actor || entries[0].Action != want.Action || entries[0].Subject != want.Subject || entries[0].Detail != want.Detail {
+		t.Errorf("got audit log %+v, want %+v", entries, want)
+	}
+}
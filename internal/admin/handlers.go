@@ -0,0 +1,620 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+
+	"github.com/nacorid/x402-feed/internal/export"
+	"github.com/nacorid/x402-feed/internal/server"
+)
+
+const (
+	defaultLimit = 50
+
+	// hidden reasons used for actions taken through the admin API so they can be undone without
+	// affecting posts hidden for other reasons
+	removedReason = "admin_removed"
+	bannedReason  = "admin_banned"
+
+	// rejectedReason is recorded when a moderator rejects a pending post
+	rejectedReason = "moderator_rejected"
+)
+
+// PostRequest is the body of a request that acts on a post
+type PostRequest struct {
+	URI string `json:"uri"`
+}
+
+// AuthorRequest is the body of a request that acts on an author
+type AuthorRequest struct {
+	DID    string `json:"did"`
+	Reason string `json:"reason"`
+}
+
+// PinRequest is the body of a request to pin a post
+type PinRequest struct {
+	URI  string `json:"uri"`
+	Feed string `json:"feed"`
+	// ExpiresIn is how long the post stays pinned for such as "72h". If empty it stays pinned until unpinned
+	ExpiresIn string `json:"expiresIn"`
+}
+
+// HandleAddPost adds a post to the feed regardless of whether it matches. The post's position in the
+// feed is taken from the time in its record key
+func (s *Server) HandleAddPost(w http.ResponseWriter, r *http.Request) {
+	var req PostRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	uri, ok := parsePostURI(w, req.URI)
+	if !ok {
+		return
+	}
+
+	createdAt := time.Now()
+	if tid, err := syntax.ParseTID(uri.RecordKey().String()); err == nil {
+		createdAt = tid.Time()
+	}
+
+	err := s.store.UnhideSubject(r.Context(), uri.String(), removedReason)
+	if err != nil {
+		serverError(w, "unhide post", err)
+		return
+	}
+	err = s.store.CreatePost(r.Context(), server.Post{
+		RKey:      uri.RecordKey().String(),
+		PostURI:   uri.String(),
+		UserDID:   uri.Authority().String(),
+		CreatedAt: createdAt.UnixMilli(),
+	})
+	if err != nil {
+		serverError(w, "create post", err)
+		return
+	}
+	err = s.store.MarkCurated(r.Context(), uri.String())
+	if err != nil {
+		serverError(w, "mark post curated", err)
+		return
+	}
+
+	s.audit(r, "add_post", uri.String(), "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleRemovePost deletes a post from the feed and stops it from being added again
+func (s *Server) HandleRemovePost(w http.ResponseWriter, r *http.Request) {
+	var req PostRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	uri, ok := parsePostURI(w, req.URI)
+	if !ok {
+		return
+	}
+
+	err := s.store.HideSubject(r.Context(), uri.String(), removedReason)
+	if err != nil {
+		serverError(w, "hide post", err)
+		return
+	}
+	err = s.store.DeletePostsFromURIs(r.Context(), []string{uri.String()})
+	if err != nil {
+		serverError(w, "delete post", err)
+		return
+	}
+
+	s.audit(r, "remove_post", uri.String(), "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleBanAuthor hides every post from an author from every feed until they are unbanned
+func (s *Server) HandleBanAuthor(w http.ResponseWriter, r *http.Request) {
+	var req AuthorRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	did, ok := parseDID(w, req.DID)
+	if !ok {
+		return
+	}
+
+	err := s.store.HideSubject(r.Context(), did, bannedReason)
+	if err != nil {
+		serverError(w, "ban author", err)
+		return
+	}
+
+	s.audit(r, "ban_author", did, req.Reason)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleUnbanAuthor shows posts from a banned author again
+func (s *Server) HandleUnbanAuthor(w http.ResponseWriter, r *http.Request) {
+	var req AuthorRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	did, ok := parseDID(w, req.DID)
+	if !ok {
+		return
+	}
+
+	err := s.store.UnhideSubject(r.Context(), did, bannedReason)
+	if err != nil {
+		serverError(w, "unban author", err)
+		return
+	}
+
+	s.audit(r, "unban_author", did, req.Reason)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PinResponse describes a pinned post
+type PinResponse struct {
+	URI       string     `json:"uri"`
+	Feed      string     `json:"feed,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// HandleGetPins lists every pin including expired ones
+func (s *Server) HandleGetPins(w http.ResponseWriter, r *http.Request) {
+	pins, err := s.store.GetAllPins(r.Context())
+	if err != nil {
+		serverError(w, "get pins", err)
+		return
+	}
+
+	resp := make([]PinResponse, 0, len(pins))
+	for _, pin := range pins {
+		p := PinResponse{
+			URI:       pin.PostURI,
+			Feed:      pin.Feed,
+			CreatedAt: time.UnixMilli(pin.CreatedAt).UTC(),
+		}
+		if pin.ExpiresAt > 0 {
+			expiresAt := time.UnixMilli(pin.ExpiresAt).UTC()
+			p.ExpiresAt = &expiresAt
+		}
+		resp = append(resp, p)
+	}
+	writeJSON(w, resp)
+}
+
+// HandlePin pins a post to the top of a feed, or every feed if no feed is given
+func (s *Server) HandlePin(w http.ResponseWriter, r *http.Request) {
+	var req PinRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	uri, ok := parsePostURI(w, req.URI)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	pin := server.Pin{
+		PostURI:   uri.String(),
+		UserDID:   uri.Authority().String(),
+		Feed:      req.Feed,
+		CreatedAt: now.UnixMilli(),
+	}
+	if req.ExpiresIn != "" {
+		expiresIn, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || expiresIn <= 0 {
+			http.Error(w, "invalid expiresIn", http.StatusBadRequest)
+			return
+		}
+		pin.ExpiresAt = now.Add(expiresIn).UnixMilli()
+	}
+
+	err := s.store.CreatePin(r.Context(), pin)
+	if err != nil {
+		serverError(w, "create pin", err)
+		return
+	}
+
+	s.audit(r, "pin", pin.PostURI, fmt.Sprintf("feed=%s expiresIn=%s", req.Feed, req.ExpiresIn))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleUnpin removes a pin
+func (s *Server) HandleUnpin(w http.ResponseWriter, r *http.Request) {
+	var req PinRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	if req.URI == "" {
+		http.Error(w, "missing uri", http.StatusBadRequest)
+		return
+	}
+
+	err := s.store.DeletePin(r.Context(), req.URI, req.Feed)
+	if err != nil {
+		serverError(w, "delete pin", err)
+		return
+	}
+
+	s.audit(r, "unpin", req.URI, fmt.Sprintf("feed=%s", req.Feed))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RejectionResponse describes a post that was rejected and why
+type RejectionResponse struct {
+	ID        int       `json:"id"`
+	URI       string    `json:"uri"`
+	AuthorDID string    `json:"authorDid"`
+	Reason    string    `json:"reason"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// RejectionsResponse is a page of rejections. Cursor is passed back to get the next page
+type RejectionsResponse struct {
+	Cursor     string              `json:"cursor,omitempty"`
+	Rejections []RejectionResponse `json:"rejections"`
+}
+
+// HandleGetRejections lists rejected posts, newest first. They can be filtered by author
+func (s *Server) HandleGetRejections(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	limit, ok := limitFromParams(w, params.Get("limit"))
+	if !ok {
+		return
+	}
+	query := server.RejectionQuery{
+		AuthorDID: params.Get("author"),
+		Limit:     limit,
+	}
+	if cursor := params.Get("cursor"); cursor != "" {
+		before, err := strconv.Atoi(cursor)
+		if err != nil {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+		query.Before = before
+	}
+
+	rejections, err := s.store.GetRejections(r.Context(), query)
+	if err != nil {
+		serverError(w, "get rejections", err)
+		return
+	}
+
+	resp := RejectionsResponse{
+		Rejections: make([]RejectionResponse, 0, len(rejections)),
+	}
+	for _, rejection := range rejections {
+		resp.Rejections = append(resp.Rejections, RejectionResponse{
+			ID:        rejection.ID,
+			URI:       rejection.PostURI,
+			AuthorDID: rejection.AuthorDID,
+			Reason:    rejection.Reason,
+			Text:      rejection.Text,
+			CreatedAt: time.UnixMilli(rejection.CreatedAt).UTC(),
+		})
+	}
+	if len(rejections) == limit {
+		resp.Cursor = strconv.Itoa(rejections[len(rejections)-1].ID)
+	}
+	writeJSON(w, resp)
+}
+
+// PendingPostResponse describes a post waiting to be approved
+type PendingPostResponse struct {
+	URI       string    `json:"uri"`
+	AuthorDID string    `json:"authorDid"`
+	ReplyRoot string    `json:"replyRoot,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// HandleGetPending lists posts waiting to be approved, oldest first
+func (s *Server) HandleGetPending(w http.ResponseWriter, r *http.Request) {
+	limit, ok := limitFromParams(w, r.URL.Query().Get("limit"))
+	if !ok {
+		return
+	}
+
+	posts, err := s.store.GetPendingPosts(r.Context(), limit)
+	if err != nil {
+		serverError(w, "get pending posts", err)
+		return
+	}
+
+	resp := make([]PendingPostResponse, 0, len(posts))
+	for _, post := range posts {
+		resp = append(resp, PendingPostResponse{
+			URI:       post.PostURI,
+			AuthorDID: post.UserDID,
+			ReplyRoot: post.ReplyRoot,
+			CreatedAt: time.UnixMilli(post.CreatedAt).UTC(),
+		})
+	}
+	writeJSON(w, resp)
+}
+
+// HandleApprovePending shows a pending post in the feed
+func (s *Server) HandleApprovePending(w http.ResponseWriter, r *http.Request) {
+	var req PostRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	uri, ok := parsePostURI(w, req.URI)
+	if !ok || !s.requirePending(w, r, uri.String()) {
+		return
+	}
+
+	err := s.store.UnhideSubject(r.Context(), uri.String(), server.HiddenReasonPending)
+	if err != nil {
+		serverError(w, "approve post", err)
+		return
+	}
+
+	s.audit(r, "approve_post", uri.String(), "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleRejectPending deletes a pending post and records it as rejected
+func (s *Server) HandleRejectPending(w http.ResponseWriter, r *http.Request) {
+	var req PostRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	uri, ok := parsePostURI(w, req.URI)
+	if !ok || !s.requirePending(w, r, uri.String()) {
+		return
+	}
+
+	// the post stays hidden as rejected so that it isn't shown if it's still waiting to be written or is
+	// stored again when it's edited
+	err := s.store.HideSubject(r.Context(), uri.String(), rejectedReason)
+	if err != nil {
+		serverError(w, "hide rejected post", err)
+		return
+	}
+	err = s.store.DeletePostsFromURIs(r.Context(), []string{uri.String()})
+	if err != nil {
+		serverError(w, "delete post", err)
+		return
+	}
+	err = s.store.UnhideSubject(r.Context(), uri.String(), server.HiddenReasonPending)
+	if err != nil {
+		serverError(w, "remove pending post", err)
+		return
+	}
+	err = s.store.CreateRejection(r.Context(), server.Rejection{
+		PostURI:   uri.String(),
+		AuthorDID: uri.Authority().String(),
+		Reason:    rejectedReason,
+		CreatedAt: time.Now().UnixMilli(),
+	})
+	if err != nil {
+		serverError(w, "record rejection", err)
+		return
+	}
+
+	s.audit(r, "reject_post", uri.String(), "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requirePending writes an error and returns false if the post isn't waiting to be approved. A post that's
+// pending may not have been written to the store yet so only whether it's hidden as pending is checked
+func (s *Server) requirePending(w http.ResponseWriter, r *http.Request, postURI string) bool {
+	pending, err := s.store.IsHidden(r.Context(), postURI, server.HiddenReasonPending)
+	if err != nil {
+		serverError(w, "check post is pending", err)
+		return false
+	}
+	if pending {
+		return true
+	}
+
+	stored, err := s.store.IsPostStored(r.Context(), postURI)
+	if err != nil {
+		serverError(w, "check post is stored", err)
+		return false
+	}
+	if stored {
+		http.Error(w, "post isn't pending", http.StatusConflict)
+		return false
+	}
+	http.Error(w, "post not found", http.StatusNotFound)
+	return false
+}
+
+// HandleRefreshLists fetches every list straight away
+func (s *Server) HandleRefreshLists(w http.ResponseWriter, r *http.Request) {
+	if s.lists == nil {
+		http.Error(w, "no lists configured", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	err := s.lists.Refresh(ctx)
+	s.audit(r, "refresh_lists", "", errorDetail(err))
+	if err != nil {
+		slog.Error("refresh lists", "error", err)
+		http.Error(w, "refresh lists: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AuditEntryResponse describes an action taken by an admin
+type AuditEntryResponse struct {
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	Subject   string    `json:"subject,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// HandleGetAuditLog lists the most recent admin actions, newest first
+func (s *Server) HandleGetAuditLog(w http.ResponseWriter, r *http.Request) {
+	limit, ok := limitFromParams(w, r.URL.Query().Get("limit"))
+	if !ok {
+		return
+	}
+
+	entries, err := s.store.GetAuditLog(r.Context(), limit)
+	if err != nil {
+		serverError(w, "get audit log", err)
+		return
+	}
+
+	resp := make([]AuditEntryResponse, 0, len(entries))
+	for _, entry := range entries {
+		resp = append(resp, AuditEntryResponse{
+			Actor:     entry.Actor,
+			Action:    entry.Action,
+			Subject:   entry.Subject,
+			Detail:    entry.Detail,
+			CreatedAt: time.UnixMilli(entry.CreatedAt).UTC(),
+		})
+	}
+	writeJSON(w, resp)
+}
+
+// HandleExport streams the stored posts as a file. The format param is csv, jsonl or parquet, since and
+// until are the range of dates the posts were created in and feed is the name of a feed to only export
+// the posts in
+func (s *Server) HandleExport(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	format := export.FormatCSV
+	if name := params.Get("format"); name != "" {
+		var err error
+		format, err = export.ParseFormat(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	query := server.ExportQuery{}
+	if name := params.Get("feed"); name != "" {
+		idx := slices.IndexFunc(s.cfg.Feeds, func(feed server.FeedConfig) bool { return feed.Name == name })
+		if idx == -1 {
+			http.Error(w, "unknown feed", http.StatusBadRequest)
+			return
+		}
+		query = export.FeedQuery(s.cfg.Feeds[idx], s.cfg.AuthorLists)
+	}
+	for param, field := range map[string]*int64{"since": &query.Since, "until": &query.Until} {
+		val := params.Get(param)
+		if val == "" {
+			continue
+		}
+		t, err := export.ParseTime(val)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid %s: %s", param, err), http.StatusBadRequest)
+			return
+		}
+		*field = t.UnixMilli()
+	}
+
+	// the export is audited before it starts so that one that fails part way through is still recorded
+	s.audit(r, "export", params.Get("feed"), fmt.Sprintf("format=%s since=%s until=%s", format, params.Get("since"), params.Get("until")))
+
+	filename := fmt.Sprintf("posts-%s.%s", time.Now().UTC().Format("20060102T150405Z"), format)
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+
+	count, err := export.Export(r.Context(), s.store, w, format, query)
+	if err != nil {
+		// the response has already started so the connection is dropped to show the export is incomplete
+		slog.Error("export posts", "error", err, "exported", count)
+		panic(http.ErrAbortHandler)
+	}
+	slog.Info("exported posts", "actor", actor(r), "count", count, "format", format, "feed", params.Get("feed"))
+}
+
+// audit records an action in the audit log. Failing to record it doesn't fail the request as the
+// action has already been taken
+func (s *Server) audit(r *http.Request, action, subject, detail string) {
+	slog.Info("admin action", "actor", actor(r), "action", action, "subject", subject, "detail", detail)
+	err := s.store.CreateAuditEntry(r.Context(), server.AuditEntry{
+		Actor:     actor(r),
+		Action:    action,
+		Subject:   subject,
+		Detail:    detail,
+		CreatedAt: time.Now().UnixMilli(),
+	})
+	if err != nil {
+		slog.Error("record audit entry", "error", err, "action", action)
+	}
+}
+
+func errorDetail(err error) string {
+	if err == nil {
+		return ""
+	}
+	return "error: " + err.Error()
+}
+
+func decodeBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func parsePostURI(w http.ResponseWriter, raw string) (syntax.ATURI, bool) {
+	uri, err := syntax.ParseATURI(raw)
+	if err != nil || uri.Collection().String() != "app.bsky.feed.post" || uri.RecordKey() == "" {
+		http.Error(w, "invalid post uri", http.StatusBadRequest)
+		return "", false
+	}
+	if _, err := uri.Authority().AsDID(); err != nil {
+		http.Error(w, "post uri must use the author's DID", http.StatusBadRequest)
+		return "", false
+	}
+	return uri, true
+}
+
+func parseDID(w http.ResponseWriter, raw string) (string, bool) {
+	did, err := syntax.ParseDID(raw)
+	if err != nil {
+		http.Error(w, "invalid did", http.StatusBadRequest)
+		return "", false
+	}
+	return did.String(), true
+}
+
+func limitFromParams(w http.ResponseWriter, raw string) (int, bool) {
+	if raw == "" {
+		return defaultLimit, true
+	}
+	limit, err := strconv.Atoi(raw)
+	if err != nil || limit < 1 || limit > 1000 {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+		return 0, false
+	}
+	return limit, true
+}
+
+func serverError(w http.ResponseWriter, msg string, err error) {
+	slog.Error(msg, "error", err)
+	http.Error(w, msg, http.StatusInternalServerError)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		serverError(w, "marshal response", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
@@ -47,16 +47,78 @@ func (m *AtProtoSigningMethod) Sign(signingString string, key interface{}) ([]by
 }
 
 func GetRequestUserDID(r *http.Request) (string, error) {
+	claims, err := parseRequestToken(r, identity.DefaultDirectory())
+	if err != nil {
+		return "", err
+	}
+	return string(claims.issuer), nil
+}
+
+// ServiceAuth describes the service auth tokens that are accepted
+type ServiceAuth struct {
+	// Audience is the DID the token must be issued for, such as the feed generator's own DID
+	Audience string
+	// Method is the lexicon method the token must be issued for in its lxm claim
+	Method string
+	// Directory resolves the issuer's signing key. identity.DefaultDirectory() is used if it's nil
+	Directory identity.Directory
+}
+
+// GetServiceAuthDID returns the DID of the issuer of a service auth token. The token must have an expiry
+// and be issued for the audience and method that are given
+func GetServiceAuthDID(r *http.Request, svc ServiceAuth) (string, error) {
+	dir := svc.Directory
+	if dir == nil {
+		dir = identity.DefaultDirectory()
+	}
+
+	claims, err := parseRequestToken(r, dir, jwt.WithAudience(svc.Audience), jwt.WithExpirationRequired())
+	if err != nil {
+		return "", err
+	}
+	if claims.method != svc.Method {
+		return "", fmt.Errorf("token was issued for method %q not %q", claims.method, svc.Method)
+	}
+	return string(claims.issuer), nil
+}
+
+// tokenClaims are the claims of a validated token that are used
+type tokenClaims struct {
+	issuer syntax.DID
+	method string
+}
+
+// issuerDID returns the DID in the iss claim without panicking on tokens that don't have one
+func issuerDID(claims jwt.Claims) (syntax.DID, error) {
+	mapClaims, ok := claims.(jwt.MapClaims)
+	if !ok {
+		return "", fmt.Errorf("token contained no claims")
+	}
+	iss, ok := mapClaims["iss"].(string)
+	if !ok {
+		return "", fmt.Errorf("iss claim missing")
+	}
+	did, err := syntax.ParseDID(iss)
+	if err != nil {
+		return "", fmt.Errorf("invalid iss claim: %s", err)
+	}
+	return did, nil
+}
+
+func parseRequestToken(r *http.Request, dir identity.Directory, opts ...jwt.ParserOption) (tokenClaims, error) {
 	headerValues := r.Header["Authorization"]
 
 	if len(headerValues) != 1 {
-		return "", fmt.Errorf("missing authorization header")
+		return tokenClaims{}, fmt.Errorf("missing authorization header")
 	}
 	token := strings.TrimSpace(strings.Replace(headerValues[0], "Bearer ", "", 1))
 
 	keyfunc := func(token *jwt.Token) (any, error) {
-		did := syntax.DID(token.Claims.(jwt.MapClaims)["iss"].(string))
-		identity, err := identity.DefaultDirectory().LookupDID(r.Context(), did)
+		did, err := issuerDID(token.Claims)
+		if err != nil {
+			return nil, err
+		}
+		identity, err := dir.LookupDID(r.Context(), did)
 		if err != nil {
 			return nil, fmt.Errorf("unable to resolve did %s: %s", did, err)
 		}
@@ -69,20 +131,16 @@ func GetRequestUserDID(r *http.Request) (string, error) {
 
 	validMethods := jwt.WithValidMethods([]string{ES256, ES256K})
 
-	parsedToken, err := jwt.ParseWithClaims(token, jwt.MapClaims{}, keyfunc, validMethods)
+	parsedToken, err := jwt.ParseWithClaims(token, jwt.MapClaims{}, keyfunc, append(opts, validMethods)...)
 	if err != nil {
-		return "", fmt.Errorf("invalid token: %s", err)
+		return tokenClaims{}, fmt.Errorf("invalid token: %s", err)
 	}
 
-	claims, ok := parsedToken.Claims.(jwt.MapClaims)
-	if !ok {
-		return "", fmt.Errorf("token contained no claims")
-	}
-
-	issVal, ok := claims["iss"].(string)
-	if !ok {
-		return "", fmt.Errorf("iss claim missing")
+	did, err := issuerDID(parsedToken.Claims)
+	if err != nil {
+		return tokenClaims{}, err
 	}
-
-	return string(syntax.DID(issVal)), nil
+	// lxm is optional for tokens that aren't service auth tokens
+	method, _ := parsedToken.Claims.(jwt.MapClaims)["lxm"].(string)
+	return tokenClaims{issuer: did, method: method}, nil
 }
@@ -0,0 +1,156 @@
+// Package backup takes periodic snapshots of the database while the feed generator is running, keeping
+// only the newest few
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Defaults for how often snapshots are taken and how many are kept
+const (
+	DefaultInterval = 24 * time.Hour
+	DefaultKeep     = 7
+)
+
+const snapshotTimeFormat = "20060102T150405Z"
+
+// Store is a database that can be backed up while it's in use
+type Store interface {
+	// Backup writes a consistent copy of the database to dest, which must not exist
+	Backup(ctx context.Context, dest string) error
+}
+
+// Config is where snapshots are written and how often
+type Config struct {
+	// Dir is the directory snapshots are written to. Snapshots are only taken if it's set
+	Dir string
+	// Interval is how long after the newest snapshot the next one is taken
+	Interval time.Duration
+	// Keep is how many snapshots are kept, older ones are deleted
+	Keep int
+}
+
+// Enabled reports whether the config takes snapshots
+func (c Config) Enabled() bool {
+	return c.Dir != ""
+}
+
+// Snapshotter takes snapshots of a database
+type Snapshotter struct {
+	store Store
+	cfg   Config
+}
+
+// NewSnapshotter returns a snapshotter. Call Run to start taking snapshots in the background
+func NewSnapshotter(store Store, cfg Config) *Snapshotter {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.Keep <= 0 {
+		cfg.Keep = DefaultKeep
+	}
+	return &Snapshotter{
+		store: store,
+		cfg:   cfg,
+	}
+}
+
+// Run takes a snapshot every interval until the context is cancelled. The first snapshot is taken an
+// interval after the newest existing one so that restarting doesn't take extra snapshots
+func (s *Snapshotter) Run(ctx context.Context) {
+	for {
+		wait := time.Duration(0)
+		if latest, ok := s.latest(); ok {
+			wait = time.Until(latest.Add(s.cfg.Interval))
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+
+		filename, err := s.Snapshot(ctx, time.Now())
+		if err != nil {
+			slog.Error("taking database snapshot", "error", err)
+			// wait a full interval rather than retrying straight away
+			select {
+			case <-time.After(s.cfg.Interval):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		slog.Info("took database snapshot", "file", filename)
+	}
+}
+
+// Snapshot writes a snapshot of the database named after the given time and then deletes the oldest
+// snapshots so that only Keep are left. It returns the path of the new snapshot
+func (s *Snapshotter) Snapshot(ctx context.Context, now time.Time) (string, error) {
+	err := os.MkdirAll(s.cfg.Dir, 0o755)
+	if err != nil {
+		return "", fmt.Errorf("create snapshot dir: %w", err)
+	}
+
+	filename := filepath.Join(s.cfg.Dir, fmt.Sprintf("database-%s.db", now.UTC().Format(snapshotTimeFormat)))
+	err = s.store.Backup(ctx, filename)
+	if err != nil {
+		return "", fmt.Errorf("backup database: %w", err)
+	}
+
+	snapshots, err := Snapshots(s.cfg.Dir)
+	if err != nil {
+		return filename, err
+	}
+	for len(snapshots) > s.cfg.Keep {
+		err = os.Remove(snapshots[0].Path)
+		if err != nil {
+			return filename, fmt.Errorf("remove old snapshot: %w", err)
+		}
+		slog.Info("removed old database snapshot", "file", snapshots[0].Path)
+		snapshots = snapshots[1:]
+	}
+	return filename, nil
+}
+
+func (s *Snapshotter) latest() (time.Time, bool) {
+	snapshots, err := Snapshots(s.cfg.Dir)
+	if err != nil || len(snapshots) == 0 {
+		return time.Time{}, false
+	}
+	return snapshots[len(snapshots)-1].TakenAt, true
+}
+
+// Snapshot is a snapshot file
+type Snapshot struct {
+	Path    string
+	TakenAt time.Time
+}
+
+// Snapshots returns the snapshots in a directory, oldest first
+func Snapshots(dir string) ([]Snapshot, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "database-*.db"))
+	if err != nil {
+		return nil, fmt.Errorf("list snapshots: %w", err)
+	}
+
+	snapshots := make([]Snapshot, 0, len(matches))
+	for _, match := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(match), "database-"), ".db")
+		takenAt, err := time.Parse(snapshotTimeFormat, stamp)
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, Snapshot{Path: match, TakenAt: takenAt})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].TakenAt.Before(snapshots[j].TakenAt) })
+	return snapshots, nil
+}
@@ -0,0 +1,53 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fileStore backs up by writing a file with the backup's name in it
+type fileStore struct{}
+
+func (fileStore) Backup(_ context.Context, dest string) error {
+	return os.WriteFile(dest, []byte(filepath.Base(dest)), 0o644)
+}
+
+func TestSnapshotRotation(t *testing.T) {
+	dir := t.TempDir()
+	snapshotter := NewSnapshotter(fileStore{}, Config{Dir: dir, Keep: 3})
+
+	start := time.Date(2026, 1, 1, 3, 0, 0, 0, time.UTC)
+	for i := range 5 {
+		_, err := snapshotter.Snapshot(context.Background(), start.Add(time.Duration(i)*24*time.Hour))
+		if err != nil {
+			t.Fatalf("snapshot: %v", err)
+		}
+	}
+	// files that aren't snapshots are left alone
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	snapshots, err := Snapshots(dir)
+	if err != nil {
+		t.Fatalf("list snapshots: %v", err)
+	}
+	want := []string{"database-20260103T030000Z.db", "database-20260104T030000Z.db", "database-20260105T030000Z.db"}
+	if len(snapshots) != len(want) {
+		t.Fatalf("got %+v, want the newest 3 snapshots", snapshots)
+	}
+	for i, snapshot := range snapshots {
+		if filepath.Base(snapshot.Path) != want[i] {
+			t.Errorf("snapshot %d: got %s, want %s", i, snapshot.Path, want[i])
+		}
+	}
+	if latest, ok := snapshotter.latest(); !ok || !latest.Equal(start.Add(4*24*time.Hour)) {
+		t.Errorf("got latest snapshot at %v", latest)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Errorf("other files were removed: %v", err)
+	}
+}
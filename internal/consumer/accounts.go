@@ -0,0 +1,85 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/bluesky-social/jetstream/pkg/models"
+)
+
+// Account statuses as sent in account events. An account that is active has no status
+const (
+	AccountStatusActive      = "active"
+	AccountStatusDeactivated = "deactivated"
+	AccountStatusTakendown   = "takendown"
+	AccountStatusSuspended   = "suspended"
+	AccountStatusDeleted     = "deleted"
+)
+
+// accountHiddenReason is the reason posts from an inactive account are hidden for
+const accountHiddenReason = "account_status"
+
+// handleAccountEvent hides posts from accounts that have been deactivated, taken down or suspended and
+// restores them if the account becomes active again. Posts from deleted accounts are deleted
+func (h *Handler) handleAccountEvent(ctx context.Context, event *models.Event) error {
+	account := event.Account
+	if account == nil {
+		return nil
+	}
+
+	// account events are sent for every account on the network but only our authors are of interest
+	known, err := h.store.IsKnownAuthor(ctx, account.Did)
+	if err != nil {
+		return fmt.Errorf("check if account is a known author: %w", err)
+	}
+	if !known {
+		return nil
+	}
+
+	status := AccountStatusActive
+	if !account.Active && account.Status != nil {
+		status = *account.Status
+	}
+
+	slog.Info("author account status changed", "did", account.Did, "status", status)
+	err = h.store.SetAuthorStatus(ctx, account.Did, status)
+	if err != nil {
+		return fmt.Errorf("store author status: %w", err)
+	}
+
+	switch status {
+	case AccountStatusActive:
+		err = h.store.UnhideSubject(ctx, account.Did, accountHiddenReason)
+	case AccountStatusDeactivated, AccountStatusTakendown, AccountStatusSuspended:
+		err = h.store.HideSubject(ctx, account.Did, accountHiddenReason)
+	case AccountStatusDeleted:
+		err = h.store.DeletePostsFromUsers(ctx, []string{account.Did})
+	}
+	if err != nil {
+		return fmt.Errorf("apply author status %s: %w", status, err)
+	}
+	return nil
+}
+
+// handleIdentityEvent keeps track of the handles of authors
+func (h *Handler) handleIdentityEvent(ctx context.Context, event *models.Event) error {
+	identity := event.Identity
+	if identity == nil || identity.Handle == nil {
+		return nil
+	}
+
+	known, err := h.store.IsKnownAuthor(ctx, identity.Did)
+	if err != nil {
+		return fmt.Errorf("check if account is a known author: %w", err)
+	}
+	if !known {
+		return nil
+	}
+
+	err = h.store.SetAuthorHandle(ctx, identity.Did, *identity.Handle)
+	if err != nil {
+		return fmt.Errorf("store author handle: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package consumer
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/jetstream/pkg/models"
+
+	"github.com/nacorid/x402-feed/internal/memstore"
+	"github.com/nacorid/x402-feed/internal/server"
+)
+
+func accountEvent(did string, active bool, status string) *models.Event {
+	account := &atproto.SyncSubscribeRepos_Account{Did: did, Active: active}
+	if status != "" {
+		account.Status = &status
+	}
+	return &models.Event{Did: did, Kind: models.EventKindAccount, Account: account}
+}
+
+func TestHandleAccountEvents(t *testing.T) {
+	a := server.Post{RKey: "a1", PostURI: "at://did:plc:a/app.bsky.feed.post/a1", UserDID: "did:plc:a", CreatedAt: 100}
+	b := server.Post{RKey: "b1", PostURI: "at://did:plc:b/app.bsky.feed.post/b1", UserDID: "did:plc:b", CreatedAt: 200}
+
+	tests := map[string]struct {
+		events []*models.Event
+		// shown are the posts left in the feed and stored are the ones still in the store
+		shown  []server.Post
+		stored []server.Post
+	}{
+		"deactivated": {
+			events: []*models.Event{accountEvent("did:plc:a", false, AccountStatusDeactivated)},
+			shown:  []server.Post{b},
+			stored: []server.Post{a, b},
+		},
+		"taken down": {
+			events: []*models.Event{accountEvent("did:plc:a", false, AccountStatusTakendown)},
+			shown:  []server.Post{b},
+			stored: []server.Post{a, b},
+		},
+		"suspended": {
+			events: []*models.Event{accountEvent("did:plc:a", false, AccountStatusSuspended)},
+			shown:  []server.Post{b},
+			stored: []server.Post{a, b},
+		},
+		"reactivated": {
+			events: []*models.Event{
+				accountEvent("did:plc:a", false, AccountStatusDeactivated),
+				accountEvent("did:plc:a", true, ""),
+			},
+			shown:  []server.Post{b, a},
+			stored: []server.Post{a, b},
+		},
+		"taken down then reinstated": {
+			events: []*models.Event{
+				accountEvent("did:plc:a", false, AccountStatusTakendown),
+				accountEvent("did:plc:a", true, AccountStatusActive),
+			},
+			shown:  []server.Post{b, a},
+			stored: []server.Post{a, b},
+		},
+		"deleted": {
+			events: []*models.Event{accountEvent("did:plc:a", false, AccountStatusDeleted)},
+			shown:  []server.Post{b},
+			stored: []server.Post{b},
+		},
+		"unknown status leaves posts": {
+			events: []*models.Event{accountEvent("did:plc:a", false, "desynchronized")},
+			shown:  []server.Post{b, a},
+			stored: []server.Post{a, b},
+		},
+		"unknown author is ignored": {
+			events: []*models.Event{accountEvent("did:plc:c", false, AccountStatusDeleted)},
+			shown:  []server.Post{b, a},
+			stored: []server.Post{a, b},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			store := memstore.New()
+			for _, p := range []server.Post{a, b} {
+				if err := store.CreatePost(t.Context(), p); err != nil {
+					t.Fatalf("create post: %v", err)
+				}
+			}
+			handler := NewFeedHandler(store, HandlerOptions{})
+
+			for _, event := range tc.events {
+				if err := handler.HandleEvent(t.Context(), event); err != nil {
+					t.Fatalf("handle event: %v", err)
+				}
+			}
+
+			want := make([]string, 0, len(tc.shown))
+			for _, p := range tc.shown {
+				want = append(want, p.PostURI)
+			}
+			if got := feedURIs(t, store); !slices.Equal(got, want) {
+				t.Errorf("got feed %v, want %v", got, want)
+			}
+			for _, p := range []server.Post{a, b} {
+				stored, err := store.IsPostStored(t.Context(), p.PostURI)
+				if err != nil {
+					t.Fatalf("is post stored: %v", err)
+				}
+				want := slices.ContainsFunc(tc.stored, func(s server.Post) bool { return s.PostURI == p.PostURI })
+				if stored != want {
+					t.Errorf("got %s stored %v, want %v", p.PostURI, stored, want)
+				}
+			}
+			if known, _ := store.IsKnownAuthor(t.Context(), "did:plc:c"); known {
+				t.Error("got unknown author recorded, want account events from other accounts ignored")
+			}
+		})
+	}
+}
@@ -17,23 +17,43 @@ import (
 	"github.com/nacorid/x402-feed/internal/server"
 )
 
+const (
+	postCollection     = "app.bsky.feed.post"
+	repostCollection   = "app.bsky.feed.repost"
+	likeCollection     = "app.bsky.feed.like"
+	listItemCollection = "app.bsky.graph.listitem"
+)
+
+// EventHandler handles the events consumed from Jetstream and decides which events it wants
+type EventHandler interface {
+	HandleEvent(ctx context.Context, event *models.Event) error
+	wantedCollections() []string
+	// wantedDIDs returns the repos events are wanted from or an empty slice for every repo
+	wantedDIDs() []string
+}
+
+// checkpointer is implemented by handlers that store how far through the stream they've got so that
+// consuming can carry on from there after a restart
+type checkpointer interface {
+	// checkpoint returns the time_us of the last event that was fully handled or 0 if there isn't one
+	checkpoint(ctx context.Context) (int64, error)
+}
+
 // JetstreamConsumer is responsible for consuming from a jetstream instance
 type JetstreamConsumer struct {
 	cfg     *client.ClientConfig
-	handler *Handler
+	handler EventHandler
 	logger  *slog.Logger
 }
 
 // NewJetstreamConsumer configures a new jetstream consumer. To run or start you should call the Consume function
-func NewJetstreamConsumer(jsAddr string, logger *slog.Logger, handler *Handler) *JetstreamConsumer {
+func NewJetstreamConsumer(jsAddr string, logger *slog.Logger, handler EventHandler) *JetstreamConsumer {
 	cfg := client.DefaultClientConfig()
 	if jsAddr != "" {
 		cfg.WebsocketURL = jsAddr
 	}
-	cfg.WantedCollections = []string{
-		"app.bsky.feed.post",
-	}
-	cfg.WantedDids = []string{}
+	cfg.WantedCollections = handler.wantedCollections()
+	cfg.WantedDids = handler.wantedDIDs()
 
 	return &JetstreamConsumer{
 		cfg:     cfg,
@@ -53,6 +73,16 @@ func (c *JetstreamConsumer) Consume(ctx context.Context) error {
 	}
 
 	cursor := time.Now().Add(1 * -time.Minute).UnixMicro()
+	if cp, ok := c.handler.(checkpointer); ok {
+		saved, err := cp.checkpoint(ctx)
+		if err != nil {
+			return fmt.Errorf("get checkpoint: %w", err)
+		}
+		if saved > 0 {
+			slog.Info("resuming from checkpoint", "cursor", saved)
+			cursor = saved
+		}
+	}
 
 	if err := client.ConnectAndRead(ctx, &cursor); err != nil {
 		return fmt.Errorf("connect and read: %w", err)
@@ -62,40 +92,124 @@ func (c *JetstreamConsumer) Consume(ctx context.Context) error {
 	return nil
 }
 
+// HandlerOptions configures the optional behaviour of a handler
+type HandlerOptions struct {
+	// Lists and SpamFilter can be nil
+	Lists       *Lists
+	SpamFilter  *SpamFilter
+	LabelPolicy LabelPolicy
+	Threads     ThreadConfig
+	// IncludeQuotes stores posts that quote a post in the feed
+	IncludeQuotes bool
+	Queue         QueueConfig
+	// Writes, if set, buffers creating and deleting posts and stores how far through the stream the
+	// handler has got
+	Writes *WriteBuffer
+}
+
 // Handler is responsible for handling a message consumed from Jetstream
 type Handler struct {
-	store     server.PostStore
-	blocklist *Blocklist
+	store         server.PostStore
+	lists         *Lists
+	spamFilter    *SpamFilter
+	labelPolicy   LabelPolicy
+	threads       ThreadConfig
+	includeQuotes bool
+	queue         QueueConfig
+	writes        *WriteBuffer
 }
 
 // NewFeedHandler returns a new handler
-func NewFeedHandler(store server.PostStore, blocklist *Blocklist) *Handler {
-	return &Handler{store: store, blocklist: blocklist}
+func NewFeedHandler(store server.PostStore, opts HandlerOptions) *Handler {
+	if opts.Writes != nil {
+		store = opts.Writes
+	}
+	return &Handler{
+		store:         store,
+		lists:         opts.Lists,
+		spamFilter:    opts.SpamFilter,
+		labelPolicy:   opts.LabelPolicy,
+		threads:       opts.Threads,
+		includeQuotes: opts.IncludeQuotes,
+		queue:         opts.Queue,
+		writes:        opts.Writes,
+	}
+}
+
+// wantedCollections returns the collections that the handler needs events for
+func (h *Handler) wantedCollections() []string {
+	collections := []string{postCollection}
+	if h.lists != nil {
+		collections = append(collections, listItemCollection)
+	}
+	return collections
+}
+
+// wantedDIDs returns an empty slice as posts from every repo are wanted
+func (h *Handler) wantedDIDs() []string {
+	return []string{}
 }
 
-func (h *Handler) DeleteBlockedPosts(ctx context.Context) error {
-	if h.blocklist == nil {
+// DeleteDeniedPosts will delete all posts from users on deny lists that apply to every feed
+func (h *Handler) DeleteDeniedPosts(ctx context.Context) error {
+	if h.lists == nil {
 		return nil
 	}
 
-	blockedDIDs := h.blocklist.GetAll()
-	if len(blockedDIDs) == 0 {
+	deniedDIDs := h.lists.GetDenied()
+	if len(deniedDIDs) == 0 {
 		return nil
 	}
 
-	return h.store.DeletePostsFromURIs(blockedDIDs)
+	return h.store.DeletePostsFromUsers(ctx, deniedDIDs)
 }
 
-// HandleEvent will handle an event based on the event's commit operation
+// HandleEvent will handle an event based on its kind and the event's commit operation. An error stops
+// the stream, which is resumed from the last checkpoint, so an event that fails is only recorded as
+// handled once it has been handled again successfully
 func (h *Handler) HandleEvent(ctx context.Context, event *models.Event) error {
+	if err := h.handleEvent(ctx, event); err != nil {
+		return err
+	}
+	if h.writes == nil {
+		return nil
+	}
+	return h.writes.eventHandled(ctx, event.TimeUS)
+}
+
+// checkpoint returns the position of the last event whose writes were committed
+func (h *Handler) checkpoint(ctx context.Context) (int64, error) {
+	if h.writes == nil {
+		return 0, nil
+	}
+	return h.writes.checkpoint(ctx)
+}
+
+func (h *Handler) handleEvent(ctx context.Context, event *models.Event) error {
+	switch event.Kind {
+	case models.EventKindAccount:
+		return h.handleAccountEvent(ctx, event)
+	case models.EventKindIdentity:
+		return h.handleIdentityEvent(ctx, event)
+	}
+
 	if event.Commit == nil {
 		return nil
 	}
 
+	switch event.Commit.Collection {
+	case listItemCollection:
+		return h.handleListItemEvent(ctx, event)
+	case postCollection:
+	default:
+		return nil
+	}
+
 	switch event.Commit.Operation {
-	case models.CommitOperationCreate:
-		return h.handleCreateEvent(ctx, event)
-		// TODO: handle deletes too
+	case models.CommitOperationCreate, models.CommitOperationUpdate:
+		return h.handlePostEvent(ctx, event)
+	case models.CommitOperationDelete:
+		return h.handleDeleteEvent(ctx, event)
 	default:
 		return nil
 	}
@@ -104,46 +218,151 @@ func (h *Handler) HandleEvent(ctx context.Context, event *models.Event) error {
 // The `(?i)` flag makes it case-insensitive
 var x402Regex = regexp.MustCompile(`(?i)\bx402\b`)
 
-func (h *Handler) handleCreateEvent(_ context.Context, event *models.Event) error {
-	if event.Commit.Collection != "app.bsky.feed.post" {
-		return nil
-	}
-
+// handlePostEvent decides whether a created or updated post belongs in the feed. An updated post that
+// no longer belongs is removed, and one that now does is added at the position of its original createdAt
+func (h *Handler) handlePostEvent(ctx context.Context, event *models.Event) error {
 	var bskyPost apibsky.FeedPost
 	if err := json.Unmarshal(event.Commit.Record, &bskyPost); err != nil {
 		// ignore this
 		return nil
 	}
 
+	postURI := fmt.Sprintf("at://%s/app.bsky.feed.post/%s", event.Did, event.Commit.RKey)
+	isUpdate := event.Commit.Operation == models.CommitOperationUpdate
+
 	// this is where logic goes for what posts you wish to store for a feed but for this example
 	// just look for any post that contains the #golang hashtag
 	/*if !strings.Contains(strings.ToLower(bskyPost.Text), "x402") {
 		return nil
 	}*/
-	if !x402Regex.MatchString(bskyPost.Text) {
+	matches := x402Regex.MatchString(bskyPost.Text) || h.isThreadReply(ctx, event.Did, &bskyPost) || h.isQuoteOfStoredPost(ctx, &bskyPost)
+	if !matches || (h.lists != nil && h.lists.Denied(event.Did)) {
+		if isUpdate {
+			return h.deletePost(ctx, postURI)
+		}
 		return nil
 	}
 
-	if h.blocklist != nil && h.blocklist.Contains(event.Did) {
+	reason := h.labelPolicy.selfLabelRejection(&bskyPost)
+	if reason == "" {
+		reason = h.queue.spamPatternRejection(bskyPost.Text)
+	}
+	if reason != "" {
+		if err := h.rejectPost(ctx, postURI, event.Did, reason, bskyPost.Text); err != nil {
+			return err
+		}
+		if isUpdate {
+			return h.deletePost(ctx, postURI)
+		}
 		return nil
 	}
 
+	// updates skip the spam filter as an edited post would count against its author twice and be
+	// found to be a near-duplicate of its own original text
+	if h.spamFilter != nil && !isUpdate {
+		if reason := h.spamFilter.Check(event.Did, &bskyPost, time.Now()); reason != "" {
+			return h.rejectPost(ctx, postURI, event.Did, reason, bskyPost.Text)
+		}
+	}
+
 	createdAt, err := time.Parse(time.RFC3339, bskyPost.CreatedAt)
 	if err != nil {
 		slog.Error("parsing createdAt time from post", "error", err, "timestamp", bskyPost.CreatedAt)
 		createdAt = time.Now().UTC()
 	}
 
-	postURI := fmt.Sprintf("at://%s/app.bsky.feed.post/%s", event.Did, event.Commit.RKey)
+	// updated posts that are already stored keep whatever approval state they have
+	if h.shouldHold(ctx, event.Did) && !(isUpdate && h.isPostStored(ctx, postURI)) {
+		if err := h.holdPost(ctx, postURI); err != nil {
+			return fmt.Errorf("hold post for approval: %w", err)
+		}
+	}
+
+	replyRoot, replyParent := replyRefs(&bskyPost)
 	post := server.Post{
-		RKey:      event.Commit.RKey,
-		PostURI:   postURI,
-		CreatedAt: createdAt.UnixMilli(),
+		RKey:        event.Commit.RKey,
+		PostURI:     postURI,
+		UserDID:     event.Did,
+		ReplyRoot:   replyRoot,
+		ReplyParent: replyParent,
+		CreatedAt:   createdAt.UnixMilli(),
+		IndexedAt:   time.Now().UnixMilli(),
+	}
+	addMetadata(&post, &bskyPost)
+	// if an updated post is already stored it keeps its place in the feed and only its metadata is updated
+	err = h.store.CreatePost(ctx, post)
+	if err != nil {
+		return fmt.Errorf("create post in store: %w", err)
 	}
-	err = h.store.CreatePost(post)
+	return nil
+}
+
+// handleDeleteEvent removes a post from the feed when its author deletes it
+func (h *Handler) handleDeleteEvent(ctx context.Context, event *models.Event) error {
+	return h.deletePost(ctx, fmt.Sprintf("at://%s/app.bsky.feed.post/%s", event.Did, event.Commit.RKey))
+}
+
+func (h *Handler) deletePost(ctx context.Context, postURI string) error {
+	err := h.store.DeletePostsFromURIs(ctx, []string{postURI})
 	if err != nil {
-		slog.Error("error creating post in store", "error", err)
+		return fmt.Errorf("delete post from store: %w", err)
+	}
+	return nil
+}
+
+// handleListItemEvent applies changes made to any of the lists as soon as they happen rather than
+// waiting for the next full refresh of the lists
+func (h *Handler) handleListItemEvent(ctx context.Context, event *models.Event) error {
+	if h.lists == nil || !h.lists.Owns(event.Did) {
 		return nil
 	}
+
+	switch event.Commit.Operation {
+	case models.CommitOperationCreate:
+		var listItem apibsky.GraphListitem
+		if err := json.Unmarshal(event.Commit.Record, &listItem); err != nil {
+			return nil
+		}
+		list, ok, err := h.lists.Add(ctx, listItem.List, event.Commit.RKey, listItem.Subject)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		slog.Info("user added to list", "did", listItem.Subject, "list", list.URI, "action", list.Action)
+		if list.Action != ListActionDeny || len(list.Feeds) > 0 {
+			return nil
+		}
+		err = h.store.DeletePostsFromUsers(ctx, []string{listItem.Subject})
+		if err != nil {
+			return fmt.Errorf("delete denied user's posts: %w", err)
+		}
+	case models.CommitOperationDelete:
+		did, ok, err := h.lists.Remove(ctx, event.Did, event.Commit.RKey)
+		if err != nil {
+			return err
+		}
+		if ok {
+			slog.Info("user removed from list", "did", did)
+		}
+	}
+	return nil
+}
+
+func (h *Handler) rejectPost(ctx context.Context, postURI, authorDID, reason, text string) error {
+	slog.Debug("rejecting post", "uri", postURI, "reason", reason)
+	rejection := server.Rejection{
+		PostURI:   postURI,
+		AuthorDID: authorDID,
+		Reason:    reason,
+		Text:      text,
+		CreatedAt: time.Now().UnixMilli(),
+	}
+	err := h.store.CreateRejection(ctx, rejection)
+	if err != nil {
+		return fmt.Errorf("record post rejection in store: %w", err)
+	}
 	return nil
 }
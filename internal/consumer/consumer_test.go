@@ -0,0 +1,518 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/jetstream/pkg/models"
+
+	"github.com/nacorid/x402-feed/internal/memstore"
+	"github.com/nacorid/x402-feed/internal/server"
+)
+
+func postEvent(t *testing.T, operation, did, rkey, text string) *models.Event {
+	t.Helper()
+	record, err := json.Marshal(map[string]any{
+		"$type":     postCollection,
+		"text":      text,
+		"createdAt": "2025-08-01T12:00:00Z",
+	})
+	if err != nil {
+		t.Fatalf("marshal record: %v", err)
+	}
+	return &models.Event{
+		Did:  did,
+		Kind: models.EventKindCommit,
+		Commit: &models.Commit{
+			Operation:  operation,
+			Collection: postCollection,
+			RKey:       rkey,
+			Record:     record,
+		},
+	}
+}
+
+// recordEvent returns a commit event for a record in any collection. The record is left out if it's nil
+func recordEvent(t *testing.T, operation, did, collection, rkey string, record any) *models.Event {
+	t.Helper()
+	var raw json.RawMessage
+	if record != nil {
+		var err error
+		raw, err = json.Marshal(record)
+		if err != nil {
+			t.Fatalf("marshal record: %v", err)
+		}
+	}
+	return &models.Event{
+		Did:  did,
+		Kind: models.EventKindCommit,
+		Commit: &models.Commit{
+			Operation:  operation,
+			Collection: collection,
+			RKey:       rkey,
+			Record:     raw,
+		},
+	}
+}
+
+func feedURIs(t *testing.T, store server.PostStore) []string {
+	t.Helper()
+	posts, err := store.GetFeedPosts(t.Context(), server.FeedQuery{Cursor: 9999999999999, Limit: 100})
+	if err != nil {
+		t.Fatalf("get feed posts: %v", err)
+	}
+	uris := make([]string, 0, len(posts))
+	for _, p := range posts {
+		uris = append(uris, p.PostURI)
+	}
+	return uris
+}
+
+func TestHandlePostEvents(t *testing.T) {
+	store := memstore.New()
+	handler := NewFeedHandler(store, HandlerOptions{})
+	ctx := context.Background()
+	uri := "at://did:plc:a/app.bsky.feed.post/1"
+
+	handle := func(event *models.Event) {
+		t.Helper()
+		if err := handler.HandleEvent(ctx, event); err != nil {
+			t.Fatalf("handle event: %v", err)
+		}
+	}
+
+	handle(postEvent(t, models.CommitOperationCreate, "did:plc:b", "1", "nothing to see here"))
+	if got := feedURIs(t, store); len(got) != 0 {
+		t.Fatalf("got %v, want posts that don't match to be ignored", got)
+	}
+
+	handle(postEvent(t, models.CommitOperationCreate, "did:plc:a", "1", "paying for APIs with x402"))
+	if got := feedURIs(t, store); len(got) != 1 || got[0] != uri {
+		t.Fatalf("got %v, want the matching post stored", got)
+	}
+
+	// editing the post so it no longer matches removes it
+	handle(postEvent(t, models.CommitOperationUpdate, "did:plc:a", "1", "paying for APIs"))
+	if got := feedURIs(t, store); len(got) != 0 {
+		t.Fatalf("got %v, want the edited post removed", got)
+	}
+
+	handle(postEvent(t, models.CommitOperationUpdate, "did:plc:a", "1", "paying for APIs with X402"))
+	if got := feedURIs(t, store); len(got) != 1 {
+		t.Fatalf("got %v, want the edited post added back", got)
+	}
+
+	handle(&models.Event{
+		Did:    "did:plc:a",
+		Kind:   models.EventKindCommit,
+		Commit: &models.Commit{Operation: models.CommitOperationDelete, Collection: postCollection, RKey: "1"},
+	})
+	if got := feedURIs(t, store); len(got) != 0 {
+		t.Fatalf("got %v, want the deleted post removed", got)
+	}
+}
+
+func TestHoldPostsFromNewAuthors(t *testing.T) {
+	store := memstore.New()
+	handler := NewFeedHandler(store, HandlerOptions{Queue: QueueConfig{HoldNewAuthors: true, AutoApproveAfter: 1}})
+	ctx := context.Background()
+
+	if err := handler.HandleEvent(ctx, postEvent(t, models.CommitOperationCreate, "did:plc:a", "1", "x402 first post")); err != nil {
+		t.Fatalf("handle event: %v", err)
+	}
+	pending, err := store.GetPendingPosts(ctx, 10)
+	if err != nil {
+		t.Fatalf("get pending posts: %v", err)
+	}
+	if len(pending) != 1 || len(feedURIs(t, store)) != 0 {
+		t.Fatalf("got %d pending posts, want the first post from a new author held", len(pending))
+	}
+
+	if err := store.UnhideSubject(ctx, pending[0].PostURI, server.HiddenReasonPending); err != nil {
+		t.Fatalf("approve post: %v", err)
+	}
+	if err := handler.HandleEvent(ctx, postEvent(t, models.CommitOperationCreate, "did:plc:a", "2", "x402 second post")); err != nil {
+		t.Fatalf("handle event: %v", err)
+	}
+	if got := feedURIs(t, store); len(got) != 2 {
+		t.Errorf("got %v, want posts shown once the author has an approved post", got)
+	}
+}
+
+func TestBufferedWrites(t *testing.T) {
+	store := memstore.New()
+	writes := NewWriteBuffer(store, WriteBufferConfig{})
+	handler := NewFeedHandler(store, HandlerOptions{
+		Threads: ThreadConfig{IncludeAuthorReplies: true},
+		Writes:  writes,
+	})
+	ctx := context.Background()
+
+	handle := func(event *models.Event) {
+		t.Helper()
+		if err := handler.HandleEvent(ctx, event); err != nil {
+			t.Fatalf("handle event: %v", err)
+		}
+	}
+
+	root := postEvent(t, models.CommitOperationCreate, "did:plc:a", "1", "how does x402 settle?")
+	root.TimeUS = 100
+	handle(root)
+
+	// the author's reply is stored because the buffered root is seen as stored
+	reply := postEvent(t, models.CommitOperationCreate, "did:plc:a", "2", "it settles on chain")
+	reply.Commit.Record, _ = json.Marshal(map[string]any{
+		"$type":     postCollection,
+		"text":      "it settles on chain",
+		"createdAt": "2025-08-01T12:01:00Z",
+		"reply": map[string]any{
+			"root":   map[string]any{"uri": "at://did:plc:a/app.bsky.feed.post/1", "cid": "bafyroot"},
+			"parent": map[string]any{"uri": "at://did:plc:a/app.bsky.feed.post/1", "cid": "bafyroot"},
+		},
+	})
+	reply.TimeUS = 200
+	handle(reply)
+
+	// a post that's created and deleted before the flush is never stored
+	deleted := postEvent(t, models.CommitOperationCreate, "did:plc:b", "1", "x402 oops")
+	deleted.TimeUS = 300
+	handle(deleted)
+	handle(&models.Event{
+		Did:    "did:plc:b",
+		Kind:   models.EventKindCommit,
+		TimeUS: 400,
+		Commit: &models.Commit{Operation: models.CommitOperationDelete, Collection: postCollection, RKey: "1"},
+	})
+
+	if got := feedURIs(t, store); len(got) != 0 {
+		t.Fatalf("got %v, want nothing stored before the buffer is flushed", got)
+	}
+	cursor, err := handler.checkpoint(ctx)
+	if err != nil {
+		t.Fatalf("checkpoint: %v", err)
+	}
+	if cursor != 400 {
+		t.Errorf("got checkpoint %d, want the last handled event 400", cursor)
+	}
+
+	got := feedURIs(t, store)
+	want := []string{"at://did:plc:a/app.bsky.feed.post/2", "at://did:plc:a/app.bsky.feed.post/1"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// failingStore fails to apply writes until it's told to stop. failHide fails hiding subjects, which
+// isn't buffered, and badPost is a post that can never be stored
+type failingStore struct {
+	server.PostStore
+	fail     bool
+	failHide bool
+	badPost  string
+}
+
+func (s *failingStore) HideSubject(ctx context.Context, subject, reason string) error {
+	if s.failHide {
+		return errors.New("database is locked")
+	}
+	return s.PostStore.HideSubject(ctx, subject, reason)
+}
+
+func (s *failingStore) ApplyWrites(ctx context.Context, batch server.WriteBatch) error {
+	if s.fail {
+		return errors.New("disk full")
+	}
+	for i, write := range batch.Writes {
+		if write.Kind == server.WriteCreatePost && write.Post.PostURI == s.badPost {
+			return &server.WriteError{Index: i, Err: errors.New("invalid byte sequence")}
+		}
+	}
+	return s.PostStore.ApplyWrites(ctx, batch)
+}
+
+func TestBufferedWritesAreRetried(t *testing.T) {
+	store := &failingStore{PostStore: memstore.New(), fail: true}
+	writes := NewWriteBuffer(store, WriteBufferConfig{})
+	handler := NewFeedHandler(store, HandlerOptions{Writes: writes})
+	ctx := context.Background()
+
+	event := postEvent(t, models.CommitOperationCreate, "did:plc:a", "1", "x402")
+	event.TimeUS = 100
+	if err := handler.HandleEvent(ctx, event); err != nil {
+		t.Fatalf("handle event: %v", err)
+	}
+
+	if err := writes.Flush(ctx); err == nil {
+		t.Fatal("expected the flush to fail")
+	}
+	cursor, err := store.GetCursor(ctx, DefaultJetstreamCursorName)
+	if err != nil {
+		t.Fatalf("get cursor: %v", err)
+	}
+	if cursor != 0 {
+		t.Fatalf("got cursor %d, want it left alone when the writes weren't committed", cursor)
+	}
+
+	store.fail = false
+	if err := writes.Flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if got := feedURIs(t, store); len(got) != 1 {
+		t.Errorf("got %v, want the post stored once the flush is retried", got)
+	}
+	cursor, err = store.GetCursor(ctx, DefaultJetstreamCursorName)
+	if err != nil {
+		t.Fatalf("get cursor: %v", err)
+	}
+	if cursor != 100 {
+		t.Errorf("got cursor %d, want 100", cursor)
+	}
+}
+
+func TestBadWritesAreDropped(t *testing.T) {
+	store := &failingStore{PostStore: memstore.New(), badPost: "at://did:plc:a/app.bsky.feed.post/2"}
+	writes := NewWriteBuffer(store, WriteBufferConfig{})
+	handler := NewFeedHandler(store, HandlerOptions{Writes: writes})
+	ctx := context.Background()
+
+	for i := range 3 {
+		event := postEvent(t, models.CommitOperationCreate, "did:plc:a", strconv.Itoa(i+1), "x402")
+		event.TimeUS = int64(i + 1)
+		if err := handler.HandleEvent(ctx, event); err != nil {
+			t.Fatalf("handle event: %v", err)
+		}
+	}
+
+	cursor, err := handler.checkpoint(ctx)
+	if err != nil {
+		t.Fatalf("checkpoint: %v", err)
+	}
+	if cursor != 3 {
+		t.Errorf("got checkpoint %d, want 3", cursor)
+	}
+	got := feedURIs(t, store)
+	want := []string{"at://did:plc:a/app.bsky.feed.post/3", "at://did:plc:a/app.bsky.feed.post/1"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want every post but the bad one stored", got)
+	}
+}
+
+func TestFailedEventsAreHandledAgain(t *testing.T) {
+	store := &failingStore{PostStore: memstore.New()}
+	writes := NewWriteBuffer(store, WriteBufferConfig{})
+	handler := NewFeedHandler(store, HandlerOptions{Writes: writes, Queue: QueueConfig{HoldNewAuthors: true}})
+	ctx := context.Background()
+
+	first := postEvent(t, models.CommitOperationCreate, "did:plc:a", "1", "x402")
+	first.TimeUS = 100
+	if err := handler.HandleEvent(ctx, first); err != nil {
+		t.Fatalf("handle event: %v", err)
+	}
+
+	store.failHide = true
+	second := postEvent(t, models.CommitOperationCreate, "did:plc:a", "2", "x402")
+	second.TimeUS = 200
+	if err := handler.HandleEvent(ctx, second); err == nil {
+		t.Fatal("expected handling the event to fail when the post can't be held")
+	}
+
+	// the stream is resumed from the last event that was handled so the failed one is handled again
+	cursor, err := handler.checkpoint(ctx)
+	if err != nil {
+		t.Fatalf("checkpoint: %v", err)
+	}
+	if cursor != 100 {
+		t.Fatalf("got checkpoint %d, want 100", cursor)
+	}
+
+	store.failHide = false
+	if err := handler.HandleEvent(ctx, second); err != nil {
+		t.Fatalf("handle event again: %v", err)
+	}
+	if cursor, err = handler.checkpoint(ctx); err != nil || cursor != 200 {
+		t.Errorf("got checkpoint %d %v, want 200", cursor, err)
+	}
+	pending, err := store.GetPendingPosts(ctx, 10)
+	if err != nil {
+		t.Fatalf("get pending posts: %v", err)
+	}
+	if len(pending) != 2 || len(feedURIs(t, store)) != 0 {
+		t.Errorf("got %d pending posts, want both posts held", len(pending))
+	}
+}
+
+func TestBufferBehindStopsStream(t *testing.T) {
+	store := &failingStore{PostStore: memstore.New(), fail: true}
+	writes := NewWriteBuffer(store, WriteBufferConfig{BatchSize: 1})
+	handler := NewFeedHandler(store, HandlerOptions{Writes: writes})
+	ctx := context.Background()
+
+	// with nothing flushing the buffer it's far behind once it has 10 batches in it
+	for i := range 10 {
+		event := postEvent(t, models.CommitOperationCreate, "did:plc:a", strconv.Itoa(i), "x402")
+		event.TimeUS = int64(i + 1)
+		err := handler.HandleEvent(ctx, event)
+		if i < 9 && err != nil {
+			t.Fatalf("handle event %d: %v", i, err)
+		}
+		if i == 9 && err == nil {
+			t.Fatal("expected handling the event to fail once the buffer is behind and can't be flushed")
+		}
+	}
+
+	store.fail = false
+	cursor, err := handler.checkpoint(ctx)
+	if err != nil {
+		t.Fatalf("checkpoint: %v", err)
+	}
+	if cursor != 10 || len(feedURIs(t, store)) != 10 {
+		t.Errorf("got checkpoint %d and %d posts, want every buffered post stored", cursor, len(feedURIs(t, store)))
+	}
+}
+
+func TestPostMetadata(t *testing.T) {
+	store := memstore.New()
+	handler := NewFeedHandler(store, HandlerOptions{})
+	ctx := context.Background()
+
+	event := postEvent(t, models.CommitOperationCreate, "did:plc:a", "1", "")
+	event.Commit.Record = []byte(`{
+		"$type": "app.bsky.feed.post",
+		"text": "settling #x402 payments, see www.X402.org/docs",
+		"createdAt": "2025-08-01T12:00:00Z",
+		"langs": ["en"],
+		"tags": ["Payments", "x402"],
+		"facets": [
+			{"index": {"byteStart": 9, "byteEnd": 14}, "features": [{"$type": "app.bsky.richtext.facet#tag", "tag": "X402"}]},
+			{"index": {"byteStart": 29, "byteEnd": 46}, "features": [{"$type": "app.bsky.richtext.facet#link", "uri": "https://www.X402.org/docs"}]}
+		],
+		"embed": {
+			"$type": "app.bsky.embed.recordWithMedia",
+			"record": {"$type": "app.bsky.embed.record", "record": {"uri": "at://did:plc:b/app.bsky.feed.post/1", "cid": "bafyquoted"}},
+			"media": {"$type": "app.bsky.embed.external", "external": {"uri": "https://github.com/coinbase/x402", "title": "x402", "description": ""}}
+		}
+	}`)
+	if err := handler.HandleEvent(ctx, event); err != nil {
+		t.Fatalf("handle event: %v", err)
+	}
+
+	posts, err := store.GetFeedPosts(ctx, server.FeedQuery{Cursor: 9999999999999, Limit: 10})
+	if err != nil {
+		t.Fatalf("get feed posts: %v", err)
+	}
+	if len(posts) != 1 {
+		t.Fatalf("got %d posts, want 1", len(posts))
+	}
+	got := posts[0]
+	if got.Text != "settling #x402 payments, see www.X402.org/docs" || got.IndexedAt == 0 {
+		t.Errorf("got text %q indexed at %d", got.Text, got.IndexedAt)
+	}
+	if !slices.Equal(got.Langs, []string{"en"}) {
+		t.Errorf("got langs %v", got.Langs)
+	}
+	if got.EmbedType != server.EmbedRecordWithMedia || got.HasMedia {
+		t.Errorf("got embed %q with media %v, want a quote with a link card", got.EmbedType, got.HasMedia)
+	}
+	if want := []string{"x402.org", "github.com"}; !slices.Equal(got.LinkDomains, want) {
+		t.Errorf("got link domains %v, want %v", got.LinkDomains, want)
+	}
+	if want := []string{"x402", "payments"}; !slices.Equal(got.Hashtags, want) {
+		t.Errorf("got hashtags %v, want %v", got.Hashtags, want)
+	}
+}
+
+func TestReevaluateUpdatedPosts(t *testing.T) {
+	const did = "did:plc:a"
+	labeled := func(operation, text, label string) *models.Event {
+		return recordEvent(t, operation, did, postCollection, "1", map[string]any{
+			"$type":     postCollection,
+			"text":      text,
+			"createdAt": "2025-08-01T12:00:00Z",
+			"labels": map[string]any{
+				"$type":  "com.atproto.label.defs#selfLabels",
+				"values": []map[string]any{{"val": label}},
+			},
+		})
+	}
+
+	tests := map[string]struct {
+		opts   HandlerOptions
+		events []*models.Event
+		stored bool
+	}{
+		"update that still matches": {
+			events: []*models.Event{
+				postEvent(t, models.CommitOperationCreate, did, "1", "paying for APIs with x402"),
+				postEvent(t, models.CommitOperationUpdate, did, "1", "paying for APIs with x402 and USDC"),
+			},
+			stored: true,
+		},
+		"update that no longer matches": {
+			events: []*models.Event{
+				postEvent(t, models.CommitOperationCreate, did, "1", "paying for APIs with x402"),
+				postEvent(t, models.CommitOperationUpdate, did, "1", "paying for APIs"),
+			},
+		},
+		"update that starts to match": {
+			events: []*models.Event{
+				postEvent(t, models.CommitOperationCreate, did, "1", "paying for APIs"),
+				postEvent(t, models.CommitOperationUpdate, did, "1", "paying for APIs with x402"),
+			},
+			stored: true,
+		},
+		"update adding a hidden self-label": {
+			opts: HandlerOptions{LabelPolicy: DefaultLabelPolicy()},
+			events: []*models.Event{
+				postEvent(t, models.CommitOperationCreate, did, "1", "paying for APIs with x402"),
+				labeled(models.CommitOperationUpdate, "paying for APIs with x402", "porn"),
+			},
+		},
+		"update isn't a duplicate of the original": {
+			opts: HandlerOptions{SpamFilter: NewSpamFilter(SpamConfig{MaxPostsPerAuthor: 1, AuthorWindow: time.Hour, DuplicateWindow: time.Hour})},
+			events: []*models.Event{
+				postEvent(t, models.CommitOperationCreate, did, "1", "paying for APIs with x402"),
+				postEvent(t, models.CommitOperationUpdate, did, "1", "paying for APIs with x402!"),
+			},
+			stored: true,
+		},
+		"update of a denied author": {
+			events: []*models.Event{
+				postEvent(t, models.CommitOperationCreate, did, "1", "paying for APIs with x402"),
+				listItemEvent(t, models.CommitOperationCreate, listOwner, "1", denyList, did),
+				postEvent(t, models.CommitOperationUpdate, did, "1", "paying for APIs with x402 and USDC"),
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			store := memstore.New()
+			opts := tc.opts
+			lists, err := LoadStoredLists(t.Context(), []ListConfig{{URI: denyList, Action: ListActionDeny}}, store)
+			if err != nil {
+				t.Fatalf("load stored lists: %v", err)
+			}
+			opts.Lists = lists
+			handler := NewFeedHandler(store, opts)
+
+			for _, event := range tc.events {
+				if err := handler.HandleEvent(t.Context(), event); err != nil {
+					t.Fatalf("handle event: %v", err)
+				}
+			}
+
+			stored, err := store.IsPostStored(t.Context(), "at://did:plc:a/app.bsky.feed.post/1")
+			if err != nil {
+				t.Fatalf("is post stored: %v", err)
+			}
+			if stored != tc.stored {
+				t.Errorf("got stored %v, want %v", stored, tc.stored)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	apibsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/jetstream/pkg/models"
+
+	"github.com/nacorid/x402-feed/internal/server"
+)
+
+// hidden reasons used for curation done from a curator's Bluesky account
+const (
+	curatorRemovedReason = "curator_removed"
+	curatorHiddenReason  = "curator_hidden"
+)
+
+// DefaultRemoveCommand is what a curator replies to a post with to remove it from the feed
+const DefaultRemoveCommand = "!remove"
+
+// CuratorConfig configures curation done by interacting with posts from a curator's Bluesky account
+type CuratorConfig struct {
+	// DIDs are the curators' accounts
+	DIDs []string
+	// RemoveCommand removes the post a curator replies to if the reply starts with it
+	RemoveCommand string
+	// HiddenList is the at:// URI of a list owned by a curator. Accounts added to it have their posts
+	// hidden from every feed
+	HiddenList string
+	// RepostDIDs are accounts whose reposts of posts in the feed are stored. They don't need to be curators
+	RepostDIDs []string
+}
+
+// CuratorHandler handles events from curators' accounts. A like from a curator adds the liked post to
+// the feed, a reply containing the remove command removes the post replied to and adding an account to
+// the hidden list hides that account's posts. Reposts are handled here too so that the main stream
+// doesn't have to receive every repost on the network
+type CuratorHandler struct {
+	store server.PostStore
+	cfg   CuratorConfig
+}
+
+// NewCuratorHandler returns a new curator handler
+func NewCuratorHandler(store server.PostStore, cfg CuratorConfig) *CuratorHandler {
+	if cfg.RemoveCommand == "" {
+		cfg.RemoveCommand = DefaultRemoveCommand
+	}
+	return &CuratorHandler{
+		store: store,
+		cfg:   cfg,
+	}
+}
+
+func (h *CuratorHandler) wantedCollections() []string {
+	collections := make([]string, 0, 4)
+	if len(h.cfg.DIDs) > 0 {
+		collections = append(collections, likeCollection, postCollection)
+	}
+	if len(h.cfg.DIDs) > 0 && h.cfg.HiddenList != "" {
+		collections = append(collections, listItemCollection)
+	}
+	if len(h.cfg.RepostDIDs) > 0 {
+		collections = append(collections, repostCollection)
+	}
+	return collections
+}
+
+func (h *CuratorHandler) wantedDIDs() []string {
+	dids := slices.Clone(h.cfg.DIDs)
+	for _, did := range h.cfg.RepostDIDs {
+		if !slices.Contains(dids, did) {
+			dids = append(dids, did)
+		}
+	}
+	return dids
+}
+
+// HandleEvent will handle an event from a curator's account
+func (h *CuratorHandler) HandleEvent(ctx context.Context, event *models.Event) error {
+	if event.Commit == nil {
+		return nil
+	}
+	if event.Commit.Collection == repostCollection {
+		if !slices.Contains(h.cfg.RepostDIDs, event.Did) {
+			return nil
+		}
+		return h.handleRepostEvent(ctx, event)
+	}
+	if !slices.Contains(h.cfg.DIDs, event.Did) {
+		return nil
+	}
+
+	switch event.Commit.Collection {
+	case likeCollection:
+		return h.handleLikeEvent(ctx, event)
+	case postCollection:
+		return h.handleCommandEvent(ctx, event)
+	case listItemCollection:
+		// only the owner of the hidden list can add accounts to it
+		if !strings.HasPrefix(h.cfg.HiddenList, "at://"+event.Did+"/") {
+			return nil
+		}
+		return h.handleHiddenListEvent(ctx, event)
+	default:
+		return nil
+	}
+}
+
+// handleLikeEvent adds a post a curator likes to the feed even if it doesn't match. Unliking the post
+// leaves it in the feed
+func (h *CuratorHandler) handleLikeEvent(ctx context.Context, event *models.Event) error {
+	if event.Commit.Operation != models.CommitOperationCreate {
+		return nil
+	}
+
+	var like apibsky.FeedLike
+	if err := json.Unmarshal(event.Commit.Record, &like); err != nil || like.Subject == nil {
+		return nil
+	}
+	uri, err := syntax.ParseATURI(like.Subject.Uri)
+	if err != nil || uri.Collection().String() != postCollection {
+		return nil
+	}
+	authorDID, err := uri.Authority().AsDID()
+	if err != nil {
+		return nil
+	}
+
+	// the liked post's record isn't fetched so its position in the feed is taken from its record key
+	createdAt := time.Now()
+	if tid, err := syntax.ParseTID(uri.RecordKey().String()); err == nil {
+		createdAt = tid.Time()
+	}
+
+	slog.Info("curator included post", "curator", event.Did, "uri", uri.String())
+	// a curator's like also approves a post that's held in the moderation queue
+	for _, reason := range []string{curatorRemovedReason, server.HiddenReasonPending} {
+		err = h.store.UnhideSubject(ctx, uri.String(), reason)
+		if err != nil {
+			slog.Error("error unhiding curated post", "error", err, "uri", uri.String(), "reason", reason)
+		}
+	}
+	err = h.store.CreatePost(ctx, server.Post{
+		RKey:      uri.RecordKey().String(),
+		PostURI:   uri.String(),
+		UserDID:   authorDID.String(),
+		CreatedAt: createdAt.UnixMilli(),
+	})
+	if err != nil {
+		slog.Error("error creating curated post in store", "error", err, "uri", uri.String())
+	}
+	err = h.store.MarkCurated(ctx, uri.String())
+	if err != nil {
+		slog.Error("error marking post as curated", "error", err, "uri", uri.String())
+	}
+	return nil
+}
+
+// handleCommandEvent removes the post that a curator replies to with the remove command
+func (h *CuratorHandler) handleCommandEvent(ctx context.Context, event *models.Event) error {
+	if event.Commit.Operation != models.CommitOperationCreate {
+		return nil
+	}
+
+	var post apibsky.FeedPost
+	if err := json.Unmarshal(event.Commit.Record, &post); err != nil {
+		return nil
+	}
+	if post.Reply == nil || post.Reply.Parent == nil || !h.isRemoveCommand(post.Text) {
+		return nil
+	}
+
+	parentURI := post.Reply.Parent.Uri
+	slog.Info("curator removed post", "curator", event.Did, "uri", parentURI)
+	err := h.store.HideSubject(ctx, parentURI, curatorRemovedReason)
+	if err != nil {
+		slog.Error("error hiding removed post", "error", err, "uri", parentURI)
+	}
+	err = h.store.DeletePostsFromURIs(ctx, []string{parentURI, fmt.Sprintf("at://%s/%s/%s", event.Did, postCollection, event.Commit.RKey)})
+	if err != nil {
+		slog.Error("error deleting removed post", "error", err, "uri", parentURI)
+	}
+	return nil
+}
+
+// isRemoveCommand reports whether a reply is the remove command. The reply has to start with the command so
+// that a curator mentioning it in a conversation doesn't remove anything
+func (h *CuratorHandler) isRemoveCommand(text string) bool {
+	rest, ok := strings.CutPrefix(strings.ToLower(strings.TrimSpace(text)), strings.ToLower(h.cfg.RemoveCommand))
+	if !ok {
+		return false
+	}
+	r, _ := utf8.DecodeRuneInString(rest)
+	return rest == "" || unicode.IsSpace(r)
+}
+
+// hiddenListKey is the key the hidden list's members are stored under. It's different to the key used for
+// lists in the feeds config so that the same list can also be used there
+func (h *CuratorHandler) hiddenListKey() string {
+	return "curator_hidden:" + h.cfg.HiddenList
+}
+
+// handleHiddenListEvent hides or shows the posts of accounts added to or removed from the hidden list.
+// The list's members are stored as a listitem delete only contains its record key
+func (h *CuratorHandler) handleHiddenListEvent(ctx context.Context, event *models.Event) error {
+	switch event.Commit.Operation {
+	case models.CommitOperationCreate:
+		var listItem apibsky.GraphListitem
+		if err := json.Unmarshal(event.Commit.Record, &listItem); err != nil || listItem.List != h.cfg.HiddenList {
+			return nil
+		}
+
+		list, err := h.store.GetList(ctx, h.hiddenListKey())
+		if err != nil {
+			return fmt.Errorf("get hidden list: %w", err)
+		}
+		list.URI = h.cfg.HiddenList
+		list.RefreshedAt = time.Now().UnixMilli()
+		// an event that's delivered again replaces the member it added rather than adding a duplicate
+		list.Members = slices.DeleteFunc(list.Members, func(m server.ListMember) bool { return m.RKey == event.Commit.RKey })
+		list.Members = append(list.Members, server.ListMember{RKey: event.Commit.RKey, DID: listItem.Subject})
+
+		slog.Info("curator hid account", "curator", event.Did, "did", listItem.Subject)
+		err = h.store.ReplaceList(ctx, list)
+		if err != nil {
+			return fmt.Errorf("store hidden list: %w", err)
+		}
+		err = h.store.HideSubject(ctx, listItem.Subject, curatorHiddenReason)
+		if err != nil {
+			return fmt.Errorf("hide account: %w", err)
+		}
+	case models.CommitOperationDelete:
+		list, err := h.store.GetList(ctx, h.hiddenListKey())
+		if err != nil {
+			return fmt.Errorf("get hidden list: %w", err)
+		}
+		i := slices.IndexFunc(list.Members, func(m server.ListMember) bool { return m.RKey == event.Commit.RKey })
+		if i < 0 {
+			return nil
+		}
+		member := list.Members[i]
+		err = h.store.RemoveListMember(ctx, h.hiddenListKey(), member.RKey)
+		if err != nil {
+			return fmt.Errorf("remove hidden list member: %w", err)
+		}
+
+		// the account stays hidden if it was added to the list more than once
+		remaining := slices.Delete(list.Members, i, i+1)
+		if slices.ContainsFunc(remaining, func(m server.ListMember) bool { return m.DID == member.DID }) {
+			return nil
+		}
+		slog.Info("curator unhid account", "curator", event.Did, "did", member.DID)
+		err = h.store.UnhideSubject(ctx, member.DID, curatorHiddenReason)
+		if err != nil {
+			return fmt.Errorf("unhide account: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+package consumer
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/bluesky-social/jetstream/pkg/models"
+
+	"github.com/nacorid/x402-feed/internal/memstore"
+	"github.com/nacorid/x402-feed/internal/server"
+)
+
+const (
+	curator     = "did:plc:curator"
+	hiddenList  = "at://did:plc:curator/app.bsky.graph.list/hidden"
+	curatedPost = "at://did:plc:author/app.bsky.feed.post/liked"
+)
+
+func likeEvent(t *testing.T, did, rkey, uri string) *models.Event {
+	t.Helper()
+	return recordEvent(t, models.CommitOperationCreate, did, likeCollection, rkey, map[string]any{
+		"$type":     likeCollection,
+		"subject":   strongRef(uri),
+		"createdAt": "2025-08-01T12:00:00Z",
+	})
+}
+
+func commandEvent(t *testing.T, did, rkey, parentURI, text string) *models.Event {
+	t.Helper()
+	return recordEvent(t, models.CommitOperationCreate, did, postCollection, rkey, map[string]any{
+		"$type":     postCollection,
+		"text":      text,
+		"createdAt": "2025-08-01T12:00:00Z",
+		"reply":     map[string]any{"root": strongRef(parentURI), "parent": strongRef(parentURI)},
+	})
+}
+
+func TestCuratorLikes(t *testing.T) {
+	tests := map[string]struct {
+		events []*models.Event
+		// hidden is a reason the liked post is hidden for before the events are handled
+		hidden string
+		want   []string
+	}{
+		"like adds post": {
+			events: []*models.Event{likeEvent(t, curator, "1", curatedPost)},
+			want:   []string{curatedPost, storedPost},
+		},
+		"like by someone else": {
+			events: []*models.Event{likeEvent(t, "did:plc:someone", "1", curatedPost)},
+			want:   []string{storedPost},
+		},
+		"like of something that isn't a post": {
+			events: []*models.Event{likeEvent(t, curator, "1", "at://did:plc:author/app.bsky.feed.generator/feed")},
+			want:   []string{storedPost},
+		},
+		"unlike leaves post": {
+			events: []*models.Event{
+				likeEvent(t, curator, "1", curatedPost),
+				recordEvent(t, models.CommitOperationDelete, curator, likeCollection, "1", nil),
+			},
+			want: []string{curatedPost, storedPost},
+		},
+		"like restores removed post": {
+			events: []*models.Event{likeEvent(t, curator, "1", curatedPost)},
+			hidden: curatorRemovedReason,
+			want:   []string{curatedPost, storedPost},
+		},
+		"like approves held post": {
+			events: []*models.Event{likeEvent(t, curator, "1", curatedPost)},
+			hidden: server.HiddenReasonPending,
+			want:   []string{curatedPost, storedPost},
+		},
+		"like doesn't override a ban": {
+			events: []*models.Event{likeEvent(t, curator, "1", curatedPost)},
+			hidden: "admin_banned",
+			want:   []string{storedPost},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			store := memstore.New()
+			err := store.CreatePost(t.Context(), server.Post{RKey: "root", PostURI: storedPost, UserDID: "did:plc:author", CreatedAt: 100})
+			if err != nil {
+				t.Fatalf("create post: %v", err)
+			}
+			if tc.hidden != "" {
+				if err := store.HideSubject(t.Context(), curatedPost, tc.hidden); err != nil {
+					t.Fatalf("hide post: %v", err)
+				}
+			}
+
+			handler := NewCuratorHandler(store, CuratorConfig{DIDs: []string{curator}})
+			for _, event := range tc.events {
+				if err := handler.HandleEvent(t.Context(), event); err != nil {
+					t.Fatalf("handle event: %v", err)
+				}
+			}
+
+			if got := feedURIs(t, store); !slices.Equal(got, tc.want) {
+				t.Errorf("got feed %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCuratorLikeApprovesHeldAuthor(t *testing.T) {
+	store := memstore.New()
+	feed := NewFeedHandler(store, HandlerOptions{Queue: QueueConfig{HoldNewAuthors: true}})
+	if err := feed.HandleEvent(t.Context(), postEvent(t, models.CommitOperationCreate, "did:plc:author", "liked", "x402 first post")); err != nil {
+		t.Fatalf("handle post event: %v", err)
+	}
+	if got := feedURIs(t, store); len(got) != 0 {
+		t.Fatalf("got feed %v, want the new author's post held", got)
+	}
+
+	curators := NewCuratorHandler(store, CuratorConfig{DIDs: []string{curator}})
+	if err := curators.HandleEvent(t.Context(), likeEvent(t, curator, "1", curatedPost)); err != nil {
+		t.Fatalf("handle like event: %v", err)
+	}
+	if got := feedURIs(t, store); !slices.Equal(got, []string{curatedPost}) {
+		t.Errorf("got feed %v, want the liked post shown", got)
+	}
+	pending, err := store.GetPendingPosts(t.Context(), 10)
+	if err != nil {
+		t.Fatalf("get pending posts: %v", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("got pending posts %v, want none", pending)
+	}
+}
+
+func TestCuratedPostsAreProtected(t *testing.T) {
+	store := memstore.New()
+	handler := NewCuratorHandler(store, CuratorConfig{DIDs: []string{curator}})
+	if err := handler.HandleEvent(t.Context(), likeEvent(t, curator, "1", curatedPost)); err != nil {
+		t.Fatalf("handle event: %v", err)
+	}
+
+	if err := store.DeleteUnprotectedPosts(t.Context(), "did:plc:author"); err != nil {
+		t.Fatalf("delete unprotected posts: %v", err)
+	}
+	if got := feedURIs(t, store); !slices.Equal(got, []string{curatedPost}) {
+		t.Errorf("got feed %v, want the curated post to be kept", got)
+	}
+}
+
+func TestRemoveCommand(t *testing.T) {
+	tests := map[string]struct {
+		cfg   CuratorConfig
+		event *models.Event
+		// removed is whether the stored post is removed
+		removed bool
+	}{
+		"command": {
+			event:   commandEvent(t, curator, "1", storedPost, "!remove"),
+			removed: true,
+		},
+		"command with a reason": {
+			event:   commandEvent(t, curator, "1", storedPost, "!remove not about x402"),
+			removed: true,
+		},
+		"command with surrounding space and different case": {
+			event:   commandEvent(t, curator, "1", storedPost, "  !Remove\n"),
+			removed: true,
+		},
+		"custom command": {
+			cfg:     CuratorConfig{RemoveCommand: "/hide"},
+			event:   commandEvent(t, curator, "1", storedPost, "/hide"),
+			removed: true,
+		},
+		"command mentioned in a reply": {
+			event: commandEvent(t, curator, "1", storedPost, "use !remove to take posts out of the feed"),
+		},
+		"longer word": {
+			event: commandEvent(t, curator, "1", storedPost, "!removed"),
+		},
+		"default command when a custom one is set": {
+			cfg:   CuratorConfig{RemoveCommand: "/hide"},
+			event: commandEvent(t, curator, "1", storedPost, "!remove"),
+		},
+		"not a reply": {
+			event: postEvent(t, models.CommitOperationCreate, curator, "1", "!remove"),
+		},
+		"reply by someone else": {
+			event: commandEvent(t, "did:plc:someone", "1", storedPost, "!remove"),
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			store := memstore.New()
+			err := store.CreatePost(t.Context(), server.Post{RKey: "root", PostURI: storedPost, UserDID: "did:plc:author", CreatedAt: 100})
+			if err != nil {
+				t.Fatalf("create post: %v", err)
+			}
+
+			tc.cfg.DIDs = []string{curator}
+			handler := NewCuratorHandler(store, tc.cfg)
+			if err := handler.HandleEvent(t.Context(), tc.event); err != nil {
+				t.Fatalf("handle event: %v", err)
+			}
+
+			stored, err := store.IsPostStored(t.Context(), storedPost)
+			if err != nil {
+				t.Fatalf("is post stored: %v", err)
+			}
+			if stored == tc.removed {
+				t.Errorf("got post stored %v, want removed %v", stored, tc.removed)
+			}
+			if !tc.removed {
+				return
+			}
+
+			// a removed post isn't added back by the main stream
+			err = store.CreatePost(t.Context(), server.Post{RKey: "root", PostURI: storedPost, UserDID: "did:plc:author", CreatedAt: 100})
+			if err != nil {
+				t.Fatalf("create post: %v", err)
+			}
+			if got := feedURIs(t, store); len(got) != 0 {
+				t.Errorf("got feed %v, want the removed post hidden", got)
+			}
+		})
+	}
+}
+
+func TestHiddenList(t *testing.T) {
+	hide := func(rkey, did string) *models.Event {
+		return listItemEvent(t, models.CommitOperationCreate, curator, rkey, hiddenList, did)
+	}
+	unhide := func(rkey string) *models.Event {
+		return listItemEvent(t, models.CommitOperationDelete, curator, rkey, "", "")
+	}
+
+	tests := map[string]struct {
+		events []*models.Event
+		hidden bool
+		stored []server.ListMember
+	}{
+		"added": {
+			events: []*models.Event{hide("1", "did:plc:author")},
+			hidden: true,
+			stored: []server.ListMember{{RKey: "1", DID: "did:plc:author"}},
+		},
+		"removed": {
+			events: []*models.Event{hide("1", "did:plc:author"), unhide("1")},
+		},
+		"added again by a redelivered event": {
+			events: []*models.Event{hide("1", "did:plc:author"), hide("1", "did:plc:author"), unhide("1")},
+		},
+		"added twice stays until both are removed": {
+			events: []*models.Event{hide("1", "did:plc:author"), hide("2", "did:plc:author"), unhide("1")},
+			hidden: true,
+			stored: []server.ListMember{{RKey: "2", DID: "did:plc:author"}},
+		},
+		"other account removed": {
+			events: []*models.Event{hide("1", "did:plc:author"), hide("2", "did:plc:other"), unhide("2")},
+			hidden: true,
+			stored: []server.ListMember{{RKey: "1", DID: "did:plc:author"}},
+		},
+		"added to another list": {
+			events: []*models.Event{listItemEvent(t, models.CommitOperationCreate, curator, "1", "at://did:plc:curator/app.bsky.graph.list/other", "did:plc:author")},
+		},
+		"added by someone who isn't the list's owner": {
+			events: []*models.Event{listItemEvent(t, models.CommitOperationCreate, "did:plc:curator2", "1", hiddenList, "did:plc:author")},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			store := memstore.New()
+			err := store.CreatePost(t.Context(), server.Post{RKey: "root", PostURI: storedPost, UserDID: "did:plc:author", CreatedAt: 100})
+			if err != nil {
+				t.Fatalf("create post: %v", err)
+			}
+
+			handler := NewCuratorHandler(store, CuratorConfig{DIDs: []string{curator, "did:plc:curator2"}, HiddenList: hiddenList})
+			for _, event := range tc.events {
+				if err := handler.HandleEvent(t.Context(), event); err != nil {
+					t.Fatalf("handle event: %v", err)
+				}
+			}
+
+			if hidden := len(feedURIs(t, store)) == 0; hidden != tc.hidden {
+				t.Errorf("got author hidden %v, want %v", hidden, tc.hidden)
+			}
+			list, err := store.GetList(t.Context(), handler.hiddenListKey())
+			if err != nil {
+				t.Fatalf("get list: %v", err)
+			}
+			if len(list.Members)+len(tc.stored) > 0 && !slices.Equal(list.Members, tc.stored) {
+				t.Errorf("got stored members %v, want %v", list.Members, tc.stored)
+			}
+		})
+	}
+}
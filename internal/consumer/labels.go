@@ -0,0 +1,248 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	apibsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/events/schedulers/sequential"
+	"github.com/gorilla/websocket"
+
+	"github.com/nacorid/x402-feed/internal/server"
+)
+
+const subscribeLabelsPath = "/xrpc/com.atproto.label.subscribeLabels"
+
+// LabelAction is what happens to a post or account that carries a label
+type LabelAction int
+
+const (
+	// LabelActionNone leaves the post or account in the feed
+	LabelActionNone LabelAction = iota
+	// LabelActionHide keeps posts stored but hides them from the feed until the label is negated
+	LabelActionHide
+	// LabelActionRemove deletes posts from the store apart from pinned and curated posts, which are only
+	// hidden. Negating the label will not bring deleted posts back
+	LabelActionRemove
+)
+
+// LabelPolicy decides what happens to posts and accounts that carry a label value. There's one policy for
+// the whole feed generator so a label that's hidden or removed is kept out of every feed
+type LabelPolicy struct {
+	Hide   []string
+	Remove []string
+}
+
+// DefaultLabelPolicy returns a policy that hides adult and graphic content
+func DefaultLabelPolicy() LabelPolicy {
+	return LabelPolicy{
+		Hide: []string{"porn", "sexual", "nudity", "graphic-media", "gore"},
+	}
+}
+
+// Action returns the action that should be taken for a label value
+func (p LabelPolicy) Action(val string) LabelAction {
+	switch {
+	case slices.Contains(p.Remove, val):
+		return LabelActionRemove
+	case slices.Contains(p.Hide, val):
+		return LabelActionHide
+	default:
+		return LabelActionNone
+	}
+}
+
+// selfLabelRejection returns the reason a post should be rejected because of its self-labels or an
+// empty string if the post can be stored
+func (p LabelPolicy) selfLabelRejection(post *apibsky.FeedPost) string {
+	if post.Labels == nil || post.Labels.LabelDefs_SelfLabels == nil {
+		return ""
+	}
+	for _, label := range post.Labels.LabelDefs_SelfLabels.Values {
+		if label != nil && p.Action(label.Val) != LabelActionNone {
+			return "self_label:" + label.Val
+		}
+	}
+	return ""
+}
+
+func labelHiddenReason(val string) string {
+	return "label:" + val
+}
+
+// LabelerConsumer subscribes to a labeler's label stream and hides or removes posts and accounts that
+// are labeled according to the policy
+type LabelerConsumer struct {
+	subscribeURL string
+	labelerDID   string
+	policy       LabelPolicy
+	store        server.PostStore
+	logger       *slog.Logger
+}
+
+// NewLabelerConsumer configures a new labeler consumer. The labeler address can be either the labeler's
+// host such as wss://mod.bsky.app or the full subscribeLabels URL. If a labeler DID is given then labels
+// created by anyone else are ignored. To run or start you should call the Consume function
+func NewLabelerConsumer(labelerAddr, labelerDID string, policy LabelPolicy, store server.PostStore, logger *slog.Logger) (*LabelerConsumer, error) {
+	u, err := url.Parse(labelerAddr)
+	if err != nil {
+		return nil, fmt.Errorf("parse labeler address: %w", err)
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	case "http":
+		u.Scheme = "ws"
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = subscribeLabelsPath
+	}
+
+	return &LabelerConsumer{
+		subscribeURL: u.String(),
+		labelerDID:   labelerDID,
+		policy:       policy,
+		store:        store,
+		logger:       logger,
+	}, nil
+}
+
+// cursorName is the name the labeler's stream position is stored under
+func (c *LabelerConsumer) cursorName() string {
+	return "labeler:" + c.subscribeURL
+}
+
+// Consume will connect to the labeler and start to consume and handle labels from it, resuming from
+// the last label that was handled
+func (c *LabelerConsumer) Consume(ctx context.Context) error {
+	cursor, err := c.store.GetCursor(ctx, c.cursorName())
+	if err != nil {
+		return fmt.Errorf("get labeler cursor: %w", err)
+	}
+
+	u, err := url.Parse(c.subscribeURL)
+	if err != nil {
+		return fmt.Errorf("parse subscribe URL: %w", err)
+	}
+	if cursor > 0 {
+		query := u.Query()
+		query.Set("cursor", fmt.Sprintf("%d", cursor))
+		u.RawQuery = query.Encode()
+	}
+
+	con, _, err := websocket.DefaultDialer.DialContext(ctx, u.String(), http.Header{})
+	if err != nil {
+		return fmt.Errorf("dial labeler: %w", err)
+	}
+
+	callbacks := &events.RepoStreamCallbacks{
+		LabelLabels: func(evt *atproto.LabelSubscribeLabels_Labels) error {
+			return c.HandleLabels(ctx, evt)
+		},
+		LabelInfo: func(evt *atproto.LabelSubscribeLabels_Info) error {
+			c.logger.Info("labeler info", "name", evt.Name, "message", evt.Message)
+			return nil
+		},
+	}
+	scheduler := sequential.NewScheduler("labeler", callbacks.EventHandler)
+
+	if err := events.HandleRepoStream(ctx, con, scheduler, c.logger); err != nil {
+		return fmt.Errorf("handle label stream: %w", err)
+	}
+
+	slog.Info("stopping labeler consume")
+	return nil
+}
+
+// HandleLabels applies a batch of labels from the label stream and records the stream position
+func (c *LabelerConsumer) HandleLabels(ctx context.Context, evt *atproto.LabelSubscribeLabels_Labels) error {
+	for _, label := range evt.Labels {
+		if label == nil {
+			continue
+		}
+		if c.labelerDID != "" && label.Src != c.labelerDID {
+			continue
+		}
+		if err := c.applyLabel(ctx, label); err != nil {
+			return fmt.Errorf("apply label %q to %s: %w", label.Val, label.Uri, err)
+		}
+	}
+
+	err := c.store.SetCursor(ctx, c.cursorName(), evt.Seq)
+	if err != nil {
+		return fmt.Errorf("store labeler cursor: %w", err)
+	}
+	return nil
+}
+
+func (c *LabelerConsumer) applyLabel(ctx context.Context, label *atproto.LabelDefs_Label) error {
+	action := c.policy.Action(label.Val)
+	if action == LabelActionNone {
+		return nil
+	}
+
+	// labels can be applied to either a record or an account
+	subject := label.Uri
+	reason := labelHiddenReason(label.Val)
+
+	if labelNegated(label) {
+		slog.Debug("label removed", "subject", subject, "label", label.Val)
+		return c.store.UnhideSubject(ctx, subject, reason)
+	}
+
+	// labelers label the whole network so labels are only kept for posts and accounts the feed has stored,
+	// rather than storing every label
+	known, err := c.isKnownSubject(ctx, subject)
+	if err != nil {
+		return fmt.Errorf("check label subject is stored: %w", err)
+	}
+	if !known {
+		return nil
+	}
+
+	slog.Debug("label applied", "subject", subject, "label", label.Val)
+	// the subject is hidden for both actions so that any future posts from a labeled account are
+	// kept out of the feed as well
+	err = c.store.HideSubject(ctx, subject, reason)
+	if err != nil {
+		return err
+	}
+	if action != LabelActionRemove {
+		return nil
+	}
+
+	// posts that were pinned or added by a curator or an admin were chosen by a person running the feed
+	// so they're only hidden rather than deleted
+	return c.store.DeleteUnprotectedPosts(ctx, subject)
+}
+
+// isKnownSubject reports whether a label's subject is an account with stored posts or a stored post
+func (c *LabelerConsumer) isKnownSubject(ctx context.Context, subject string) (bool, error) {
+	if strings.HasPrefix(subject, "did:") {
+		return c.store.IsKnownAuthor(ctx, subject)
+	}
+	return c.store.IsPostStored(ctx, subject)
+}
+
+// labelNegated reports whether the label is a negation or has expired
+func labelNegated(label *atproto.LabelDefs_Label) bool {
+	if label.Neg != nil && *label.Neg {
+		return true
+	}
+	if label.Exp == nil {
+		return false
+	}
+	exp, err := time.Parse(time.RFC3339, *label.Exp)
+	if err != nil {
+		return false
+	}
+	return exp.Before(time.Now())
+}
@@ -0,0 +1,226 @@
+package consumer
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	apibsky "github.com/bluesky-social/indigo/api/bsky"
+
+	"github.com/nacorid/x402-feed/internal/memstore"
+	"github.com/nacorid/x402-feed/internal/server"
+)
+
+func TestSelfLabelRejection(t *testing.T) {
+	policy := LabelPolicy{Hide: []string{"porn"}, Remove: []string{"spam"}}
+	selfLabels := func(vals ...string) *apibsky.FeedPost_Labels {
+		labels := &atproto.LabelDefs_SelfLabels{}
+		for _, val := range vals {
+			labels.Values = append(labels.Values, &atproto.LabelDefs_SelfLabel{Val: val})
+		}
+		return &apibsky.FeedPost_Labels{LabelDefs_SelfLabels: labels}
+	}
+
+	tests := map[string]struct {
+		labels *apibsky.FeedPost_Labels
+		want   string
+	}{
+		"no labels":        {},
+		"no self-labels":   {labels: &apibsky.FeedPost_Labels{}},
+		"unhandled label":  {labels: selfLabels("!no-unauthenticated")},
+		"hidden label":     {labels: selfLabels("porn"), want: "self_label:porn"},
+		"removed label":    {labels: selfLabels("spam"), want: "self_label:spam"},
+		"first label wins": {labels: selfLabels("graphic-media", "spam", "porn"), want: "self_label:spam"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := policy.selfLabelRejection(&apibsky.FeedPost{Text: "x402", Labels: tc.labels})
+			if got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLabelNegated(t *testing.T) {
+	yes, no := true, false
+	past := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	future := time.Now().Add(time.Hour).Format(time.RFC3339)
+	invalid := "yesterday"
+
+	tests := map[string]struct {
+		label atproto.LabelDefs_Label
+		want  bool
+	}{
+		"applied":        {label: atproto.LabelDefs_Label{}},
+		"not negated":    {label: atproto.LabelDefs_Label{Neg: &no}},
+		"negated":        {label: atproto.LabelDefs_Label{Neg: &yes}, want: true},
+		"expired":        {label: atproto.LabelDefs_Label{Exp: &past}, want: true},
+		"not expired":    {label: atproto.LabelDefs_Label{Exp: &future}},
+		"invalid expiry": {label: atproto.LabelDefs_Label{Exp: &invalid}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := labelNegated(&tc.label); got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHandleLabels(t *testing.T) {
+	const labelerDID = "did:plc:labeler"
+	policy := LabelPolicy{Hide: []string{"porn"}, Remove: []string{"spam"}}
+	a1 := server.Post{RKey: "a1", PostURI: "at://did:plc:a/app.bsky.feed.post/a1", UserDID: "did:plc:a", CreatedAt: 100}
+	a2 := server.Post{RKey: "a2", PostURI: "at://did:plc:a/app.bsky.feed.post/a2", UserDID: "did:plc:a", CreatedAt: 200}
+	pinned := server.Post{RKey: "a3", PostURI: "at://did:plc:a/app.bsky.feed.post/a3", UserDID: "did:plc:a", CreatedAt: 300}
+	curated := server.Post{RKey: "a4", PostURI: "at://did:plc:a/app.bsky.feed.post/a4", UserDID: "did:plc:a", CreatedAt: 400}
+	b1 := server.Post{RKey: "b1", PostURI: "at://did:plc:b/app.bsky.feed.post/b1", UserDID: "did:plc:b", CreatedAt: 500}
+
+	negated := true
+	label := func(src, uri, val string) *atproto.LabelDefs_Label {
+		return &atproto.LabelDefs_Label{Src: src, Uri: uri, Val: val}
+	}
+	negation := func(src, uri, val string) *atproto.LabelDefs_Label {
+		l := label(src, uri, val)
+		l.Neg = &negated
+		return l
+	}
+
+	tests := map[string]struct {
+		labels []*atproto.LabelDefs_Label
+		// shown are the posts left in the feed and stored are the ones still in the store
+		shown  []server.Post
+		stored []server.Post
+		// unlabeled are subjects whose labels mustn't be kept
+		unlabeled []string
+	}{
+		"unhandled label": {
+			labels: []*atproto.LabelDefs_Label{label(labelerDID, a1.PostURI, "funny")},
+			shown:  []server.Post{b1, curated, pinned, a2, a1},
+			stored: []server.Post{a1, a2, pinned, curated, b1},
+		},
+		"hide post": {
+			labels: []*atproto.LabelDefs_Label{label(labelerDID, a1.PostURI, "porn")},
+			shown:  []server.Post{b1, curated, pinned, a2},
+			stored: []server.Post{a1, a2, pinned, curated, b1},
+		},
+		"hide account": {
+			labels: []*atproto.LabelDefs_Label{label(labelerDID, "did:plc:a", "porn")},
+			shown:  []server.Post{b1},
+			stored: []server.Post{a1, a2, pinned, curated, b1},
+		},
+		"negated label is shown again": {
+			labels: []*atproto.LabelDefs_Label{
+				label(labelerDID, "did:plc:a", "porn"),
+				negation(labelerDID, "did:plc:a", "porn"),
+			},
+			shown:  []server.Post{b1, curated, pinned, a2, a1},
+			stored: []server.Post{a1, a2, pinned, curated, b1},
+		},
+		"remove post": {
+			labels: []*atproto.LabelDefs_Label{label(labelerDID, a1.PostURI, "spam")},
+			shown:  []server.Post{b1, curated, pinned, a2},
+			stored: []server.Post{a2, pinned, curated, b1},
+		},
+		"remove account keeps pinned and curated posts": {
+			labels: []*atproto.LabelDefs_Label{label(labelerDID, "did:plc:a", "spam")},
+			shown:  []server.Post{b1},
+			stored: []server.Post{pinned, curated, b1},
+		},
+		"remove curated post": {
+			labels: []*atproto.LabelDefs_Label{label(labelerDID, curated.PostURI, "spam")},
+			shown:  []server.Post{b1, pinned, a2, a1},
+			stored: []server.Post{a1, a2, pinned, curated, b1},
+		},
+		"negated removal leaves post deleted": {
+			labels: []*atproto.LabelDefs_Label{
+				label(labelerDID, a1.PostURI, "spam"),
+				negation(labelerDID, a1.PostURI, "spam"),
+			},
+			shown:  []server.Post{b1, curated, pinned, a2},
+			stored: []server.Post{a2, pinned, curated, b1},
+		},
+		"label for a post that isn't stored isn't kept": {
+			labels:    []*atproto.LabelDefs_Label{label(labelerDID, "at://did:plc:a/app.bsky.feed.post/other", "porn")},
+			shown:     []server.Post{b1, curated, pinned, a2, a1},
+			stored:    []server.Post{a1, a2, pinned, curated, b1},
+			unlabeled: []string{"at://did:plc:a/app.bsky.feed.post/other"},
+		},
+		"label for an unknown account isn't kept": {
+			labels:    []*atproto.LabelDefs_Label{label(labelerDID, "did:plc:unknown", "spam")},
+			shown:     []server.Post{b1, curated, pinned, a2, a1},
+			stored:    []server.Post{a1, a2, pinned, curated, b1},
+			unlabeled: []string{"did:plc:unknown"},
+		},
+		"other labeler is ignored": {
+			labels: []*atproto.LabelDefs_Label{label("did:plc:other", "did:plc:a", "spam")},
+			shown:  []server.Post{b1, curated, pinned, a2, a1},
+			stored: []server.Post{a1, a2, pinned, curated, b1},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			store := memstore.New()
+			for _, p := range []server.Post{a1, a2, pinned, curated, b1} {
+				if err := store.CreatePost(t.Context(), p); err != nil {
+					t.Fatalf("create post: %v", err)
+				}
+			}
+			if err := store.CreatePin(t.Context(), server.Pin{PostURI: pinned.PostURI, UserDID: pinned.UserDID, CreatedAt: 1}); err != nil {
+				t.Fatalf("create pin: %v", err)
+			}
+			if err := store.MarkCurated(t.Context(), curated.PostURI); err != nil {
+				t.Fatalf("mark curated: %v", err)
+			}
+
+			labeler, err := NewLabelerConsumer("wss://labeler.example", labelerDID, policy, store, nil)
+			if err != nil {
+				t.Fatalf("new labeler consumer: %v", err)
+			}
+			err = labeler.HandleLabels(t.Context(), &atproto.LabelSubscribeLabels_Labels{Seq: 42, Labels: tc.labels})
+			if err != nil {
+				t.Fatalf("handle labels: %v", err)
+			}
+
+			want := make([]string, 0, len(tc.shown))
+			for _, p := range tc.shown {
+				want = append(want, p.PostURI)
+			}
+			if got := feedURIs(t, store); !slices.Equal(got, want) {
+				t.Errorf("got feed %v, want %v", got, want)
+			}
+			for _, p := range []server.Post{a1, a2, pinned, curated, b1} {
+				stored, err := store.IsPostStored(t.Context(), p.PostURI)
+				if err != nil {
+					t.Fatalf("is post stored: %v", err)
+				}
+				want := slices.ContainsFunc(tc.stored, func(s server.Post) bool { return s.PostURI == p.PostURI })
+				if stored != want {
+					t.Errorf("got %s stored %v, want %v", p.PostURI, stored, want)
+				}
+			}
+
+			for _, subject := range tc.unlabeled {
+				for _, val := range []string{"porn", "spam"} {
+					hidden, err := store.IsHidden(t.Context(), subject, labelHiddenReason(val))
+					if err != nil {
+						t.Fatalf("is hidden: %v", err)
+					}
+					if hidden {
+						t.Errorf("got %s labeled %s, want no label kept", subject, val)
+					}
+				}
+			}
+
+			cursor, err := store.GetCursor(t.Context(), labeler.cursorName())
+			if err != nil || cursor != 42 {
+				t.Errorf("got cursor %d (%v), want 42", cursor, err)
+			}
+		})
+	}
+}
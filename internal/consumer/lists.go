@@ -0,0 +1,504 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/avast/retry-go/v4"
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/xrpc"
+
+	"github.com/nacorid/x402-feed/internal/pds"
+	"github.com/nacorid/x402-feed/internal/server"
+)
+
+// ListAction is what happens to posts from accounts on a list
+type ListAction string
+
+const (
+	// ListActionDeny drops posts from accounts on the list. If the list applies to every feed the posts
+	// are never stored and existing ones are purged
+	ListActionDeny ListAction = "deny"
+	// ListActionAllow turns a feed into a curated feed that only contains posts from accounts on allow lists
+	ListActionAllow ListAction = "allow"
+	// ListActionBoost ranks posts from accounts on the list higher in a feed
+	ListActionBoost ListAction = "boost"
+)
+
+// ListConfig describes a Bluesky list and what it's used for
+type ListConfig struct {
+	// URI is the at:// URI of the list. It can also be just the rkey of a list owned by the logged in account
+	URI    string     `json:"uri"`
+	Action ListAction `json:"action"`
+	// Feeds are the names of the feeds that the list applies to. If empty it applies to every feed
+	Feeds []string `json:"feeds"`
+}
+
+func (c ListConfig) appliesTo(feed string) bool {
+	return len(c.Feeds) == 0 || slices.Contains(c.Feeds, feed)
+}
+
+type list struct {
+	ListConfig
+	// key is the list's URI as it was configured, which is what it's stored under
+	key   string
+	owner string
+
+	members map[string]struct{}
+	// items maps the rkey of each listitem record to the DID it adds so that deletes, which don't
+	// include the record, can be applied
+	items       map[string]string
+	refreshedAt time.Time
+
+	// refreshing is how many refreshes of the list are fetching it. Any listitem changes made while
+	// it's being fetched are recorded so they can be applied on top of the fetched members
+	refreshing int
+	changes    []listChange
+}
+
+// listChange is a listitem that was created or deleted
+type listChange struct {
+	rkey    string
+	did     string
+	deleted bool
+}
+
+// resolved reports whether the full URI of the list is known
+func (l *list) resolved() bool {
+	return strings.HasPrefix(l.URI, "at://")
+}
+
+func (l *list) setURI(uri string) error {
+	parsed, err := syntax.ParseATURI(uri)
+	if err != nil {
+		return fmt.Errorf("parse list URI %s: %w", uri, err)
+	}
+	l.URI = uri
+	l.owner = parsed.Authority().String()
+	return nil
+}
+
+// Lists keeps the members of a set of Bluesky lists up to date
+type Lists struct {
+	client *pds.Client
+	store  server.PostStore
+
+	lists []*list
+	mu    sync.RWMutex
+	// storeMu orders writes of list members to the store so that a stored refresh can't overwrite a
+	// change made after it. It's separate from mu so that feed requests aren't blocked by the store
+	storeMu sync.Mutex
+}
+
+// NewLists will load the last known members of the configured lists from the store and then keep them
+// up to date in the background. If Bluesky can't be reached the stored members are used until it can
+func NewLists(ctx context.Context, client *pds.Client, configs []ListConfig, store server.PostStore) (*Lists, error) {
+	l, err := LoadStoredLists(ctx, configs, store)
+	if err != nil {
+		return nil, err
+	}
+	l.client = client
+
+	slog.Default().InfoContext(ctx, "Initial lists fetch...")
+	fetchCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	err = l.refreshAll(fetchCtx)
+	cancel()
+	if err != nil {
+		// the stored lists are used until the background updater manages to refresh them
+		slog.Default().WarnContext(ctx, "Failed initial lists fetch, using stored lists", "error", err, "lastRefreshed", l.LastRefreshed())
+	}
+
+	// Start background updater
+	go l.startBackgroundUpdater(ctx)
+
+	return l, nil
+}
+
+// LoadStoredLists returns the configured lists with the members they had when they were last stored. They
+// aren't fetched from Bluesky or kept up to date, which is what NewLists is for
+func LoadStoredLists(ctx context.Context, configs []ListConfig, store server.PostStore) (*Lists, error) {
+	l := &Lists{
+		store: store,
+		lists: make([]*list, 0, len(configs)),
+	}
+
+	for _, cfg := range configs {
+		switch cfg.Action {
+		case ListActionDeny, ListActionAllow, ListActionBoost:
+		default:
+			return nil, fmt.Errorf("list %s has unknown action %q", cfg.URI, cfg.Action)
+		}
+
+		list := &list{
+			ListConfig: cfg,
+			key:        cfg.URI,
+			members:    make(map[string]struct{}),
+			items:      make(map[string]string),
+		}
+		if list.resolved() {
+			if err := list.setURI(cfg.URI); err != nil {
+				return nil, err
+			}
+		}
+
+		err := l.loadList(ctx, list)
+		if err != nil {
+			return nil, fmt.Errorf("load stored list %s: %w", cfg.URI, err)
+		}
+		l.lists = append(l.lists, list)
+	}
+	return l, nil
+}
+
+// loadList populates a list from the last state stored
+func (l *Lists) loadList(ctx context.Context, list *list) error {
+	stored, err := l.store.GetList(ctx, list.key)
+	if err != nil {
+		return err
+	}
+	if stored.URI == "" {
+		return nil
+	}
+
+	if !list.resolved() {
+		if err := list.setURI(stored.URI); err != nil {
+			return err
+		}
+	}
+	for _, member := range stored.Members {
+		list.members[member.DID] = struct{}{}
+		list.items[member.RKey] = member.DID
+	}
+	list.refreshedAt = time.UnixMilli(stored.RefreshedAt)
+
+	slog.Info("loaded stored list", "list", list.URI, "memberCount", len(list.members), "refreshedAt", list.refreshedAt)
+	return nil
+}
+
+// Denied reports whether the DID is on a deny list that applies to every feed
+func (l *Lists) Denied(did string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for _, list := range l.lists {
+		if list.Action != ListActionDeny || len(list.Feeds) > 0 {
+			continue
+		}
+		if _, exists := list.members[did]; exists {
+			return true
+		}
+	}
+	return false
+}
+
+// GetDenied returns every DID on deny lists that apply to every feed
+func (l *Lists) GetDenied() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	denied := make(map[string]struct{})
+	for _, list := range l.lists {
+		if list.Action != ListActionDeny || len(list.Feeds) > 0 {
+			continue
+		}
+		for did := range list.members {
+			denied[did] = struct{}{}
+		}
+	}
+
+	dids := make([]string, 0, len(denied))
+	for did := range denied {
+		dids = append(dids, did)
+	}
+	return dids
+}
+
+// FeedAuthors returns the keys of each type of list that applies to the feed. The lists' members are
+// read from the store rather than passed to it, as lists can have far more members than a query can take
+func (l *Lists) FeedAuthors(feed string) server.FeedAuthors {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var authors server.FeedAuthors
+	for _, list := range l.lists {
+		if !list.appliesTo(feed) {
+			continue
+		}
+		switch list.Action {
+		case ListActionDeny:
+			authors.DenyLists = append(authors.DenyLists, list.key)
+		case ListActionAllow:
+			authors.AllowLists = append(authors.AllowLists, list.key)
+		case ListActionBoost:
+			authors.BoostLists = append(authors.BoostLists, list.key)
+		}
+	}
+	return authors
+}
+
+// LastRefreshed returns when the least recently refreshed list was last fully fetched. If any list has
+// never been fetched the zero time is returned
+func (l *Lists) LastRefreshed() time.Time {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var oldest time.Time
+	for i, list := range l.lists {
+		if i == 0 || list.refreshedAt.Before(oldest) {
+			oldest = list.refreshedAt
+		}
+	}
+	return oldest
+}
+
+// Owns reports whether the DID owns any of the lists
+func (l *Lists) Owns(did string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for _, list := range l.lists {
+		if list.owner == did {
+			return true
+		}
+	}
+	return false
+}
+
+// Add will add a DID to the list with the given URI because of the listitem record with the given rkey.
+// The list's config is returned if the list is one of the configured lists. The list is changed in memory
+// even if storing the member fails, as the event is handled again once the stream is resumed
+func (l *Lists) Add(ctx context.Context, listURI, rkey, did string) (ListConfig, bool, error) {
+	l.mu.Lock()
+	var (
+		cfg   ListConfig
+		key   string
+		found bool
+	)
+	for _, list := range l.lists {
+		if list.URI != listURI {
+			continue
+		}
+		list.items[rkey] = did
+		list.members[did] = struct{}{}
+		if list.refreshing > 0 {
+			list.changes = append(list.changes, listChange{rkey: rkey, did: did})
+		}
+		cfg, key, found = list.ListConfig, list.key, true
+		break
+	}
+	l.mu.Unlock()
+
+	if !found {
+		return ListConfig{}, false, nil
+	}
+	// the store is written to without the lock held so that feed requests aren't blocked by it
+	l.storeMu.Lock()
+	defer l.storeMu.Unlock()
+	err := l.store.AddListMember(ctx, key, server.ListMember{RKey: rkey, DID: did})
+	if err != nil {
+		return cfg, true, fmt.Errorf("store member of list %s: %w", listURI, err)
+	}
+	return cfg, true, nil
+}
+
+// Remove will remove the DID that the listitem record with the given rkey, owned by the given DID,
+// added to a list unless the DID was also added by another listitem. The DID that was removed is returned
+func (l *Lists) Remove(ctx context.Context, owner, rkey string) (string, bool, error) {
+	l.mu.Lock()
+	var (
+		key, listURI, did string
+		found, gone       bool
+	)
+	for _, list := range l.lists {
+		if list.owner != owner {
+			continue
+		}
+		if did, found = list.items[rkey]; !found {
+			continue
+		}
+		delete(list.items, rkey)
+		if !slices.Contains(mapValues(list.items), did) {
+			delete(list.members, did)
+			gone = true
+		}
+		if list.refreshing > 0 {
+			list.changes = append(list.changes, listChange{rkey: rkey, did: did, deleted: true})
+		}
+		key, listURI = list.key, list.URI
+		break
+	}
+	l.mu.Unlock()
+
+	if !found {
+		return "", false, nil
+	}
+	l.storeMu.Lock()
+	defer l.storeMu.Unlock()
+	err := l.store.RemoveListMember(ctx, key, rkey)
+	if err != nil {
+		return "", false, fmt.Errorf("remove stored member of list %s: %w", listURI, err)
+	}
+	if !gone {
+		return "", false, nil
+	}
+	return did, true, nil
+}
+
+func (l *Lists) startBackgroundUpdater(ctx context.Context) {
+	for {
+		// keep retrying with a backoff until every list has been refreshed so that an outage doesn't
+		// leave the lists stale for longer than it has to
+		_ = retry.Do(func() error {
+			fetchCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			defer cancel()
+			return l.refreshAll(fetchCtx)
+		},
+			retry.Context(ctx),
+			retry.Attempts(0),
+			retry.Delay(10*time.Second),
+			retry.MaxDelay(5*time.Minute),
+			retry.DelayType(retry.BackOffDelay),
+			retry.LastErrorOnly(true),
+			retry.OnRetry(func(n uint, err error) {
+				slog.Default().ErrorContext(ctx, "Error refreshing lists", "error", err, "attempt", n+1, "lastRefreshed", l.LastRefreshed())
+			}),
+		)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Minute):
+		}
+	}
+}
+
+// Refresh fetches every list now rather than waiting for the next background refresh
+func (l *Lists) Refresh(ctx context.Context) error {
+	return l.refreshAll(ctx)
+}
+
+// refreshAll will log in if needed and then fetch every list
+func (l *Lists) refreshAll(ctx context.Context) error {
+	// the logged in account's DID is needed to find lists that were configured with just an rkey
+	if l.client.DID() == "" {
+		if err := l.client.Login(ctx); err != nil {
+			return err
+		}
+	}
+
+	errs := make([]error, 0)
+	for _, list := range l.lists {
+		if err := l.refreshList(ctx, list); err != nil {
+			errs = append(errs, fmt.Errorf("refresh list %s: %w", list.key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (l *Lists) refreshList(ctx context.Context, list *list) error {
+	l.mu.Lock()
+	listURI := list.URI
+	if !list.resolved() {
+		listURI = fmt.Sprintf("at://%s/app.bsky.graph.list/%s", l.client.DID(), list.key)
+	}
+	list.refreshing++
+	since := len(list.changes)
+	l.mu.Unlock()
+
+	defer func() {
+		l.mu.Lock()
+		list.refreshing--
+		if list.refreshing == 0 {
+			list.changes = nil
+		}
+		l.mu.Unlock()
+	}()
+
+	var cursor string
+	newMap := make(map[string]struct{})
+	newItems := make(map[string]string)
+
+	for {
+		var resp *bsky.GraphGetList_Output
+		err := l.client.Do(ctx, func(client *xrpc.Client) error {
+			var err error
+			resp, err = bsky.GraphGetList(ctx, client, cursor, 100, listURI)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, item := range resp.Items {
+			newMap[item.Subject.Did] = struct{}{}
+			if uri, err := syntax.ParseATURI(item.Uri); err == nil {
+				newItems[uri.RecordKey().String()] = item.Subject.Did
+			}
+		}
+
+		if resp.Cursor == nil || *resp.Cursor == "" {
+			break
+		}
+		cursor = *resp.Cursor
+	}
+
+	l.storeMu.Lock()
+	defer l.storeMu.Unlock()
+
+	// Hot swap: Lock only for the microsecond it takes to replace the map
+	refreshedAt := time.Now()
+	l.mu.Lock()
+	// listitems created or deleted while the list was being fetched may not be in what was fetched
+	for _, change := range list.changes[since:] {
+		if !change.deleted {
+			newItems[change.rkey] = change.did
+			newMap[change.did] = struct{}{}
+			continue
+		}
+		delete(newItems, change.rkey)
+		if !slices.Contains(mapValues(newItems), change.did) {
+			delete(newMap, change.did)
+		}
+	}
+	if !list.resolved() {
+		_ = list.setURI(listURI)
+	}
+	list.members = newMap
+	list.items = newItems
+	list.refreshedAt = refreshedAt
+	count := len(list.members)
+	members := make([]server.ListMember, 0, len(newItems))
+	for rkey, did := range newItems {
+		members = append(members, server.ListMember{RKey: rkey, DID: did})
+	}
+	l.mu.Unlock()
+
+	err := l.store.ReplaceList(ctx, server.StoredList{
+		Key:         list.key,
+		URI:         listURI,
+		RefreshedAt: refreshedAt.UnixMilli(),
+		Members:     members,
+	})
+	if err != nil {
+		// the in memory list is still updated as it's the source of truth while running
+		slog.Default().ErrorContext(ctx, "Error storing list", "error", err, "list", listURI)
+	}
+
+	slog.Default().DebugContext(ctx, "List updated.", "list", listURI, "memberCount", count)
+	return nil
+}
+
+func mapValues(m map[string]string) []string {
+	values := make([]string, 0, len(m))
+	for _, v := range m {
+		values = append(values, v)
+	}
+	return values
+}
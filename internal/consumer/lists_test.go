@@ -0,0 +1,374 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	apibsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/jetstream/pkg/models"
+
+	"github.com/nacorid/x402-feed/internal/memstore"
+	"github.com/nacorid/x402-feed/internal/pds"
+	"github.com/nacorid/x402-feed/internal/server"
+)
+
+const (
+	listOwner = "did:plc:owner"
+	denyList  = "at://did:plc:owner/app.bsky.graph.list/deny"
+	boostList = "at://did:plc:owner/app.bsky.graph.list/boost"
+)
+
+func listItemEvent(t *testing.T, operation, did, rkey, listURI, subject string) *models.Event {
+	t.Helper()
+	var record any
+	if operation == models.CommitOperationCreate {
+		record = apibsky.GraphListitem{LexiconTypeID: listItemCollection, List: listURI, Subject: subject, CreatedAt: "2025-08-01T12:00:00Z"}
+	}
+	return recordEvent(t, operation, did, listItemCollection, rkey, record)
+}
+
+func TestHandleListItemEvents(t *testing.T) {
+	configs := []ListConfig{
+		{URI: denyList, Action: ListActionDeny},
+		{URI: boostList, Action: ListActionBoost, Feeds: []string{"x402"}},
+	}
+
+	tests := map[string]struct {
+		events    []*models.Event
+		denied    []string
+		boosted   []string
+		stored    []server.ListMember
+		remaining []string
+	}{
+		"add to deny list": {
+			events: []*models.Event{
+				listItemEvent(t, models.CommitOperationCreate, listOwner, "1", denyList, "did:plc:a"),
+			},
+			denied:    []string{"did:plc:a"},
+			stored:    []server.ListMember{{RKey: "1", DID: "did:plc:a"}},
+			remaining: []string{"at://did:plc:b/app.bsky.feed.post/1"},
+		},
+		"add to feed list keeps posts": {
+			events: []*models.Event{
+				listItemEvent(t, models.CommitOperationCreate, listOwner, "1", boostList, "did:plc:a"),
+			},
+			boosted:   []string{"did:plc:a"},
+			remaining: []string{"at://did:plc:b/app.bsky.feed.post/1", "at://did:plc:a/app.bsky.feed.post/1"},
+		},
+		"remove from list": {
+			events: []*models.Event{
+				listItemEvent(t, models.CommitOperationCreate, listOwner, "1", denyList, "did:plc:a"),
+				listItemEvent(t, models.CommitOperationDelete, listOwner, "1", "", ""),
+			},
+			remaining: []string{"at://did:plc:b/app.bsky.feed.post/1"},
+		},
+		"added twice stays until both are removed": {
+			events: []*models.Event{
+				listItemEvent(t, models.CommitOperationCreate, listOwner, "1", denyList, "did:plc:a"),
+				listItemEvent(t, models.CommitOperationCreate, listOwner, "2", denyList, "did:plc:a"),
+				listItemEvent(t, models.CommitOperationDelete, listOwner, "1", "", ""),
+			},
+			denied:    []string{"did:plc:a"},
+			stored:    []server.ListMember{{RKey: "2", DID: "did:plc:a"}},
+			remaining: []string{"at://did:plc:b/app.bsky.feed.post/1"},
+		},
+		"other owners are ignored": {
+			events: []*models.Event{
+				listItemEvent(t, models.CommitOperationCreate, "did:plc:other", "1", denyList, "did:plc:a"),
+			},
+			remaining: []string{"at://did:plc:b/app.bsky.feed.post/1", "at://did:plc:a/app.bsky.feed.post/1"},
+		},
+		"unknown list is ignored": {
+			events: []*models.Event{
+				listItemEvent(t, models.CommitOperationCreate, listOwner, "1", "at://did:plc:owner/app.bsky.graph.list/other", "did:plc:a"),
+			},
+			remaining: []string{"at://did:plc:b/app.bsky.feed.post/1", "at://did:plc:a/app.bsky.feed.post/1"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			store := memstore.New()
+			for i, did := range []string{"did:plc:a", "did:plc:b"} {
+				post := server.Post{RKey: did + "-1", PostURI: "at://" + did + "/app.bsky.feed.post/1", UserDID: did, CreatedAt: int64(i + 1)}
+				if err := store.CreatePost(t.Context(), post); err != nil {
+					t.Fatalf("create post: %v", err)
+				}
+			}
+			// the list has been fetched before with no members
+			if err := store.ReplaceList(t.Context(), server.StoredList{Key: denyList, URI: denyList, RefreshedAt: 1}); err != nil {
+				t.Fatalf("replace list: %v", err)
+			}
+			lists, err := LoadStoredLists(t.Context(), configs, store)
+			if err != nil {
+				t.Fatalf("load stored lists: %v", err)
+			}
+			handler := NewFeedHandler(store, HandlerOptions{Lists: lists})
+
+			for _, event := range tc.events {
+				if err := handler.HandleEvent(t.Context(), event); err != nil {
+					t.Fatalf("handle event: %v", err)
+				}
+			}
+
+			if got := lists.GetDenied(); !slices.Equal(got, tc.denied) && len(got)+len(tc.denied) > 0 {
+				t.Errorf("got denied %v, want %v", got, tc.denied)
+			}
+			query := server.NewFeedQuery(server.FeedConfig{Name: "x402", BoostHours: 1}, lists)
+			query.Cursor, query.Limit = math.MaxInt64, 10
+			posts, err := store.GetFeedPosts(t.Context(), query)
+			if err != nil {
+				t.Fatalf("get feed posts: %v", err)
+			}
+			var boosted []string
+			for _, p := range posts {
+				if p.Score > p.CreatedAt {
+					boosted = append(boosted, p.UserDID)
+				}
+			}
+			if !slices.Equal(boosted, tc.boosted) {
+				t.Errorf("got boosted %v, want %v", boosted, tc.boosted)
+			}
+			if got := lists.FeedAuthors("other").BoostLists; len(got) != 0 {
+				t.Errorf("got boost lists %v in a feed the list doesn't apply to", got)
+			}
+
+			stored, err := store.GetList(t.Context(), denyList)
+			if err != nil {
+				t.Fatalf("get list: %v", err)
+			}
+			if !slices.Equal(stored.Members, tc.stored) && len(stored.Members)+len(tc.stored) > 0 {
+				t.Errorf("got stored members %v, want %v", stored.Members, tc.stored)
+			}
+			if got := feedURIs(t, store); !slices.Equal(got, tc.remaining) {
+				t.Errorf("got feed %v, want %v", got, tc.remaining)
+			}
+		})
+	}
+}
+
+// fakeListPDS serves a list with the given items. Each getList call waits for a value on proceed after
+// signalling on fetching so that tests can make changes while the list is being fetched
+func fakeListPDS(t *testing.T, items map[string]string, fetching chan<- struct{}, proceed <-chan struct{}) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/xrpc/com.atproto.server.createSession", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{"accessJwt": "access", "refreshJwt": "refresh", "handle": "owner.test", "did": listOwner})
+	})
+	mux.HandleFunc("/xrpc/app.bsky.graph.getList", func(w http.ResponseWriter, r *http.Request) {
+		fetching <- struct{}{}
+		<-proceed
+		resp := map[string]any{"list": map[string]any{"uri": r.URL.Query().Get("list")}}
+		listItems := make([]map[string]any, 0, len(items))
+		for rkey, did := range items {
+			listItems = append(listItems, map[string]any{
+				"uri":     "at://" + listOwner + "/app.bsky.graph.listitem/" + rkey,
+				"subject": map[string]any{"did": did, "handle": "user.test"},
+			})
+		}
+		resp["items"] = listItems
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestRefreshKeepsChangesMadeDuringFetch(t *testing.T) {
+	fetched := map[string]string{"1": "did:plc:a", "2": "did:plc:b"}
+
+	tests := map[string]struct {
+		// during is called while the list is being fetched
+		during func(ctx context.Context, lists *Lists)
+		want   map[string]string
+	}{
+		"nothing changed": {
+			during: func(ctx context.Context, lists *Lists) {},
+			want:   fetched,
+		},
+		"member added": {
+			during: func(ctx context.Context, lists *Lists) {
+				lists.Add(ctx, denyList, "3", "did:plc:c")
+			},
+			want: map[string]string{"1": "did:plc:a", "2": "did:plc:b", "3": "did:plc:c"},
+		},
+		"member removed": {
+			during: func(ctx context.Context, lists *Lists) {
+				lists.Remove(ctx, listOwner, "2")
+			},
+			want: map[string]string{"1": "did:plc:a"},
+		},
+		"member added and removed": {
+			during: func(ctx context.Context, lists *Lists) {
+				lists.Add(ctx, denyList, "3", "did:plc:c")
+				lists.Remove(ctx, listOwner, "3")
+			},
+			want: fetched,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			store := memstore.New()
+			// the last refresh stored both fetched members
+			stored := server.StoredList{Key: denyList, URI: denyList, RefreshedAt: 1}
+			for rkey, did := range fetched {
+				stored.Members = append(stored.Members, server.ListMember{RKey: rkey, DID: did})
+			}
+			if err := store.ReplaceList(t.Context(), stored); err != nil {
+				t.Fatalf("replace list: %v", err)
+			}
+			lists, err := LoadStoredLists(t.Context(), []ListConfig{{URI: denyList, Action: ListActionDeny}}, store)
+			if err != nil {
+				t.Fatalf("load stored lists: %v", err)
+			}
+
+			fetching, proceed := make(chan struct{}), make(chan struct{})
+			lists.client = pds.NewClient(fakeListPDS(t, fetched, fetching, proceed).URL, "owner.test", "password")
+
+			errs := make(chan error)
+			go func() {
+				errs <- lists.Refresh(t.Context())
+			}()
+			<-fetching
+			tc.during(t.Context(), lists)
+			close(proceed)
+			if err := <-errs; err != nil {
+				t.Fatalf("refresh: %v", err)
+			}
+
+			wantDIDs := make([]string, 0, len(tc.want))
+			for _, did := range tc.want {
+				wantDIDs = append(wantDIDs, did)
+			}
+			slices.Sort(wantDIDs)
+			denied := lists.GetDenied()
+			slices.Sort(denied)
+			if !slices.Equal(denied, wantDIDs) {
+				t.Errorf("got members %v, want %v", denied, wantDIDs)
+			}
+
+			got, err := store.GetList(t.Context(), denyList)
+			if err != nil {
+				t.Fatalf("get list: %v", err)
+			}
+			gotItems := make(map[string]string)
+			for _, member := range got.Members {
+				gotItems[member.RKey] = member.DID
+			}
+			if !maps.Equal(gotItems, tc.want) {
+				t.Errorf("got stored members %v, want %v", gotItems, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoadStoredLists(t *testing.T) {
+	stored := server.StoredList{
+		Key:         "deny",
+		URI:         denyList,
+		RefreshedAt: 1000,
+		Members:     []server.ListMember{{RKey: "1", DID: "did:plc:a"}, {RKey: "2", DID: "did:plc:b"}},
+	}
+
+	tests := map[string]struct {
+		configs []ListConfig
+		denied  []string
+		owner   bool
+		// refreshedAt is when the oldest list was last fetched
+		refreshedAt int64
+		wantErr     bool
+	}{
+		"stored members are loaded": {
+			configs:     []ListConfig{{URI: "deny", Action: ListActionDeny}},
+			denied:      []string{"did:plc:a", "did:plc:b"},
+			owner:       true,
+			refreshedAt: 1000,
+		},
+		"list that was never stored is empty": {
+			configs: []ListConfig{
+				{URI: "deny", Action: ListActionDeny},
+				{URI: "at://did:plc:other/app.bsky.graph.list/new", Action: ListActionDeny},
+			},
+			denied: []string{"did:plc:a", "did:plc:b"},
+			owner:  true,
+		},
+		"feed list isn't denied everywhere": {
+			configs:     []ListConfig{{URI: "deny", Action: ListActionDeny, Feeds: []string{"x402"}}},
+			owner:       true,
+			refreshedAt: 1000,
+		},
+		"unknown action": {
+			configs: []ListConfig{{URI: "deny", Action: "mute"}},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			store := memstore.New()
+			if err := store.ReplaceList(t.Context(), stored); err != nil {
+				t.Fatalf("replace list: %v", err)
+			}
+
+			lists, err := LoadStoredLists(t.Context(), tc.configs, store)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("got no error, want one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("load stored lists: %v", err)
+			}
+
+			denied := lists.GetDenied()
+			slices.Sort(denied)
+			if !slices.Equal(denied, tc.denied) && len(denied)+len(tc.denied) > 0 {
+				t.Errorf("got denied %v, want %v", denied, tc.denied)
+			}
+			if got := lists.Owns(listOwner); got != tc.owner {
+				t.Errorf("got owns %v, want %v", got, tc.owner)
+			}
+			// a list that was never stored counts as never fetched
+			want := time.Time{}
+			if tc.refreshedAt != 0 {
+				want = time.UnixMilli(tc.refreshedAt)
+			}
+			if got := lists.LastRefreshed(); !got.Equal(want) {
+				t.Errorf("got last refreshed %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestNewListsUsesStoredListsWhenFetchFails(t *testing.T) {
+	store := memstore.New()
+	err := store.ReplaceList(t.Context(), server.StoredList{Key: denyList, URI: denyList, RefreshedAt: 1000, Members: []server.ListMember{{RKey: "1", DID: "did:plc:a"}}})
+	if err != nil {
+		t.Fatalf("replace list: %v", err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"AuthFactorTokenRequired"}`))
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	lists, err := NewLists(ctx, pds.NewClient(srv.URL, "owner.test", "password"), []ListConfig{{URI: denyList, Action: ListActionDeny}}, store)
+	if err != nil {
+		t.Fatalf("new lists: %v", err)
+	}
+	if !lists.Denied("did:plc:a") {
+		t.Error("got stored member not denied, want the stored list used")
+	}
+}
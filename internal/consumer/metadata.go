@@ -0,0 +1,91 @@
+package consumer
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+
+	apibsky "github.com/bluesky-social/indigo/api/bsky"
+
+	"github.com/nacorid/x402-feed/internal/server"
+)
+
+// addMetadata fills in the metadata of a post that's taken from its record
+func addMetadata(post *server.Post, record *apibsky.FeedPost) {
+	post.Text = record.Text
+	post.Langs = record.Langs
+
+	var links, hashtags []string
+	for _, facet := range record.Facets {
+		if facet == nil {
+			continue
+		}
+		for _, feature := range facet.Features {
+			switch {
+			case feature == nil:
+			case feature.RichtextFacet_Link != nil:
+				links = append(links, feature.RichtextFacet_Link.Uri)
+			case feature.RichtextFacet_Tag != nil:
+				hashtags = append(hashtags, feature.RichtextFacet_Tag.Tag)
+			}
+		}
+	}
+	hashtags = append(hashtags, record.Tags...)
+
+	if embed := record.Embed; embed != nil {
+		var external *apibsky.EmbedExternal
+		switch {
+		case embed.EmbedImages != nil:
+			post.EmbedType = server.EmbedImages
+			post.HasMedia = true
+		case embed.EmbedVideo != nil:
+			post.EmbedType = server.EmbedVideo
+			post.HasMedia = true
+		case embed.EmbedExternal != nil:
+			post.EmbedType = server.EmbedExternal
+			external = embed.EmbedExternal
+		case embed.EmbedRecord != nil:
+			post.EmbedType = server.EmbedRecord
+		case embed.EmbedRecordWithMedia != nil:
+			post.EmbedType = server.EmbedRecordWithMedia
+			if media := embed.EmbedRecordWithMedia.Media; media != nil {
+				post.HasMedia = media.EmbedImages != nil || media.EmbedVideo != nil
+				external = media.EmbedExternal
+			}
+		}
+		if external != nil && external.External != nil {
+			links = append(links, external.External.Uri)
+		}
+	}
+
+	post.LinkDomains = linkDomains(links)
+	post.Hashtags = normalizeHashtags(hashtags)
+}
+
+// linkDomains returns the distinct domains of links, in lowercase and without a www. prefix
+func linkDomains(links []string) []string {
+	var domains []string
+	for _, link := range links {
+		u, err := url.Parse(link)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		domain := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+		if !slices.Contains(domains, domain) {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// normalizeHashtags returns the distinct hashtags in lowercase without a leading #
+func normalizeHashtags(tags []string) []string {
+	var hashtags []string
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#"))
+		if tag != "" && !slices.Contains(hashtags, tag) {
+			hashtags = append(hashtags, tag)
+		}
+	}
+	return hashtags
+}
@@ -0,0 +1,73 @@
+package consumer
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+
+	"github.com/nacorid/x402-feed/internal/server"
+)
+
+// RejectReasonSpamPattern is recorded when a post matches one of the known spam patterns
+const RejectReasonSpamPattern = "spam_pattern"
+
+// DefaultAutoApproveAfter is how many approved posts an author needs before their posts stop being held
+const DefaultAutoApproveAfter = 3
+
+// QueueConfig configures the moderation queue for authors the feed hasn't seen before
+type QueueConfig struct {
+	// HoldNewAuthors stores posts from authors with fewer than AutoApproveAfter approved posts as
+	// pending. Pending posts are hidden from every feed until they are approved
+	HoldNewAuthors   bool
+	AutoApproveAfter int
+	// RejectPatterns are known spam patterns. Posts matching any of them are rejected
+	RejectPatterns []*regexp.Regexp
+}
+
+// spamPatternRejection returns the reason a post should be rejected because it matches a known spam
+// pattern or an empty string if it doesn't match any
+func (c QueueConfig) spamPatternRejection(text string) string {
+	for _, pattern := range c.RejectPatterns {
+		if pattern.MatchString(text) {
+			return RejectReasonSpamPattern
+		}
+	}
+	return ""
+}
+
+// shouldHold reports whether a new post from the author needs to be approved before it's shown. Only
+// approved posts that have been flushed to the store are counted, so a post that's approved or added by
+// a curator while it's still in the write buffer counts towards its author once it's flushed. That can
+// hold a post that would otherwise have been approved but never shows one that shouldn't be
+func (h *Handler) shouldHold(ctx context.Context, authorDID string) bool {
+	if !h.queue.HoldNewAuthors {
+		return false
+	}
+
+	autoApproveAfter := h.queue.AutoApproveAfter
+	if autoApproveAfter <= 0 {
+		autoApproveAfter = DefaultAutoApproveAfter
+	}
+	approved, err := h.store.CountApprovedPosts(ctx, authorDID)
+	if err != nil {
+		// hold the post if it can't be told whether the author is trusted yet
+		slog.Error("error counting author's approved posts", "error", err, "did", authorDID)
+		return true
+	}
+	return approved < autoApproveAfter
+}
+
+// holdPost hides a post until it's approved. It's hidden before it's stored so that it's never shown
+func (h *Handler) holdPost(ctx context.Context, postURI string) error {
+	slog.Debug("holding post for approval", "uri", postURI)
+	return h.store.HideSubject(ctx, postURI, server.HiddenReasonPending)
+}
+
+func (h *Handler) isPostStored(ctx context.Context, postURI string) bool {
+	stored, err := h.store.IsPostStored(ctx, postURI)
+	if err != nil {
+		slog.Error("error checking if post is stored", "error", err, "uri", postURI)
+		return false
+	}
+	return stored
+}
@@ -0,0 +1,123 @@
+package consumer
+
+import (
+	"regexp"
+	"slices"
+	"testing"
+
+	"github.com/bluesky-social/jetstream/pkg/models"
+
+	"github.com/nacorid/x402-feed/internal/memstore"
+	"github.com/nacorid/x402-feed/internal/server"
+)
+
+func TestQueue(t *testing.T) {
+	post := func(did, rkey, text string) *models.Event {
+		return postEvent(t, models.CommitOperationCreate, did, rkey, text)
+	}
+	uri := func(did, rkey string) string {
+		return "at://" + did + "/app.bsky.feed.post/" + rkey
+	}
+
+	tests := map[string]struct {
+		cfg QueueConfig
+		// approved are posts that are already stored and approved before the events are handled
+		approved []server.Post
+		events   []*models.Event
+		pending  []string
+		shown    []string
+		rejected []string
+	}{
+		"not holding": {
+			events: []*models.Event{post("did:plc:a", "1", "x402 first post")},
+			shown:  []string{uri("did:plc:a", "1")},
+		},
+		"new author held": {
+			cfg:     QueueConfig{HoldNewAuthors: true},
+			events:  []*models.Event{post("did:plc:a", "1", "x402 first post"), post("did:plc:a", "2", "x402 second post")},
+			pending: []string{uri("did:plc:a", "1"), uri("did:plc:a", "2")},
+		},
+		"trusted author shown": {
+			cfg: QueueConfig{HoldNewAuthors: true, AutoApproveAfter: 2},
+			approved: []server.Post{
+				{RKey: "0", PostURI: uri("did:plc:a", "0"), UserDID: "did:plc:a", CreatedAt: 1},
+				{RKey: "00", PostURI: uri("did:plc:a", "00"), UserDID: "did:plc:a", CreatedAt: 2},
+			},
+			events: []*models.Event{post("did:plc:a", "1", "x402 third post")},
+			shown:  []string{uri("did:plc:a", "1"), uri("did:plc:a", "00"), uri("did:plc:a", "0")},
+		},
+		"author with too few approved posts held": {
+			cfg:      QueueConfig{HoldNewAuthors: true, AutoApproveAfter: 2},
+			approved: []server.Post{{RKey: "0", PostURI: uri("did:plc:a", "0"), UserDID: "did:plc:a", CreatedAt: 1}},
+			events:   []*models.Event{post("did:plc:a", "1", "x402 second post")},
+			pending:  []string{uri("did:plc:a", "1")},
+			shown:    []string{uri("did:plc:a", "0")},
+		},
+		"default auto approve": {
+			cfg: QueueConfig{HoldNewAuthors: true},
+			approved: []server.Post{
+				{RKey: "0", PostURI: uri("did:plc:a", "0"), UserDID: "did:plc:a", CreatedAt: 1},
+				{RKey: "00", PostURI: uri("did:plc:a", "00"), UserDID: "did:plc:a", CreatedAt: 2},
+			},
+			events:  []*models.Event{post("did:plc:a", "1", "x402 third post")},
+			pending: []string{uri("did:plc:a", "1")},
+			shown:   []string{uri("did:plc:a", "00"), uri("did:plc:a", "0")},
+		},
+		"spam pattern rejected": {
+			cfg:      QueueConfig{RejectPatterns: []*regexp.Regexp{regexp.MustCompile(`(?i)airdrop`)}},
+			events:   []*models.Event{post("did:plc:a", "1", "claim your x402 AIRDROP"), post("did:plc:b", "1", "x402 payments")},
+			shown:    []string{uri("did:plc:b", "1")},
+			rejected: []string{uri("did:plc:a", "1")},
+		},
+		"spam pattern rejected before holding": {
+			cfg:      QueueConfig{HoldNewAuthors: true, RejectPatterns: []*regexp.Regexp{regexp.MustCompile(`airdrop`)}},
+			events:   []*models.Event{post("did:plc:a", "1", "x402 airdrop")},
+			rejected: []string{uri("did:plc:a", "1")},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			store := memstore.New()
+			for _, p := range tc.approved {
+				if err := store.CreatePost(t.Context(), p); err != nil {
+					t.Fatalf("create post: %v", err)
+				}
+			}
+			handler := NewFeedHandler(store, HandlerOptions{Queue: tc.cfg})
+			for _, event := range tc.events {
+				if err := handler.HandleEvent(t.Context(), event); err != nil {
+					t.Fatalf("handle event: %v", err)
+				}
+			}
+
+			posts, err := store.GetPendingPosts(t.Context(), 100)
+			if err != nil {
+				t.Fatalf("get pending posts: %v", err)
+			}
+			pending := make([]string, 0, len(posts))
+			for _, p := range posts {
+				pending = append(pending, p.PostURI)
+			}
+			if len(pending)+len(tc.pending) > 0 && !slices.Equal(pending, tc.pending) {
+				t.Errorf("got pending %v, want %v", pending, tc.pending)
+			}
+
+			if got := feedURIs(t, store); len(got)+len(tc.shown) > 0 && !slices.Equal(got, tc.shown) {
+				t.Errorf("got feed %v, want %v", got, tc.shown)
+			}
+
+			rejections, err := store.GetRejections(t.Context(), server.RejectionQuery{Limit: 100})
+			if err != nil {
+				t.Fatalf("get rejections: %v", err)
+			}
+			rejected := make([]string, 0, len(rejections))
+			for _, r := range rejections {
+				rejected = append(rejected, r.PostURI)
+			}
+			if len(rejected)+len(tc.rejected) > 0 && !slices.Equal(rejected, tc.rejected) {
+				t.Errorf("got rejected %v, want %v", rejected, tc.rejected)
+			}
+		})
+	}
+}
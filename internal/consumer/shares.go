@@ -0,0 +1,103 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	apibsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/jetstream/pkg/models"
+
+	"github.com/nacorid/x402-feed/internal/server"
+)
+
+// quotedPostURI returns the URI of the post that a post quotes, or an empty string if it doesn't quote one
+func quotedPostURI(post *apibsky.FeedPost) string {
+	if post.Embed == nil {
+		return ""
+	}
+
+	var record *apibsky.EmbedRecord
+	switch {
+	case post.Embed.EmbedRecord != nil:
+		record = post.Embed.EmbedRecord
+	case post.Embed.EmbedRecordWithMedia != nil:
+		record = post.Embed.EmbedRecordWithMedia.Record
+	}
+	if record == nil || record.Record == nil {
+		return ""
+	}
+
+	// records such as lists and feeds can be embedded too
+	uri, err := syntax.ParseATURI(record.Record.Uri)
+	if err != nil || uri.Collection().String() != postCollection {
+		return ""
+	}
+	return record.Record.Uri
+}
+
+// isQuoteOfStoredPost reports whether the post quotes a post that's already in the feed
+func (h *Handler) isQuoteOfStoredPost(ctx context.Context, post *apibsky.FeedPost) bool {
+	if !h.includeQuotes {
+		return false
+	}
+	quotedURI := quotedPostURI(post)
+	if quotedURI == "" {
+		return false
+	}
+
+	stored, err := h.store.IsPostStored(ctx, quotedURI)
+	if err != nil {
+		slog.Error("error checking if quoted post is stored", "error", err, "uri", quotedURI)
+		return false
+	}
+	return stored
+}
+
+// handleRepostEvent stores reposts that curators make of posts that are in the feed
+func (h *CuratorHandler) handleRepostEvent(ctx context.Context, event *models.Event) error {
+	repostURI := fmt.Sprintf("at://%s/%s/%s", event.Did, repostCollection, event.Commit.RKey)
+
+	switch event.Commit.Operation {
+	case models.CommitOperationCreate:
+		var repost apibsky.FeedRepost
+		if err := json.Unmarshal(event.Commit.Record, &repost); err != nil {
+			return nil
+		}
+		if repost.Subject == nil {
+			return nil
+		}
+
+		stored, err := h.store.IsPostStored(ctx, repost.Subject.Uri)
+		if err != nil {
+			slog.Error("error checking if reposted post is stored", "error", err, "uri", repost.Subject.Uri)
+			return nil
+		}
+		if !stored {
+			return nil
+		}
+
+		createdAt, err := time.Parse(time.RFC3339, repost.CreatedAt)
+		if err != nil {
+			createdAt = time.Now().UTC()
+		}
+		err = h.store.CreateRepost(ctx, server.Repost{
+			RepostURI: repostURI,
+			PostURI:   repost.Subject.Uri,
+			UserDID:   event.Did,
+			CreatedAt: createdAt.UnixMilli(),
+		})
+		if err != nil {
+			slog.Error("error creating repost in store", "error", err)
+		}
+	case models.CommitOperationDelete:
+		err := h.store.DeleteRepost(ctx, repostURI)
+		if err != nil {
+			slog.Error("error deleting repost from store", "error", err, "uri", repostURI)
+		}
+	}
+	return nil
+}
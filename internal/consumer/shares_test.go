@@ -0,0 +1,222 @@
+package consumer
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	apibsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/jetstream/pkg/models"
+
+	"github.com/nacorid/x402-feed/internal/memstore"
+	"github.com/nacorid/x402-feed/internal/server"
+)
+
+const storedPost = "at://did:plc:author/app.bsky.feed.post/root"
+
+func strongRef(uri string) map[string]string {
+	return map[string]string{"uri": uri, "cid": "bafyreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm"}
+}
+
+func TestQuotedPostURI(t *testing.T) {
+	record := func(uri string) *apibsky.EmbedRecord {
+		return &apibsky.EmbedRecord{Record: &atproto.RepoStrongRef{Uri: uri}}
+	}
+
+	tests := map[string]struct {
+		embed *apibsky.FeedPost_Embed
+		want  string
+	}{
+		"no embed": {},
+		"quote": {
+			embed: &apibsky.FeedPost_Embed{EmbedRecord: record(storedPost)},
+			want:  storedPost,
+		},
+		"quote with media": {
+			embed: &apibsky.FeedPost_Embed{EmbedRecordWithMedia: &apibsky.EmbedRecordWithMedia{Record: record(storedPost)}},
+			want:  storedPost,
+		},
+		"embedded list": {
+			embed: &apibsky.FeedPost_Embed{EmbedRecord: record("at://did:plc:author/app.bsky.graph.list/1")},
+		},
+		"invalid uri": {
+			embed: &apibsky.FeedPost_Embed{EmbedRecord: record("not a uri")},
+		},
+		"link card": {
+			embed: &apibsky.FeedPost_Embed{EmbedExternal: &apibsky.EmbedExternal{External: &apibsky.EmbedExternal_External{Uri: "https://x402.org"}}},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := quotedPostURI(&apibsky.FeedPost{Embed: tc.embed}); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestQuotesOfStoredPosts(t *testing.T) {
+	quote := func(uri string) *models.Event {
+		return recordEvent(t, models.CommitOperationCreate, "did:plc:quoter", postCollection, "quote", map[string]any{
+			"$type":     postCollection,
+			"text":      "this is worth reading",
+			"createdAt": "2025-08-01T12:00:00Z",
+			"embed":     map[string]any{"$type": "app.bsky.embed.record", "record": strongRef(uri)},
+		})
+	}
+
+	tests := map[string]struct {
+		includeQuotes bool
+		quote         *models.Event
+		stored        bool
+	}{
+		"quote of stored post": {
+			includeQuotes: true,
+			quote:         quote(storedPost),
+			stored:        true,
+		},
+		"quotes not included": {
+			quote: quote(storedPost),
+		},
+		"quote of other post": {
+			includeQuotes: true,
+			quote:         quote("at://did:plc:author/app.bsky.feed.post/other"),
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			store := memstore.New()
+			handler := NewFeedHandler(store, HandlerOptions{IncludeQuotes: tc.includeQuotes})
+			if err := handler.HandleEvent(t.Context(), postEvent(t, models.CommitOperationCreate, "did:plc:author", "root", "paying for APIs with x402")); err != nil {
+				t.Fatalf("handle post: %v", err)
+			}
+			if err := handler.HandleEvent(t.Context(), tc.quote); err != nil {
+				t.Fatalf("handle quote: %v", err)
+			}
+
+			stored, err := store.IsPostStored(t.Context(), "at://did:plc:quoter/app.bsky.feed.post/quote")
+			if err != nil {
+				t.Fatalf("is post stored: %v", err)
+			}
+			if stored != tc.stored {
+				t.Errorf("got quote stored %v, want %v", stored, tc.stored)
+			}
+		})
+	}
+}
+
+func TestCuratorReposts(t *testing.T) {
+	repost := func(did, rkey, uri string) *models.Event {
+		return recordEvent(t, models.CommitOperationCreate, did, repostCollection, rkey, map[string]any{
+			"$type":     repostCollection,
+			"subject":   strongRef(uri),
+			"createdAt": "2025-08-02T12:00:00Z",
+		})
+	}
+	cfg := CuratorConfig{DIDs: []string{"did:plc:curator"}, RepostDIDs: []string{"did:plc:reposter"}}
+
+	tests := map[string]struct {
+		events []*models.Event
+		// want are the URIs of the reposts that are stored
+		want []string
+	}{
+		"repost of stored post": {
+			events: []*models.Event{repost("did:plc:reposter", "1", storedPost)},
+			want:   []string{"at://did:plc:reposter/app.bsky.feed.repost/1"},
+		},
+		"repost of other post": {
+			events: []*models.Event{repost("did:plc:reposter", "1", "at://did:plc:author/app.bsky.feed.post/other")},
+		},
+		"repost by curator without reposts": {
+			events: []*models.Event{repost("did:plc:curator", "1", storedPost)},
+		},
+		"repost by someone else": {
+			events: []*models.Event{repost("did:plc:someone", "1", storedPost)},
+		},
+		"undone repost": {
+			events: []*models.Event{
+				repost("did:plc:reposter", "1", storedPost),
+				recordEvent(t, models.CommitOperationDelete, "did:plc:reposter", repostCollection, "1", nil),
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			store := memstore.New()
+			err := store.CreatePost(t.Context(), server.Post{RKey: "root", PostURI: storedPost, UserDID: "did:plc:author", CreatedAt: 100})
+			if err != nil {
+				t.Fatalf("create post: %v", err)
+			}
+			handler := NewCuratorHandler(store, cfg)
+			for _, event := range tc.events {
+				if err := handler.HandleEvent(t.Context(), event); err != nil {
+					t.Fatalf("handle event: %v", err)
+				}
+			}
+
+			posts, err := store.GetFeedPosts(t.Context(), server.FeedQuery{Cursor: 9999999999999, Limit: 100, IncludeReposts: true})
+			if err != nil {
+				t.Fatalf("get feed posts: %v", err)
+			}
+			reposts := make([]string, 0)
+			for _, p := range posts {
+				if p.RepostURI != "" {
+					reposts = append(reposts, p.RepostURI)
+				}
+			}
+			if !slices.Equal(reposts, tc.want) && len(reposts)+len(tc.want) > 0 {
+				t.Errorf("got reposts %v, want %v", reposts, tc.want)
+			}
+		})
+	}
+}
+
+func TestRepostSubscriptions(t *testing.T) {
+	tests := map[string]struct {
+		cfg             CuratorConfig
+		wantCollections []string
+		wantDIDs        []string
+	}{
+		"curators": {
+			cfg:             CuratorConfig{DIDs: []string{"did:plc:curator"}},
+			wantCollections: []string{likeCollection, postCollection},
+			wantDIDs:        []string{"did:plc:curator"},
+		},
+		"curators with hidden list": {
+			cfg:             CuratorConfig{DIDs: []string{"did:plc:curator"}, HiddenList: "at://did:plc:curator/app.bsky.graph.list/1"},
+			wantCollections: []string{likeCollection, postCollection, listItemCollection},
+			wantDIDs:        []string{"did:plc:curator"},
+		},
+		"reposts only": {
+			cfg:             CuratorConfig{RepostDIDs: []string{"did:plc:reposter"}},
+			wantCollections: []string{repostCollection},
+			wantDIDs:        []string{"did:plc:reposter"},
+		},
+		"curators who repost": {
+			cfg:             CuratorConfig{DIDs: []string{"did:plc:curator"}, RepostDIDs: []string{"did:plc:curator", "did:plc:reposter"}},
+			wantCollections: []string{likeCollection, postCollection, repostCollection},
+			wantDIDs:        []string{"did:plc:curator", "did:plc:reposter"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			handler := NewCuratorHandler(memstore.New(), tc.cfg)
+			if got := handler.wantedCollections(); !slices.Equal(got, tc.wantCollections) {
+				t.Errorf("got collections %v, want %v", got, tc.wantCollections)
+			}
+			if got := handler.wantedDIDs(); !slices.Equal(got, tc.wantDIDs) {
+				t.Errorf("got DIDs %v, want %v", got, tc.wantDIDs)
+			}
+		})
+	}
+
+	// the main stream receives every repo so it mustn't ask for every repost on the network
+	feedHandler := NewFeedHandler(memstore.New(), HandlerOptions{})
+	if slices.Contains(feedHandler.wantedCollections(), repostCollection) {
+		t.Error("got reposts wanted by the feed handler")
+	}
+}
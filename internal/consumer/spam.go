@@ -0,0 +1,342 @@
+package consumer
+
+import (
+	"hash/fnv"
+	"math/bits"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	apibsky "github.com/bluesky-social/indigo/api/bsky"
+)
+
+// Reasons recorded when the spam filter rejects a post
+const (
+	RejectReasonRateLimited   = "rate_limited"
+	RejectReasonNearDuplicate = "near_duplicate"
+	RejectReasonTooManyLinks  = "too_many_links"
+	RejectReasonSuspiciousURL = "suspicious_link"
+)
+
+// SpamConfig configures the spam filter stage of the handler
+type SpamConfig struct {
+	// MaxPostsPerAuthor is how many matching posts a single author can make within AuthorWindow
+	MaxPostsPerAuthor int
+	AuthorWindow      time.Duration
+
+	// DuplicateWindow is how long post fingerprints are remembered for near-duplicate detection
+	DuplicateWindow time.Duration
+	// DuplicateDistance is the maximum number of differing simhash bits for two posts to be
+	// considered near-duplicates
+	DuplicateDistance int
+
+	// MaxLinks is the maximum number of distinct links a post can contain
+	MaxLinks int
+	// SuspiciousDomains are domains (and their subdomains) that cause a post to be rejected when linked
+	SuspiciousDomains []string
+}
+
+// DefaultSpamConfig returns the spam filter configuration used when nothing is overridden
+func DefaultSpamConfig() SpamConfig {
+	return SpamConfig{
+		MaxPostsPerAuthor: 10,
+		AuthorWindow:      time.Hour,
+		DuplicateWindow:   6 * time.Hour,
+		DuplicateDistance: 3,
+		MaxLinks:          3,
+		SuspiciousDomains: []string{
+			"bit.ly", "tinyurl.com", "t.co", "goo.gl", "is.gd", "cutt.ly", "rb.gy", "shorturl.at", "t.me",
+		},
+	}
+}
+
+type fingerprint struct {
+	hash      uint64
+	seenAt    time.Time
+	authorDID string
+}
+
+// band is one slice of a fingerprint's bits. Fingerprints within DuplicateDistance bits of each other
+// always have at least one band in common so only fingerprints that share a band need comparing
+type band struct {
+	index int
+	value uint64
+}
+
+// SpamFilter rejects posts from authors posting too often, posts that are near-duplicates of recent
+// posts (from any author) and posts containing suspicious links
+type SpamFilter struct {
+	cfg SpamConfig
+
+	mu          sync.Mutex
+	authorPosts map[string][]time.Time
+	// lastSweep is when authors that have gone quiet were last dropped from authorPosts
+	lastSweep time.Time
+	// fingerprints are in the order they were seen so that expired ones are always at the front, and
+	// buckets holds the same fingerprints keyed by each of their bands
+	fingerprints []fingerprint
+	buckets      map[band][]fingerprint
+}
+
+// NewSpamFilter returns a new spam filter
+func NewSpamFilter(cfg SpamConfig) *SpamFilter {
+	return &SpamFilter{
+		cfg:         cfg,
+		authorPosts: make(map[string][]time.Time),
+		buckets:     make(map[band][]fingerprint),
+	}
+}
+
+// Check will return the reason the post should be rejected or an empty string if the post looks fine.
+// Every post checked counts towards the author's rate limit and the duplicate window, even if rejected
+func (f *SpamFilter) Check(authorDID string, post *apibsky.FeedPost, now time.Time) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rateLimited := f.recordAuthorPost(authorDID, now)
+
+	// posts with too few words, such as quotes without any text or emoji replies, would all have the same
+	// fingerprint so they aren't checked for duplicates
+	duplicate := false
+	if words := normalizeText(post.Text); len(words) >= minDuplicateWords {
+		duplicate = f.recordFingerprint(fingerprint{hash: simhash(words), seenAt: now, authorDID: authorDID})
+	}
+
+	switch {
+	case rateLimited:
+		return RejectReasonRateLimited
+	case duplicate:
+		return RejectReasonNearDuplicate
+	}
+
+	links := postLinks(post)
+	if f.cfg.MaxLinks > 0 && len(links) > f.cfg.MaxLinks {
+		return RejectReasonTooManyLinks
+	}
+	for _, link := range links {
+		if f.suspiciousLink(link) {
+			return RejectReasonSuspiciousURL
+		}
+	}
+
+	return ""
+}
+
+func (f *SpamFilter) recordAuthorPost(authorDID string, now time.Time) bool {
+	if f.cfg.MaxPostsPerAuthor <= 0 {
+		return false
+	}
+
+	cutoff := now.Add(-f.cfg.AuthorWindow)
+	recent := f.authorPosts[authorDID][:0]
+	for _, t := range f.authorPosts[authorDID] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	f.authorPosts[authorDID] = recent
+
+	// authors that have gone quiet are dropped once a window so the map doesn't grow forever without
+	// walking it for every post
+	if now.Sub(f.lastSweep) >= f.cfg.AuthorWindow {
+		f.lastSweep = now
+		for did, times := range f.authorPosts {
+			if len(times) > 0 && !times[len(times)-1].After(cutoff) {
+				delete(f.authorPosts, did)
+			}
+		}
+	}
+
+	return len(recent) > f.cfg.MaxPostsPerAuthor
+}
+
+func (f *SpamFilter) recordFingerprint(fp fingerprint) bool {
+	if f.cfg.DuplicateWindow <= 0 {
+		return false
+	}
+
+	cutoff := fp.seenAt.Add(-f.cfg.DuplicateWindow)
+	expired := 0
+	for expired < len(f.fingerprints) && !f.fingerprints[expired].seenAt.After(cutoff) {
+		f.expireBuckets(f.fingerprints[expired], cutoff)
+		expired++
+	}
+	f.fingerprints = append(f.fingerprints[:0], f.fingerprints[expired:]...)
+
+	bands := f.bands(fp.hash)
+	duplicate := false
+	for _, b := range bands {
+		for _, existing := range f.buckets[b] {
+			if bits.OnesCount64(existing.hash^fp.hash) <= f.cfg.DuplicateDistance {
+				duplicate = true
+				break
+			}
+		}
+		if duplicate {
+			break
+		}
+	}
+
+	f.fingerprints = append(f.fingerprints, fp)
+	for _, b := range bands {
+		f.buckets[b] = append(f.buckets[b], fp)
+	}
+	return duplicate
+}
+
+// expireBuckets drops the expired fingerprints from the front of each bucket the fingerprint is in
+func (f *SpamFilter) expireBuckets(fp fingerprint, cutoff time.Time) {
+	for _, b := range f.bands(fp.hash) {
+		bucket := f.buckets[b]
+		expired := 0
+		for expired < len(bucket) && !bucket[expired].seenAt.After(cutoff) {
+			expired++
+		}
+		if expired == len(bucket) {
+			delete(f.buckets, b)
+			continue
+		}
+		f.buckets[b] = bucket[expired:]
+	}
+}
+
+// bands splits a fingerprint into DuplicateDistance+1 bands. Two fingerprints that differ in at most
+// DuplicateDistance bits can't differ in every band so they share at least one
+func (f *SpamFilter) bands(hash uint64) []band {
+	n := min(max(f.cfg.DuplicateDistance+1, 1), 64)
+	width := 64 / n
+
+	bands := make([]band, n)
+	for i := range bands {
+		value := hash >> uint(i*width)
+		// the last band takes whatever bits are left over
+		if i < n-1 {
+			value &= 1<<uint(width) - 1
+		}
+		bands[i] = band{index: i, value: value}
+	}
+	return bands
+}
+
+func (f *SpamFilter) suspiciousLink(link string) bool {
+	u, err := url.Parse(link)
+	if err != nil {
+		return true
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return false
+	}
+
+	// raw IP addresses and punycode domains are rarely used by legitimate posters
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	for _, label := range strings.Split(host, ".") {
+		if strings.HasPrefix(label, "xn--") {
+			return true
+		}
+	}
+
+	for _, domain := range f.cfg.SuspiciousDomains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	urlRegex      = regexp.MustCompile(`https?://\S+`)
+	nonWordRegex  = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+	shingleLength = 3
+	// minDuplicateWords is how many words a post needs after it's normalized to be checked for duplicates
+	minDuplicateWords = 3
+)
+
+// normalizeText lowercases the text and strips links and punctuation so that trivial variations
+// of the same spam message end up with the same words
+func normalizeText(text string) []string {
+	text = strings.ToLower(text)
+	text = urlRegex.ReplaceAllString(text, " ")
+	text = nonWordRegex.ReplaceAllString(text, " ")
+	return strings.Fields(text)
+}
+
+// simhash builds a 64 bit fingerprint from word shingles where similar texts produce fingerprints
+// that differ in only a few bits
+func simhash(words []string) uint64 {
+	if len(words) == 0 {
+		return 0
+	}
+
+	var weights [64]int
+	addShingle := func(shingle string) {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(shingle))
+		sum := h.Sum64()
+		for i := 0; i < 64; i++ {
+			if sum&(1<<uint(i)) != 0 {
+				weights[i]++
+			} else {
+				weights[i]--
+			}
+		}
+	}
+
+	if len(words) < shingleLength {
+		addShingle(strings.Join(words, " "))
+	}
+	for i := 0; i+shingleLength <= len(words); i++ {
+		addShingle(strings.Join(words[i:i+shingleLength], " "))
+	}
+
+	var hash uint64
+	for i, w := range weights {
+		if w > 0 {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+// postLinks returns the distinct links found in a post's link facets, external embed and text
+func postLinks(post *apibsky.FeedPost) []string {
+	seen := make(map[string]struct{})
+	links := make([]string, 0)
+	add := func(link string) {
+		if _, ok := seen[link]; ok || link == "" {
+			return
+		}
+		seen[link] = struct{}{}
+		links = append(links, link)
+	}
+
+	for _, facet := range post.Facets {
+		if facet == nil {
+			continue
+		}
+		for _, feature := range facet.Features {
+			if feature != nil && feature.RichtextFacet_Link != nil {
+				add(feature.RichtextFacet_Link.Uri)
+			}
+		}
+	}
+
+	if post.Embed != nil && post.Embed.EmbedExternal != nil && post.Embed.EmbedExternal.External != nil {
+		add(post.Embed.EmbedExternal.External.Uri)
+	}
+
+	// facets are optional so also pick up any links that are only in the text
+	if len(post.Facets) == 0 {
+		for _, link := range urlRegex.FindAllString(post.Text, -1) {
+			add(link)
+		}
+	}
+
+	return links
+}
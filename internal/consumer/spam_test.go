@@ -0,0 +1,201 @@
+package consumer
+
+import (
+	"fmt"
+	"math/bits"
+	"math/rand/v2"
+	"testing"
+	"time"
+
+	apibsky "github.com/bluesky-social/indigo/api/bsky"
+)
+
+func TestSpamFilterCheck(t *testing.T) {
+	now := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+
+	type post struct {
+		author string
+		text   string
+		at     time.Duration
+	}
+	tests := map[string]struct {
+		cfg   SpamConfig
+		posts []post
+		// want is the reason the last post is rejected for
+		want string
+	}{
+		"fine": {
+			cfg:   DefaultSpamConfig(),
+			posts: []post{{author: "did:plc:a", text: "settling payments with x402"}},
+		},
+		"rate limited": {
+			cfg: SpamConfig{MaxPostsPerAuthor: 2, AuthorWindow: time.Hour},
+			posts: []post{
+				{author: "did:plc:a", text: "one"},
+				{author: "did:plc:a", text: "two"},
+				{author: "did:plc:a", text: "three"},
+			},
+			want: RejectReasonRateLimited,
+		},
+		"rate limit is per author": {
+			cfg: SpamConfig{MaxPostsPerAuthor: 2, AuthorWindow: time.Hour},
+			posts: []post{
+				{author: "did:plc:a", text: "one"},
+				{author: "did:plc:a", text: "two"},
+				{author: "did:plc:b", text: "three"},
+			},
+		},
+		"rate limit window passed": {
+			cfg: SpamConfig{MaxPostsPerAuthor: 2, AuthorWindow: time.Hour},
+			posts: []post{
+				{author: "did:plc:a", text: "one"},
+				{author: "did:plc:a", text: "two"},
+				{author: "did:plc:a", text: "three", at: 2 * time.Hour},
+			},
+		},
+		"near duplicate from another author": {
+			cfg: SpamConfig{DuplicateWindow: time.Hour, DuplicateDistance: 3},
+			posts: []post{
+				{author: "did:plc:a", text: "Claim your free x402 tokens now at the link below before they run out"},
+				{author: "did:plc:b", text: "claim your FREE x402 tokens now, at the link below before they run out!! https://example.com"},
+			},
+			want: RejectReasonNearDuplicate,
+		},
+		"duplicate window passed": {
+			cfg: SpamConfig{DuplicateWindow: time.Hour, DuplicateDistance: 3},
+			posts: []post{
+				{author: "did:plc:a", text: "Claim your free x402 tokens now at the link below before they run out"},
+				{author: "did:plc:b", text: "Claim your free x402 tokens now at the link below before they run out", at: 2 * time.Hour},
+			},
+		},
+		"different text": {
+			cfg: SpamConfig{DuplicateWindow: time.Hour, DuplicateDistance: 3},
+			posts: []post{
+				{author: "did:plc:a", text: "Claim your free x402 tokens now at the link below before they run out"},
+				{author: "did:plc:b", text: "I wrote up how our API started charging per request with x402 and USDC"},
+			},
+		},
+		"posts without text aren't duplicates": {
+			cfg: SpamConfig{DuplicateWindow: time.Hour, DuplicateDistance: 3},
+			posts: []post{
+				{author: "did:plc:a", text: ""},
+				{author: "did:plc:b", text: ""},
+			},
+		},
+		"emoji only posts aren't duplicates": {
+			cfg: SpamConfig{DuplicateWindow: time.Hour, DuplicateDistance: 3},
+			posts: []post{
+				{author: "did:plc:a", text: "🔥🔥"},
+				{author: "did:plc:b", text: "🚀 https://example.com"},
+			},
+		},
+		"short posts aren't duplicates": {
+			cfg: SpamConfig{DuplicateWindow: time.Hour, DuplicateDistance: 3},
+			posts: []post{
+				{author: "did:plc:a", text: "x402 gm"},
+				{author: "did:plc:b", text: "x402 GM!"},
+			},
+		},
+		"too many links": {
+			cfg:   SpamConfig{MaxLinks: 2},
+			posts: []post{{author: "did:plc:a", text: "x402 https://a.example https://b.example https://c.example"}},
+			want:  RejectReasonTooManyLinks,
+		},
+		"link shortener": {
+			cfg:   SpamConfig{SuspiciousDomains: []string{"bit.ly"}},
+			posts: []post{{author: "did:plc:a", text: "x402 https://go.bit.ly/abc"}},
+			want:  RejectReasonSuspiciousURL,
+		},
+		"ip address link": {
+			cfg:   SpamConfig{},
+			posts: []post{{author: "did:plc:a", text: "x402 http://203.0.113.7/claim"}},
+			want:  RejectReasonSuspiciousURL,
+		},
+		"punycode link": {
+			cfg:   SpamConfig{},
+			posts: []post{{author: "did:plc:a", text: "x402 https://xn--x402-9ua.example/claim"}},
+			want:  RejectReasonSuspiciousURL,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			filter := NewSpamFilter(tc.cfg)
+			got := ""
+			for _, p := range tc.posts {
+				got = filter.Check(p.author, &apibsky.FeedPost{Text: p.text}, now.Add(p.at))
+			}
+			if got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSimhashDistance(t *testing.T) {
+	base := "Claim your free x402 tokens now at the link below before they run out"
+	tests := map[string]struct {
+		text string
+		// near is whether the text should be within the default duplicate distance of base
+		near bool
+	}{
+		"same text":             {text: base, near: true},
+		"case and punctuation":  {text: "CLAIM your free x402 tokens, now at the link below... before they run out!", near: true},
+		"links stripped":        {text: base + " https://spam.example/claim", near: true},
+		"unrelated":             {text: "I wrote up how our API started charging per request with x402 and USDC", near: false},
+		"same words reordered":  {text: "before they run out claim the link below now at your free x402 tokens", near: false},
+		"shorter than shingles": {text: "x402", near: false},
+	}
+
+	baseHash := simhash(normalizeText(base))
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			distance := bits.OnesCount64(baseHash ^ simhash(normalizeText(tc.text)))
+			if near := distance <= DefaultSpamConfig().DuplicateDistance; near != tc.near {
+				t.Errorf("got distance %d, want near %v", distance, tc.near)
+			}
+		})
+	}
+}
+
+func TestFingerprintBands(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	for _, distance := range []int{0, 1, 3, 7, 16, 63} {
+		t.Run(fmt.Sprintf("distance %d", distance), func(t *testing.T) {
+			filter := NewSpamFilter(SpamConfig{DuplicateDistance: distance})
+			for range 1000 {
+				hash := rng.Uint64()
+				flipped := hash
+				for _, bit := range rng.Perm(64)[:distance] {
+					flipped ^= 1 << uint(bit)
+				}
+
+				shared := false
+				bands := filter.bands(flipped)
+				for i, b := range filter.bands(hash) {
+					shared = shared || b == bands[i]
+				}
+				if !shared {
+					t.Fatalf("fingerprints %x and %x are %d bits apart but share no band", hash, flipped, distance)
+				}
+			}
+		})
+	}
+}
+
+func TestSpamFilterForgetsQuietAuthors(t *testing.T) {
+	now := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	filter := NewSpamFilter(SpamConfig{MaxPostsPerAuthor: 10, AuthorWindow: time.Hour, DuplicateWindow: time.Hour})
+
+	for i := range 100 {
+		filter.Check(fmt.Sprintf("did:plc:%d", i), &apibsky.FeedPost{Text: fmt.Sprintf("post number %d", i)}, now)
+	}
+	filter.Check("did:plc:late", &apibsky.FeedPost{Text: "a post after everyone went quiet"}, now.Add(2*time.Hour))
+
+	if len(filter.authorPosts) != 1 {
+		t.Errorf("got %d authors remembered, want only the one that posted within the window", len(filter.authorPosts))
+	}
+	if len(filter.fingerprints) != 1 || len(filter.buckets) != len(filter.bands(0)) {
+		t.Errorf("got %d fingerprints in %d buckets, want the expired ones dropped", len(filter.fingerprints), len(filter.buckets))
+	}
+}
@@ -0,0 +1,59 @@
+package consumer
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+
+	apibsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+// ThreadConfig controls which replies in threads that contain matching posts are also stored, even
+// though they don't match themselves
+type ThreadConfig struct {
+	// IncludeAuthorReplies stores replies made by the author of the post at the root of the thread
+	IncludeAuthorReplies bool
+	// Experts are users whose replies are stored
+	Experts []string
+}
+
+func (c ThreadConfig) enabled() bool {
+	return c.IncludeAuthorReplies || len(c.Experts) > 0
+}
+
+// replyRefs returns the URIs of the root and parent posts if the post is a reply
+func replyRefs(post *apibsky.FeedPost) (string, string) {
+	if post.Reply == nil || post.Reply.Root == nil || post.Reply.Parent == nil {
+		return "", ""
+	}
+	return post.Reply.Root.Uri, post.Reply.Parent.Uri
+}
+
+// isThreadReply reports whether the post is a reply that should be stored because of who made it and
+// because the thread it's in already has posts in the feed
+func (h *Handler) isThreadReply(ctx context.Context, authorDID string, post *apibsky.FeedPost) bool {
+	if !h.threads.enabled() {
+		return false
+	}
+	rootURI, _ := replyRefs(post)
+	if rootURI == "" {
+		return false
+	}
+
+	relevant := slices.Contains(h.threads.Experts, authorDID)
+	if !relevant && h.threads.IncludeAuthorReplies {
+		root, err := syntax.ParseATURI(rootURI)
+		relevant = err == nil && root.Authority().String() == authorDID
+	}
+	if !relevant {
+		return false
+	}
+
+	stored, err := h.store.IsThreadStored(ctx, rootURI)
+	if err != nil {
+		slog.Error("error checking if thread is stored", "error", err, "root", rootURI)
+		return false
+	}
+	return stored
+}
@@ -0,0 +1,90 @@
+package consumer
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/bluesky-social/jetstream/pkg/models"
+
+	"github.com/nacorid/x402-feed/internal/memstore"
+)
+
+func replyEvent(t *testing.T, did, rkey, text, rootURI, parentURI string) *models.Event {
+	t.Helper()
+	return recordEvent(t, models.CommitOperationCreate, did, postCollection, rkey, map[string]any{
+		"$type":     postCollection,
+		"text":      text,
+		"createdAt": "2025-08-01T12:00:00Z",
+		"reply":     map[string]any{"root": strongRef(rootURI), "parent": strongRef(parentURI)},
+	})
+}
+
+func TestThreadReplies(t *testing.T) {
+	const (
+		root     = "at://did:plc:author/app.bsky.feed.post/root"
+		unstored = "at://did:plc:author/app.bsky.feed.post/other"
+		reply    = "at://did:plc:author/app.bsky.feed.post/reply"
+	)
+
+	tests := map[string]struct {
+		threads ThreadConfig
+		reply   *models.Event
+		// want is the URI of the reply if it should be stored
+		want string
+	}{
+		"author reply": {
+			threads: ThreadConfig{IncludeAuthorReplies: true},
+			reply:   replyEvent(t, "did:plc:author", "reply", "and another thing", root, root),
+			want:    reply,
+		},
+		"author reply further down the thread": {
+			threads: ThreadConfig{IncludeAuthorReplies: true},
+			reply:   replyEvent(t, "did:plc:author", "reply", "and another thing", root, reply),
+			want:    reply,
+		},
+		"author reply when disabled": {
+			reply: replyEvent(t, "did:plc:author", "reply", "and another thing", root, root),
+		},
+		"reply by someone else": {
+			threads: ThreadConfig{IncludeAuthorReplies: true},
+			reply:   replyEvent(t, "did:plc:someone", "reply", "nice", root, root),
+		},
+		"expert reply": {
+			threads: ThreadConfig{Experts: []string{"did:plc:expert"}},
+			reply:   replyEvent(t, "did:plc:expert", "reply", "the facilitator settles that", root, root),
+			want:    "at://did:plc:expert/app.bsky.feed.post/reply",
+		},
+		"author reply in a thread that isn't stored": {
+			threads: ThreadConfig{IncludeAuthorReplies: true},
+			reply:   replyEvent(t, "did:plc:author", "reply", "and another thing", unstored, unstored),
+		},
+		"reply that matches on its own": {
+			reply: replyEvent(t, "did:plc:someone", "reply", "x402 is neat", unstored, unstored),
+			want:  "at://did:plc:someone/app.bsky.feed.post/reply",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			store := memstore.New()
+			handler := NewFeedHandler(store, HandlerOptions{Threads: tc.threads})
+			if err := handler.HandleEvent(t.Context(), postEvent(t, models.CommitOperationCreate, "did:plc:author", "root", "paying for APIs with x402")); err != nil {
+				t.Fatalf("handle root: %v", err)
+			}
+			if err := handler.HandleEvent(t.Context(), tc.reply); err != nil {
+				t.Fatalf("handle reply: %v", err)
+			}
+
+			got := feedURIs(t, store)
+			want := []string{root}
+			if tc.want != "" {
+				want = append(want, tc.want)
+			}
+			slices.Sort(got)
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Errorf("got feed %v, want %v", got, want)
+			}
+		})
+	}
+}
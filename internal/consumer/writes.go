@@ -0,0 +1,279 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nacorid/x402-feed/internal/server"
+)
+
+// Defaults for how often buffered writes are flushed to the store
+const (
+	DefaultWriteBatchSize     = 500
+	DefaultWriteFlushInterval = time.Second
+)
+
+// DefaultJetstreamCursorName is the name the position in the Jetstream stream is stored under. Feed
+// generators that share a database each need their own name, as each one has its own position
+const DefaultJetstreamCursorName = "jetstream"
+
+// WriteBufferConfig configures when buffered writes are flushed
+type WriteBufferConfig struct {
+	// BatchSize is how many writes are buffered before they're flushed without waiting for FlushInterval
+	BatchSize     int
+	FlushInterval time.Duration
+	// CursorName is the stream cursor that's stored with each flush
+	CursorName string
+}
+
+// WriteBuffer is a store that buffers creating and deleting posts so that handling an event doesn't
+// wait for the disk. The buffered writes are flushed in order in a single transaction along with the
+// position of the last event that was handled, so after a restart the stream is resumed from the last
+// event whose writes were committed. Everything else is passed straight through to the store.
+//
+// Lookups of whether posts, threads and authors are stored include the buffered writes
+type WriteBuffer struct {
+	server.PostStore
+
+	batchSize     int
+	flushInterval time.Duration
+	cursorName    string
+	flushNow      chan struct{}
+
+	// flushMu is held for the whole of a flush so that flushes can't be committed out of order
+	flushMu sync.Mutex
+
+	mu sync.Mutex
+	// pending are the writes waiting to be flushed and flushing are the writes being flushed
+	pending  []server.Write
+	flushing []server.Write
+	// cursor is the position of the last event that was handled and committed is the position stored
+	// by the last flush
+	cursor    int64
+	committed int64
+}
+
+// NewWriteBuffer returns a buffer in front of the store. Call Run to start flushing
+func NewWriteBuffer(store server.PostStore, cfg WriteBufferConfig) *WriteBuffer {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultWriteBatchSize
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultWriteFlushInterval
+	}
+	if cfg.CursorName == "" {
+		cfg.CursorName = DefaultJetstreamCursorName
+	}
+
+	return &WriteBuffer{
+		PostStore:     store,
+		batchSize:     cfg.BatchSize,
+		flushInterval: cfg.FlushInterval,
+		cursorName:    cfg.CursorName,
+		flushNow:      make(chan struct{}, 1),
+	}
+}
+
+// Run flushes the buffer every flush interval or whenever a batch fills up. When the context is
+// cancelled whatever is left is flushed before returning
+func (b *WriteBuffer) Run(ctx context.Context) {
+	ticker := time.NewTicker(b.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.flushNow:
+		case <-ctx.Done():
+			if err := b.Flush(context.WithoutCancel(ctx)); err != nil {
+				slog.Error("flushing buffered writes on shutdown", "error", err)
+			}
+			return
+		}
+
+		if err := b.Flush(ctx); err != nil {
+			slog.Error("flushing buffered writes", "error", err)
+		}
+	}
+}
+
+// CreatePost buffers storing a post
+func (b *WriteBuffer) CreatePost(ctx context.Context, post server.Post) error {
+	b.add(server.Write{Kind: server.WriteCreatePost, Post: post})
+	return nil
+}
+
+// DeletePostsFromURIs buffers deleting posts
+func (b *WriteBuffer) DeletePostsFromURIs(ctx context.Context, uris []string) error {
+	b.add(server.Write{Kind: server.WriteDeletePosts, Subjects: uris})
+	return nil
+}
+
+// DeletePostsFromUsers buffers deleting every post from the users
+func (b *WriteBuffer) DeletePostsFromUsers(ctx context.Context, dids []string) error {
+	if len(dids) == 0 {
+		return nil
+	}
+	b.add(server.Write{Kind: server.WriteDeleteUserPosts, Subjects: dids})
+	return nil
+}
+
+func (b *WriteBuffer) add(write server.Write) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.pending = append(b.pending, write)
+	if len(b.pending) >= b.batchSize {
+		select {
+		case b.flushNow <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// eventHandled records that every write for events up to and including the one at the given position
+// has been buffered. If the store has fallen far behind it flushes before returning so that the buffer
+// can't keep growing. If that flush fails the error is returned, which stops the stream until the
+// buffer can be flushed as it's resumed from the checkpoint
+func (b *WriteBuffer) eventHandled(ctx context.Context, cursor int64) error {
+	b.mu.Lock()
+	b.cursor = cursor
+	behind := len(b.pending) >= b.batchSize*10
+	b.mu.Unlock()
+
+	if !behind {
+		return nil
+	}
+	return b.Flush(ctx)
+}
+
+// Flush writes everything that's buffered to the store. If one of the writes can't be applied the writes
+// are applied one at a time so that only the writes that fail on their own are dropped, rather than one
+// bad write stopping every write after it. If the store fails for any other reason the writes are kept to
+// be retried by the next flush
+func (b *WriteBuffer) Flush(ctx context.Context) error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	writes, cursor := b.pending, b.cursor
+	if len(writes) == 0 && cursor == b.committed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.pending = nil
+	b.flushing = writes
+	b.mu.Unlock()
+
+	batch := server.WriteBatch{Writes: writes}
+	if cursor > 0 {
+		batch.CursorName, batch.Cursor = b.cursorName, cursor
+	}
+	err := b.PostStore.ApplyWrites(ctx, batch)
+	unapplied := writes
+	if isWriteError(err) {
+		unapplied, err = b.applyEach(ctx, batch)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushing = nil
+	if err != nil {
+		b.pending = append(unapplied, b.pending...)
+		return fmt.Errorf("apply %d writes: %w", len(writes), err)
+	}
+	b.committed = cursor
+	return nil
+}
+
+// applyEach applies the writes in the batch one at a time, followed by the cursor. A write that fails on
+// its own is logged and dropped. If the store fails for any other reason the writes that haven't been
+// applied are returned along with the error
+func (b *WriteBuffer) applyEach(ctx context.Context, batch server.WriteBatch) ([]server.Write, error) {
+	for i, write := range batch.Writes {
+		err := b.PostStore.ApplyWrites(ctx, server.WriteBatch{Writes: []server.Write{write}})
+		if isWriteError(err) {
+			slog.Error("dropping write that can't be applied", "error", err, "kind", write.Kind, "uri", write.Post.PostURI, "subjects", write.Subjects)
+			continue
+		}
+		if err != nil {
+			return batch.Writes[i:], err
+		}
+	}
+	return nil, b.PostStore.ApplyWrites(ctx, server.WriteBatch{CursorName: batch.CursorName, Cursor: batch.Cursor})
+}
+
+// isWriteError reports whether the error is from one of the writes in a batch rather than the store, and
+// isn't because the write ran out of time, which could happen to any write
+func isWriteError(err error) bool {
+	var writeErr *server.WriteError
+	return errors.As(err, &writeErr) && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// checkpoint flushes the buffer and returns the position of the last event whose writes were committed
+// or 0 if nothing has been committed yet
+func (b *WriteBuffer) checkpoint(ctx context.Context) (int64, error) {
+	if err := b.Flush(ctx); err != nil {
+		return 0, err
+	}
+	return b.PostStore.GetCursor(ctx, b.cursorName)
+}
+
+// IsPostStored reports whether the post is stored or waiting to be
+func (b *WriteBuffer) IsPostStored(ctx context.Context, uri string) (bool, error) {
+	if b.buffered(func(p server.Post) bool { return p.PostURI == uri }) {
+		return true, nil
+	}
+	return b.PostStore.IsPostStored(ctx, uri)
+}
+
+// IsThreadStored reports whether the root post or any replies in the thread are stored or waiting to be
+func (b *WriteBuffer) IsThreadStored(ctx context.Context, rootURI string) (bool, error) {
+	if b.buffered(func(p server.Post) bool { return p.PostURI == rootURI || p.ReplyRoot == rootURI }) {
+		return true, nil
+	}
+	return b.PostStore.IsThreadStored(ctx, rootURI)
+}
+
+// IsKnownAuthor reports whether the author has posts stored or waiting to be
+func (b *WriteBuffer) IsKnownAuthor(ctx context.Context, did string) (bool, error) {
+	if b.buffered(func(p server.Post) bool { return p.UserDID == did }) {
+		return true, nil
+	}
+	return b.PostStore.IsKnownAuthor(ctx, did)
+}
+
+// buffered reports whether any post that matches will still be stored once the buffered writes have
+// been flushed
+func (b *WriteBuffer) buffered(match func(p server.Post) bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	posts := make(map[string]server.Post)
+	for _, writes := range [][]server.Write{b.flushing, b.pending} {
+		for _, write := range writes {
+			switch write.Kind {
+			case server.WriteCreatePost:
+				if match(write.Post) {
+					posts[write.Post.PostURI] = write.Post
+				}
+			case server.WriteDeletePosts:
+				for _, uri := range write.Subjects {
+					delete(posts, uri)
+				}
+			case server.WriteDeleteUserPosts:
+				for uri, post := range posts {
+					if slices.Contains(write.Subjects, post.UserDID) {
+						delete(posts, uri)
+					}
+				}
+			}
+		}
+	}
+	return len(posts) > 0
+}
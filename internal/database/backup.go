@@ -0,0 +1,227 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"time"
+)
+
+// ErrBackupUnsupported is returned when backing up or restoring postgres, which should be done with
+// pg_dump and pg_restore instead
+var ErrBackupUnsupported = errors.New("backups are only supported for sqlite, use pg_dump for postgres")
+
+// ErrDatabaseInUse is returned when restoring over a database that another process has open
+var ErrDatabaseInUse = errors.New("database is in use, stop the feed generator before restoring")
+
+// Backup writes a copy of the database to dest without stopping reads or writes. The copy is a
+// consistent snapshot and only appears at dest once it's complete
+func (d *Database) Backup(ctx context.Context, dest string) error {
+	if d.postgres {
+		return ErrBackupUnsupported
+	}
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("%s already exists", dest)
+	}
+
+	tmp := dest + ".tmp"
+	err := os.Remove(tmp)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove old temporary backup: %w", err)
+	}
+
+	err = d.vacuumInto(ctx, tmp)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("vacuum into backup: %w", err)
+	}
+
+	err = syncFile(tmp)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, dest)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("rename backup: %w", err)
+	}
+	return nil
+}
+
+// vacuumInto copies the database into a new file. VACUUM INTO only reads from the database so it runs on
+// a connection from the read pool and doesn't hold up writes, but sqlite treats it as a write so the
+// connection is only query_only again once it's done
+func (d *Database) vacuumInto(ctx context.Context, filename string) error {
+	if d.readDB == d.db {
+		_, err := d.db.ExecContext(ctx, `VACUUM INTO ?`, filename)
+		return err
+	}
+
+	conn, err := d.readDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `PRAGMA query_only = 0;`)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_, err := conn.ExecContext(context.WithoutCancel(ctx), `PRAGMA query_only = 1;`)
+		if err != nil {
+			// the connection mustn't go back in the pool if it can still write
+			_ = conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+	}()
+
+	_, err = conn.ExecContext(ctx, `VACUUM INTO ?`, filename)
+	return err
+}
+
+// CheckBackup verifies that a sqlite database file is intact and has a schema this version can open,
+// returning its schema version. Older schemas are migrated when the database is next opened
+func CheckBackup(ctx context.Context, filename string) (int, error) {
+	if _, err := os.Stat(filename); err != nil {
+		return 0, fmt.Errorf("backup file: %w", err)
+	}
+
+	params := url.Values{}
+	params.Add("_pragma", "query_only(1)")
+	db, err := sql.Open("sqlite", filename+"?"+params.Encode())
+	if err != nil {
+		return 0, fmt.Errorf("open backup: %w", err)
+	}
+	defer db.Close()
+
+	var result string
+	err = db.QueryRowContext(ctx, `PRAGMA integrity_check(1);`).Scan(&result)
+	if err != nil {
+		return 0, fmt.Errorf("check integrity: %w", err)
+	}
+	if result != "ok" {
+		return 0, fmt.Errorf("backup is corrupt: %s", result)
+	}
+
+	var version int
+	err = db.QueryRowContext(ctx, `PRAGMA user_version;`).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("get schema version: %w", err)
+	}
+	var tables int
+	err = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'posts';`).Scan(&tables)
+	if err != nil {
+		return 0, fmt.Errorf("check posts table: %w", err)
+	}
+	if version == 0 || tables == 0 {
+		return 0, fmt.Errorf("%s is not a feed database", filename)
+	}
+	if version > len(migrations) {
+		return version, fmt.Errorf("backup has schema version %d but this version only supports up to %d, upgrade first", version, len(migrations))
+	}
+	return version, nil
+}
+
+// Restore replaces the sqlite database at dbPath with a backup once it's been checked with CheckBackup.
+// The database being replaced is kept next to it and its path is returned. Nothing else can have the
+// database open while it's restored
+func Restore(ctx context.Context, backup, dbPath string) (string, error) {
+	_, err := CheckBackup(ctx, backup)
+	if err != nil {
+		return "", err
+	}
+
+	// copy the backup next to the database first so that the swap is just renames
+	restoring := dbPath + ".restoring"
+	err = copyFile(backup, restoring)
+	if err != nil {
+		_ = os.Remove(restoring)
+		return "", fmt.Errorf("copy backup: %w", err)
+	}
+
+	previous := ""
+	if _, err := os.Stat(dbPath); err == nil {
+		err = closeWAL(ctx, dbPath)
+		if err != nil {
+			_ = os.Remove(restoring)
+			return "", err
+		}
+		previous = fmt.Sprintf("%s.pre-restore-%s", dbPath, time.Now().UTC().Format("20060102T150405Z"))
+		err = os.Rename(dbPath, previous)
+		if err != nil {
+			_ = os.Remove(restoring)
+			return "", fmt.Errorf("move database aside: %w", err)
+		}
+	}
+
+	err = os.Rename(restoring, dbPath)
+	if err != nil {
+		return previous, fmt.Errorf("move backup into place: %w", err)
+	}
+	return previous, nil
+}
+
+// closeWAL checkpoints the database's write-ahead log into the database file and removes it, so that the
+// database is a single file that can be moved. This can only happen when no other connection has the
+// database open, which makes it a check that the feed generator isn't running
+func closeWAL(ctx context.Context, dbPath string) error {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		return fmt.Errorf("open database: %w", err)
+	}
+	defer db.Close()
+
+	// sqlite leaves the journal mode as it was rather than failing if another connection is open
+	var mode string
+	err = db.QueryRowContext(ctx, `PRAGMA journal_mode = DELETE;`).Scan(&mode)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDatabaseInUse, err)
+	}
+	if mode != "delete" {
+		return ErrDatabaseInUse
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		_ = out.Close()
+		return err
+	}
+	err = out.Sync()
+	if err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func syncFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("open backup: %w", err)
+	}
+	defer file.Close()
+	err = file.Sync()
+	if err != nil {
+		return fmt.Errorf("sync backup: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nacorid/x402-feed/internal/server"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "database.db")
+
+	database, err := NewDatabase(dbPath)
+	if err != nil {
+		t.Fatalf("create database: %v", err)
+	}
+	post := server.Post{RKey: "1", PostURI: "at://did:plc:a/app.bsky.feed.post/1", UserDID: "did:plc:a", CreatedAt: 100}
+	err = database.CreatePost(ctx, post)
+	if err != nil {
+		t.Fatalf("create post: %v", err)
+	}
+
+	backup := filepath.Join(dir, "backup.db")
+	err = database.Backup(ctx, backup)
+	if err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	if err := database.Backup(ctx, backup); err == nil {
+		t.Errorf("expected an error backing up over an existing file")
+	}
+	version, err := CheckBackup(ctx, backup)
+	if err != nil || version != len(migrations) {
+		t.Errorf("check backup: got version %d, %v", version, err)
+	}
+
+	// posts added after the backup are lost when it's restored
+	err = database.CreatePost(ctx, server.Post{RKey: "2", PostURI: "at://did:plc:a/app.bsky.feed.post/2", UserDID: "did:plc:a", CreatedAt: 200})
+	if err != nil {
+		t.Fatalf("create post: %v", err)
+	}
+
+	_, err = Restore(ctx, backup, dbPath)
+	if !errors.Is(err, ErrDatabaseInUse) {
+		t.Fatalf("got %v restoring an open database, want ErrDatabaseInUse", err)
+	}
+	database.Close()
+
+	previous, err := Restore(ctx, backup, dbPath)
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if _, err := os.Stat(previous); err != nil {
+		t.Errorf("the replaced database wasn't kept: %v", err)
+	}
+
+	restored, err := NewDatabase(dbPath)
+	if err != nil {
+		t.Fatalf("open restored database: %v", err)
+	}
+	defer restored.Close()
+	posts, err := restored.GetFeedPosts(ctx, server.FeedQuery{Cursor: 1000, Limit: 10})
+	if err != nil {
+		t.Fatalf("get feed posts: %v", err)
+	}
+	if len(posts) != 1 || posts[0].PostURI != post.PostURI {
+		t.Errorf("got %+v, want only the post from before the backup", posts)
+	}
+}
+
+func TestCheckBackup(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	notDB := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(notDB, []byte("not a database"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if _, err := CheckBackup(ctx, notDB); err == nil {
+		t.Errorf("expected an error checking a file that isn't a database")
+	}
+	if _, err := CheckBackup(ctx, filepath.Join(dir, "missing.db")); err == nil {
+		t.Errorf("expected an error checking a missing file")
+	}
+
+	newer := filepath.Join(dir, "newer.db")
+	database, err := NewDatabase(newer)
+	if err != nil {
+		t.Fatalf("create database: %v", err)
+	}
+	_, err = database.db.Exec(`PRAGMA user_version = 1000;`)
+	database.Close()
+	if err != nil {
+		t.Fatalf("set user version: %v", err)
+	}
+	if _, err := CheckBackup(ctx, newer); err == nil {
+		t.Errorf("expected an error checking a backup from a newer version")
+	}
+}
@@ -1,36 +1,76 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
+	"net/url"
 	"os"
+	"runtime"
+	"strconv"
 	"strings"
+	"time"
 
 	_ "github.com/glebarez/go-sqlite"
 
+	"github.com/nacorid/x402-feed/internal/search"
 	"github.com/nacorid/x402-feed/internal/server"
 )
 
-// Database is a sqlite database
+// Database is a sqlite or postgres database
 type Database struct {
+	// db is used for writes. For sqlite it only has one connection because sqlite only allows one writer
+	// at a time, so writes queue here rather than failing with SQLITE_BUSY
 	db *sql.DB
+	// readDB is used for queries. For a sqlite file it's a separate pool of read only connections which,
+	// in WAL mode, can read while a write is in progress. Otherwise it's the same pool as db
+	readDB *sql.DB
+
+	writeStmts *stmtCache
+	readStmts  *stmtCache
+
+	// postgres is set when the database is postgres rather than sqlite. Queries are written with ?
+	// bind parameters and rebound for postgres
+	postgres bool
+
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+// Default limits on how long a single store operation can take
+const (
+	DefaultReadTimeout  = 5 * time.Second
+	DefaultWriteTimeout = 10 * time.Second
+)
+
+// SetTimeouts changes how long a single read or write can take before it's cancelled
+func (d *Database) SetTimeouts(read, write time.Duration) {
+	d.readTimeout = read
+	d.writeTimeout = write
 }
 
+// busyTimeout is how long sqlite waits for another connection, such as the admin command, to finish
+// writing before giving up
+const busyTimeout = 5 * time.Second
+
 // NewDatabase will open a new database. It will ping the database to ensure it is available and error if not
 func NewDatabase(dbPath string) (*Database, error) {
-	if dbPath != ":memory:" {
+	memory := dbPath == ":memory:"
+	if !memory {
 		err := createDbFile(dbPath)
 		if err != nil {
 			return nil, fmt.Errorf("create db file: %w", err)
 		}
 	}
 
-	db, err := sql.Open("sqlite", dbPath)
+	db, err := sql.Open("sqlite", sqliteDSN(dbPath, false))
 	if err != nil {
 		return nil, fmt.Errorf("open database: %w", err)
 	}
+	db.SetMaxOpenConns(1)
 
 	err = db.Ping()
 	if err != nil {
@@ -42,11 +82,78 @@ func NewDatabase(dbPath string) (*Database, error) {
 		return nil, fmt.Errorf("creating posts table: %w", err)
 	}
 
-	return &Database{db: db}, nil
+	err = createRejectionsTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("creating rejections table: %w", err)
+	}
+
+	err = migrate(db)
+	if err != nil {
+		return nil, fmt.Errorf("migrating database: %w", err)
+	}
+
+	// every connection to an in memory database gets its own empty database so it can't have a
+	// separate pool for reads
+	readDB := db
+	if !memory {
+		readDB, err = sql.Open("sqlite", sqliteDSN(dbPath, true))
+		if err != nil {
+			return nil, fmt.Errorf("open read database: %w", err)
+		}
+		readDB.SetMaxOpenConns(max(4, runtime.NumCPU()))
+
+		err = readDB.Ping()
+		if err != nil {
+			return nil, fmt.Errorf("ping read db: %w", err)
+		}
+	}
+
+	return newDatabase(db, readDB, false), nil
+}
+
+func newDatabase(db, readDB *sql.DB, postgres bool) *Database {
+	d := &Database{
+		db:           db,
+		readDB:       readDB,
+		writeStmts:   newStmtCache(db),
+		postgres:     postgres,
+		readTimeout:  DefaultReadTimeout,
+		writeTimeout: DefaultWriteTimeout,
+	}
+	d.readStmts = d.writeStmts
+	if readDB != db {
+		d.readStmts = newStmtCache(readDB)
+	}
+	return d
+}
+
+// sqliteDSN adds the pragmas every connection needs to the path of a sqlite database. WAL mode lets the
+// feed be read while the consumer is writing to it
+func sqliteDSN(dbPath string, readOnly bool) string {
+	params := url.Values{}
+	params.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", busyTimeout.Milliseconds()))
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", "synchronous(NORMAL)")
+	if readOnly {
+		params.Add("_pragma", "query_only(1)")
+	} else {
+		// take the write lock when a transaction starts so that it can't fail part way through
+		params.Set("_txlock", "immediate")
+	}
+	return dbPath + "?" + params.Encode()
 }
 
 // Close will cleanly stop the database connection
 func (d *Database) Close() {
+	d.writeStmts.close()
+	if d.readDB != d.db {
+		d.readStmts.close()
+		err := d.readDB.Close()
+		if err != nil {
+			slog.Error("failed to close read db", "error", err)
+		}
+	}
+
 	err := d.db.Close()
 	if err != nil {
 		slog.Error("failed to close db", "error", err)
@@ -92,10 +199,295 @@ func createPostsTable(db *sql.DB) error {
 	return nil
 }
 
+func createRejectionsTable(db *sql.DB) error {
+	createTableSQL := `CREATE TABLE IF NOT EXISTS rejections (
+		"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"postURI" TEXT NOT NULL,
+		"authorDID" TEXT NOT NULL,
+		"reason" TEXT NOT NULL,
+		"text" TEXT,
+		"createdAt" integer NOT NULL
+	  );`
+
+	slog.Info("Create rejections table...")
+	statement, err := db.Prepare(createTableSQL)
+	if err != nil {
+		return fmt.Errorf("prepare DB statement to create rejections table: %w", err)
+	}
+	_, err = statement.Exec()
+	if err != nil {
+		return fmt.Errorf("exec sql statement to create rejections table: %w", err)
+	}
+	slog.Info("rejections table created")
+
+	return nil
+}
+
+// migrations are applied in order to bring an existing database up to date with the latest schema.
+// The number of migrations applied is stored in the database's user_version
+var migrations = [][]string{
+	{
+		`ALTER TABLE posts ADD COLUMN "userDID" TEXT NOT NULL DEFAULT '';`,
+		// posts stored before the userDID column existed can have it taken from their at:// URI
+		`UPDATE posts SET userDID = substr(postURI, 6, instr(substr(postURI, 6), '/') - 1) WHERE postURI LIKE 'at://%/%';`,
+		`CREATE INDEX IF NOT EXISTS posts_userDID ON posts (userDID);`,
+		`CREATE TABLE IF NOT EXISTS hidden (
+			"subject" TEXT NOT NULL,
+			"reason" TEXT NOT NULL,
+			"createdAt" integer NOT NULL,
+			PRIMARY KEY (subject, reason)
+		);`,
+		`CREATE TABLE IF NOT EXISTS cursors (
+			"name" TEXT NOT NULL PRIMARY KEY,
+			"value" integer NOT NULL
+		);`,
+	},
+	{
+		`CREATE TABLE IF NOT EXISTS lists (
+			"key" TEXT NOT NULL PRIMARY KEY,
+			"uri" TEXT NOT NULL,
+			"refreshedAt" integer NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS list_members (
+			"listKey" TEXT NOT NULL,
+			"rkey" TEXT NOT NULL,
+			"did" TEXT NOT NULL,
+			PRIMARY KEY (listKey, rkey)
+		);`,
+	},
+	{
+		`CREATE TABLE IF NOT EXISTS authors (
+			"did" TEXT NOT NULL PRIMARY KEY,
+			"status" TEXT NOT NULL DEFAULT 'active',
+			"handle" TEXT NOT NULL DEFAULT '',
+			"updatedAt" integer NOT NULL
+		);`,
+	},
+	{
+		// every post deleted on the network is looked up by its URI
+		`CREATE INDEX IF NOT EXISTS posts_postURI ON posts (postURI);`,
+	},
+	{
+		`ALTER TABLE posts ADD COLUMN "replyRoot" TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE posts ADD COLUMN "replyParent" TEXT NOT NULL DEFAULT '';`,
+		`CREATE INDEX IF NOT EXISTS posts_replyRoot ON posts (replyRoot);`,
+	},
+	{
+		`CREATE TABLE IF NOT EXISTS reposts (
+			"repostURI" TEXT NOT NULL PRIMARY KEY,
+			"postURI" TEXT NOT NULL,
+			"userDID" TEXT NOT NULL,
+			"createdAt" integer NOT NULL
+		);`,
+		`CREATE INDEX IF NOT EXISTS reposts_createdAt ON reposts (createdAt);`,
+	},
+	{
+		`CREATE TABLE IF NOT EXISTS pins (
+			"postURI" TEXT NOT NULL,
+			"userDID" TEXT NOT NULL,
+			"feed" TEXT NOT NULL DEFAULT '',
+			"createdAt" integer NOT NULL,
+			"expiresAt" integer NOT NULL DEFAULT 0,
+			PRIMARY KEY (postURI, feed)
+		);`,
+	},
+	{
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+			"actor" TEXT NOT NULL,
+			"action" TEXT NOT NULL,
+			"subject" TEXT NOT NULL,
+			"detail" TEXT NOT NULL DEFAULT '',
+			"createdAt" integer NOT NULL
+		);`,
+		`CREATE INDEX IF NOT EXISTS rejections_authorDID ON rejections (authorDID);`,
+	},
+	{
+		// pending posts are looked up by reason rather than subject
+		`CREATE INDEX IF NOT EXISTS hidden_reason ON hidden (reason);`,
+	},
+	{
+		// lets the feed be read newest first without sorting every post
+		`CREATE INDEX IF NOT EXISTS posts_createdAt ON posts (createdAt);`,
+	},
+	{
+		// lists are stored as JSON arrays
+		`ALTER TABLE posts ADD COLUMN "text" TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE posts ADD COLUMN "langs" TEXT NOT NULL DEFAULT '[]';`,
+		`ALTER TABLE posts ADD COLUMN "embedType" TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE posts ADD COLUMN "linkDomains" TEXT NOT NULL DEFAULT '[]';`,
+		`ALTER TABLE posts ADD COLUMN "hashtags" TEXT NOT NULL DEFAULT '[]';`,
+		`ALTER TABLE posts ADD COLUMN "hasMedia" integer NOT NULL DEFAULT 0;`,
+		`ALTER TABLE posts ADD COLUMN "indexedAt" integer NOT NULL DEFAULT 0;`,
+	},
+	{
+		// the full-text index reads the text from the posts table and is kept up to date by triggers
+		`CREATE VIRTUAL TABLE IF NOT EXISTS posts_fts USING fts5(text, content='posts', content_rowid='id');`,
+		`CREATE TRIGGER IF NOT EXISTS posts_fts_insert AFTER INSERT ON posts BEGIN
+			INSERT INTO posts_fts (rowid, text) VALUES (new.id, new.text);
+		END;`,
+		`CREATE TRIGGER IF NOT EXISTS posts_fts_delete AFTER DELETE ON posts BEGIN
+			INSERT INTO posts_fts (posts_fts, rowid, text) VALUES ('delete', old.id, old.text);
+		END;`,
+		`CREATE TRIGGER IF NOT EXISTS posts_fts_update AFTER UPDATE OF text ON posts BEGIN
+			INSERT INTO posts_fts (posts_fts, rowid, text) VALUES ('delete', old.id, old.text);
+			INSERT INTO posts_fts (rowid, text) VALUES (new.id, new.text);
+		END;`,
+		`INSERT INTO posts_fts (posts_fts) VALUES ('rebuild');`,
+	},
+	{
+		`CREATE TABLE IF NOT EXISTS curated (
+			"postURI" TEXT NOT NULL PRIMARY KEY,
+			"createdAt" integer NOT NULL
+		);`,
+	},
+	{
+		// record keys are only unique within a repo so posts are unique by their URI. sqlite can't drop a
+		// constraint so the table is rebuilt, keeping the IDs that the full-text index refers to
+		`CREATE TABLE posts_new (
+			"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+			"postRKey" TEXT,
+			"postURI" TEXT,
+			"createdAt" integer NOT NULL,
+			"userDID" TEXT NOT NULL DEFAULT '',
+			"replyRoot" TEXT NOT NULL DEFAULT '',
+			"replyParent" TEXT NOT NULL DEFAULT '',
+			"text" TEXT NOT NULL DEFAULT '',
+			"langs" TEXT NOT NULL DEFAULT '[]',
+			"embedType" TEXT NOT NULL DEFAULT '',
+			"linkDomains" TEXT NOT NULL DEFAULT '[]',
+			"hashtags" TEXT NOT NULL DEFAULT '[]',
+			"hasMedia" integer NOT NULL DEFAULT 0,
+			"indexedAt" integer NOT NULL DEFAULT 0,
+			UNIQUE(postURI)
+		);`,
+		`INSERT OR IGNORE INTO posts_new (id, postRKey, postURI, createdAt, userDID, replyRoot, replyParent,
+			text, langs, embedType, linkDomains, hashtags, hasMedia, indexedAt)
+			SELECT id, postRKey, postURI, createdAt, userDID, replyRoot, replyParent,
+			text, langs, embedType, linkDomains, hashtags, hasMedia, indexedAt FROM posts ORDER BY id;`,
+		`DROP TABLE posts;`,
+		`ALTER TABLE posts_new RENAME TO posts;`,
+		`CREATE INDEX IF NOT EXISTS posts_userDID ON posts (userDID);`,
+		`CREATE INDEX IF NOT EXISTS posts_replyRoot ON posts (replyRoot);`,
+		`CREATE INDEX IF NOT EXISTS posts_createdAt ON posts (createdAt);`,
+		`CREATE TRIGGER IF NOT EXISTS posts_fts_insert AFTER INSERT ON posts BEGIN
+			INSERT INTO posts_fts (rowid, text) VALUES (new.id, new.text);
+		END;`,
+		`CREATE TRIGGER IF NOT EXISTS posts_fts_delete AFTER DELETE ON posts BEGIN
+			INSERT INTO posts_fts (posts_fts, rowid, text) VALUES ('delete', old.id, old.text);
+		END;`,
+		`CREATE TRIGGER IF NOT EXISTS posts_fts_update AFTER UPDATE OF text ON posts BEGIN
+			INSERT INTO posts_fts (posts_fts, rowid, text) VALUES ('delete', old.id, old.text);
+			INSERT INTO posts_fts (rowid, text) VALUES (new.id, new.text);
+		END;`,
+		`INSERT INTO posts_fts (posts_fts) VALUES ('rebuild');`,
+	},
+}
+
+func migrate(db *sql.DB) error {
+	var version int
+	err := db.QueryRow(`PRAGMA user_version;`).Scan(&version)
+	if err != nil {
+		return fmt.Errorf("get schema version: %w", err)
+	}
+
+	for i := version; i < len(migrations); i++ {
+		slog.Info("applying database migration", "version", i+1)
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("begin migration %d: %w", i+1, err)
+		}
+		for _, statement := range migrations[i] {
+			_, err = tx.Exec(statement)
+			if err != nil {
+				_ = tx.Rollback()
+				return fmt.Errorf("exec migration %d: %w", i+1, err)
+			}
+		}
+		// PRAGMA statements can't take bound parameters
+		_, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d;`, i+1))
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("set schema version %d: %w", i+1, err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("commit migration %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// insertPostSQL stores a post. If the post is already stored it keeps its place in the feed but its
+// metadata is replaced, as long as the new version was stored from its record
+const insertPostSQL = `INSERT INTO posts (postRKey, postURI, userDID, replyRoot, replyParent, createdAt,
+		text, langs, embedType, linkDomains, hashtags, hasMedia, indexedAt)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(postURI) DO UPDATE SET text = excluded.text, langs = excluded.langs, embedType = excluded.embedType,
+		linkDomains = excluded.linkDomains, hashtags = excluded.hashtags, hasMedia = excluded.hasMedia
+		WHERE excluded.indexedAt > 0;`
+
+// insertPostArgs are the bind parameters for insertPostSQL
+func insertPostArgs(post server.Post) []interface{} {
+	return []interface{}{
+		post.RKey, post.PostURI, post.UserDID, post.ReplyRoot, post.ReplyParent, post.CreatedAt,
+		post.Text, encodeList(post.Langs), post.EmbedType, encodeList(post.LinkDomains), encodeList(post.Hashtags),
+		post.HasMedia, post.IndexedAt,
+	}
+}
+
+// postColumns are the columns of the posts table, aliased as p, that scanPost reads
+const postColumns = `p.id, p.postRKey, p.postURI, p.userDID, p.replyRoot, p.replyParent, p.createdAt,
+	p.text, p.langs, p.embedType, p.linkDomains, p.hashtags, p.hasMedia, p.indexedAt`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanPost reads the postColumns of a row into post, followed by any extra columns
+func scanPost(row rowScanner, post *server.Post, extra ...interface{}) error {
+	var langs, linkDomains, hashtags string
+	dest := []interface{}{
+		&post.ID, &post.RKey, &post.PostURI, &post.UserDID, &post.ReplyRoot, &post.ReplyParent, &post.CreatedAt,
+		&post.Text, &langs, &post.EmbedType, &linkDomains, &hashtags, &post.HasMedia, &post.IndexedAt,
+	}
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return err
+	}
+	post.Langs = decodeList(langs)
+	post.LinkDomains = decodeList(linkDomains)
+	post.Hashtags = decodeList(hashtags)
+	return nil
+}
+
+// encodeList encodes a list of strings to be stored in a column as a JSON array
+func encodeList(vals []string) string {
+	if len(vals) == 0 {
+		return "[]"
+	}
+	b, err := json.Marshal(vals)
+	if err != nil {
+		return "[]"
+	}
+	return string(b)
+}
+
+func decodeList(val string) []string {
+	var vals []string
+	if err := json.Unmarshal([]byte(val), &vals); err != nil || len(vals) == 0 {
+		return nil
+	}
+	return vals
+}
+
 // CreatePost will insert a post into a database
-func (d *Database) CreatePost(post server.Post) error {
-	sql := `INSERT INTO posts (postRKey, postURI, createdAt) VALUES (?, ?, ?) ON CONFLICT(postRKey) DO NOTHING;`
-	_, err := d.db.Exec(sql, post.RKey, post.PostURI, post.CreatedAt)
+func (d *Database) CreatePost(ctx context.Context, post server.Post) error {
+	ctx, cancel := d.writeContext(ctx)
+	defer cancel()
+
+	_, err := d.exec(ctx, insertPostSQL, insertPostArgs(post)...)
 	if err != nil {
 		return fmt.Errorf("exec insert post: %w", err)
 	}
@@ -103,11 +495,90 @@ func (d *Database) CreatePost(post server.Post) error {
 }
 
 // GetFeedPosts return a slice of posts
-func (d *Database) GetFeedPosts(cursor, limit int) ([]server.Post, error) {
-	sql := `SELECT id, postRKey, postURI, createdAt FROM posts
-			WHERE createdAt < ?
-			ORDER BY createdAt DESC LIMIT ?;`
-	rows, err := d.db.Query(sql, cursor, limit)
+func (d *Database) GetFeedPosts(ctx context.Context, query server.FeedQuery) ([]server.Post, error) {
+	ctx, cancel := d.readContext(ctx)
+	defer cancel()
+
+	posts := make([]server.Post, 0)
+	if query.OnlyUsers != nil && len(query.OnlyUsers) == 0 {
+		return posts, nil
+	}
+
+	scoreArgs := make([]interface{}, 0)
+	score := `p.createdAt`
+	if (len(query.BoostUsers) > 0 || len(query.BoostLists) > 0) && query.Boost > 0 {
+		boosted := make([]string, 0, 2)
+		if len(query.BoostUsers) > 0 {
+			boosted = append(boosted, `p.userDID IN (`+placeholders(len(query.BoostUsers))+`)`)
+			scoreArgs = append(scoreArgs, stringArgs(query.BoostUsers)...)
+		}
+		if len(query.BoostLists) > 0 {
+			boosted = append(boosted, `p.userDID IN (`+listMembersSQL(len(query.BoostLists))+`)`)
+			scoreArgs = append(scoreArgs, stringArgs(query.BoostLists)...)
+		}
+		score = `p.createdAt + CASE WHEN ` + strings.Join(boosted, ` OR `) + ` THEN CAST(? AS BIGINT) ELSE 0 END`
+		scoreArgs = append(scoreArgs, query.Boost)
+	}
+
+	filters, filterArgs, err := d.postFilters(query.ExcludeUsers, query.OnlyUsers, query.ExcludeLists, query.OnlyLists, query.RootsOnly, query.Search)
+	if err != nil {
+		return nil, err
+	}
+	if query.OnlyIDs != nil {
+		if len(query.OnlyIDs) == 0 {
+			return posts, nil
+		}
+		filters += ` AND p.id IN (` + placeholders(len(query.OnlyIDs)) + `)`
+		for _, id := range query.OnlyIDs {
+			filterArgs = append(filterArgs, id)
+		}
+	}
+
+	// posts with the same score are ordered by their ID so that the cursor can carry on from between them
+	before := func(score string) string {
+		if query.CursorID > 0 {
+			return `(` + score + `, p.id) < (?, ?)`
+		}
+		return score + ` < ?`
+	}
+	cursorArgs := []interface{}{query.Cursor}
+	if query.CursorID > 0 {
+		cursorArgs = append(cursorArgs, query.CursorID)
+	}
+
+	// each part of the feed is limited on its own so that the posts and reposts can be read newest first
+	// from their createdAt indexes rather than sorting everything older than the cursor
+	feed := `SELECT * FROM (
+				SELECT ` + postColumns + `, ` + score + ` AS score, '' AS repostURI FROM posts AS p
+				WHERE ` + filters + ` AND ` + before(score) + ` ORDER BY score DESC, p.id DESC LIMIT ?
+			) AS posts`
+	args := append(scoreArgs, filterArgs...)
+	args = append(args, scoreArgs...)
+	args = append(args, cursorArgs...)
+	args = append(args, query.Limit)
+	if query.IncludeReposts {
+		// reposts are placed in the feed at the time they were reposted
+		feed += ` UNION ALL
+			SELECT * FROM (
+				SELECT ` + postColumns + `, r.createdAt AS score, r.repostURI AS repostURI FROM reposts AS r
+				JOIN posts AS p ON p.postURI = r.postURI
+				WHERE ` + filters + ` AND ` + before(`r.createdAt`) + ` ORDER BY r.createdAt DESC, p.id DESC LIMIT ?
+			) AS reposts`
+		args = append(args, filterArgs...)
+		args = append(args, cursorArgs...)
+		args = append(args, query.Limit)
+	}
+	args = append(args, query.Limit)
+
+	sql := `SELECT * FROM (
+				` + feed + `
+			) AS feed
+			ORDER BY score DESC, id DESC LIMIT ?;`
+	run := d.query
+	if hasUserLists(query.ExcludeUsers, query.OnlyUsers) || len(query.BoostUsers) > 0 || query.OnlyIDs != nil {
+		run = d.queryUnprepared
+	}
+	rows, err := run(ctx, sql, args...)
 	if err != nil {
 		return nil, fmt.Errorf("run query to get feed posts: %w", err)
 	}
@@ -115,10 +586,9 @@ func (d *Database) GetFeedPosts(cursor, limit int) ([]server.Post, error) {
 		_ = rows.Close()
 	}()
 
-	posts := make([]server.Post, 0)
 	for rows.Next() {
 		var post server.Post
-		if err := rows.Scan(&post.ID, &post.RKey, &post.PostURI, &post.CreatedAt); err != nil {
+		if err := scanPost(rows, &post, &post.Score, &post.RepostURI); err != nil {
 			return nil, fmt.Errorf("scan row: %w", err)
 		}
 		posts = append(posts, post)
@@ -127,16 +597,801 @@ func (d *Database) GetFeedPosts(cursor, limit int) ([]server.Post, error) {
 	return posts, nil
 }
 
-func (d *Database) DeletePostsFromURIs(uris []string) error {
+// hasUserLists reports whether postFilters adds IN clauses for the users, in which case the query shouldn't
+// be prepared
+func hasUserLists(excludeUsers, onlyUsers []string) bool {
+	return len(excludeUsers) > 0 || onlyUsers != nil
+}
+
+// postFilters returns the conditions on the posts table, aliased as p, that leave out hidden posts and
+// apply the filters shared by feeds and exports. The members of the lists are read from list_members
+func (d *Database) postFilters(excludeUsers, onlyUsers, excludeLists, onlyLists []string, rootsOnly bool, searchQuery string) (string, []interface{}, error) {
+	filters := `p.postURI NOT IN (SELECT subject FROM hidden) AND p.userDID NOT IN (SELECT subject FROM hidden)`
+	args := make([]interface{}, 0)
+	if len(excludeUsers) > 0 {
+		filters += ` AND p.userDID NOT IN (` + placeholders(len(excludeUsers)) + `)`
+		args = append(args, stringArgs(excludeUsers)...)
+	}
+	if onlyUsers != nil {
+		filters += ` AND p.userDID IN (` + placeholders(len(onlyUsers)) + `)`
+		args = append(args, stringArgs(onlyUsers)...)
+	}
+	if len(excludeLists) > 0 {
+		filters += ` AND p.userDID NOT IN (` + listMembersSQL(len(excludeLists)) + `)`
+		args = append(args, stringArgs(excludeLists)...)
+	}
+	if len(onlyLists) > 0 {
+		filters += ` AND p.userDID IN (` + listMembersSQL(len(onlyLists)) + `)`
+		args = append(args, stringArgs(onlyLists)...)
+	}
+	if rootsOnly {
+		filters += ` AND p.replyRoot = ''`
+	}
+	if searchQuery != "" {
+		parsed, err := search.Parse(searchQuery)
+		if err != nil {
+			return "", nil, fmt.Errorf("parse search: %w", err)
+		}
+		if d.postgres {
+			filters += ` AND to_tsvector('simple', p.text) @@ to_tsquery('simple', ?)`
+			args = append(args, parsed.TSQuery())
+		} else {
+			filters += ` AND p.id IN (SELECT rowid FROM posts_fts WHERE posts_fts MATCH ?)`
+			args = append(args, parsed.FTS5())
+		}
+	}
+	return filters, args, nil
+}
+
+func (d *Database) DeletePostsFromURIs(ctx context.Context, uris []string) error {
+	ctx, cancel := d.writeContext(ctx)
+	defer cancel()
+
 	sql := `DELETE FROM posts WHERE postURI IN (?` + strings.Repeat(",?", len(uris)-1) + `);`
 	args := make([]interface{}, len(uris))
 	for i, uri := range uris {
 		args[i] = uri
 	}
 
-	_, err := d.db.Exec(sql, args...)
+	_, err := d.execUnprepared(ctx, sql, args...)
 	if err != nil {
 		return fmt.Errorf("exec delete posts: %w", err)
 	}
 	return nil
 }
+
+// CreateRejection will record a post that was rejected from the feed and why
+func (d *Database) CreateRejection(ctx context.Context, rejection server.Rejection) error {
+	ctx, cancel := d.writeContext(ctx)
+	defer cancel()
+
+	sql := `INSERT INTO rejections (postURI, authorDID, reason, text, createdAt) VALUES (?, ?, ?, ?, ?);`
+	_, err := d.exec(ctx, sql, rejection.PostURI, rejection.AuthorDID, rejection.Reason, rejection.Text, rejection.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("exec insert rejection: %w", err)
+	}
+	return nil
+}
+
+// DeletePostsFromUsers will delete all posts made by the given users
+func (d *Database) DeletePostsFromUsers(ctx context.Context, dids []string) error {
+	ctx, cancel := d.writeContext(ctx)
+	defer cancel()
+
+	if len(dids) == 0 {
+		return nil
+	}
+	sql := `DELETE FROM posts WHERE userDID IN (` + placeholders(len(dids)) + `);`
+	_, err := d.execUnprepared(ctx, sql, stringArgs(dids)...)
+	if err != nil {
+		return fmt.Errorf("exec delete user posts: %w", err)
+	}
+	return nil
+}
+
+// DeleteUnprotectedPosts will delete a post URI or every post from a user DID apart from posts that are
+// pinned or were added by a curator or an admin
+func (d *Database) DeleteUnprotectedPosts(ctx context.Context, subject string) error {
+	ctx, cancel := d.writeContext(ctx)
+	defer cancel()
+
+	sql := `DELETE FROM posts WHERE (postURI = ? OR userDID = ?)
+		AND postURI NOT IN (SELECT postURI FROM pins)
+		AND postURI NOT IN (SELECT postURI FROM curated);`
+	_, err := d.exec(ctx, sql, subject, subject)
+	if err != nil {
+		return fmt.Errorf("exec delete unprotected posts: %w", err)
+	}
+	return nil
+}
+
+// MarkCurated records that a post was added to the feed by a curator or an admin
+func (d *Database) MarkCurated(ctx context.Context, postURI string) error {
+	ctx, cancel := d.writeContext(ctx)
+	defer cancel()
+
+	sql := `INSERT INTO curated (postURI, createdAt) VALUES (?, ?) ON CONFLICT(postURI) DO NOTHING;`
+	_, err := d.exec(ctx, sql, postURI, time.Now().UnixMilli())
+	if err != nil {
+		return fmt.Errorf("exec insert curated post: %w", err)
+	}
+	return nil
+}
+
+// GetPrunablePosts returns the posts outside the retention policy, oldest first
+func (d *Database) GetPrunablePosts(ctx context.Context, query server.PruneQuery) ([]server.Post, error) {
+	ctx, cancel := d.readContext(ctx)
+	defer cancel()
+
+	posts := make([]server.Post, 0)
+	if query.Before <= 0 {
+		return posts, nil
+	}
+
+	sql := `SELECT ` + postColumns + ` FROM posts AS p
+			WHERE p.createdAt < ? ORDER BY p.createdAt ASC, p.id ASC LIMIT ? OFFSET ?;`
+	rows, err := d.query(ctx, sql, query.Before, query.Limit, query.Offset)
+	if err != nil {
+		return nil, fmt.Errorf("run query to get prunable posts: %w", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	for rows.Next() {
+		var post server.Post
+		if err := scanPost(rows, &post); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		post.Score = post.CreatedAt
+		posts = append(posts, post)
+	}
+	return posts, nil
+}
+
+// GetExportPosts returns a page of the posts to export in the order they were stored
+func (d *Database) GetExportPosts(ctx context.Context, query server.ExportQuery) ([]server.Post, error) {
+	ctx, cancel := d.readContext(ctx)
+	defer cancel()
+
+	posts := make([]server.Post, 0)
+	if query.OnlyUsers != nil && len(query.OnlyUsers) == 0 {
+		return posts, nil
+	}
+
+	filters, args, err := d.postFilters(query.ExcludeUsers, query.OnlyUsers, query.ExcludeLists, query.OnlyLists, query.RootsOnly, query.Search)
+	if err != nil {
+		return nil, err
+	}
+	filters += ` AND p.id > ?`
+	args = append(args, query.AfterID)
+	if query.Since > 0 {
+		filters += ` AND p.createdAt >= ?`
+		args = append(args, query.Since)
+	}
+	if query.Until > 0 {
+		filters += ` AND p.createdAt < ?`
+		args = append(args, query.Until)
+	}
+	args = append(args, query.Limit)
+
+	sql := `SELECT ` + postColumns + ` FROM posts AS p
+			WHERE ` + filters + ` ORDER BY p.id ASC LIMIT ?;`
+	run := d.query
+	if hasUserLists(query.ExcludeUsers, query.OnlyUsers) {
+		run = d.queryUnprepared
+	}
+	rows, err := run(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("run query to get export posts: %w", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	for rows.Next() {
+		var post server.Post
+		if err := scanPost(rows, &post); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		post.Score = post.CreatedAt
+		posts = append(posts, post)
+	}
+	return posts, nil
+}
+
+// ApplyWrites applies a batch of writes in order in a single transaction, along with the batch's cursor
+func (d *Database) ApplyWrites(ctx context.Context, batch server.WriteBatch) error {
+	ctx, cancel := d.writeContext(ctx)
+	defer cancel()
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	for i, write := range batch.Writes {
+		switch write.Kind {
+		case server.WriteCreatePost:
+			_, err = tx.ExecContext(ctx, d.rebind(insertPostSQL), insertPostArgs(write.Post)...)
+		case server.WriteDeletePosts:
+			if len(write.Subjects) == 0 {
+				continue
+			}
+			_, err = tx.ExecContext(ctx, d.rebind(`DELETE FROM posts WHERE postURI IN (`+placeholders(len(write.Subjects))+`);`), stringArgs(write.Subjects)...)
+		case server.WriteDeleteUserPosts:
+			if len(write.Subjects) == 0 {
+				continue
+			}
+			_, err = tx.ExecContext(ctx, d.rebind(`DELETE FROM posts WHERE userDID IN (`+placeholders(len(write.Subjects))+`);`), stringArgs(write.Subjects)...)
+		default:
+			err = fmt.Errorf("unknown write kind %d", write.Kind)
+		}
+		if err != nil {
+			return &server.WriteError{Index: i, Err: fmt.Errorf("exec write: %w", err)}
+		}
+	}
+
+	if batch.CursorName != "" {
+		_, err = tx.ExecContext(ctx, d.rebind(`INSERT INTO cursors (name, value) VALUES (?, ?) ON CONFLICT(name) DO UPDATE SET value = excluded.value;`),
+			batch.CursorName, batch.Cursor)
+		if err != nil {
+			return fmt.Errorf("exec upsert cursor: %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
+
+// HideSubject will hide a post URI or every post from a user DID from the feed for the given reason.
+// The subject stays hidden until every reason it was hidden for has been removed
+func (d *Database) HideSubject(ctx context.Context, subject, reason string) error {
+	ctx, cancel := d.writeContext(ctx)
+	defer cancel()
+
+	sql := `INSERT INTO hidden (subject, reason, createdAt) VALUES (?, ?, ?) ON CONFLICT(subject, reason) DO NOTHING;`
+	_, err := d.exec(ctx, sql, subject, reason, time.Now().UnixMilli())
+	if err != nil {
+		return fmt.Errorf("exec insert hidden subject: %w", err)
+	}
+	return nil
+}
+
+// UnhideSubject will remove a reason a subject was hidden for
+func (d *Database) UnhideSubject(ctx context.Context, subject, reason string) error {
+	ctx, cancel := d.writeContext(ctx)
+	defer cancel()
+
+	sql := `DELETE FROM hidden WHERE subject = ? AND reason = ?;`
+	_, err := d.exec(ctx, sql, subject, reason)
+	if err != nil {
+		return fmt.Errorf("exec delete hidden subject: %w", err)
+	}
+	return nil
+}
+
+// IsHidden reports whether a subject is hidden for the given reason
+func (d *Database) IsHidden(ctx context.Context, subject, reason string) (bool, error) {
+	ctx, cancel := d.readContext(ctx)
+	defer cancel()
+
+	var hidden bool
+	err := d.queryRow(ctx, `SELECT EXISTS (SELECT 1 FROM hidden WHERE subject = ? AND reason = ?);`, subject, reason).Scan(&hidden)
+	if err != nil {
+		return false, fmt.Errorf("query hidden subject: %w", err)
+	}
+	return hidden, nil
+}
+
+// GetCursor returns the stored value of a named stream cursor or 0 if one hasn't been stored
+func (d *Database) GetCursor(ctx context.Context, name string) (int64, error) {
+	ctx, cancel := d.readContext(ctx)
+	defer cancel()
+
+	var value int64
+	err := d.queryRow(ctx, `SELECT value FROM cursors WHERE name = ?;`, name).Scan(&value)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("query cursor: %w", err)
+	}
+	return value, nil
+}
+
+// SetCursor stores the value of a named stream cursor
+func (d *Database) SetCursor(ctx context.Context, name string, value int64) error {
+	ctx, cancel := d.writeContext(ctx)
+	defer cancel()
+
+	sql := `INSERT INTO cursors (name, value) VALUES (?, ?) ON CONFLICT(name) DO UPDATE SET value = excluded.value;`
+	_, err := d.exec(ctx, sql, name, value)
+	if err != nil {
+		return fmt.Errorf("exec upsert cursor: %w", err)
+	}
+	return nil
+}
+
+func (d *Database) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	query = d.rebind(query)
+	if stmt := d.writeStmts.get(ctx, query); stmt != nil {
+		return stmt.ExecContext(ctx, args...)
+	}
+	return d.db.ExecContext(ctx, query, args...)
+}
+
+// execUnprepared runs a write without preparing it. Queries with IN clauses are different for every number
+// of values so preparing them would fill the statement cache with statements that are rarely used again
+func (d *Database) execUnprepared(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return d.db.ExecContext(ctx, d.rebind(query), args...)
+}
+
+func (d *Database) query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	query = d.rebind(query)
+	if stmt := d.readStmts.get(ctx, query); stmt != nil {
+		return stmt.QueryContext(ctx, args...)
+	}
+	return d.readDB.QueryContext(ctx, query, args...)
+}
+
+// queryUnprepared runs a query without preparing it, see execUnprepared
+func (d *Database) queryUnprepared(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return d.readDB.QueryContext(ctx, d.rebind(query), args...)
+}
+
+func (d *Database) queryRow(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	query = d.rebind(query)
+	if stmt := d.readStmts.get(ctx, query); stmt != nil {
+		return stmt.QueryRowContext(ctx, args...)
+	}
+	return d.readDB.QueryRowContext(ctx, query, args...)
+}
+
+// readContext limits how long a query can run for so that it stops once whoever asked for it is
+// unlikely to still be waiting
+func (d *Database) readContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, d.readTimeout)
+}
+
+// writeContext limits how long a write can run for
+func (d *Database) writeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, d.writeTimeout)
+}
+
+// rebind replaces the ? bind parameters in a query with the numbered parameters postgres uses. Question
+// marks inside string literals are left alone
+func (d *Database) rebind(query string) string {
+	if !d.postgres || !strings.Contains(query, "?") {
+		return query
+	}
+
+	var b strings.Builder
+	b.Grow(len(query) + 16)
+	n := 0
+	inString := false
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			inString = !inString
+		case c == '?' && !inString:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// placeholders returns n comma separated bind parameters for use in an IN clause
+// listMembersSQL returns a query for the members of n stored lists, whose keys are its arguments
+func listMembersSQL(n int) string {
+	return `SELECT did FROM list_members WHERE listKey IN (` + placeholders(n) + `)`
+}
+
+func placeholders(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return "?" + strings.Repeat(",?", n-1)
+}
+
+func stringArgs(vals []string) []interface{} {
+	args := make([]interface{}, len(vals))
+	for i, val := range vals {
+		args[i] = val
+	}
+	return args
+}
+
+// GetList returns the last stored state of a list. If the list has never been stored then only the key is set
+func (d *Database) GetList(ctx context.Context, key string) (server.StoredList, error) {
+	ctx, cancel := d.readContext(ctx)
+	defer cancel()
+
+	list := server.StoredList{
+		Key:     key,
+		Members: make([]server.ListMember, 0),
+	}
+
+	err := d.queryRow(ctx, `SELECT uri, refreshedAt FROM lists WHERE key = ?;`, key).Scan(&list.URI, &list.RefreshedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return list, nil
+		}
+		return list, fmt.Errorf("query list: %w", err)
+	}
+
+	rows, err := d.query(ctx, `SELECT rkey, did FROM list_members WHERE listKey = ?;`, key)
+	if err != nil {
+		return list, fmt.Errorf("query list members: %w", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	for rows.Next() {
+		var member server.ListMember
+		if err := rows.Scan(&member.RKey, &member.DID); err != nil {
+			return list, fmt.Errorf("scan row: %w", err)
+		}
+		list.Members = append(list.Members, member)
+	}
+
+	return list, nil
+}
+
+// ReplaceList stores the full state of a list, replacing whatever was stored before
+func (d *Database) ReplaceList(ctx context.Context, list server.StoredList) error {
+	ctx, cancel := d.writeContext(ctx)
+	defer cancel()
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	_, err = tx.ExecContext(ctx, d.rebind(`INSERT INTO lists (key, uri, refreshedAt) VALUES (?, ?, ?)
+		ON CONFLICT(key) DO UPDATE SET uri = excluded.uri, refreshedAt = excluded.refreshedAt;`), list.Key, list.URI, list.RefreshedAt)
+	if err != nil {
+		return fmt.Errorf("exec upsert list: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, d.rebind(`DELETE FROM list_members WHERE listKey = ?;`), list.Key)
+	if err != nil {
+		return fmt.Errorf("exec delete list members: %w", err)
+	}
+
+	for _, member := range list.Members {
+		_, err = tx.ExecContext(ctx, d.rebind(`INSERT INTO list_members (listKey, rkey, did) VALUES (?, ?, ?) ON CONFLICT(listKey, rkey) DO NOTHING;`),
+			list.Key, member.RKey, member.DID)
+		if err != nil {
+			return fmt.Errorf("exec insert list member: %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
+
+// AddListMember stores a single member that has been added to a list
+func (d *Database) AddListMember(ctx context.Context, key string, member server.ListMember) error {
+	ctx, cancel := d.writeContext(ctx)
+	defer cancel()
+
+	sql := `INSERT INTO list_members (listKey, rkey, did) VALUES (?, ?, ?) ON CONFLICT(listKey, rkey) DO UPDATE SET did = excluded.did;`
+	_, err := d.exec(ctx, sql, key, member.RKey, member.DID)
+	if err != nil {
+		return fmt.Errorf("exec insert list member: %w", err)
+	}
+	return nil
+}
+
+// RemoveListMember removes the member that was added to a list by the listitem with the given rkey
+func (d *Database) RemoveListMember(ctx context.Context, key, rkey string) error {
+	ctx, cancel := d.writeContext(ctx)
+	defer cancel()
+
+	sql := `DELETE FROM list_members WHERE listKey = ? AND rkey = ?;`
+	_, err := d.exec(ctx, sql, key, rkey)
+	if err != nil {
+		return fmt.Errorf("exec delete list member: %w", err)
+	}
+	return nil
+}
+
+// IsKnownAuthor reports whether the user has any stored posts or has had their status recorded
+func (d *Database) IsKnownAuthor(ctx context.Context, did string) (bool, error) {
+	ctx, cancel := d.readContext(ctx)
+	defer cancel()
+
+	sql := `SELECT EXISTS (SELECT 1 FROM posts WHERE userDID = ?) OR EXISTS (SELECT 1 FROM authors WHERE did = ?);`
+	var known bool
+	err := d.queryRow(ctx, sql, did, did).Scan(&known)
+	if err != nil {
+		return false, fmt.Errorf("query known author: %w", err)
+	}
+	return known, nil
+}
+
+// SetAuthorStatus records the account status of an author
+func (d *Database) SetAuthorStatus(ctx context.Context, did, status string) error {
+	ctx, cancel := d.writeContext(ctx)
+	defer cancel()
+
+	sql := `INSERT INTO authors (did, status, updatedAt) VALUES (?, ?, ?)
+			ON CONFLICT(did) DO UPDATE SET status = excluded.status, updatedAt = excluded.updatedAt;`
+	_, err := d.exec(ctx, sql, did, status, time.Now().UnixMilli())
+	if err != nil {
+		return fmt.Errorf("exec upsert author status: %w", err)
+	}
+	return nil
+}
+
+// SetAuthorHandle records the current handle of an author
+func (d *Database) SetAuthorHandle(ctx context.Context, did, handle string) error {
+	ctx, cancel := d.writeContext(ctx)
+	defer cancel()
+
+	sql := `INSERT INTO authors (did, handle, updatedAt) VALUES (?, ?, ?)
+			ON CONFLICT(did) DO UPDATE SET handle = excluded.handle, updatedAt = excluded.updatedAt;`
+	_, err := d.exec(ctx, sql, did, handle, time.Now().UnixMilli())
+	if err != nil {
+		return fmt.Errorf("exec upsert author handle: %w", err)
+	}
+	return nil
+}
+
+// IsThreadStored reports whether the post at the root of a thread, or any reply in the thread, is stored
+func (d *Database) IsThreadStored(ctx context.Context, rootURI string) (bool, error) {
+	ctx, cancel := d.readContext(ctx)
+	defer cancel()
+
+	sql := `SELECT EXISTS (SELECT 1 FROM posts WHERE postURI = ?) OR EXISTS (SELECT 1 FROM posts WHERE replyRoot = ?);`
+	var stored bool
+	err := d.queryRow(ctx, sql, rootURI, rootURI).Scan(&stored)
+	if err != nil {
+		return false, fmt.Errorf("query thread stored: %w", err)
+	}
+	return stored, nil
+}
+
+// IsPostStored reports whether a post is stored
+func (d *Database) IsPostStored(ctx context.Context, uri string) (bool, error) {
+	ctx, cancel := d.readContext(ctx)
+	defer cancel()
+
+	var stored bool
+	err := d.queryRow(ctx, `SELECT EXISTS (SELECT 1 FROM posts WHERE postURI = ?);`, uri).Scan(&stored)
+	if err != nil {
+		return false, fmt.Errorf("query post stored: %w", err)
+	}
+	return stored, nil
+}
+
+// CreateRepost will insert a repost of a stored post into the database
+func (d *Database) CreateRepost(ctx context.Context, repost server.Repost) error {
+	ctx, cancel := d.writeContext(ctx)
+	defer cancel()
+
+	sql := `INSERT INTO reposts (repostURI, postURI, userDID, createdAt) VALUES (?, ?, ?, ?) ON CONFLICT(repostURI) DO NOTHING;`
+	_, err := d.exec(ctx, sql, repost.RepostURI, repost.PostURI, repost.UserDID, repost.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("exec insert repost: %w", err)
+	}
+	return nil
+}
+
+// DeleteRepost will delete a repost
+func (d *Database) DeleteRepost(ctx context.Context, repostURI string) error {
+	ctx, cancel := d.writeContext(ctx)
+	defer cancel()
+
+	_, err := d.exec(ctx, `DELETE FROM reposts WHERE repostURI = ?;`, repostURI)
+	if err != nil {
+		return fmt.Errorf("exec delete repost: %w", err)
+	}
+	return nil
+}
+
+// CreatePin will pin a post to a feed. Pinning a post that's already pinned to the feed replaces its expiry
+func (d *Database) CreatePin(ctx context.Context, pin server.Pin) error {
+	ctx, cancel := d.writeContext(ctx)
+	defer cancel()
+
+	sql := `INSERT INTO pins (postURI, userDID, feed, createdAt, expiresAt) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(postURI, feed) DO UPDATE SET expiresAt = excluded.expiresAt;`
+	_, err := d.exec(ctx, sql, pin.PostURI, pin.UserDID, pin.Feed, pin.CreatedAt, pin.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("exec upsert pin: %w", err)
+	}
+	return nil
+}
+
+// DeletePin will unpin a post from a feed
+func (d *Database) DeletePin(ctx context.Context, postURI, feed string) error {
+	ctx, cancel := d.writeContext(ctx)
+	defer cancel()
+
+	_, err := d.exec(ctx, `DELETE FROM pins WHERE postURI = ? AND feed = ?;`, postURI, feed)
+	if err != nil {
+		return fmt.Errorf("exec delete pin: %w", err)
+	}
+	return nil
+}
+
+// GetPins returns the pins that haven't expired for a feed, newest first. Pinned posts that have been
+// hidden are not returned
+func (d *Database) GetPins(ctx context.Context, feed string, now int64) ([]server.Pin, error) {
+	ctx, cancel := d.readContext(ctx)
+	defer cancel()
+
+	sql := `SELECT postURI, userDID, feed, createdAt, expiresAt FROM pins
+		WHERE (feed = ? OR feed = '') AND (expiresAt = 0 OR expiresAt > ?)
+		AND postURI NOT IN (SELECT subject FROM hidden) AND userDID NOT IN (SELECT subject FROM hidden)
+		ORDER BY createdAt DESC;`
+	return d.queryPins(ctx, sql, feed, now)
+}
+
+// GetAllPins returns every pin, newest first
+func (d *Database) GetAllPins(ctx context.Context) ([]server.Pin, error) {
+	ctx, cancel := d.readContext(ctx)
+	defer cancel()
+
+	return d.queryPins(ctx, `SELECT postURI, userDID, feed, createdAt, expiresAt FROM pins ORDER BY createdAt DESC;`)
+}
+
+func (d *Database) queryPins(ctx context.Context, sql string, args ...interface{}) ([]server.Pin, error) {
+	rows, err := d.query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("run query to get pins: %w", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	pins := make([]server.Pin, 0)
+	for rows.Next() {
+		var pin server.Pin
+		if err := rows.Scan(&pin.PostURI, &pin.UserDID, &pin.Feed, &pin.CreatedAt, &pin.ExpiresAt); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// GetRejections returns the rejected posts that match the query, newest first
+func (d *Database) GetRejections(ctx context.Context, query server.RejectionQuery) ([]server.Rejection, error) {
+	ctx, cancel := d.readContext(ctx)
+	defer cancel()
+
+	filters := `1 = 1`
+	args := make([]interface{}, 0)
+	if query.AuthorDID != "" {
+		filters += ` AND authorDID = ?`
+		args = append(args, query.AuthorDID)
+	}
+	if query.Before > 0 {
+		filters += ` AND id < ?`
+		args = append(args, query.Before)
+	}
+	args = append(args, query.Limit)
+
+	sql := `SELECT id, postURI, authorDID, reason, text, createdAt FROM rejections WHERE ` + filters + ` ORDER BY id DESC LIMIT ?;`
+	rows, err := d.query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("run query to get rejections: %w", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	rejections := make([]server.Rejection, 0)
+	for rows.Next() {
+		var rejection server.Rejection
+		var text *string
+		if err := rows.Scan(&rejection.ID, &rejection.PostURI, &rejection.AuthorDID, &rejection.Reason, &text, &rejection.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		if text != nil {
+			rejection.Text = *text
+		}
+		rejections = append(rejections, rejection)
+	}
+	return rejections, nil
+}
+
+// CreateAuditEntry will record an action taken by an admin
+func (d *Database) CreateAuditEntry(ctx context.Context, entry server.AuditEntry) error {
+	ctx, cancel := d.writeContext(ctx)
+	defer cancel()
+
+	sql := `INSERT INTO audit_log (actor, action, subject, detail, createdAt) VALUES (?, ?, ?, ?, ?);`
+	_, err := d.exec(ctx, sql, entry.Actor, entry.Action, entry.Subject, entry.Detail, entry.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("exec insert audit entry: %w", err)
+	}
+	return nil
+}
+
+// GetAuditLog returns the most recent admin actions, newest first
+func (d *Database) GetAuditLog(ctx context.Context, limit int) ([]server.AuditEntry, error) {
+	ctx, cancel := d.readContext(ctx)
+	defer cancel()
+
+	sql := `SELECT id, actor, action, subject, detail, createdAt FROM audit_log ORDER BY id DESC LIMIT ?;`
+	rows, err := d.query(ctx, sql, limit)
+	if err != nil {
+		return nil, fmt.Errorf("run query to get audit log: %w", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	entries := make([]server.AuditEntry, 0)
+	for rows.Next() {
+		var entry server.AuditEntry
+		if err := rows.Scan(&entry.ID, &entry.Actor, &entry.Action, &entry.Subject, &entry.Detail, &entry.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// GetPendingPosts returns posts waiting to be approved, oldest first
+func (d *Database) GetPendingPosts(ctx context.Context, limit int) ([]server.Post, error) {
+	ctx, cancel := d.readContext(ctx)
+	defer cancel()
+
+	sql := `SELECT ` + postColumns + ` FROM posts AS p
+		WHERE p.postURI IN (SELECT subject FROM hidden WHERE reason = ?)
+		ORDER BY p.createdAt ASC LIMIT ?;`
+	rows, err := d.query(ctx, sql, server.HiddenReasonPending, limit)
+	if err != nil {
+		return nil, fmt.Errorf("run query to get pending posts: %w", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	posts := make([]server.Post, 0)
+	for rows.Next() {
+		var post server.Post
+		if err := scanPost(rows, &post); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		post.Score = post.CreatedAt
+		posts = append(posts, post)
+	}
+	return posts, nil
+}
+
+// CountApprovedPosts returns how many of an author's stored posts aren't waiting to be approved
+func (d *Database) CountApprovedPosts(ctx context.Context, did string) (int, error) {
+	ctx, cancel := d.readContext(ctx)
+	defer cancel()
+
+	sql := `SELECT COUNT(*) FROM posts WHERE userDID = ?
+		AND postURI NOT IN (SELECT subject FROM hidden WHERE reason = ?);`
+	var count int
+	err := d.queryRow(ctx, sql, did, server.HiddenReasonPending).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("query approved posts: %w", err)
+	}
+	return count, nil
+}
@@ -0,0 +1,208 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log/slog"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// NewPostgresDatabase will connect to a postgres database. It will ping the database to ensure it is
+// available and error if not. Unlike sqlite, many feed generators can share the same postgres database
+func NewPostgresDatabase(dsn string) (*Database, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open database: %w", err)
+	}
+
+	err = db.Ping()
+	if err != nil {
+		return nil, fmt.Errorf("ping db: %w", err)
+	}
+
+	err = migratePostgres(db)
+	if err != nil {
+		return nil, fmt.Errorf("migrating database: %w", err)
+	}
+
+	return newDatabase(db, db, true), nil
+}
+
+// postgresMigrations are the postgres equivalent of migrations. The first one creates the schema as it
+// was when postgres support was added and any later changes to the schema need adding to both lists
+var postgresMigrations = [][]string{
+	{
+		`CREATE TABLE IF NOT EXISTS posts (
+			id BIGSERIAL PRIMARY KEY,
+			postRKey TEXT,
+			postURI TEXT,
+			createdAt BIGINT NOT NULL,
+			userDID TEXT NOT NULL DEFAULT '',
+			replyRoot TEXT NOT NULL DEFAULT '',
+			replyParent TEXT NOT NULL DEFAULT '',
+			UNIQUE (postRKey)
+		);`,
+		`CREATE INDEX IF NOT EXISTS posts_userDID ON posts (userDID);`,
+		`CREATE INDEX IF NOT EXISTS posts_postURI ON posts (postURI);`,
+		`CREATE INDEX IF NOT EXISTS posts_replyRoot ON posts (replyRoot);`,
+		`CREATE TABLE IF NOT EXISTS rejections (
+			id BIGSERIAL PRIMARY KEY,
+			postURI TEXT NOT NULL,
+			authorDID TEXT NOT NULL,
+			reason TEXT NOT NULL,
+			text TEXT,
+			createdAt BIGINT NOT NULL
+		);`,
+		`CREATE INDEX IF NOT EXISTS rejections_authorDID ON rejections (authorDID);`,
+		`CREATE TABLE IF NOT EXISTS hidden (
+			subject TEXT NOT NULL,
+			reason TEXT NOT NULL,
+			createdAt BIGINT NOT NULL,
+			PRIMARY KEY (subject, reason)
+		);`,
+		`CREATE INDEX IF NOT EXISTS hidden_reason ON hidden (reason);`,
+		`CREATE TABLE IF NOT EXISTS cursors (
+			name TEXT NOT NULL PRIMARY KEY,
+			value BIGINT NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS lists (
+			key TEXT NOT NULL PRIMARY KEY,
+			uri TEXT NOT NULL,
+			refreshedAt BIGINT NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS list_members (
+			listKey TEXT NOT NULL,
+			rkey TEXT NOT NULL,
+			did TEXT NOT NULL,
+			PRIMARY KEY (listKey, rkey)
+		);`,
+		`CREATE TABLE IF NOT EXISTS authors (
+			did TEXT NOT NULL PRIMARY KEY,
+			status TEXT NOT NULL DEFAULT 'active',
+			handle TEXT NOT NULL DEFAULT '',
+			updatedAt BIGINT NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS reposts (
+			repostURI TEXT NOT NULL PRIMARY KEY,
+			postURI TEXT NOT NULL,
+			userDID TEXT NOT NULL,
+			createdAt BIGINT NOT NULL
+		);`,
+		`CREATE INDEX IF NOT EXISTS reposts_createdAt ON reposts (createdAt);`,
+		`CREATE TABLE IF NOT EXISTS pins (
+			postURI TEXT NOT NULL,
+			userDID TEXT NOT NULL,
+			feed TEXT NOT NULL DEFAULT '',
+			createdAt BIGINT NOT NULL,
+			expiresAt BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (postURI, feed)
+		);`,
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id BIGSERIAL PRIMARY KEY,
+			actor TEXT NOT NULL,
+			action TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			detail TEXT NOT NULL DEFAULT '',
+			createdAt BIGINT NOT NULL
+		);`,
+	},
+	{
+		`CREATE INDEX IF NOT EXISTS posts_createdAt ON posts (createdAt);`,
+	},
+	{
+		`ALTER TABLE posts
+			ADD COLUMN IF NOT EXISTS text TEXT NOT NULL DEFAULT '',
+			ADD COLUMN IF NOT EXISTS langs TEXT NOT NULL DEFAULT '[]',
+			ADD COLUMN IF NOT EXISTS embedType TEXT NOT NULL DEFAULT '',
+			ADD COLUMN IF NOT EXISTS linkDomains TEXT NOT NULL DEFAULT '[]',
+			ADD COLUMN IF NOT EXISTS hashtags TEXT NOT NULL DEFAULT '[]',
+			ADD COLUMN IF NOT EXISTS hasMedia BOOLEAN NOT NULL DEFAULT FALSE,
+			ADD COLUMN IF NOT EXISTS indexedAt BIGINT NOT NULL DEFAULT 0;`,
+	},
+	{
+		`CREATE INDEX IF NOT EXISTS posts_text_search ON posts USING GIN (to_tsvector('simple', text));`,
+	},
+	{
+		`CREATE TABLE IF NOT EXISTS curated (
+			postURI TEXT NOT NULL PRIMARY KEY,
+			createdAt BIGINT NOT NULL
+		);`,
+	},
+	{
+		// record keys are only unique within a repo so posts are unique by their URI, which makes the
+		// index on postURI redundant
+		`ALTER TABLE posts DROP CONSTRAINT IF EXISTS posts_postrkey_key;`,
+		`ALTER TABLE posts ADD CONSTRAINT posts_posturi_key UNIQUE (postURI);`,
+		`DROP INDEX IF EXISTS posts_postURI;`,
+	},
+}
+
+// migrationLockID is the key of the advisory lock held while migrating so that feed generators sharing a
+// database and starting at the same time don't both apply the same migrations
+const migrationLockID = 402_402
+
+// migratePostgres applies any migrations the database doesn't have yet
+func migratePostgres(db *sql.DB) error {
+	ctx := context.Background()
+	// the advisory lock belongs to the session that took it so everything runs on the one connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("get connection: %w", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1);`, migrationLockID)
+	if err != nil {
+		return fmt.Errorf("take migration lock: %w", err)
+	}
+	defer func() {
+		_, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1);`, migrationLockID)
+		if err != nil {
+			// the connection is closed rather than returned to the pool so that the lock is released
+			slog.Error("release migration lock", "error", err)
+			_ = conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+	}()
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL);`)
+	if err != nil {
+		return fmt.Errorf("create schema version table: %w", err)
+	}
+
+	var version int
+	err = conn.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_version;`).Scan(&version)
+	if err != nil {
+		return fmt.Errorf("get schema version: %w", err)
+	}
+
+	for i := version; i < len(postgresMigrations); i++ {
+		slog.Info("applying database migration", "version", i+1)
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("begin migration %d: %w", i+1, err)
+		}
+		for _, statement := range postgresMigrations[i] {
+			_, err = tx.Exec(statement)
+			if err != nil {
+				_ = tx.Rollback()
+				return fmt.Errorf("exec migration %d: %w", i+1, err)
+			}
+		}
+		_, err = tx.Exec(`DELETE FROM schema_version;`)
+		if err == nil {
+			_, err = tx.Exec(`INSERT INTO schema_version (version) VALUES ($1);`, i+1)
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("set schema version %d: %w", i+1, err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("commit migration %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"sync"
+)
+
+// maxCachedStatements limits how many prepared statements are kept per connection pool. Queries with IN
+// clauses aren't prepared, so this is only a safeguard against the cache growing without limit
+const maxCachedStatements = 256
+
+// stmtCache keeps prepared statements for a connection pool so that the same query isn't parsed and
+// planned every time it runs
+type stmtCache struct {
+	db *sql.DB
+
+	mu     sync.Mutex
+	stmts  map[string]*sql.Stmt
+	closed bool
+}
+
+func newStmtCache(db *sql.DB) *stmtCache {
+	return &stmtCache{
+		db:    db,
+		stmts: make(map[string]*sql.Stmt),
+	}
+}
+
+// get returns the prepared statement for a query, preparing it if needed. It returns nil if the query
+// couldn't be prepared or the cache is full, in which case the query should be run without a statement
+func (c *stmtCache) get(ctx context.Context, query string) *sql.Stmt {
+	c.mu.Lock()
+	stmt, ok := c.stmts[query]
+	full := c.closed || len(c.stmts) >= maxCachedStatements
+	c.mu.Unlock()
+	if ok {
+		return stmt
+	}
+	if full {
+		return nil
+	}
+
+	// preparing has to wait for a connection so it's done without holding the lock, otherwise every
+	// query would wait for it even if its statement was already prepared
+	stmt, err := c.db.PrepareContext(ctx, query)
+	if err != nil {
+		// running the query unprepared will return the same error to the caller
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if existing, ok := c.stmts[query]; ok {
+		// another caller prepared the same query first
+		closeStmt(stmt)
+		return existing
+	}
+	if c.closed || len(c.stmts) >= maxCachedStatements {
+		closeStmt(stmt)
+		return nil
+	}
+	c.stmts[query] = stmt
+	return stmt
+}
+
+// size returns how many statements are cached
+func (c *stmtCache) size() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.stmts)
+}
+
+func (c *stmtCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	for query, stmt := range c.stmts {
+		closeStmt(stmt)
+		delete(c.stmts, query)
+	}
+}
+
+func closeStmt(stmt *sql.Stmt) {
+	err := stmt.Close()
+	if err != nil {
+		slog.Error("failed to close prepared statement", "error", err)
+	}
+}
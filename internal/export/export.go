@@ -0,0 +1,179 @@
+// Package export writes stored posts out as CSV, JSONL or Parquet so they can be analyzed elsewhere. Posts
+// are read from the store a page at a time and written as they're read, so exports of any size use little
+// memory
+package export
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/nacorid/x402-feed/internal/server"
+)
+
+// Format is a file format posts can be exported as
+type Format string
+
+const (
+	FormatCSV     Format = "csv"
+	FormatJSONL   Format = "jsonl"
+	FormatParquet Format = "parquet"
+)
+
+// ParseFormat returns the format with the given name
+func ParseFormat(name string) (Format, error) {
+	switch format := Format(name); format {
+	case FormatCSV, FormatJSONL, FormatParquet:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown export format %q, it must be csv, jsonl or parquet", name)
+	}
+}
+
+// ContentType returns the MIME type of the format
+func (f Format) ContentType() string {
+	switch f {
+	case FormatCSV:
+		return "text/csv"
+	case FormatJSONL:
+		return "application/x-ndjson"
+	default:
+		return "application/vnd.apache.parquet"
+	}
+}
+
+// pageSize is how many posts are read from the store at a time
+const pageSize = 1000
+
+// Row is an exported post
+type Row struct {
+	URI         string     `json:"uri" parquet:"uri"`
+	DID         string     `json:"did" parquet:"did"`
+	ReplyRoot   string     `json:"replyRoot" parquet:"replyRoot"`
+	ReplyParent string     `json:"replyParent" parquet:"replyParent"`
+	CreatedAt   time.Time  `json:"createdAt" parquet:"createdAt,timestamp(millisecond)"`
+	Text        string     `json:"text" parquet:"text"`
+	Langs       []string   `json:"langs" parquet:"langs,list"`
+	EmbedType   string     `json:"embedType" parquet:"embedType"`
+	LinkDomains []string   `json:"linkDomains" parquet:"linkDomains,list"`
+	Hashtags    []string   `json:"hashtags" parquet:"hashtags,list"`
+	HasMedia    bool       `json:"hasMedia" parquet:"hasMedia"`
+	IndexedAt   *time.Time `json:"indexedAt" parquet:"indexedAt,optional,timestamp(millisecond)"`
+}
+
+func newRow(post server.Post) Row {
+	row := Row{
+		URI:         post.PostURI,
+		DID:         post.UserDID,
+		ReplyRoot:   post.ReplyRoot,
+		ReplyParent: post.ReplyParent,
+		CreatedAt:   time.UnixMilli(post.CreatedAt).UTC(),
+		Text:        post.Text,
+		Langs:       nonNil(post.Langs),
+		EmbedType:   post.EmbedType,
+		LinkDomains: nonNil(post.LinkDomains),
+		Hashtags:    nonNil(post.Hashtags),
+		HasMedia:    post.HasMedia,
+	}
+	// posts that weren't stored from their record don't have any metadata
+	if post.IndexedAt > 0 {
+		indexedAt := time.UnixMilli(post.IndexedAt).UTC()
+		row.IndexedAt = &indexedAt
+	}
+	return row
+}
+
+// nonNil returns an empty list rather than nil so that missing lists are exported as empty lists
+func nonNil(vals []string) []string {
+	if vals == nil {
+		return []string{}
+	}
+	return vals
+}
+
+// rowWriter writes rows in one of the formats
+type rowWriter interface {
+	Write(rows []Row) error
+	// Close finishes the export, it doesn't close the underlying writer
+	Close() error
+}
+
+func newRowWriter(w io.Writer, format Format) (rowWriter, error) {
+	switch format {
+	case FormatCSV:
+		return newCSVWriter(w)
+	case FormatJSONL:
+		return newJSONLWriter(w), nil
+	case FormatParquet:
+		return newParquetWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unknown export format %q", format)
+	}
+}
+
+// Export writes every post matching the query to w, ignoring the query's AfterID and Limit. It returns
+// how many posts were written
+func Export(ctx context.Context, store server.PostStore, w io.Writer, format Format, query server.ExportQuery) (int, error) {
+	rw, err := newRowWriter(w, format)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	query.AfterID = 0
+	query.Limit = pageSize
+	for {
+		posts, err := store.GetExportPosts(ctx, query)
+		if err != nil {
+			return count, fmt.Errorf("get posts: %w", err)
+		}
+		if len(posts) == 0 {
+			break
+		}
+
+		rows := make([]Row, 0, len(posts))
+		for _, post := range posts {
+			rows = append(rows, newRow(post))
+		}
+		err = rw.Write(rows)
+		if err != nil {
+			return count, fmt.Errorf("write posts: %w", err)
+		}
+		count += len(posts)
+		query.AfterID = posts[len(posts)-1].ID
+	}
+
+	err = rw.Close()
+	if err != nil {
+		return count, fmt.Errorf("finish export: %w", err)
+	}
+	return count, nil
+}
+
+// FeedQuery returns a query that exports the posts in a feed. The author lists are optional and can be nil
+func FeedQuery(feed server.FeedConfig, authorLists server.AuthorLists) server.ExportQuery {
+	query := server.NewFeedQuery(feed, authorLists)
+	return server.ExportQuery{
+		RootsOnly:    query.RootsOnly,
+		ExcludeUsers: query.ExcludeUsers,
+		OnlyUsers:    query.OnlyUsers,
+		ExcludeLists: query.ExcludeLists,
+		OnlyLists:    query.OnlyLists,
+		Search:       query.Search,
+	}
+}
+
+// ParseTime parses the start or end of a date range, which is either a date such as 2026-01-31 or an
+// RFC 3339 time
+func ParseTime(val string) (time.Time, error) {
+	t, err := time.Parse(time.DateOnly, val)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.Parse(time.RFC3339, val)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not a date or RFC 3339 time", val)
+	}
+	return t, nil
+}
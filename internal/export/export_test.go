@@ -0,0 +1,162 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+
+	"github.com/nacorid/x402-feed/internal/memstore"
+	"github.com/nacorid/x402-feed/internal/server"
+)
+
+// newStore returns a store with more posts than fit in a page. Every tenth post is a reply with metadata
+func newStore(t *testing.T) *memstore.Store {
+	t.Helper()
+	store := memstore.New()
+	for i := range pageSize + 500 {
+		post := server.Post{
+			RKey:      fmt.Sprintf("%d", i),
+			PostURI:   fmt.Sprintf("at://did:plc:a/app.bsky.feed.post/%d", i),
+			UserDID:   "did:plc:a",
+			CreatedAt: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(i) * time.Minute).UnixMilli(),
+		}
+		if i%10 == 0 {
+			post.ReplyRoot = "at://did:plc:b/app.bsky.feed.post/root"
+			post.ReplyParent = post.ReplyRoot
+			post.Text = "x402, \"quoted\"\nand a new line"
+			post.Langs = []string{"en", "de"}
+			post.Hashtags = []string{"x402"}
+			post.LinkDomains = []string{"x402.org"}
+			post.EmbedType = server.EmbedImages
+			post.HasMedia = true
+			post.IndexedAt = post.CreatedAt + 1000
+		}
+		if err := store.CreatePost(context.Background(), post); err != nil {
+			t.Fatalf("create post: %v", err)
+		}
+	}
+	return store
+}
+
+func TestExportFormats(t *testing.T) {
+	store := newStore(t)
+	total := pageSize + 500
+	want := Row{
+		URI:         "at://did:plc:a/app.bsky.feed.post/1000",
+		DID:         "did:plc:a",
+		ReplyRoot:   "at://did:plc:b/app.bsky.feed.post/root",
+		ReplyParent: "at://did:plc:b/app.bsky.feed.post/root",
+		Text:        "x402, \"quoted\"\nand a new line",
+		Langs:       []string{"en", "de"},
+		EmbedType:   server.EmbedImages,
+		LinkDomains: []string{"x402.org"},
+		Hashtags:    []string{"x402"},
+		HasMedia:    true,
+	}
+
+	export := func(format Format) *bytes.Buffer {
+		t.Helper()
+		var buf bytes.Buffer
+		count, err := Export(context.Background(), store, &buf, format, server.ExportQuery{})
+		if err != nil {
+			t.Fatalf("export %s: %v", format, err)
+		}
+		if count != total {
+			t.Errorf("export %s: exported %d posts, want %d", format, count, total)
+		}
+		return &buf
+	}
+
+	t.Run("csv", func(t *testing.T) {
+		records, err := csv.NewReader(export(FormatCSV)).ReadAll()
+		if err != nil {
+			t.Fatalf("read csv: %v", err)
+		}
+		if len(records) != total+1 || strings.Join(records[0], ",") != strings.Join(csvHeader, ",") {
+			t.Fatalf("got %d records with header %v", len(records), records[0])
+		}
+		got := records[1001]
+		if got[0] != want.URI || got[4] != "2026-01-01T16:40:00.000Z" || got[5] != want.Text || got[6] != "en de" ||
+			got[9] != "x402" || got[10] != "true" || got[11] != "2026-01-01T16:40:01.000Z" {
+			t.Errorf("got record %q", got)
+		}
+		if got := records[2]; got[6] != "" || got[10] != "false" || got[11] != "" {
+			t.Errorf("got record %q, want no metadata", got)
+		}
+	})
+
+	t.Run("jsonl", func(t *testing.T) {
+		lines := strings.Split(strings.TrimSpace(export(FormatJSONL).String()), "\n")
+		if len(lines) != total {
+			t.Fatalf("got %d lines, want %d", len(lines), total)
+		}
+		var got Row
+		if err := json.Unmarshal([]byte(lines[1000]), &got); err != nil {
+			t.Fatalf("decode line: %v", err)
+		}
+		if got.URI != want.URI || got.Text != want.Text || got.IndexedAt == nil || strings.Join(got.Langs, " ") != "en de" {
+			t.Errorf("got %+v", got)
+		}
+		if !strings.Contains(lines[1], `"langs":[]`) || !strings.Contains(lines[1], `"indexedAt":null`) {
+			t.Errorf("got %s, want empty metadata", lines[1])
+		}
+	})
+
+	t.Run("parquet", func(t *testing.T) {
+		buf := export(FormatParquet)
+		rows, err := parquet.Read[Row](bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatalf("read parquet: %v", err)
+		}
+		if len(rows) != total {
+			t.Fatalf("got %d rows, want %d", len(rows), total)
+		}
+		got := rows[1000]
+		if got.URI != want.URI || got.Text != want.Text || !got.HasMedia || got.IndexedAt == nil ||
+			!got.CreatedAt.Equal(time.Date(2026, 1, 1, 16, 40, 0, 0, time.UTC)) || strings.Join(got.LinkDomains, " ") != "x402.org" {
+			t.Errorf("got %+v", got)
+		}
+		if rows[1].IndexedAt != nil {
+			t.Errorf("got %+v, want no indexedAt", rows[1])
+		}
+	})
+}
+
+func TestExportFilters(t *testing.T) {
+	store := newStore(t)
+	since, err := ParseTime("2026-01-01")
+	if err != nil {
+		t.Fatalf("parse time: %v", err)
+	}
+	until, err := ParseTime("2026-01-01T01:00:00Z")
+	if err != nil {
+		t.Fatalf("parse time: %v", err)
+	}
+
+	query := FeedQuery(server.FeedConfig{Name: "x402", ThreadRootsOnly: true}, nil)
+	query.Since = since.UnixMilli()
+	query.Until = until.UnixMilli()
+	var buf bytes.Buffer
+	count, err := Export(context.Background(), store, &buf, FormatJSONL, query)
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	// the first hour has 60 posts and 6 of them are replies
+	if count != 54 {
+		t.Errorf("exported %d posts, want 54", count)
+	}
+
+	if _, err := ParseTime("yesterday"); err == nil {
+		t.Errorf("expected an error parsing an invalid time")
+	}
+	if _, err := ParseFormat("xlsx"); err == nil {
+		t.Errorf("expected an error parsing an unknown format")
+	}
+}
@@ -0,0 +1,124 @@
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// csvTimeFormat is RFC 3339 with milliseconds, which is the precision posts' times are stored with
+const csvTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+var csvHeader = []string{
+	"uri", "did", "replyRoot", "replyParent", "createdAt", "text", "langs", "embedType", "linkDomains",
+	"hashtags", "hasMedia", "indexedAt",
+}
+
+// csvWriter writes a header and then a line for each post. Lists are space separated as none of the
+// values in them can contain spaces
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func newCSVWriter(w io.Writer) (*csvWriter, error) {
+	cw := &csvWriter{w: csv.NewWriter(w)}
+	err := cw.w.Write(csvHeader)
+	if err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (c *csvWriter) Write(rows []Row) error {
+	for _, row := range rows {
+		indexedAt := ""
+		if row.IndexedAt != nil {
+			indexedAt = row.IndexedAt.Format(csvTimeFormat)
+		}
+		err := c.w.Write([]string{
+			row.URI,
+			row.DID,
+			row.ReplyRoot,
+			row.ReplyParent,
+			row.CreatedAt.Format(csvTimeFormat),
+			row.Text,
+			strings.Join(row.Langs, " "),
+			row.EmbedType,
+			strings.Join(row.LinkDomains, " "),
+			strings.Join(row.Hashtags, " "),
+			strconv.FormatBool(row.HasMedia),
+			indexedAt,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// flushed after every page so that the export is streamed
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// jsonlWriter writes each post as a JSON object on its own line
+type jsonlWriter struct {
+	enc *json.Encoder
+}
+
+func newJSONLWriter(w io.Writer) *jsonlWriter {
+	return &jsonlWriter{enc: json.NewEncoder(w)}
+}
+
+func (j *jsonlWriter) Write(rows []Row) error {
+	for _, row := range rows {
+		err := j.enc.Encode(row)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *jsonlWriter) Close() error {
+	return nil
+}
+
+// parquetRowGroupSize is how many posts are buffered before they're written out as a row group. Parquet
+// files are written a row group at a time so this bounds how much of an export is held in memory
+const parquetRowGroupSize = 50_000
+
+// parquetWriter writes a snappy compressed parquet file
+type parquetWriter struct {
+	w        *parquet.GenericWriter[Row]
+	buffered int
+}
+
+func newParquetWriter(w io.Writer) *parquetWriter {
+	return &parquetWriter{
+		w: parquet.NewGenericWriter[Row](w, parquet.Compression(&parquet.Snappy)),
+	}
+}
+
+func (p *parquetWriter) Write(rows []Row) error {
+	_, err := p.w.Write(rows)
+	if err != nil {
+		return err
+	}
+	p.buffered += len(rows)
+	if p.buffered < parquetRowGroupSize {
+		return nil
+	}
+	p.buffered = 0
+	return p.w.Flush()
+}
+
+func (p *parquetWriter) Close() error {
+	return p.w.Close()
+}
@@ -0,0 +1,696 @@
+// Package memstore is an in-memory implementation of server.PostStore. Nothing is persisted so it's
+// meant for tests and trying out the feed generator
+package memstore
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/nacorid/x402-feed/internal/search"
+	"github.com/nacorid/x402-feed/internal/server"
+)
+
+type hiddenKey struct {
+	subject string
+	reason  string
+}
+
+type pinKey struct {
+	postURI string
+	feed    string
+}
+
+type author struct {
+	status string
+	handle string
+}
+
+// Store is an in-memory post store that is safe for concurrent use
+type Store struct {
+	mu sync.RWMutex
+
+	nextPostID int
+	// posts are kept in the order they were created and are unique by record key like the SQL stores
+	posts       []server.Post
+	reposts     map[string]server.Repost
+	hidden      map[hiddenKey]struct{}
+	cursors     map[string]int64
+	lists       map[string]server.StoredList
+	listMembers map[string]map[string]string
+	authors     map[string]author
+	pins        map[pinKey]server.Pin
+	curated     map[string]struct{}
+	rejections  []server.Rejection
+	audit       []server.AuditEntry
+}
+
+// New returns an empty store
+func New() *Store {
+	return &Store{
+		reposts:     make(map[string]server.Repost),
+		hidden:      make(map[hiddenKey]struct{}),
+		cursors:     make(map[string]int64),
+		lists:       make(map[string]server.StoredList),
+		listMembers: make(map[string]map[string]string),
+		authors:     make(map[string]author),
+		pins:        make(map[pinKey]server.Pin),
+		curated:     make(map[string]struct{}),
+	}
+}
+
+// CreatePost stores a post. Storing a post that's already stored does nothing
+func (s *Store) CreatePost(_ context.Context, post server.Post) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.createPost(post)
+	return nil
+}
+
+// createPost stores a post. A post that's already stored keeps its place but has its metadata replaced
+// if the new version was stored from its record. The lock must be held
+func (s *Store) createPost(post server.Post) {
+	for i, p := range s.posts {
+		if p.PostURI != post.PostURI {
+			continue
+		}
+		if post.IndexedAt > 0 {
+			p.Text = post.Text
+			p.Langs = post.Langs
+			p.EmbedType = post.EmbedType
+			p.LinkDomains = post.LinkDomains
+			p.Hashtags = post.Hashtags
+			p.HasMedia = post.HasMedia
+			s.posts[i] = p
+		}
+		return
+	}
+
+	s.nextPostID++
+	post.ID = s.nextPostID
+	post.Score = 0
+	post.RepostURI = ""
+	s.posts = append(s.posts, post)
+}
+
+// isHidden reports whether a subject has been hidden for any reason. The lock must be held
+func (s *Store) isHidden(subject string) bool {
+	for key := range s.hidden {
+		if key.subject == subject {
+			return true
+		}
+	}
+	return false
+}
+
+// GetFeedPosts returns the posts for a page of a feed, highest score first
+func (s *Store) GetFeedPosts(_ context.Context, query server.FeedQuery) ([]server.Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	posts := make([]server.Post, 0)
+	if (query.OnlyUsers != nil && len(query.OnlyUsers) == 0) || (query.OnlyIDs != nil && len(query.OnlyIDs) == 0) {
+		return posts, nil
+	}
+
+	filter, err := s.postFilter(query.ExcludeUsers, query.OnlyUsers, query.ExcludeLists, query.OnlyLists, query.RootsOnly, query.Search)
+	if err != nil {
+		return nil, err
+	}
+	include := func(p server.Post) bool {
+		return filter(p) && (query.OnlyIDs == nil || slices.Contains(query.OnlyIDs, p.ID))
+	}
+
+	boostLists := s.listsMembers(query.BoostLists)
+	for _, p := range s.posts {
+		if !include(p) {
+			continue
+		}
+		p.Score = p.CreatedAt
+		if query.Boost > 0 && (slices.Contains(query.BoostUsers, p.UserDID) || boostLists[p.UserDID]) {
+			p.Score += query.Boost
+		}
+		posts = append(posts, p)
+	}
+
+	if query.IncludeReposts {
+		for _, repost := range s.reposts {
+			for _, p := range s.posts {
+				if p.PostURI != repost.PostURI || !include(p) {
+					continue
+				}
+				p.Score = repost.CreatedAt
+				p.RepostURI = repost.RepostURI
+				posts = append(posts, p)
+			}
+		}
+	}
+
+	page := make([]server.Post, 0)
+	for _, p := range posts {
+		if p.Score < query.Cursor || (query.CursorID > 0 && p.Score == query.Cursor && p.ID < query.CursorID) {
+			page = append(page, p)
+		}
+	}
+	sort.SliceStable(page, func(i, j int) bool {
+		if page[i].Score != page[j].Score {
+			return page[i].Score > page[j].Score
+		}
+		return page[i].ID > page[j].ID
+	})
+	if len(page) > query.Limit {
+		page = page[:query.Limit]
+	}
+	return page, nil
+}
+
+// postFilter returns a function that reports whether a post isn't hidden and passes the filters shared
+// by feeds and exports. The lock must be held while it's used
+func (s *Store) postFilter(excludeUsers, onlyUsers, excludeLists, onlyLists []string, rootsOnly bool, searchQuery string) (func(p server.Post) bool, error) {
+	excluded, only := s.listsMembers(excludeLists), s.listsMembers(onlyLists)
+	var parsed *search.Query
+	if searchQuery != "" {
+		q, err := search.Parse(searchQuery)
+		if err != nil {
+			return nil, fmt.Errorf("parse search: %w", err)
+		}
+		parsed = &q
+	}
+
+	return func(p server.Post) bool {
+		switch {
+		case s.isHidden(p.PostURI) || s.isHidden(p.UserDID):
+			return false
+		case slices.Contains(excludeUsers, p.UserDID):
+			return false
+		case onlyUsers != nil && !slices.Contains(onlyUsers, p.UserDID):
+			return false
+		case excluded[p.UserDID]:
+			return false
+		case len(onlyLists) > 0 && !only[p.UserDID]:
+			return false
+		case rootsOnly && p.ReplyRoot != "":
+			return false
+		case parsed != nil && !parsed.Match(p.Text):
+			return false
+		}
+		return true
+	}, nil
+}
+
+// listsMembers returns the members of the stored lists with the given keys
+func (s *Store) listsMembers(keys []string) map[string]bool {
+	members := make(map[string]bool)
+	for _, key := range keys {
+		for _, did := range s.listMembers[key] {
+			members[did] = true
+		}
+	}
+	return members
+}
+
+// DeletePostsFromURIs deletes the posts with the given URIs
+func (s *Store) DeletePostsFromURIs(_ context.Context, uris []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deletePosts(func(p server.Post) bool {
+		return slices.Contains(uris, p.PostURI)
+	})
+	return nil
+}
+
+// DeletePostsFromUsers deletes all posts made by the given users
+func (s *Store) DeletePostsFromUsers(_ context.Context, dids []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deletePosts(func(p server.Post) bool {
+		return slices.Contains(dids, p.UserDID)
+	})
+	return nil
+}
+
+// DeleteUnprotectedPosts deletes a post URI or every post from a user DID apart from posts that are
+// pinned or were added by a curator or an admin
+func (s *Store) DeleteUnprotectedPosts(_ context.Context, subject string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deletePosts(func(p server.Post) bool {
+		if p.PostURI != subject && p.UserDID != subject {
+			return false
+		}
+		if _, ok := s.curated[p.PostURI]; ok {
+			return false
+		}
+		for key := range s.pins {
+			if key.postURI == p.PostURI {
+				return false
+			}
+		}
+		return true
+	})
+	return nil
+}
+
+// MarkCurated records that a post was added to the feed by a curator or an admin
+func (s *Store) MarkCurated(_ context.Context, postURI string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.curated[postURI] = struct{}{}
+	return nil
+}
+
+// deletePosts deletes the posts that match. The lock must be held
+func (s *Store) deletePosts(match func(p server.Post) bool) {
+	s.posts = slices.DeleteFunc(s.posts, match)
+}
+
+// GetPrunablePosts returns the posts outside the retention policy, oldest first
+func (s *Store) GetPrunablePosts(_ context.Context, query server.PruneQuery) ([]server.Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// posts are kept in the order they were stored so a stable sort orders posts created at the same
+	// time by ID
+	posts := slices.Clone(s.posts)
+	sort.SliceStable(posts, func(i, j int) bool {
+		return posts[i].CreatedAt < posts[j].CreatedAt
+	})
+
+	prunable := make([]server.Post, 0)
+	for i, post := range posts {
+		if post.CreatedAt >= query.Before || len(prunable) >= query.Limit {
+			break
+		}
+		if i < query.Offset {
+			continue
+		}
+		post.Score = post.CreatedAt
+		prunable = append(prunable, post)
+	}
+	return prunable, nil
+}
+
+// GetExportPosts returns a page of the posts to export in the order they were stored
+func (s *Store) GetExportPosts(_ context.Context, query server.ExportQuery) ([]server.Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	include, err := s.postFilter(query.ExcludeUsers, query.OnlyUsers, query.ExcludeLists, query.OnlyLists, query.RootsOnly, query.Search)
+	if err != nil {
+		return nil, err
+	}
+
+	// posts are kept in the order they were stored so they're already in ID order
+	posts := make([]server.Post, 0)
+	for _, p := range s.posts {
+		switch {
+		case len(posts) >= query.Limit:
+			return posts, nil
+		case p.ID <= query.AfterID || !include(p):
+			continue
+		case query.Since > 0 && p.CreatedAt < query.Since:
+			continue
+		case query.Until > 0 && p.CreatedAt >= query.Until:
+			continue
+		}
+		p.Score = p.CreatedAt
+		posts = append(posts, p)
+	}
+	return posts, nil
+}
+
+// ApplyWrites applies the writes in order and sets the batch's cursor
+func (s *Store) ApplyWrites(_ context.Context, batch server.WriteBatch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// nothing is applied if any of the writes are invalid
+	for i, write := range batch.Writes {
+		if write.Kind < server.WriteCreatePost || write.Kind > server.WriteDeleteUserPosts {
+			return &server.WriteError{Index: i, Err: fmt.Errorf("unknown write kind %d", write.Kind)}
+		}
+	}
+
+	for _, write := range batch.Writes {
+		switch write.Kind {
+		case server.WriteCreatePost:
+			s.createPost(write.Post)
+		case server.WriteDeletePosts:
+			s.deletePosts(func(p server.Post) bool {
+				return slices.Contains(write.Subjects, p.PostURI)
+			})
+		case server.WriteDeleteUserPosts:
+			s.deletePosts(func(p server.Post) bool {
+				return slices.Contains(write.Subjects, p.UserDID)
+			})
+		}
+	}
+	if batch.CursorName != "" {
+		s.cursors[batch.CursorName] = batch.Cursor
+	}
+	return nil
+}
+
+// CreateRejection records a post that was rejected from the feed and why
+func (s *Store) CreateRejection(_ context.Context, rejection server.Rejection) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rejection.ID = len(s.rejections) + 1
+	s.rejections = append(s.rejections, rejection)
+	return nil
+}
+
+// GetRejections returns the rejected posts that match the query, newest first
+func (s *Store) GetRejections(_ context.Context, query server.RejectionQuery) ([]server.Rejection, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rejections := make([]server.Rejection, 0)
+	for i := len(s.rejections) - 1; i >= 0 && len(rejections) < query.Limit; i-- {
+		rejection := s.rejections[i]
+		if query.AuthorDID != "" && rejection.AuthorDID != query.AuthorDID {
+			continue
+		}
+		if query.Before > 0 && rejection.ID >= query.Before {
+			continue
+		}
+		rejections = append(rejections, rejection)
+	}
+	return rejections, nil
+}
+
+// HideSubject hides a post URI or every post from a user DID for the given reason
+func (s *Store) HideSubject(_ context.Context, subject, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.hidden[hiddenKey{subject: subject, reason: reason}] = struct{}{}
+	return nil
+}
+
+// UnhideSubject removes a reason a subject was hidden for
+func (s *Store) UnhideSubject(_ context.Context, subject, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.hidden, hiddenKey{subject: subject, reason: reason})
+	return nil
+}
+
+// IsHidden reports whether a subject is hidden for the given reason
+func (s *Store) IsHidden(_ context.Context, subject, reason string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.hidden[hiddenKey{subject: subject, reason: reason}]
+	return ok, nil
+}
+
+// GetCursor returns the stored value of a named stream cursor or 0 if one hasn't been stored
+func (s *Store) GetCursor(_ context.Context, name string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.cursors[name], nil
+}
+
+// SetCursor stores the value of a named stream cursor
+func (s *Store) SetCursor(_ context.Context, name string, value int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cursors[name] = value
+	return nil
+}
+
+// GetList returns the last stored state of a list. If the list has never been stored then only the key is set
+func (s *Store) GetList(_ context.Context, key string) (server.StoredList, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list, ok := s.lists[key]
+	if !ok {
+		return server.StoredList{Key: key, Members: make([]server.ListMember, 0)}, nil
+	}
+
+	list.Members = make([]server.ListMember, 0, len(s.listMembers[key]))
+	for rkey, did := range s.listMembers[key] {
+		list.Members = append(list.Members, server.ListMember{RKey: rkey, DID: did})
+	}
+	return list, nil
+}
+
+// ReplaceList stores the state of a list, replacing all of its members
+func (s *Store) ReplaceList(_ context.Context, list server.StoredList) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	members := make(map[string]string, len(list.Members))
+	for _, member := range list.Members {
+		members[member.RKey] = member.DID
+	}
+	list.Members = nil
+	s.lists[list.Key] = list
+	s.listMembers[list.Key] = members
+	return nil
+}
+
+// AddListMember adds a member to a stored list
+func (s *Store) AddListMember(_ context.Context, key string, member server.ListMember) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listMembers[key] == nil {
+		s.listMembers[key] = make(map[string]string)
+	}
+	s.listMembers[key][member.RKey] = member.DID
+	return nil
+}
+
+// RemoveListMember removes a member from a stored list
+func (s *Store) RemoveListMember(_ context.Context, key, rkey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.listMembers[key], rkey)
+	return nil
+}
+
+// IsKnownAuthor reports whether the author has any posts stored or their account has been seen
+func (s *Store) IsKnownAuthor(_ context.Context, did string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.authors[did]; ok {
+		return true, nil
+	}
+	for _, p := range s.posts {
+		if p.UserDID == did {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// SetAuthorStatus records the status of an author's account
+func (s *Store) SetAuthorStatus(_ context.Context, did, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := s.authors[did]
+	a.status = status
+	s.authors[did] = a
+	return nil
+}
+
+// SetAuthorHandle records an author's handle
+func (s *Store) SetAuthorHandle(_ context.Context, did, handle string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.authors[did]
+	if !ok {
+		a.status = "active"
+	}
+	a.handle = handle
+	s.authors[did] = a
+	return nil
+}
+
+// IsThreadStored reports whether the root of a thread or any reply in it is stored
+func (s *Store) IsThreadStored(_ context.Context, rootURI string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, p := range s.posts {
+		if p.PostURI == rootURI || p.ReplyRoot == rootURI {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// IsPostStored reports whether a post is stored
+func (s *Store) IsPostStored(_ context.Context, uri string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, p := range s.posts {
+		if p.PostURI == uri {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// CreateRepost stores a repost of a stored post
+func (s *Store) CreateRepost(_ context.Context, repost server.Repost) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.reposts[repost.RepostURI]; !ok {
+		s.reposts[repost.RepostURI] = repost
+	}
+	return nil
+}
+
+// DeleteRepost deletes a repost
+func (s *Store) DeleteRepost(_ context.Context, repostURI string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.reposts, repostURI)
+	return nil
+}
+
+// CreatePin pins a post to a feed. Pinning a post that's already pinned to the feed replaces its expiry
+func (s *Store) CreatePin(_ context.Context, pin server.Pin) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := pinKey{postURI: pin.PostURI, feed: pin.Feed}
+	if existing, ok := s.pins[key]; ok {
+		existing.ExpiresAt = pin.ExpiresAt
+		pin = existing
+	}
+	s.pins[key] = pin
+	return nil
+}
+
+// DeletePin unpins a post from a feed
+func (s *Store) DeletePin(_ context.Context, postURI, feed string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.pins, pinKey{postURI: postURI, feed: feed})
+	return nil
+}
+
+// GetPins returns the pins that haven't expired for a feed, newest first
+func (s *Store) GetPins(_ context.Context, feed string, now int64) ([]server.Pin, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	pins := make([]server.Pin, 0)
+	for _, pin := range s.pins {
+		if pin.Feed != feed && pin.Feed != "" {
+			continue
+		}
+		if pin.ExpiresAt != 0 && pin.ExpiresAt <= now {
+			continue
+		}
+		if s.isHidden(pin.PostURI) || s.isHidden(pin.UserDID) {
+			continue
+		}
+		pins = append(pins, pin)
+	}
+	sortPins(pins)
+	return pins, nil
+}
+
+// GetAllPins returns every pin, newest first
+func (s *Store) GetAllPins(_ context.Context) ([]server.Pin, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	pins := make([]server.Pin, 0, len(s.pins))
+	for _, pin := range s.pins {
+		pins = append(pins, pin)
+	}
+	sortPins(pins)
+	return pins, nil
+}
+
+func sortPins(pins []server.Pin) {
+	sort.Slice(pins, func(i, j int) bool {
+		return pins[i].CreatedAt > pins[j].CreatedAt
+	})
+}
+
+// CreateAuditEntry records an action taken by an admin
+func (s *Store) CreateAuditEntry(_ context.Context, entry server.AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry.ID = len(s.audit) + 1
+	s.audit = append(s.audit, entry)
+	return nil
+}
+
+// GetAuditLog returns the most recent admin actions, newest first
+func (s *Store) GetAuditLog(_ context.Context, limit int) ([]server.AuditEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := make([]server.AuditEntry, 0)
+	for i := len(s.audit) - 1; i >= 0 && len(entries) < limit; i-- {
+		entries = append(entries, s.audit[i])
+	}
+	return entries, nil
+}
+
+// GetPendingPosts returns posts waiting to be approved, oldest first
+func (s *Store) GetPendingPosts(_ context.Context, limit int) ([]server.Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	posts := make([]server.Post, 0)
+	for _, p := range s.posts {
+		if _, ok := s.hidden[hiddenKey{subject: p.PostURI, reason: server.HiddenReasonPending}]; ok {
+			p.Score = p.CreatedAt
+			posts = append(posts, p)
+		}
+	}
+	sort.SliceStable(posts, func(i, j int) bool {
+		return posts[i].CreatedAt < posts[j].CreatedAt
+	})
+	if len(posts) > limit {
+		posts = posts[:limit]
+	}
+	return posts, nil
+}
+
+// CountApprovedPosts returns how many of an author's stored posts aren't waiting to be approved
+func (s *Store) CountApprovedPosts(_ context.Context, did string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	for _, p := range s.posts {
+		if p.UserDID != did {
+			continue
+		}
+		if _, ok := s.hidden[hiddenKey{subject: p.PostURI, reason: server.HiddenReasonPending}]; !ok {
+			count++
+		}
+	}
+	return count, nil
+}
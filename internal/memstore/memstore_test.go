@@ -0,0 +1,16 @@
+package memstore
+
+import (
+	"testing"
+
+	"github.com/nacorid/x402-feed/internal/server"
+	"github.com/nacorid/x402-feed/internal/storetest"
+)
+
+var _ server.PostStore = (*Store)(nil)
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) server.PostStore {
+		return New()
+	})
+}
@@ -0,0 +1,155 @@
+package pds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+// Client is an authenticated xrpc client for a PDS that keeps its session alive. It can be shared by
+// anything in the process that needs to talk to the PDS
+type Client struct {
+	host     string
+	handle   string
+	password string
+
+	// auth is replaced rather than modified so that calls in flight keep using the session they started with
+	auth *xrpc.AuthInfo
+	mu   sync.Mutex
+}
+
+// NewClient returns a new client. It doesn't log in until the first call is made or Login is called
+func NewClient(host, handle, password string) *Client {
+	return &Client{
+		host:     host,
+		handle:   handle,
+		password: password,
+	}
+}
+
+// Login will create a new session using the password
+func (c *Client) Login(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.login(ctx)
+}
+
+// DID returns the DID of the logged in account or an empty string if not logged in
+func (c *Client) DID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.auth == nil {
+		return ""
+	}
+	return c.auth.Did
+}
+
+// Do calls fn with an authenticated xrpc client, logging in first if needed. If the call fails because
+// the session has expired the session is refreshed and fn is called once more
+func (c *Client) Do(ctx context.Context, fn func(client *xrpc.Client) error) error {
+	client, err := c.authedClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = fn(client)
+	if err == nil || !isExpiredSession(err) {
+		return err
+	}
+
+	client, err = c.refresh(ctx, client.Auth)
+	if err != nil {
+		return fmt.Errorf("refresh expired session: %w", err)
+	}
+	return fn(client)
+}
+
+func (c *Client) authedClient(ctx context.Context) (*xrpc.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.auth == nil {
+		if err := c.login(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return c.xrpcClient(c.auth), nil
+}
+
+// refresh will refresh the session that expired. If another call has already replaced that session then
+// the new one is used
+func (c *Client) refresh(ctx context.Context, expired *xrpc.AuthInfo) (*xrpc.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.auth != expired {
+		return c.xrpcClient(c.auth), nil
+	}
+
+	slog.Default().InfoContext(ctx, "Refreshing session...")
+	// refreshSession is authenticated with the refresh token rather than the access token
+	refreshClient := c.xrpcClient(&xrpc.AuthInfo{AccessJwt: expired.RefreshJwt})
+	session, err := atproto.ServerRefreshSession(ctx, refreshClient)
+	if err != nil {
+		slog.Default().WarnContext(ctx, "Failed to refresh session, logging in again", "error", err)
+		if err := c.login(ctx); err != nil {
+			return nil, err
+		}
+		return c.xrpcClient(c.auth), nil
+	}
+
+	c.auth = &xrpc.AuthInfo{
+		AccessJwt:  session.AccessJwt,
+		RefreshJwt: session.RefreshJwt,
+		Handle:     session.Handle,
+		Did:        session.Did,
+	}
+	return c.xrpcClient(c.auth), nil
+}
+
+// login must be called with the lock held
+func (c *Client) login(ctx context.Context) error {
+	session, err := atproto.ServerCreateSession(ctx, c.xrpcClient(nil), &atproto.ServerCreateSession_Input{
+		Identifier: c.handle,
+		Password:   c.password,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create bluesky session: %w", err)
+	}
+	c.auth = &xrpc.AuthInfo{
+		AccessJwt:  session.AccessJwt,
+		RefreshJwt: session.RefreshJwt,
+		Handle:     session.Handle,
+		Did:        session.Did,
+	}
+	return nil
+}
+
+func (c *Client) xrpcClient(auth *xrpc.AuthInfo) *xrpc.Client {
+	return &xrpc.Client{
+		Host: c.host,
+		Auth: auth,
+	}
+}
+
+// isExpiredSession reports whether the error is because the access token has expired or is no longer valid
+func isExpiredSession(err error) bool {
+	// a 401 usually has an XRPC error of its own so the status is checked first
+	var httpErr *xrpc.Error
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusUnauthorized {
+		return true
+	}
+	var xrpcErr *xrpc.XRPCError
+	if errors.As(err, &xrpcErr) {
+		return xrpcErr.ErrStr == "ExpiredToken" || xrpcErr.ErrStr == "InvalidToken"
+	}
+	return false
+}
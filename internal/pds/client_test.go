@@ -0,0 +1,184 @@
+package pds
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+// fakePDS hands out numbered sessions and only accepts the access token of the latest one
+type fakePDS struct {
+	mu sync.Mutex
+
+	logins, refreshes int
+	access, refresh   string
+
+	// expiredStatus and expiredError are what's returned for an access token that isn't the latest one
+	expiredStatus int
+	expiredError  string
+	refreshFails  bool
+}
+
+func (p *fakePDS) session(w http.ResponseWriter, kind string, n int) {
+	p.access, p.refresh = fmt.Sprintf("%s-access-%d", kind, n), fmt.Sprintf("%s-refresh-%d", kind, n)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"accessJwt":  p.access,
+		"refreshJwt": p.refresh,
+		"handle":     "feed.test",
+		"did":        "did:plc:feed",
+	})
+}
+
+func xrpcError(w http.ResponseWriter, status int, name string) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": name})
+}
+
+func (p *fakePDS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	auth := r.Header.Get("Authorization")
+	switch r.URL.Path {
+	case "/xrpc/com.atproto.server.createSession":
+		p.logins++
+		p.session(w, "login", p.logins)
+	case "/xrpc/com.atproto.server.refreshSession":
+		if p.refreshFails || auth != "Bearer "+p.refresh {
+			xrpcError(w, http.StatusBadRequest, "ExpiredToken")
+			return
+		}
+		p.refreshes++
+		p.session(w, "refreshed", p.refreshes)
+	case "/xrpc/com.atproto.server.getSession":
+		if auth != "Bearer "+p.access {
+			xrpcError(w, p.expiredStatus, p.expiredError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"handle": "feed.test", "did": "did:plc:feed"})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// expire makes the current access token stop working
+func (p *fakePDS) expire() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.access = "expired"
+}
+
+func TestClientDo(t *testing.T) {
+	tests := map[string]struct {
+		pds *fakePDS
+		// expire expires the access token after the first call
+		expire        bool
+		wantLogins    int
+		wantRefreshes int
+		wantErr       bool
+	}{
+		"logs in on first call": {
+			pds:        &fakePDS{expiredStatus: http.StatusBadRequest, expiredError: "ExpiredToken"},
+			wantLogins: 1,
+		},
+		"expired token is refreshed": {
+			pds:           &fakePDS{expiredStatus: http.StatusBadRequest, expiredError: "ExpiredToken"},
+			expire:        true,
+			wantLogins:    1,
+			wantRefreshes: 1,
+		},
+		"invalid token is refreshed": {
+			pds:           &fakePDS{expiredStatus: http.StatusBadRequest, expiredError: "InvalidToken"},
+			expire:        true,
+			wantLogins:    1,
+			wantRefreshes: 1,
+		},
+		"unauthorized is refreshed": {
+			pds:           &fakePDS{expiredStatus: http.StatusUnauthorized, expiredError: "AuthenticationRequired"},
+			expire:        true,
+			wantLogins:    1,
+			wantRefreshes: 1,
+		},
+		"logs in again when refresh fails": {
+			pds:        &fakePDS{expiredStatus: http.StatusBadRequest, expiredError: "ExpiredToken", refreshFails: true},
+			expire:     true,
+			wantLogins: 2,
+		},
+		"other errors are returned": {
+			pds:        &fakePDS{expiredStatus: http.StatusBadRequest, expiredError: "InvalidRequest"},
+			expire:     true,
+			wantLogins: 1,
+			wantErr:    true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(tc.pds)
+			defer srv.Close()
+			client := NewClient(srv.URL, "feed.test", "password")
+
+			getSession := func(client *xrpc.Client) error {
+				_, err := atproto.ServerGetSession(t.Context(), client)
+				return err
+			}
+			if err := client.Do(t.Context(), getSession); err != nil {
+				t.Fatalf("first call: %v", err)
+			}
+			if tc.expire {
+				tc.pds.expire()
+			}
+			err := client.Do(t.Context(), getSession)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tc.wantErr)
+			}
+
+			if tc.pds.logins != tc.wantLogins || tc.pds.refreshes != tc.wantRefreshes {
+				t.Errorf("got %d logins and %d refreshes, want %d and %d", tc.pds.logins, tc.pds.refreshes, tc.wantLogins, tc.wantRefreshes)
+			}
+			if got := client.DID(); got != "did:plc:feed" {
+				t.Errorf("got DID %q, want did:plc:feed", got)
+			}
+		})
+	}
+}
+
+func TestClientRefreshesOnce(t *testing.T) {
+	pds := &fakePDS{expiredStatus: http.StatusBadRequest, expiredError: "ExpiredToken"}
+	srv := httptest.NewServer(pds)
+	defer srv.Close()
+	client := NewClient(srv.URL, "feed.test", "password")
+	if err := client.Login(t.Context()); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	pds.expire()
+
+	// calls that fail with the same expired session share one refresh
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for range 10 {
+		wg.Go(func() {
+			errs <- client.Do(t.Context(), func(client *xrpc.Client) error {
+				_, err := atproto.ServerGetSession(t.Context(), client)
+				return err
+			})
+		})
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("call: %v", err)
+		}
+	}
+	if pds.refreshes != 1 {
+		t.Errorf("got %d refreshes, want 1", pds.refreshes)
+	}
+}
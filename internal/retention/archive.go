@@ -0,0 +1,211 @@
+package retention
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nacorid/x402-feed/internal/server"
+)
+
+// importBatchSize is how many archived posts are written to the store in each transaction
+const importBatchSize = 500
+
+// archivedPost is a line of an archive file
+type archivedPost struct {
+	RKey        string   `json:"rkey"`
+	URI         string   `json:"uri"`
+	DID         string   `json:"did"`
+	ReplyRoot   string   `json:"replyRoot,omitempty"`
+	ReplyParent string   `json:"replyParent,omitempty"`
+	CreatedAt   int64    `json:"createdAt"`
+	Text        string   `json:"text,omitempty"`
+	Langs       []string `json:"langs,omitempty"`
+	EmbedType   string   `json:"embedType,omitempty"`
+	LinkDomains []string `json:"linkDomains,omitempty"`
+	Hashtags    []string `json:"hashtags,omitempty"`
+	HasMedia    bool     `json:"hasMedia,omitempty"`
+	IndexedAt   int64    `json:"indexedAt,omitempty"`
+}
+
+func newArchivedPost(post server.Post) archivedPost {
+	return archivedPost{
+		RKey:        post.RKey,
+		URI:         post.PostURI,
+		DID:         post.UserDID,
+		ReplyRoot:   post.ReplyRoot,
+		ReplyParent: post.ReplyParent,
+		CreatedAt:   post.CreatedAt,
+		Text:        post.Text,
+		Langs:       post.Langs,
+		EmbedType:   post.EmbedType,
+		LinkDomains: post.LinkDomains,
+		Hashtags:    post.Hashtags,
+		HasMedia:    post.HasMedia,
+		IndexedAt:   post.IndexedAt,
+	}
+}
+
+func (a archivedPost) post() server.Post {
+	return server.Post{
+		RKey:        a.RKey,
+		PostURI:     a.URI,
+		UserDID:     a.DID,
+		ReplyRoot:   a.ReplyRoot,
+		ReplyParent: a.ReplyParent,
+		CreatedAt:   a.CreatedAt,
+		Text:        a.Text,
+		Langs:       a.Langs,
+		EmbedType:   a.EmbedType,
+		LinkDomains: a.LinkDomains,
+		Hashtags:    a.Hashtags,
+		HasMedia:    a.HasMedia,
+		IndexedAt:   a.IndexedAt,
+	}
+}
+
+// Archive is a gzip compressed JSONL file of pruned posts, one post per line
+type Archive struct {
+	file *os.File
+	gz   *gzip.Writer
+	enc  *json.Encoder
+}
+
+// CreateArchive creates a new archive file in dir named after the time it was created
+func CreateArchive(dir string, now time.Time) (*Archive, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("create archive dir: %w", err)
+	}
+
+	filename := filepath.Join(dir, fmt.Sprintf("posts-%s.jsonl.gz", now.UTC().Format("20060102T150405Z")))
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("create archive file: %w", err)
+	}
+
+	gz := gzip.NewWriter(file)
+	return &Archive{
+		file: file,
+		gz:   gz,
+		enc:  json.NewEncoder(gz),
+	}, nil
+}
+
+// Name returns the path of the archive file
+func (a *Archive) Name() string {
+	return a.file.Name()
+}
+
+// Write adds posts to the archive. The posts are on disk once it returns so they can be safely deleted
+func (a *Archive) Write(posts []server.Post) error {
+	for _, post := range posts {
+		err := a.enc.Encode(newArchivedPost(post))
+		if err != nil {
+			return fmt.Errorf("encode post: %w", err)
+		}
+	}
+
+	err := a.gz.Flush()
+	if err != nil {
+		return fmt.Errorf("flush archive: %w", err)
+	}
+	err = a.file.Sync()
+	if err != nil {
+		return fmt.Errorf("sync archive: %w", err)
+	}
+	return nil
+}
+
+// Close finishes the archive file
+func (a *Archive) Close() error {
+	err := a.gz.Close()
+	if err != nil {
+		_ = a.file.Close()
+		return fmt.Errorf("close archive: %w", err)
+	}
+	return a.file.Close()
+}
+
+// ReadArchive calls fn for every post in an archive. An archive that wasn't closed, because the pruner
+// was stopped part way through, can still be read up to the last batch of posts that was written
+func ReadArchive(r io.Reader, fn func(post server.Post) error) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("open gzip: %w", err)
+	}
+	defer func() {
+		_ = gz.Close()
+	}()
+
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var archived archivedPost
+		err := json.Unmarshal(scanner.Bytes(), &archived)
+		if err != nil {
+			return fmt.Errorf("decode post: %w", err)
+		}
+		err = fn(archived.post())
+		if err != nil {
+			return err
+		}
+	}
+
+	err = scanner.Err()
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		slog.Warn("archive is truncated, it was probably not closed cleanly")
+		return nil
+	}
+	return err
+}
+
+// ImportArchive stores every post in an archive file. Posts that are already stored keep their place in
+// the feed. It returns how many posts were read from the archive
+func ImportArchive(ctx context.Context, store server.PostStore, filename string) (int, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, fmt.Errorf("open archive: %w", err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	count := 0
+	batch := make([]server.Write, 0, importBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := store.ApplyWrites(ctx, server.WriteBatch{Writes: batch})
+		if err != nil {
+			return fmt.Errorf("store posts: %w", err)
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	err = ReadArchive(file, func(post server.Post) error {
+		count++
+		batch = append(batch, server.Write{Kind: server.WriteCreatePost, Post: post})
+		if len(batch) < importBatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, flush()
+}
@@ -0,0 +1,213 @@
+// Package retention stops the posts table growing forever by pruning posts that are older than the
+// feed needs, optionally archiving them first so they can be imported again
+package retention
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/nacorid/x402-feed/internal/server"
+)
+
+// Defaults for how the pruner runs
+const (
+	DefaultBatchSize  = 500
+	DefaultBatchDelay = 100 * time.Millisecond
+	DefaultInterval   = time.Hour
+)
+
+// Config is the retention policy and how the pruner applies it
+type Config struct {
+	// MaxAge, if set, prunes posts created longer ago than it
+	MaxAge time.Duration
+	// MaxPosts, if set, prunes posts that aren't among the newest MaxPosts posts of any of the feeds.
+	// Feeds with allow lists or searches serve different posts so each of them keeps its own newest posts
+	MaxPosts int
+	// Feeds are the feeds MaxPosts applies to, with their authors from AuthorLists if it's set. Without
+	// any feeds MaxPosts applies to every post that isn't hidden
+	Feeds       []server.FeedConfig
+	AuthorLists server.AuthorLists
+	// BatchSize is how many posts are deleted at a time and BatchDelay is how long to wait between
+	// batches, so that the feed can still be read and written to while a lot of posts are pruned
+	BatchSize  int
+	BatchDelay time.Duration
+	// Interval is how often the pruner runs
+	Interval time.Duration
+	// ArchiveDir, if set, is where pruned posts are written before they're deleted
+	ArchiveDir string
+}
+
+// Enabled reports whether the config prunes anything
+func (c Config) Enabled() bool {
+	return c.MaxAge > 0 || c.MaxPosts > 0
+}
+
+// Pruner deletes posts that are outside the retention policy
+type Pruner struct {
+	store server.PostStore
+	cfg   Config
+}
+
+// NewPruner returns a pruner. Call Run to start pruning in the background
+func NewPruner(store server.PostStore, cfg Config) *Pruner {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+	if cfg.BatchDelay <= 0 {
+		cfg.BatchDelay = DefaultBatchDelay
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	return &Pruner{
+		store: store,
+		cfg:   cfg,
+	}
+}
+
+// Run prunes straight away and then every interval until the context is cancelled
+func (p *Pruner) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		pruned, err := p.Prune(ctx, time.Now())
+		if err != nil {
+			slog.Error("pruning posts", "error", err, "pruned", pruned)
+		} else if pruned > 0 {
+			slog.Info("pruned posts", "count", pruned)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Prune deletes every post outside the retention policy at the given time, a batch at a time. It
+// returns how many posts were deleted
+func (p *Pruner) Prune(ctx context.Context, now time.Time) (int, error) {
+	var tooOld int64
+	if p.cfg.MaxAge > 0 {
+		tooOld = now.Add(-p.cfg.MaxAge).UnixMilli()
+	}
+	kept, keptBefore, err := p.newestPosts(ctx)
+	if err != nil {
+		return 0, err
+	}
+	query := server.PruneQuery{
+		Before: max(tooOld, keptBefore),
+		Limit:  p.cfg.BatchSize,
+	}
+
+	var archive *Archive
+	defer func() {
+		if archive == nil {
+			return
+		}
+		if err := archive.Close(); err != nil {
+			slog.Error("closing archive", "error", err, "file", archive.Name())
+		}
+	}()
+
+	pruned := 0
+	for {
+		posts, err := p.store.GetPrunablePosts(ctx, query)
+		if err != nil {
+			return pruned, fmt.Errorf("get prunable posts: %w", err)
+		}
+		if len(posts) == 0 {
+			return pruned, nil
+		}
+
+		// posts that a feed still serves are left where they are and paged past
+		prunable := make([]server.Post, 0, len(posts))
+		for _, post := range posts {
+			if post.CreatedAt < tooOld || !kept[post.PostURI] {
+				prunable = append(prunable, post)
+			}
+		}
+		query.Offset += len(posts) - len(prunable)
+		posts = prunable
+		if len(posts) == 0 {
+			continue
+		}
+
+		if p.cfg.ArchiveDir != "" {
+			// the archive is only created once there's something to put in it
+			if archive == nil {
+				archive, err = CreateArchive(p.cfg.ArchiveDir, now)
+				if err != nil {
+					return pruned, err
+				}
+				slog.Info("archiving pruned posts", "file", archive.Name())
+			}
+			err = archive.Write(posts)
+			if err != nil {
+				return pruned, fmt.Errorf("archive posts: %w", err)
+			}
+		}
+
+		uris := make([]string, 0, len(posts))
+		for _, post := range posts {
+			uris = append(uris, post.PostURI)
+		}
+		err = p.store.DeletePostsFromURIs(ctx, uris)
+		if err != nil {
+			return pruned, fmt.Errorf("delete posts: %w", err)
+		}
+		pruned += len(posts)
+
+		select {
+		case <-time.After(p.cfg.BatchDelay):
+		case <-ctx.Done():
+			return pruned, ctx.Err()
+		}
+	}
+}
+
+// newestPosts returns the URIs of the newest MaxPosts posts of each feed and the time before which posts
+// that none of the feeds keep are pruned. That's when the oldest kept post of the feed whose kept posts
+// are the most recent was created, as newer posts are still within that feed's newest MaxPosts
+func (p *Pruner) newestPosts(ctx context.Context) (map[string]bool, int64, error) {
+	if p.cfg.MaxPosts <= 0 {
+		return nil, 0, nil
+	}
+
+	feeds := p.cfg.Feeds
+	if len(feeds) == 0 {
+		feeds = []server.FeedConfig{{}}
+	}
+
+	kept := make(map[string]bool)
+	var keptBefore int64
+	for _, feed := range feeds {
+		query := server.NewFeedQuery(feed, p.cfg.AuthorLists)
+		// the newest posts are kept whether or not they are boosted and reposts aren't posts of their own
+		query.BoostUsers = nil
+		query.BoostLists = nil
+		query.Boost = 0
+		query.IncludeReposts = false
+		query.Cursor = math.MaxInt64
+		query.Limit = p.cfg.MaxPosts
+
+		posts, err := p.store.GetFeedPosts(ctx, query)
+		if err != nil {
+			return nil, 0, fmt.Errorf("get newest posts of feed %q: %w", feed.Name, err)
+		}
+		for _, post := range posts {
+			kept[post.PostURI] = true
+		}
+		// every post of a feed with fewer posts than it keeps is in kept so it has no say in when posts are
+		// pruned
+		if len(posts) == p.cfg.MaxPosts {
+			keptBefore = max(keptBefore, posts[len(posts)-1].CreatedAt)
+		}
+	}
+	return kept, keptBefore, nil
+}
@@ -0,0 +1,192 @@
+package retention
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nacorid/x402-feed/internal/memstore"
+	"github.com/nacorid/x402-feed/internal/server"
+)
+
+func storedURIs(t *testing.T, store server.PostStore) []string {
+	t.Helper()
+	posts, err := store.GetFeedPosts(context.Background(), server.FeedQuery{Cursor: 9999999999999, Limit: 100})
+	if err != nil {
+		t.Fatalf("get feed posts: %v", err)
+	}
+	uris := make([]string, 0, len(posts))
+	for _, p := range posts {
+		uris = append(uris, p.PostURI)
+	}
+	return uris
+}
+
+func TestPruneAndImport(t *testing.T) {
+	now := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	store := memstore.New()
+	ctx := context.Background()
+
+	// a post a day for the last 10 days, the newest first
+	for i := range 10 {
+		err := store.CreatePost(ctx, server.Post{
+			RKey:      fmt.Sprintf("%d", i),
+			PostURI:   fmt.Sprintf("at://did:plc:a/app.bsky.feed.post/%d", i),
+			UserDID:   "did:plc:a",
+			CreatedAt: now.Add(-time.Duration(i)*24*time.Hour - time.Hour).UnixMilli(),
+		})
+		if err != nil {
+			t.Fatalf("create post: %v", err)
+		}
+	}
+
+	archiveDir := t.TempDir()
+	pruner := NewPruner(store, Config{MaxAge: 7 * 24 * time.Hour, BatchSize: 2, BatchDelay: time.Millisecond, ArchiveDir: archiveDir})
+	pruned, err := pruner.Prune(ctx, now)
+	if err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if pruned != 3 {
+		t.Errorf("pruned %d posts, want the 3 older than 7 days", pruned)
+	}
+	if got := storedURIs(t, store); len(got) != 7 {
+		t.Errorf("got %d posts left, want 7", len(got))
+	}
+
+	pruner = NewPruner(store, Config{MaxPosts: 5, BatchDelay: time.Millisecond})
+	pruned, err = pruner.Prune(ctx, now)
+	if err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if got := storedURIs(t, store); pruned != 2 || len(got) != 5 || got[4] != "at://did:plc:a/app.bsky.feed.post/4" {
+		t.Errorf("pruned %d posts leaving %v, want the newest 5 posts kept", pruned, got)
+	}
+
+	archives, err := filepath.Glob(filepath.Join(archiveDir, "*.jsonl.gz"))
+	if err != nil || len(archives) != 1 {
+		t.Fatalf("got archives %v, want one archive file: %v", archives, err)
+	}
+
+	restored := memstore.New()
+	imported, err := ImportArchive(ctx, restored, archives[0])
+	if err != nil {
+		t.Fatalf("import archive: %v", err)
+	}
+	got := storedURIs(t, restored)
+	want := []string{"at://did:plc:a/app.bsky.feed.post/7", "at://did:plc:a/app.bsky.feed.post/8", "at://did:plc:a/app.bsky.feed.post/9"}
+	if imported != 3 || len(got) != 3 || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("imported %d posts %v, want %v", imported, got, want)
+	}
+}
+
+// allowLists maps feeds to the key of the stored list of authors they allow
+type allowLists map[string]string
+
+func (a allowLists) FeedAuthors(feed string) server.FeedAuthors {
+	if a[feed] == "" {
+		return server.FeedAuthors{}
+	}
+	return server.FeedAuthors{AllowLists: []string{a[feed]}}
+}
+
+func (a allowLists) LastRefreshed() time.Time {
+	return time.Now()
+}
+
+func TestPruneKeepsNewestPostsOfEachFeed(t *testing.T) {
+	now := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	store := memstore.New()
+	ctx := context.Background()
+
+	// a post an hour, the newest first
+	posts := []struct{ did, text string }{
+		{"did:plc:a", "x402"},
+		{"did:plc:a", "x402"},
+		{"did:plc:a", "x402"},
+		{"did:plc:b", "x402"},
+		{"did:plc:a", "x402 payments"},
+		{"did:plc:b", "x402"},
+		{"did:plc:a", "x402"},
+		{"did:plc:b", "x402"},
+	}
+	for i, p := range posts {
+		err := store.CreatePost(ctx, server.Post{
+			RKey:      fmt.Sprintf("%d", i),
+			PostURI:   fmt.Sprintf("at://%s/app.bsky.feed.post/%d", p.did, i),
+			UserDID:   p.did,
+			Text:      p.text,
+			CreatedAt: now.Add(-time.Duration(i) * time.Hour).UnixMilli(),
+		})
+		if err != nil {
+			t.Fatalf("create post: %v", err)
+		}
+	}
+	err := store.ReplaceList(ctx, server.StoredList{Key: "b", URI: "at://did:plc:owner/app.bsky.graph.list/b", Members: []server.ListMember{{RKey: "1", DID: "did:plc:b"}}})
+	if err != nil {
+		t.Fatalf("replace list: %v", err)
+	}
+
+	pruner := NewPruner(store, Config{
+		MaxPosts:   2,
+		BatchSize:  2,
+		BatchDelay: time.Millisecond,
+		Feeds: []server.FeedConfig{
+			{Name: "all"},
+			{Name: "b"},
+			{Name: "payments", Search: "payments"},
+		},
+		AuthorLists: allowLists{"b": "b"},
+	})
+	pruned, err := pruner.Prune(ctx, now)
+	if err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+
+	got := storedURIs(t, store)
+	want := []string{
+		"at://did:plc:a/app.bsky.feed.post/0",
+		"at://did:plc:a/app.bsky.feed.post/1",
+		"at://did:plc:b/app.bsky.feed.post/3",
+		"at://did:plc:a/app.bsky.feed.post/4",
+		"at://did:plc:b/app.bsky.feed.post/5",
+	}
+	if pruned != 3 || !slices.Equal(got, want) {
+		t.Errorf("pruned %d posts leaving %v, want %v", pruned, got, want)
+	}
+}
+
+func TestReadUnclosedArchive(t *testing.T) {
+	dir := t.TempDir()
+	archive, err := CreateArchive(dir, time.Now())
+	if err != nil {
+		t.Fatalf("create archive: %v", err)
+	}
+	err = archive.Write([]server.Post{{RKey: "1", PostURI: "at://did:plc:a/app.bsky.feed.post/1", UserDID: "did:plc:a", CreatedAt: 100}})
+	if err != nil {
+		t.Fatalf("write archive: %v", err)
+	}
+
+	// the archive is read without being closed, as if the pruner had been stopped
+	file, err := os.Open(archive.Name())
+	if err != nil {
+		t.Fatalf("open archive: %v", err)
+	}
+	defer file.Close()
+
+	var posts []server.Post
+	err = ReadArchive(file, func(post server.Post) error {
+		posts = append(posts, post)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("read archive: %v", err)
+	}
+	if len(posts) != 1 || posts[0].PostURI != "at://did:plc:a/app.bsky.feed.post/1" || posts[0].CreatedAt != 100 {
+		t.Errorf("got %+v, want the written post", posts)
+	}
+	_ = archive.Close()
+}
@@ -0,0 +1,220 @@
+// Package search parses the queries used to search stored posts. The syntax is the same as most web
+// search engines: words are all required, "quoted phrases" must appear together, OR between words
+// matches either of them and a leading - excludes a word. For example:
+//
+//	x402 facilitator OR usdc -scam
+//
+// matches posts mentioning x402 along with either facilitator or usdc that don't mention scam
+package search
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+// Term is a word or phrase in a query
+type Term struct {
+	// Tokens are the words of the term in lowercase. A term with more than one token is a phrase
+	Tokens []string
+	// Negated terms must not appear in matching posts
+	Negated bool
+}
+
+// Query is a parsed search. A post matches if every term of any one of the groups matches
+type Query struct {
+	Groups [][]Term
+}
+
+// ErrEmptyQuery is returned for queries without any words to search for
+var ErrEmptyQuery = errors.New("search has nothing to search for")
+
+// Parse parses a search query
+func Parse(q string) (Query, error) {
+	var query Query
+	var group []Term
+	for _, word := range splitWords(q) {
+		if word == "OR" {
+			if len(group) > 0 {
+				query.Groups = append(query.Groups, group)
+				group = nil
+			}
+			continue
+		}
+
+		term := Term{}
+		if strings.HasPrefix(word, "-") {
+			term.Negated = true
+			word = word[1:]
+		}
+		term.Tokens = Tokenize(strings.Trim(word, `"`))
+		if len(term.Tokens) == 0 {
+			continue
+		}
+		group = append(group, term)
+	}
+	if len(group) > 0 {
+		query.Groups = append(query.Groups, group)
+	}
+
+	if len(query.Groups) == 0 {
+		return query, ErrEmptyQuery
+	}
+	for _, group := range query.Groups {
+		if !hasPositiveTerm(group) {
+			return query, errors.New("search can't only exclude words, it needs a word to search for")
+		}
+	}
+	return query, nil
+}
+
+// splitWords splits a query on spaces, keeping quoted phrases together
+func splitWords(q string) []string {
+	var words []string
+	var word strings.Builder
+	quoted := false
+	for _, r := range q {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			word.WriteRune(r)
+		case unicode.IsSpace(r) && !quoted:
+			if word.Len() > 0 {
+				words = append(words, word.String())
+				word.Reset()
+			}
+		default:
+			word.WriteRune(r)
+		}
+	}
+	if word.Len() > 0 {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+func hasPositiveTerm(group []Term) bool {
+	for _, term := range group {
+		if !term.Negated {
+			return true
+		}
+	}
+	return false
+}
+
+// Tokenize splits text into lowercase words the same way the sqlite full-text index does, on anything
+// that isn't a letter or number
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// FTS5 returns the query in sqlite's full-text search syntax
+func (q Query) FTS5() string {
+	groups := make([]string, 0, len(q.Groups))
+	for _, group := range q.Groups {
+		// fts5 can't start with NOT so the words that must appear come first
+		var positive, negative []string
+		for _, term := range group {
+			phrase := `"` + strings.Join(term.Tokens, " ") + `"`
+			if term.Negated {
+				negative = append(negative, "NOT "+phrase)
+			} else {
+				positive = append(positive, phrase)
+			}
+		}
+		groups = append(groups, "("+strings.Join(append(positive, negative...), " ")+")")
+	}
+	return strings.Join(groups, " OR ")
+}
+
+// Match reports whether text matches the query
+func (q Query) Match(text string) bool {
+	tokens := Tokenize(text)
+	for _, group := range q.Groups {
+		if groupMatches(group, tokens) {
+			return true
+		}
+	}
+	return false
+}
+
+func groupMatches(group []Term, tokens []string) bool {
+	for _, term := range group {
+		if containsPhrase(tokens, term.Tokens) == term.Negated {
+			return false
+		}
+	}
+	return true
+}
+
+func containsPhrase(tokens, phrase []string) bool {
+	for i := 0; i+len(phrase) <= len(tokens); i++ {
+		match := true
+		for j, token := range phrase {
+			if tokens[i+j] != token {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// TSQuery returns the query in postgres's to_tsquery syntax
+func (q Query) TSQuery() string {
+	groups := make([]string, 0, len(q.Groups))
+	for _, group := range q.Groups {
+		terms := make([]string, 0, len(group))
+		for _, term := range group {
+			// tokens are only letters and numbers so don't need quoting
+			phrase := strings.Join(term.Tokens, " <-> ")
+			if len(term.Tokens) > 1 {
+				phrase = "(" + phrase + ")"
+			}
+			if term.Negated {
+				phrase = "!" + phrase
+			}
+			terms = append(terms, phrase)
+		}
+		groups = append(groups, "("+strings.Join(terms, " & ")+")")
+	}
+	return strings.Join(groups, " | ")
+}
+
+// And returns a query matching posts that match both queries
+func (q Query) And(other Query) Query {
+	var and Query
+	for _, a := range q.Groups {
+		for _, b := range other.Groups {
+			group := make([]Term, 0, len(a)+len(b))
+			group = append(group, a...)
+			and.Groups = append(and.Groups, append(group, b...))
+		}
+	}
+	return and
+}
+
+// String returns the query in the syntax Parse accepts
+func (q Query) String() string {
+	groups := make([]string, 0, len(q.Groups))
+	for _, group := range q.Groups {
+		terms := make([]string, 0, len(group))
+		for _, term := range group {
+			word := strings.Join(term.Tokens, " ")
+			if len(term.Tokens) > 1 {
+				word = `"` + word + `"`
+			}
+			if term.Negated {
+				word = "-" + word
+			}
+			terms = append(terms, word)
+		}
+		groups = append(groups, strings.Join(terms, " "))
+	}
+	return strings.Join(groups, " OR ")
+}
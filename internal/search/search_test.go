@@ -0,0 +1,80 @@
+package search
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		query  string
+		fts5   string
+		ts     string
+		string string
+	}{
+		{query: "x402", fts5: `("x402")`, ts: `(x402)`, string: "x402"},
+		{query: "X402  Facilitator", fts5: `("x402" "facilitator")`, ts: `(x402 & facilitator)`, string: "x402 facilitator"},
+		{query: "facilitator OR usdc", fts5: `("facilitator") OR ("usdc")`, ts: `(facilitator) | (usdc)`, string: "facilitator OR usdc"},
+		{query: "-scam x402", fts5: `("x402" NOT "scam")`, ts: `(!scam & x402)`, string: "-scam x402"},
+		{query: `"payment required" #x402`, fts5: `("payment required" "x402")`, ts: `((payment <-> required) & x402)`, string: `"payment required" x402`},
+		{query: `x402.org`, fts5: `("x402 org")`, ts: `((x402 <-> org))`, string: `"x402 org"`},
+		{query: `OR x402 OR`, fts5: `("x402")`, ts: `(x402)`, string: "x402"},
+	}
+	for _, tt := range tests {
+		q, err := Parse(tt.query)
+		if err != nil {
+			t.Errorf("parse %q: %v", tt.query, err)
+			continue
+		}
+		if got := q.FTS5(); got != tt.fts5 {
+			t.Errorf("parse %q: got fts5 %s, want %s", tt.query, got, tt.fts5)
+		}
+		if got := q.TSQuery(); got != tt.ts {
+			t.Errorf("parse %q: got tsquery %s, want %s", tt.query, got, tt.ts)
+		}
+		if got := q.String(); got != tt.string {
+			t.Errorf("parse %q: got string %s, want %s", tt.query, got, tt.string)
+		}
+	}
+
+	for _, query := range []string{"", "  ", "OR", "-scam", "x402 OR -scam", `"!!"`} {
+		if _, err := Parse(query); err == nil {
+			t.Errorf("parse %q: expected an error", query)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	text := "Running an x402 facilitator that settles in USDC on Base"
+	tests := map[string]bool{
+		"x402":                  true,
+		"X402 usdc":             true,
+		"x402 eth":              false,
+		"eth OR usdc":           true,
+		"x402 -usdc":            false,
+		"x402 -eth":             true,
+		`"x402 facilitator"`:    true,
+		`"facilitator x402"`:    false,
+		`"settles in usdc" x40`: false,
+	}
+	for query, want := range tests {
+		q, err := Parse(query)
+		if err != nil {
+			t.Fatalf("parse %q: %v", query, err)
+		}
+		if got := q.Match(text); got != want {
+			t.Errorf("match %q: got %v, want %v", query, got, want)
+		}
+	}
+}
+
+func TestAnd(t *testing.T) {
+	a, err := Parse("facilitator OR usdc")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	b, err := Parse("x402 -scam")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if got, want := a.And(b).String(), "facilitator x402 -scam OR usdc x402 -scam"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// defaultCursorScore is used when no cursor is provided. It's a date waaaaay in the future to start the
+// less than query
+const defaultCursorScore = 9999999999999
+
+// feedCursor is the position in a feed that the next page starts from. As well as the score and ID of the
+// last post shown, as posts can share a score, it holds the IDs of posts that were pushed back from
+// earlier pages by a feed's diversity limits and are yet to be shown. It's encoded as "score", "score:id"
+// or "score:id:id,id,id"
+type feedCursor struct {
+	Score    int64
+	ID       int
+	Deferred []int
+}
+
+func parseFeedCursor(cursor string) (feedCursor, error) {
+	fCursor := feedCursor{Score: defaultCursorScore}
+	if cursor == "" {
+		return fCursor, nil
+	}
+
+	parts := strings.SplitN(cursor, ":", 3)
+	score, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return fCursor, fmt.Errorf("parse cursor score: %w", err)
+	}
+	if score == 0 {
+		return fCursor, nil
+	}
+
+	var id int
+	if len(parts) > 1 {
+		id, err = strconv.Atoi(parts[1])
+		if err != nil {
+			return fCursor, fmt.Errorf("parse cursor ID: %w", err)
+		}
+	}
+
+	deferred := make([]int, 0)
+	if len(parts) > 2 && parts[2] != "" {
+		for _, idStr := range strings.Split(parts[2], ",") {
+			id, err := strconv.Atoi(idStr)
+			if err != nil {
+				return fCursor, fmt.Errorf("parse cursor deferred post: %w", err)
+			}
+			deferred = append(deferred, id)
+		}
+	}
+
+	fCursor.Score = score
+	fCursor.ID = id
+	fCursor.Deferred = deferred
+	return fCursor, nil
+}
+
+func (c feedCursor) String() string {
+	cursor := strconv.FormatInt(c.Score, 10)
+	if c.ID == 0 && len(c.Deferred) == 0 {
+		return cursor
+	}
+	cursor += ":" + strconv.Itoa(c.ID)
+	if len(c.Deferred) == 0 {
+		return cursor
+	}
+	ids := make([]string, 0, len(c.Deferred))
+	for _, id := range c.Deferred {
+		ids = append(ids, strconv.Itoa(id))
+	}
+	return cursor + ":" + strings.Join(ids, ",")
+}
+
+// maxDeferredPosts is how many pushed back posts can be carried in a cursor. Once it's full posts are
+// shown even if they break the feed's limits so that the cursor stays small
+const maxDeferredPosts = 50
+
+// maxDiversityFetches is how many times the store is asked for more posts when filling a page before
+// giving up and returning a short page
+const maxDiversityFetches = 5
+
+// getDiversifiedPage builds a page of a feed where posts that would take an author over the feed's per
+// page limit, or that are from a thread already on the page, are pushed back to a later page. The pushed
+// back posts are carried in the cursor and shown first on the next page so that paging through the feed
+// still returns every post exactly once
+func (s *Server) getDiversifiedPage(ctx context.Context, feed FeedConfig, query FeedQuery, cursor feedCursor) ([]Post, *feedCursor, error) {
+	limit := query.Limit
+	page := make([]Post, 0, limit)
+	pushedBack := make([]int, 0)
+	authorCounts := make(map[string]int)
+	threads := make(map[string]struct{})
+	next := feedCursor{Score: cursor.Score, ID: cursor.ID}
+
+	consider := func(post Post) {
+		thread := post.ReplyRoot
+		if thread == "" {
+			thread = post.PostURI
+		}
+		_, threadOnPage := threads[thread]
+		overAuthorLimit := feed.MaxPostsPerAuthor > 0 && authorCounts[post.UserDID] >= feed.MaxPostsPerAuthor
+
+		// reposts are never pushed back as they're placed by when they were reposted rather than posted
+		pushBack := post.RepostURI == "" && (overAuthorLimit || (feed.CollapseThreads && threadOnPage))
+		if pushBack && len(pushedBack) < maxDeferredPosts {
+			pushedBack = append(pushedBack, post.ID)
+			return
+		}
+
+		page = append(page, post)
+		authorCounts[post.UserDID]++
+		threads[thread] = struct{}{}
+	}
+
+	if len(cursor.Deferred) > 0 {
+		deferredQuery := query
+		deferredQuery.Cursor = defaultCursorScore
+		deferredQuery.Limit = len(cursor.Deferred)
+		deferredQuery.OnlyIDs = cursor.Deferred
+		deferredQuery.IncludeReposts = false
+		deferred, err := s.postStore.GetFeedPosts(ctx, deferredQuery)
+		if err != nil {
+			return nil, nil, fmt.Errorf("get deferred posts from DB: %w", err)
+		}
+
+		for i, post := range deferred {
+			if len(page) == limit {
+				// deferred posts that weren't reached still need to be shown on a later page
+				for _, unreached := range deferred[i:] {
+					pushedBack = append(pushedBack, unreached.ID)
+				}
+				break
+			}
+			consider(post)
+		}
+	}
+
+	// fetch more than a page at a time so that there's something to fill the page with when posts are
+	// pushed back
+	query.Limit = limit * 2
+	moreFresh := true
+	for fetches := 0; moreFresh && len(page) < limit && fetches < maxDiversityFetches; fetches++ {
+		query.Cursor, query.CursorID = next.Score, next.ID
+		fresh, err := s.postStore.GetFeedPosts(ctx, query)
+		if err != nil {
+			return nil, nil, fmt.Errorf("get feed from DB: %w", err)
+		}
+
+		consumed := 0
+		for _, post := range fresh {
+			if len(page) == limit {
+				break
+			}
+			next.Score, next.ID = post.Score, post.ID
+			consider(post)
+			consumed++
+		}
+		// fresh posts that weren't reached are after the cursor so will be fetched again
+		moreFresh = len(fresh) == query.Limit || consumed < len(fresh)
+	}
+	next.Deferred = pushedBack
+
+	if !moreFresh && len(next.Deferred) == 0 {
+		return page, nil, nil
+	}
+	return page, &next, nil
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"testing"
+)
+
+// fakeStore is a post store that only serves feed queries from a fixed set of posts
+type fakeStore struct {
+	PostStore
+	posts []Post
+}
+
+func (f *fakeStore) GetFeedPosts(_ context.Context, query FeedQuery) ([]Post, error) {
+	posts := make([]Post, 0)
+	for _, post := range f.posts {
+		if post.Score > query.Cursor || (post.Score == query.Cursor && (query.CursorID == 0 || post.ID >= query.CursorID)) {
+			continue
+		}
+		if query.OnlyIDs != nil && !slices.Contains(query.OnlyIDs, post.ID) {
+			continue
+		}
+		posts = append(posts, post)
+	}
+	sort.Slice(posts, func(i, j int) bool {
+		if posts[i].Score != posts[j].Score {
+			return posts[i].Score > posts[j].Score
+		}
+		return posts[i].ID > posts[j].ID
+	})
+	if len(posts) > query.Limit {
+		posts = posts[:query.Limit]
+	}
+	return posts, nil
+}
+
+func (f *fakeStore) GetPins(_ context.Context, feed string, now int64) ([]Pin, error) {
+	return nil, nil
+}
+
+// testPosts returns posts where the first author posts in bursts and most posts are replies in a few
+// threads, which are the cases the diversity limits push back
+func testPosts(n int) []Post {
+	posts := make([]Post, 0, n)
+	for i := 0; i < n; i++ {
+		author := fmt.Sprintf("did:plc:author%d", i%3)
+		if i%5 < 3 {
+			author = "did:plc:prolific"
+		}
+		uri := fmt.Sprintf("at://%s/app.bsky.feed.post/%d", author, i)
+		root := ""
+		if i%4 != 0 {
+			root = fmt.Sprintf("at://did:plc:author0/app.bsky.feed.post/thread%d", i%2)
+		}
+		posts = append(posts, Post{
+			ID:        i + 1,
+			PostURI:   uri,
+			UserDID:   author,
+			ReplyRoot: root,
+			CreatedAt: int64(1000 + i),
+			Score:     int64(1000 + i),
+		})
+	}
+	return posts
+}
+
+// tiedPosts returns the test posts with groups of them sharing a score, as boosted posts and posts stored
+// in the same millisecond do
+func tiedPosts(n int) []Post {
+	posts := testPosts(n)
+	for i := range posts {
+		posts[i].Score = int64(1000 + i/4)
+	}
+	return posts
+}
+
+func TestDiversifiedFeedPagination(t *testing.T) {
+	tests := map[string]FeedConfig{
+		"no limits":                       {Name: "feed"},
+		"author cap":                      {Name: "feed", MaxPostsPerAuthor: 2},
+		"collapse threads":                {Name: "feed", CollapseThreads: true},
+		"author cap and collapse threads": {Name: "feed", MaxPostsPerAuthor: 1, CollapseThreads: true},
+	}
+
+	for name, feed := range tests {
+		for _, tc := range []struct{ posts, limit int }{{45, 1}, {45, 3}, {45, 7}, {45, 50}, {300, 10}, {300, 30}} {
+			for postsName, makePosts := range map[string]func(int) []Post{"unique scores": testPosts, "tied scores": tiedPosts} {
+				limit := tc.limit
+				t.Run(fmt.Sprintf("%s %s %d posts limit %d", name, postsName, tc.posts, limit), func(t *testing.T) {
+					posts := makePosts(tc.posts)
+					s := &Server{postStore: &fakeStore{posts: posts}, feeds: []FeedConfig{feed}}
+
+					seen := make(map[string]int)
+					cursor := ""
+					for page := 0; ; page++ {
+						if page > len(posts)*2 {
+							t.Fatalf("pagination did not finish")
+						}
+
+						resp, err := s.getFeed(context.Background(), feed, cursor, limit)
+						if err != nil {
+							t.Fatalf("get feed: %v", err)
+						}
+						if len(resp.Feed) > limit {
+							t.Fatalf("page has %d posts but the limit is %d", len(resp.Feed), limit)
+						}
+
+						authorCounts := make(map[string]int)
+						for _, post := range resp.Feed {
+							seen[post.Post]++
+							for _, p := range posts {
+								if p.PostURI == post.Post {
+									authorCounts[p.UserDID]++
+								}
+							}
+						}
+						// the cap can only be broken once the cursor can't carry any more pushed back posts
+						if feed.MaxPostsPerAuthor > 0 && len(posts) <= maxDeferredPosts {
+							for author, count := range authorCounts {
+								if count > feed.MaxPostsPerAuthor {
+									t.Errorf("page %d has %d posts from %s", page, count, author)
+								}
+							}
+						}
+
+						if resp.Cursor == "" {
+							break
+						}
+						cursor = resp.Cursor
+					}
+
+					for _, post := range posts {
+						if seen[post.PostURI] != 1 {
+							t.Errorf("post %s was returned %d times", post.PostURI, seen[post.PostURI])
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestDiversifiedFeedSpreadsAuthors(t *testing.T) {
+	posts := make([]Post, 0)
+	for i := 0; i < 6; i++ {
+		author := "did:plc:prolific"
+		if i == 0 {
+			author = "did:plc:other"
+		}
+		posts = append(posts, Post{
+			ID:      i + 1,
+			PostURI: fmt.Sprintf("at://%s/app.bsky.feed.post/%d", author, i),
+			UserDID: author,
+			Score:   int64(1000 + i),
+		})
+	}
+	feed := FeedConfig{Name: "feed", MaxPostsPerAuthor: 1}
+	s := &Server{postStore: &fakeStore{posts: posts}, feeds: []FeedConfig{feed}}
+
+	resp, err := s.getFeed(context.Background(), feed, "", 2)
+	if err != nil {
+		t.Fatalf("get feed: %v", err)
+	}
+	got := make([]string, 0)
+	for _, post := range resp.Feed {
+		got = append(got, post.Post)
+	}
+	want := []string{
+		"at://did:plc:prolific/app.bsky.feed.post/5",
+		"at://did:plc:other/app.bsky.feed.post/0",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got page %v, want %v", got, want)
+	}
+}
+
+func TestFeedCursor(t *testing.T) {
+	tests := map[string]feedCursor{
+		"":              {Score: defaultCursorScore},
+		"1234":          {Score: 1234, Deferred: []int{}},
+		"1234:8":        {Score: 1234, ID: 8, Deferred: []int{}},
+		"1234:8:5,6,7":  {Score: 1234, ID: 8, Deferred: []int{5, 6, 7}},
+		"9999999999999": {Score: defaultCursorScore, Deferred: []int{}},
+	}
+	for input, want := range tests {
+		got, err := parseFeedCursor(input)
+		if err != nil {
+			t.Fatalf("parse %q: %v", input, err)
+		}
+		if got.Score != want.Score || got.ID != want.ID || !slices.Equal(got.Deferred, want.Deferred) {
+			t.Errorf("parse %q: got %+v, want %+v", input, got, want)
+		}
+		if input != "" && got.String() != input {
+			t.Errorf("cursor %q encoded as %q", input, got.String())
+		}
+	}
+
+	if _, err := parseFeedCursor("abc"); err == nil {
+		t.Errorf("expected an error for an invalid cursor")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"time"
 
 	"github.com/nacorid/x402-feed/internal/auth"
 )
@@ -25,8 +26,15 @@ type FeedSkeletonReponse struct {
 
 // FeedSkeletonPost describes an individual post which is just the post URI
 type FeedSkeletonPost struct {
-	Post        string `json:"post"`
-	FeedContext string `json:"feedContext"`
+	Post        string              `json:"post"`
+	Reason      *FeedSkeletonReason `json:"reason,omitempty"`
+	FeedContext string              `json:"feedContext"`
+}
+
+// FeedSkeletonReason describes why a post is in a feed when it's there because it was reposted or pinned
+type FeedSkeletonReason struct {
+	Type   string `json:"$type"`
+	Repost string `json:"repost,omitempty"`
 }
 
 // HandleGetFeedSkeleton is the handler that will build up and return a feed response
@@ -52,6 +60,13 @@ func (s *Server) HandleGetFeedSkeleton(w http.ResponseWriter, r *http.Request) {
 	}
 	slog.Debug("request for feed", "feed", feed)
 
+	feedCfg, ok := s.feedConfig(feed)
+	if !ok {
+		slog.Error("unknown feed requested", "feed", feed)
+		http.Error(w, "unknown feed", http.StatusBadRequest)
+		return
+	}
+
 	limit, err := limitFromParams(params)
 	if err != nil {
 		slog.Error("get limit from params", "error", err)
@@ -64,7 +79,7 @@ func (s *Server) HandleGetFeedSkeleton(w http.ResponseWriter, r *http.Request) {
 
 	cursor := params.Get("cursor")
 
-	resp, err := s.getFeed(r.Context(), feed, cursor, limit)
+	resp, err := s.getFeed(r.Context(), feedCfg, cursor, limit)
 	if err != nil {
 		slog.Error("get feed", "error", err, "feed", feed)
 		http.Error(w, "error getting feed", http.StatusInternalServerError)
@@ -98,12 +113,13 @@ type Feed struct {
 func (s *Server) HandleDescribeFeedGenerator(w http.ResponseWriter, r *http.Request) {
 	slog.Debug("got request for describe feed", "host", r.RemoteAddr)
 	resp := DescribeFeedResponse{
-		DID: fmt.Sprintf("did:web:%s", s.feedHost),
-		Feeds: []Feed{
-			{
-				URI: fmt.Sprintf("at://%s/app.bsky.feed.generator/%s", s.feedHost, s.feedName),
-			},
-		},
+		DID:   fmt.Sprintf("did:web:%s", s.feedHost),
+		Feeds: make([]Feed, 0, len(s.feeds)),
+	}
+	for _, feed := range s.feeds {
+		resp.Feeds = append(resp.Feeds, Feed{
+			URI: fmt.Sprintf("at://%s/app.bsky.feed.generator/%s", s.feedHost, feed.Name),
+		})
 	}
 
 	b, err := json.Marshal(resp)
@@ -196,6 +212,54 @@ func (s *Server) HandleWellKnown(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(b)
 }
 
+// listsStaleAfter is how long after the last successful refresh lists are reported as stale
+const listsStaleAfter = 15 * time.Minute
+
+// HealthResponse is what's returned when the health endpoint is called
+type HealthResponse struct {
+	Status string       `json:"status"`
+	Lists  *ListsHealth `json:"lists,omitempty"`
+}
+
+// ListsHealth describes how up to date the lists used by the feeds are
+type ListsHealth struct {
+	LastRefreshed *time.Time `json:"lastRefreshed"`
+	StaleSeconds  int64      `json:"staleSeconds"`
+	Stale         bool       `json:"stale"`
+}
+
+// HandleHealth reports whether the feed generator is healthy. If the lists haven't been refreshed
+// recently the status is "degraded" as the feeds may be showing posts that should have been removed
+func (s *Server) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	resp := HealthResponse{
+		Status: "ok",
+	}
+
+	if s.authorLists != nil {
+		lastRefreshed := s.authorLists.LastRefreshed()
+		health := &ListsHealth{
+			Stale: lastRefreshed.IsZero() || time.Since(lastRefreshed) > listsStaleAfter,
+		}
+		if !lastRefreshed.IsZero() {
+			health.LastRefreshed = &lastRefreshed
+			health.StaleSeconds = int64(time.Since(lastRefreshed).Seconds())
+		}
+		if health.Stale {
+			resp.Status = "degraded"
+		}
+		resp.Lists = health
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, "failed to encode resp", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
 func limitFromParams(params url.Values) (int, error) {
 	limitStr := params.Get("limit")
 	if limitStr == "" {
@@ -208,39 +272,109 @@ func limitFromParams(params url.Values) (int, error) {
 	return limit, nil
 }
 
-func (s *Server) getFeed(ctx context.Context, feed, cursor string, limit int) (FeedSkeletonReponse, error) {
+func (s *Server) getFeed(ctx context.Context, feed FeedConfig, cursor string, limit int) (FeedSkeletonReponse, error) {
 	resp := FeedSkeletonReponse{
 		Feed: make([]FeedSkeletonPost, 0),
 	}
 
-	cursorInt, err := strconv.Atoi(cursor)
-	if err != nil && cursor != "" {
-		slog.Error("convert cursor to int", "error", err, "cursor value", cursor)
+	fCursor, err := parseFeedCursor(cursor)
+	if err != nil {
+		slog.Error("parse cursor", "error", err, "cursor value", cursor)
 	}
-	if cursorInt == 0 {
-		// if no cursor provided use a date waaaaay in the future to start the less than query
-		cursorInt = 9999999999999
+
+	query := s.feedQuery(feed)
+	query.Cursor, query.CursorID = fCursor.Score, fCursor.ID
+	query.Limit = limit
+
+	var posts []Post
+	var nextCursor *feedCursor
+	if feed.diversified() {
+		posts, nextCursor, err = s.getDiversifiedPage(ctx, feed, query, fCursor)
+		if err != nil {
+			return resp, fmt.Errorf("get diversified feed: %w", err)
+		}
+	} else {
+		posts, err = s.postStore.GetFeedPosts(ctx, query)
+		if err != nil {
+			return resp, fmt.Errorf("get feed from DB: %w", err)
+		}
+
+		// only set the return cursor if there was at least 1 record returned and that the len of records
+		// being returned is the same as the limit
+		if len(posts) > 0 && len(posts) == limit {
+			lastPost := posts[len(posts)-1]
+			nextCursor = &feedCursor{Score: lastPost.Score, ID: lastPost.ID}
+		}
 	}
 
-	posts, err := s.postStore.GetFeedPosts(cursorInt, limit)
+	pins, err := s.postStore.GetPins(ctx, feed.Name, time.Now().UnixMilli())
 	if err != nil {
-		return resp, fmt.Errorf("get feed from DB: %w", err)
+		return resp, fmt.Errorf("get pins from DB: %w", err)
 	}
 
-	usersFeed := make([]FeedSkeletonPost, 0, len(posts))
-	for _, post := range posts {
+	usersFeed := make([]FeedSkeletonPost, 0, len(pins)+len(posts))
+	pinned := make(map[string]struct{}, len(pins))
+	for _, pin := range pins {
+		if _, ok := pinned[pin.PostURI]; ok {
+			continue
+		}
+		pinned[pin.PostURI] = struct{}{}
+
+		// pins are only shown at the top of the first page
+		if cursor != "" {
+			continue
+		}
 		usersFeed = append(usersFeed, FeedSkeletonPost{
-			Post: post.PostURI,
+			Post: pin.PostURI,
+			Reason: &FeedSkeletonReason{
+				Type: "app.bsky.feed.defs#skeletonReasonPin",
+			},
 		})
 	}
 
-	resp.Feed = usersFeed
+	for _, post := range posts {
+		// pinned posts are left out of the rest of the feed so they aren't shown twice
+		if _, ok := pinned[post.PostURI]; ok && post.RepostURI == "" {
+			continue
+		}
+		skeletonPost := FeedSkeletonPost{
+			Post: post.PostURI,
+		}
+		if post.RepostURI != "" {
+			skeletonPost.Reason = &FeedSkeletonReason{
+				Type:   "app.bsky.feed.defs#skeletonReasonRepost",
+				Repost: post.RepostURI,
+			}
+		}
+		usersFeed = append(usersFeed, skeletonPost)
+	}
 
-	// only set the return cursor if there was at least 1 record returned and that the len of records
-	// being returned is the same as the limit
-	if len(posts) > 0 && len(posts) == limit {
-		lastPost := posts[len(posts)-1]
-		resp.Cursor = fmt.Sprintf("%d", lastPost.CreatedAt)
+	resp.Feed = usersFeed
+	if nextCursor != nil {
+		resp.Cursor = nextCursor.String()
 	}
 	return resp, nil
 }
+
+// feedQuery returns the query for the posts of a feed, without the cursor and limit
+func (s *Server) feedQuery(feed FeedConfig) FeedQuery {
+	return NewFeedQuery(feed, s.authorLists)
+}
+
+// NewFeedQuery returns the query for the posts of a feed, without the cursor and limit. The author lists
+// are optional and can be nil
+func NewFeedQuery(feed FeedConfig, authorLists AuthorLists) FeedQuery {
+	query := FeedQuery{
+		RootsOnly:      feed.ThreadRootsOnly,
+		IncludeReposts: feed.ShowReposts,
+		Search:         feed.Search,
+	}
+	if authorLists != nil {
+		authors := authorLists.FeedAuthors(feed.Name)
+		query.ExcludeLists = authors.DenyLists
+		query.OnlyLists = authors.AllowLists
+		query.BoostLists = authors.BoostLists
+		query.Boost = (time.Duration(feed.BoostHours) * time.Hour).Milliseconds()
+	}
+	return query
+}
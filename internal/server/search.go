@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/nacorid/x402-feed/internal/search"
+)
+
+const (
+	defaultSearchLimit = 25
+	maxSearchLimit     = 100
+	// maxSearchLength is the longest search that's accepted. Searching is public so this bounds how much
+	// work each request can ask the database to do
+	maxSearchLength = 256
+)
+
+// SearchPostsResponse is what's returned when the 'net.x402feed.searchPosts' endpoint is called. It's in
+// the same form as app.bsky.unspecced.searchPostsSkeleton so the posts can be hydrated the same way
+type SearchPostsResponse struct {
+	Cursor string               `json:"cursor,omitempty"`
+	Posts  []SearchSkeletonPost `json:"posts"`
+}
+
+// SearchSkeletonPost is a post that matched a search, which is just the post URI
+type SearchSkeletonPost struct {
+	URI string `json:"uri"`
+}
+
+// HandleSearchPosts searches the text of stored posts, newest first. The q param is the search, see the
+// search package for its syntax. If the feed param is set only posts that would be in that feed are
+// searched. Unlike feeds, searching doesn't need service auth so that it can be used from outside Bluesky
+func (s *Server) HandleSearchPosts(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("got request to search posts", "host", r.RemoteAddr)
+	params := r.URL.Query()
+
+	if len(params.Get("q")) > maxSearchLength {
+		http.Error(w, fmt.Sprintf("q query param is longer than %d characters", maxSearchLength), http.StatusBadRequest)
+		return
+	}
+	q, err := search.Parse(params.Get("q"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid q query param: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	limit, err := limitFromParams(params)
+	if err != nil {
+		http.Error(w, "invalid limit query param", http.StatusBadRequest)
+		return
+	}
+	if limit < 1 {
+		limit = defaultSearchLimit
+	}
+	limit = min(limit, maxSearchLimit)
+
+	query := FeedQuery{}
+	if feedURI := params.Get("feed"); feedURI != "" {
+		feed, ok := s.feedConfig(feedURI)
+		if !ok {
+			http.Error(w, "unknown feed", http.StatusBadRequest)
+			return
+		}
+		query = s.feedQuery(feed)
+		if query.Search != "" {
+			// already validated when the server was created
+			saved, _ := search.Parse(query.Search)
+			q = saved.And(q)
+		}
+	}
+	// each post is only returned once, reposts would just repeat it
+	query.IncludeReposts = false
+	query.Search = q.String()
+	query.Limit = limit
+
+	cursor := params.Get("cursor")
+	resp, err := s.searchPosts(r.Context(), query, cursor)
+	if err != nil {
+		slog.Error("search posts", "error", err, "q", query.Search)
+		http.Error(w, "error searching posts", http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, "failed to encode resp", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
+func (s *Server) searchPosts(ctx context.Context, query FeedQuery, cursor string) (SearchPostsResponse, error) {
+	resp := SearchPostsResponse{
+		Posts: make([]SearchSkeletonPost, 0),
+	}
+
+	fCursor, err := parseFeedCursor(cursor)
+	if err != nil {
+		slog.Error("parse cursor", "error", err, "cursor value", cursor)
+	}
+	query.Cursor, query.CursorID = fCursor.Score, fCursor.ID
+
+	posts, err := s.postStore.GetFeedPosts(ctx, query)
+	if err != nil {
+		return resp, fmt.Errorf("get posts from DB: %w", err)
+	}
+	for _, post := range posts {
+		resp.Posts = append(resp.Posts, SearchSkeletonPost{URI: post.PostURI})
+	}
+	if len(posts) > 0 && len(posts) == query.Limit {
+		lastPost := posts[len(posts)-1]
+		resp.Cursor = feedCursor{Score: lastPost.Score, ID: lastPost.ID}.String()
+	}
+	return resp, nil
+}
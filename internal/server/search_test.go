@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// searchStore records the query it was asked for
+type searchStore struct {
+	fakeStore
+	query FeedQuery
+}
+
+func (s *searchStore) GetFeedPosts(ctx context.Context, query FeedQuery) ([]Post, error) {
+	s.query = query
+	return s.fakeStore.GetFeedPosts(ctx, query)
+}
+
+func TestHandleSearchPosts(t *testing.T) {
+	store := &searchStore{fakeStore: fakeStore{posts: testPosts(5)}}
+	feeds := []FeedConfig{{Name: "facilitators", Search: "facilitator OR usdc", ShowReposts: true}}
+	srv, err := NewServer(0, "feed.example.com", feeds, store, nil)
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+
+	search := func(query string) (*httptest.ResponseRecorder, SearchPostsResponse) {
+		rec := httptest.NewRecorder()
+		srv.HandleSearchPosts(rec, httptest.NewRequest(http.MethodGet, "/xrpc/net.x402feed.searchPosts?"+query, nil))
+		var resp SearchPostsResponse
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+		}
+		return rec, resp
+	}
+
+	rec, resp := search("q=x402&limit=2")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	if len(resp.Posts) != 2 || resp.Posts[0].URI != "at://did:plc:author1/app.bsky.feed.post/4" || resp.Cursor != "1003:4" {
+		t.Errorf("got %+v, want the newest 2 posts and a cursor", resp)
+	}
+	if store.query.Search != "x402" || store.query.Limit != 2 {
+		t.Errorf("got query %+v", store.query)
+	}
+
+	_, resp = search("q=x402&limit=2&cursor=" + resp.Cursor)
+	if len(resp.Posts) != 2 || resp.Posts[0].URI != "at://did:plc:prolific/app.bsky.feed.post/2" {
+		t.Errorf("got %+v, want the next page", resp)
+	}
+
+	rec, _ = search("q=x402+-scam&feed=at://did:web:feed.example.com/app.bsky.feed.generator/facilitators")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	if want := "facilitator x402 -scam OR usdc x402 -scam"; store.query.Search != want || store.query.IncludeReposts {
+		t.Errorf("got query %+v, want search %q without reposts", store.query, want)
+	}
+
+	for _, query := range []string{"", "q=-scam", "q=" + strings.Repeat("x402+", maxSearchLength/5+1), "q=x402&feed=at://did:web:feed.example.com/app.bsky.feed.generator/unknown"} {
+		if rec, _ := search(query); rec.Code != http.StatusBadRequest {
+			t.Errorf("search %q: got status %d, want bad request", query, rec.Code)
+		}
+	}
+}
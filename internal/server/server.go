@@ -5,45 +5,354 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+
+	"github.com/nacorid/x402-feed/internal/search"
 )
 
 // Post describes a Bluesky post
 type Post struct {
-	ID        int
-	RKey      string
+	ID      int
+	RKey    string
+	PostURI string
+	UserDID string
+	// ReplyRoot and ReplyParent are the URIs of the posts this post replies to if it's a reply
+	ReplyRoot   string
+	ReplyParent string
+	CreatedAt   int64
+	// Score is what the feed is ordered by. It's the same as CreatedAt unless the post has been boosted
+	// or is a repost
+	Score int64
+	// RepostURI is set if the post is in the feed because it was reposted
+	RepostURI string
+
+	// The rest of the fields are taken from the post record when it's stored so that ranking, search and
+	// stats don't need to fetch the post again. They're empty for posts stored before they were added
+	// and for posts stored without their record, such as posts liked by a curator
+	Text  string
+	Langs []string
+	// EmbedType is the kind of embed the post has, one of the Embed constants, or empty if it has none
+	EmbedType string
+	// LinkDomains are the domains of links in the post's text and link card
+	LinkDomains []string
+	// Hashtags are the post's hashtags and tags in lowercase without the #
+	Hashtags []string
+	// HasMedia is set if the post has images or a video
+	HasMedia bool
+	// IndexedAt is when the post was stored
+	IndexedAt int64
+}
+
+// The kinds of embed a post can have
+const (
+	EmbedImages          = "images"
+	EmbedVideo           = "video"
+	EmbedExternal        = "external"
+	EmbedRecord          = "record"
+	EmbedRecordWithMedia = "recordWithMedia"
+)
+
+// Repost describes a repost of a stored post
+type Repost struct {
+	RepostURI string
 	PostURI   string
 	UserDID   string
 	CreatedAt int64
 }
 
+// HiddenReasonPending is the reason posts waiting for a moderator to approve them are hidden for
+const HiddenReasonPending = "pending"
+
+// Pin is a post that the feed owner has pinned to the top of a feed
+type Pin struct {
+	PostURI string
+	UserDID string
+	// Feed is the name of the feed the post is pinned to or empty if it's pinned to every feed
+	Feed      string
+	CreatedAt int64
+	// ExpiresAt is when the pin stops being shown or 0 if it's pinned until it's removed
+	ExpiresAt int64
+}
+
+// FeedQuery describes which posts should be returned for a page of a feed
+type FeedQuery struct {
+	// Cursor is the score that all returned posts must be below. If CursorID is set, posts with the same
+	// score as Cursor and a lower ID are returned too so that posts sharing a score aren't skipped
+	Cursor   int64
+	CursorID int
+	Limit    int
+	// ExcludeUsers are users whose posts won't be returned
+	ExcludeUsers []string
+	// OnlyUsers, if not nil, restricts the returned posts to those made by these users
+	OnlyUsers []string
+	// BoostUsers are users whose posts have Boost added to their score
+	BoostUsers []string
+	Boost      int64
+	// ExcludeLists, OnlyLists and BoostLists are the keys of stored lists whose members are treated as if
+	// they were in ExcludeUsers, OnlyUsers and BoostUsers, so that lists of any size can be applied by the
+	// store. OnlyLists only restricts the returned posts if it isn't empty
+	ExcludeLists []string
+	OnlyLists    []string
+	BoostLists   []string
+	// RootsOnly excludes replies
+	RootsOnly bool
+	// IncludeReposts adds reposts of posts to the feed as well as the posts themselves
+	IncludeReposts bool
+	// OnlyIDs, if not nil, restricts the returned posts to those with these IDs
+	OnlyIDs []int
+	// Search, if set, restricts the returned posts to those whose text matches the search. See the
+	// search package for the syntax
+	Search string
+}
+
+// Rejection describes a post that was not added to the feed and the reason why
+type Rejection struct {
+	ID        int
+	PostURI   string
+	AuthorDID string
+	Reason    string
+	Text      string
+	CreatedAt int64
+}
+
+// RejectionQuery describes which rejections should be returned, newest first
+type RejectionQuery struct {
+	// AuthorDID, if set, only returns rejections of posts by this author
+	AuthorDID string
+	// Before, if set, only returns rejections with an ID lower than it
+	Before int
+	Limit  int
+}
+
+// AuditEntry records an action taken by an admin
+type AuditEntry struct {
+	ID        int
+	Actor     string
+	Action    string
+	Subject   string
+	Detail    string
+	CreatedAt int64
+}
+
+// ListMember is an account that was added to a Bluesky list by the listitem record with RKey
+type ListMember struct {
+	RKey string
+	DID  string
+}
+
+// StoredList is the last known state of a Bluesky list. Key is how the list was configured which may
+// be just an rkey rather than the full URI
+type StoredList struct {
+	Key         string
+	URI         string
+	RefreshedAt int64
+	Members     []ListMember
+}
+
+// PruneQuery describes which posts are outside the retention policy and should be pruned
+type PruneQuery struct {
+	// Before selects posts created before it
+	Before int64
+	// Offset skips that many of the oldest posts, so that posts the pruner decides to keep can be paged past
+	Offset int
+	Limit  int
+}
+
+// ExportQuery describes which posts to export. Posts are returned in the order they were stored, a page
+// at a time, and hidden posts are never exported
+type ExportQuery struct {
+	// Since and Until, if set, select posts created at or after Since and before Until
+	Since int64
+	Until int64
+	// AfterID is the ID of the last post of the previous page
+	AfterID int
+	Limit   int
+	// RootsOnly, ExcludeUsers, OnlyUsers, ExcludeLists, OnlyLists and Search filter the posts in the same
+	// way as a FeedQuery
+	RootsOnly    bool
+	ExcludeUsers []string
+	OnlyUsers    []string
+	ExcludeLists []string
+	OnlyLists    []string
+	Search       string
+}
+
+// WriteKind is the kind of change a Write makes to the stored posts
+type WriteKind int
+
+const (
+	// WriteCreatePost stores Post
+	WriteCreatePost WriteKind = iota
+	// WriteDeletePosts deletes the posts with the URIs in Subjects
+	WriteDeletePosts
+	// WriteDeleteUserPosts deletes every post made by the users in Subjects
+	WriteDeleteUserPosts
+)
+
+// Write is a single change to the stored posts
+type Write struct {
+	Kind     WriteKind
+	Post     Post
+	Subjects []string
+}
+
+// WriteError is returned by ApplyWrites when one of the writes in a batch can't be applied, rather than
+// the batch as a whole failing such as when the store can't be reached
+type WriteError struct {
+	// Index is the position of the write in the batch
+	Index int
+	Err   error
+}
+
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("write %d: %s", e.Index, e.Err)
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
+// WriteBatch is a set of writes that are applied in order in a single transaction
+type WriteBatch struct {
+	Writes []Write
+	// CursorName, if set, is the stream cursor that's set to Cursor in the same transaction so that
+	// the cursor never gets ahead of the writes made for the events before it
+	CursorName string
+	Cursor     int64
+}
+
 // PostStore defines the interactions with a store
 type PostStore interface {
-	GetFeedPosts(cursor, limit int) ([]Post, error)
-	CreatePost(post Post) error
-	DeletePostsFromURIs(uris []string) error
+	GetFeedPosts(ctx context.Context, query FeedQuery) ([]Post, error)
+	CreatePost(ctx context.Context, post Post) error
+	DeletePostsFromURIs(ctx context.Context, uris []string) error
+	DeletePostsFromUsers(ctx context.Context, dids []string) error
+	// DeleteUnprotectedPosts deletes a post URI or every post from a user DID apart from posts that are
+	// pinned or marked as curated
+	DeleteUnprotectedPosts(ctx context.Context, subject string) error
+	// MarkCurated records that a post was added to the feed by a curator or an admin
+	MarkCurated(ctx context.Context, postURI string) error
+	// GetPrunablePosts returns the posts outside the retention policy, oldest first
+	GetPrunablePosts(ctx context.Context, query PruneQuery) ([]Post, error)
+	// GetExportPosts returns a page of the posts to export
+	GetExportPosts(ctx context.Context, query ExportQuery) ([]Post, error)
+	// ApplyWrites applies every write in the batch or none of them. If it's one of the writes that fails a
+	// *WriteError is returned
+	ApplyWrites(ctx context.Context, batch WriteBatch) error
+	CreateRejection(ctx context.Context, rejection Rejection) error
+	HideSubject(ctx context.Context, subject, reason string) error
+	UnhideSubject(ctx context.Context, subject, reason string) error
+	// IsHidden reports whether a subject is hidden for the given reason
+	IsHidden(ctx context.Context, subject, reason string) (bool, error)
+	GetCursor(ctx context.Context, name string) (int64, error)
+	SetCursor(ctx context.Context, name string, value int64) error
+	GetList(ctx context.Context, key string) (StoredList, error)
+	ReplaceList(ctx context.Context, list StoredList) error
+	AddListMember(ctx context.Context, key string, member ListMember) error
+	RemoveListMember(ctx context.Context, key, rkey string) error
+	IsKnownAuthor(ctx context.Context, did string) (bool, error)
+	IsThreadStored(ctx context.Context, rootURI string) (bool, error)
+	IsPostStored(ctx context.Context, uri string) (bool, error)
+	CreatePin(ctx context.Context, pin Pin) error
+	DeletePin(ctx context.Context, postURI, feed string) error
+	// GetPins returns the pins that are active at the given time for a feed, including pins for every feed
+	GetPins(ctx context.Context, feed string, now int64) ([]Pin, error)
+	// GetAllPins returns every pin including ones that have expired
+	GetAllPins(ctx context.Context) ([]Pin, error)
+	GetRejections(ctx context.Context, query RejectionQuery) ([]Rejection, error)
+	// GetPendingPosts returns posts waiting to be approved, oldest first
+	GetPendingPosts(ctx context.Context, limit int) ([]Post, error)
+	// CountApprovedPosts returns how many of an author's stored posts aren't waiting to be approved
+	CountApprovedPosts(ctx context.Context, did string) (int, error)
+	CreateAuditEntry(ctx context.Context, entry AuditEntry) error
+	// GetAuditLog returns the most recent admin actions, newest first
+	GetAuditLog(ctx context.Context, limit int) ([]AuditEntry, error)
+	CreateRepost(ctx context.Context, repost Repost) error
+	DeleteRepost(ctx context.Context, repostURI string) error
+	SetAuthorStatus(ctx context.Context, did, status string) error
+	SetAuthorHandle(ctx context.Context, did, handle string) error
+}
+
+// FeedConfig describes one of the feeds served by the server
+type FeedConfig struct {
+	// Name is the rkey the feed is registered with
+	Name string `json:"name"`
+	// BoostHours is how many hours newer than they really are posts from boosted users are treated as
+	BoostHours int `json:"boostHours"`
+	// ThreadRootsOnly leaves replies out of the feed so that only the posts that start threads are shown
+	ThreadRootsOnly bool `json:"threadRootsOnly"`
+	// ShowReposts adds reposts made by curators to the feed
+	ShowReposts bool `json:"showReposts"`
+	// MaxPostsPerAuthor is how many posts by the same author can be on a page of the feed. Any others
+	// are pushed back to later pages
+	MaxPostsPerAuthor int `json:"maxPostsPerAuthor"`
+	// CollapseThreads only allows one post from each thread on a page of the feed
+	CollapseThreads bool `json:"collapseThreads"`
+	// Search makes the feed a saved search that only shows posts matching it
+	Search string `json:"search"`
+}
+
+// diversified reports whether the feed limits how much of a page a single author or thread can take up
+func (c FeedConfig) diversified() bool {
+	return c.MaxPostsPerAuthor > 0 || c.CollapseThreads
+}
+
+// FeedAuthors describes how a feed should treat posts from particular users. The users are the members
+// of stored lists, which are given by their keys
+type FeedAuthors struct {
+	DenyLists []string
+	// AllowLists, if not empty, restricts the feed to posts from members of these lists
+	AllowLists []string
+	BoostLists []string
+}
+
+// AuthorLists provides the users that a feed denies, allows or boosts
+type AuthorLists interface {
+	FeedAuthors(feed string) FeedAuthors
+	// LastRefreshed returns when the least recently refreshed list was last fully fetched
+	LastRefreshed() time.Time
 }
 
 // Server is the feed server that will be called when a user requests to view a feed
 type Server struct {
-	httpsrv   *http.Server
-	postStore PostStore
-	feedHost  string
-	feedName  string
+	httpsrv     *http.Server
+	postStore   PostStore
+	authorLists AuthorLists
+	feedHost    string
+	feeds       []FeedConfig
 }
 
-// NewServer builds a server - call the Run function to start the server
-func NewServer(port int, feedHost, feedName string, postStore PostStore) (*Server, error) {
+// NewServer builds a server - call the Run function to start the server. The author lists are optional
+// and can be nil
+func NewServer(port int, feedHost string, feeds []FeedConfig, postStore PostStore, authorLists AuthorLists) (*Server, error) {
+	if len(feeds) == 0 {
+		return nil, fmt.Errorf("no feeds configured")
+	}
+	for _, feed := range feeds {
+		if feed.Search == "" {
+			continue
+		}
+		if _, err := search.Parse(feed.Search); err != nil {
+			return nil, fmt.Errorf("feed %q search: %w", feed.Name, err)
+		}
+	}
+
 	srv := &Server{
-		feedHost:  feedHost,
-		feedName:  feedName,
-		postStore: postStore,
+		feedHost:    feedHost,
+		feeds:       feeds,
+		postStore:   postStore,
+		authorLists: authorLists,
 	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/xrpc/app.bsky.feed.getFeedSkeleton", srv.HandleGetFeedSkeleton)
 	mux.HandleFunc("/xrpc/app.bsky.feed.describeFeedGenerator", srv.HandleDescribeFeedGenerator)
 	mux.HandleFunc("POST /xrpc/app.bsky.feed.sendInteractions", srv.HandleFeedInteractions)
+	mux.HandleFunc("/xrpc/net.x402feed.searchPosts", srv.HandleSearchPosts)
 	mux.HandleFunc("/.well-known/did.json", srv.HandleWellKnown)
+	mux.HandleFunc("/xrpc/_health", srv.HandleHealth)
 	addr := fmt.Sprintf("127.0.0.1:%d", port)
 
 	srv.httpsrv = &http.Server{
@@ -61,6 +370,21 @@ func (s *Server) Run() {
 	}
 }
 
+// feedConfig returns the config of the feed with the given at:// URI
+func (s *Server) feedConfig(feedURI string) (FeedConfig, bool) {
+	uri, err := syntax.ParseATURI(feedURI)
+	if err != nil {
+		return FeedConfig{}, false
+	}
+	name := uri.RecordKey().String()
+	for _, feed := range s.feeds {
+		if feed.Name == name {
+			return feed, true
+		}
+	}
+	return FeedConfig{}, false
+}
+
 // Stop will shutdown the server
 func (s *Server) Stop(ctx context.Context) error {
 	return s.httpsrv.Shutdown(ctx)
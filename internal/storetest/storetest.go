@@ -0,0 +1,987 @@
+// Package storetest is a conformance suite that every implementation of server.PostStore must pass
+package storetest
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/nacorid/x402-feed/internal/server"
+)
+
+// NewStore returns an empty store. It's called once for every test in the suite
+type NewStore func(t *testing.T) server.PostStore
+
+// Run runs the conformance suite against the stores returned by newStore
+func Run(t *testing.T, newStore NewStore) {
+	tests := map[string]func(t *testing.T, store server.PostStore){
+		"feed is ordered newest first":         testFeedOrdering,
+		"cursor pages through the feed":        testFeedCursor,
+		"cursor pages through tied scores":     testFeedCursorTies,
+		"duplicate posts are stored once":      testCreatePostDedupe,
+		"deleting posts":                       testDeletePosts,
+		"protected posts are kept":             testDeleteUnprotectedPosts,
+		"feed query filters":                   testFeedFilters,
+		"boosted users are ranked higher":      testFeedBoost,
+		"reposts are placed when reposted":     testReposts,
+		"hidden subjects are left out":         testHiddenSubjects,
+		"cursors are stored":                   testCursors,
+		"lists are stored":                     testLists,
+		"feed query list filters":              testListFilters,
+		"authors":                              testAuthors,
+		"threads and posts are looked up":      testStoredLookups,
+		"pins":                                 testPins,
+		"rejections are returned newest first": testRejections,
+		"audit log is returned newest first":   testAuditLog,
+		"pending posts are waiting to approve": testPendingPosts,
+		"batched writes are applied in order":  testApplyWrites,
+		"posts outside retention are pruned":   testPrunablePosts,
+		"post metadata is stored":              testPostMetadata,
+		"posts are searched":                   testSearch,
+		"posts are exported in pages":          testExportPosts,
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			test(t, newStore(t))
+		})
+	}
+}
+
+const farFuture = 9999999999999
+
+func post(did string, n int, createdAt int64) server.Post {
+	rkey := fmt.Sprintf("%s-%d", did, n)
+	return server.Post{
+		RKey:      rkey,
+		PostURI:   fmt.Sprintf("at://%s/app.bsky.feed.post/%s", did, rkey),
+		UserDID:   did,
+		CreatedAt: createdAt,
+	}
+}
+
+func mustCreate(t *testing.T, store server.PostStore, posts ...server.Post) {
+	t.Helper()
+	for _, p := range posts {
+		if err := store.CreatePost(t.Context(), p); err != nil {
+			t.Fatalf("create post %s: %v", p.PostURI, err)
+		}
+	}
+}
+
+func feedURIs(t *testing.T, store server.PostStore, query server.FeedQuery) []string {
+	t.Helper()
+	if query.Cursor == 0 {
+		query.Cursor = farFuture
+	}
+	if query.Limit == 0 {
+		query.Limit = 100
+	}
+	posts, err := store.GetFeedPosts(t.Context(), query)
+	if err != nil {
+		t.Fatalf("get feed posts: %v", err)
+	}
+	uris := make([]string, 0, len(posts))
+	for _, p := range posts {
+		uris = append(uris, p.PostURI)
+	}
+	return uris
+}
+
+func assertURIs(t *testing.T, got []string, want ...server.Post) {
+	t.Helper()
+	wantURIs := make([]string, 0, len(want))
+	for _, p := range want {
+		wantURIs = append(wantURIs, p.PostURI)
+	}
+	if !slices.Equal(got, wantURIs) {
+		t.Errorf("got posts %v, want %v", got, wantURIs)
+	}
+}
+
+func testFeedOrdering(t *testing.T, store server.PostStore) {
+	a, b, c := post("did:plc:a", 1, 300), post("did:plc:b", 1, 100), post("did:plc:c", 1, 200)
+	mustCreate(t, store, a, b, c)
+
+	posts, err := store.GetFeedPosts(t.Context(), server.FeedQuery{Cursor: farFuture, Limit: 10})
+	if err != nil {
+		t.Fatalf("get feed posts: %v", err)
+	}
+	if len(posts) != 3 {
+		t.Fatalf("got %d posts, want 3", len(posts))
+	}
+	for i, want := range []server.Post{a, c, b} {
+		got := posts[i]
+		if got.PostURI != want.PostURI || got.UserDID != want.UserDID || got.RKey != want.RKey ||
+			got.CreatedAt != want.CreatedAt || got.Score != want.CreatedAt || got.RepostURI != "" || got.ID == 0 {
+			t.Errorf("post %d: got %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func testFeedCursor(t *testing.T, store server.PostStore) {
+	posts := make([]server.Post, 0)
+	for i := 0; i < 25; i++ {
+		p := post("did:plc:a", i, int64(1000+i))
+		posts = append(posts, p)
+		mustCreate(t, store, p)
+	}
+
+	seen := make([]string, 0)
+	cursor := int64(farFuture)
+	for {
+		page, err := store.GetFeedPosts(t.Context(), server.FeedQuery{Cursor: cursor, Limit: 10})
+		if err != nil {
+			t.Fatalf("get feed posts: %v", err)
+		}
+		for _, p := range page {
+			if p.Score >= cursor {
+				t.Fatalf("post %s has score %d which isn't below the cursor %d", p.PostURI, p.Score, cursor)
+			}
+			seen = append(seen, p.PostURI)
+		}
+		if len(page) < 10 {
+			break
+		}
+		cursor = page[len(page)-1].Score
+	}
+
+	slices.Reverse(posts)
+	assertURIs(t, seen, posts...)
+}
+
+func testFeedCursorTies(t *testing.T, store server.PostStore) {
+	// posts share scores in groups, as boosted posts and posts stored in the same millisecond do, and the
+	// oldest posts are reposted at the same time as the next group was posted
+	want := make([]string, 0)
+	for i := 0; i < 12; i++ {
+		p := post("did:plc:a", i, int64(1000+i/4))
+		mustCreate(t, store, p)
+		want = append(want, p.PostURI)
+		if i < 4 {
+			repost := server.Repost{RepostURI: fmt.Sprintf("at://did:plc:r/app.bsky.feed.repost/%d", i), PostURI: p.PostURI, UserDID: "did:plc:r", CreatedAt: 1001}
+			if err := store.CreateRepost(t.Context(), repost); err != nil {
+				t.Fatalf("create repost: %v", err)
+			}
+			want = append(want, repost.RepostURI)
+		}
+	}
+
+	seen := make([]string, 0)
+	query := server.FeedQuery{Cursor: farFuture, Limit: 5, IncludeReposts: true}
+	for range len(want) {
+		page, err := store.GetFeedPosts(t.Context(), query)
+		if err != nil {
+			t.Fatalf("get feed posts: %v", err)
+		}
+		for _, p := range page {
+			if p.RepostURI != "" {
+				seen = append(seen, p.RepostURI)
+			} else {
+				seen = append(seen, p.PostURI)
+			}
+		}
+		if len(page) < query.Limit {
+			break
+		}
+		query.Cursor, query.CursorID = page[len(page)-1].Score, page[len(page)-1].ID
+	}
+
+	slices.Sort(seen)
+	slices.Sort(want)
+	if !slices.Equal(seen, want) {
+		t.Errorf("paged through %v, want every post and repost once %v", seen, want)
+	}
+}
+
+func testCreatePostDedupe(t *testing.T, store server.PostStore) {
+	p := post("did:plc:a", 1, 100)
+	mustCreate(t, store, p, p)
+
+	// storing a post again keeps its original place in the feed
+	updated := p
+	updated.CreatedAt = 500
+	mustCreate(t, store, updated)
+
+	posts, err := store.GetFeedPosts(t.Context(), server.FeedQuery{Cursor: farFuture, Limit: 10})
+	if err != nil {
+		t.Fatalf("get feed posts: %v", err)
+	}
+	if len(posts) != 1 || posts[0].CreatedAt != 100 {
+		t.Errorf("got %+v, want the post stored once with its original createdAt", posts)
+	}
+
+	// record keys are only unique within a repo so another author's post with the same one is stored too
+	other := p
+	other.PostURI = "at://did:plc:b/app.bsky.feed.post/" + p.RKey
+	other.UserDID = "did:plc:b"
+	other.CreatedAt = 200
+	mustCreate(t, store, other)
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{}), other, p)
+}
+
+func testDeletePosts(t *testing.T, store server.PostStore) {
+	a1, a2, b1, c1 := post("did:plc:a", 1, 100), post("did:plc:a", 2, 200), post("did:plc:b", 1, 300), post("did:plc:c", 1, 400)
+	mustCreate(t, store, a1, a2, b1, c1)
+
+	if err := store.DeletePostsFromURIs(t.Context(), []string{c1.PostURI, "at://did:plc:x/app.bsky.feed.post/missing"}); err != nil {
+		t.Fatalf("delete posts from uris: %v", err)
+	}
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{}), b1, a2, a1)
+
+	if err := store.DeletePostsFromUsers(t.Context(), []string{"did:plc:a"}); err != nil {
+		t.Fatalf("delete posts from users: %v", err)
+	}
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{}), b1)
+
+	if err := store.DeletePostsFromUsers(t.Context(), nil); err != nil {
+		t.Fatalf("delete posts from no users: %v", err)
+	}
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{}), b1)
+}
+
+func testDeleteUnprotectedPosts(t *testing.T, store server.PostStore) {
+	a1, a2, a3, b1 := post("did:plc:a", 1, 100), post("did:plc:a", 2, 200), post("did:plc:a", 3, 300), post("did:plc:b", 1, 400)
+	mustCreate(t, store, a1, a2, a3, b1)
+
+	if err := store.CreatePin(t.Context(), server.Pin{PostURI: a1.PostURI, UserDID: a1.UserDID, CreatedAt: 100}); err != nil {
+		t.Fatalf("create pin: %v", err)
+	}
+	if err := store.MarkCurated(t.Context(), a2.PostURI); err != nil {
+		t.Fatalf("mark curated: %v", err)
+	}
+	if err := store.MarkCurated(t.Context(), b1.PostURI); err != nil {
+		t.Fatalf("mark curated: %v", err)
+	}
+
+	if err := store.DeleteUnprotectedPosts(t.Context(), "did:plc:a"); err != nil {
+		t.Fatalf("delete unprotected user posts: %v", err)
+	}
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{}), b1, a2, a1)
+
+	if err := store.DeleteUnprotectedPosts(t.Context(), b1.PostURI); err != nil {
+		t.Fatalf("delete unprotected post: %v", err)
+	}
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{}), b1, a2, a1)
+}
+
+func testFeedFilters(t *testing.T, store server.PostStore) {
+	a, b, c := post("did:plc:a", 1, 100), post("did:plc:b", 1, 200), post("did:plc:c", 1, 300)
+	reply := post("did:plc:a", 2, 400)
+	reply.ReplyRoot = c.PostURI
+	reply.ReplyParent = c.PostURI
+	mustCreate(t, store, a, b, c, reply)
+
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{ExcludeUsers: []string{"did:plc:a"}}), c, b)
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{OnlyUsers: []string{"did:plc:a", "did:plc:b"}}), reply, b, a)
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{OnlyUsers: []string{}}))
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{RootsOnly: true}), c, b, a)
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{Limit: 2}), reply, c)
+
+	posts, err := store.GetFeedPosts(t.Context(), server.FeedQuery{Cursor: farFuture, Limit: 10})
+	if err != nil {
+		t.Fatalf("get feed posts: %v", err)
+	}
+	if posts[0].ReplyRoot != c.PostURI || posts[0].ReplyParent != c.PostURI {
+		t.Errorf("got reply refs %q %q, want %q", posts[0].ReplyRoot, posts[0].ReplyParent, c.PostURI)
+	}
+	ids := []int{posts[1].ID, posts[3].ID}
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{OnlyIDs: ids}), c, a)
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{OnlyIDs: []int{}}))
+}
+
+func testFeedBoost(t *testing.T, store server.PostStore) {
+	a, b, c := post("did:plc:a", 1, 100), post("did:plc:b", 1, 200), post("did:plc:c", 1, 300)
+	mustCreate(t, store, a, b, c)
+
+	query := server.FeedQuery{Cursor: farFuture, Limit: 10, BoostUsers: []string{"did:plc:a"}, Boost: 1000}
+	posts, err := store.GetFeedPosts(t.Context(), query)
+	if err != nil {
+		t.Fatalf("get feed posts: %v", err)
+	}
+	if len(posts) != 3 || posts[0].PostURI != a.PostURI || posts[0].Score != 1100 || posts[0].CreatedAt != 100 {
+		t.Fatalf("got %+v, want the boosted post first with a score of 1100", posts)
+	}
+
+	// the cursor is compared against the boosted score
+	query.Cursor = 1100
+	assertURIs(t, feedURIs(t, store, query), c, b)
+}
+
+func testReposts(t *testing.T, store server.PostStore) {
+	a, b := post("did:plc:a", 1, 100), post("did:plc:b", 1, 200)
+	mustCreate(t, store, a, b)
+
+	repost := server.Repost{
+		RepostURI: "at://did:plc:curator/app.bsky.feed.repost/1",
+		PostURI:   a.PostURI,
+		UserDID:   "did:plc:curator",
+		CreatedAt: 300,
+	}
+	for i := 0; i < 2; i++ {
+		if err := store.CreateRepost(t.Context(), repost); err != nil {
+			t.Fatalf("create repost: %v", err)
+		}
+	}
+
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{}), b, a)
+
+	posts, err := store.GetFeedPosts(t.Context(), server.FeedQuery{Cursor: farFuture, Limit: 10, IncludeReposts: true})
+	if err != nil {
+		t.Fatalf("get feed posts: %v", err)
+	}
+	if len(posts) != 3 || posts[0].RepostURI != repost.RepostURI || posts[0].PostURI != a.PostURI || posts[0].Score != 300 {
+		t.Fatalf("got %+v, want the repost first", posts)
+	}
+
+	if err := store.DeleteRepost(t.Context(), repost.RepostURI); err != nil {
+		t.Fatalf("delete repost: %v", err)
+	}
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{IncludeReposts: true}), b, a)
+}
+
+func testHiddenSubjects(t *testing.T, store server.PostStore) {
+	a, b, c := post("did:plc:a", 1, 100), post("did:plc:b", 1, 200), post("did:plc:c", 1, 300)
+	mustCreate(t, store, a, b, c)
+
+	hide := func(subject, reason string) {
+		if err := store.HideSubject(t.Context(), subject, reason); err != nil {
+			t.Fatalf("hide subject: %v", err)
+		}
+	}
+	unhide := func(subject, reason string) {
+		if err := store.UnhideSubject(t.Context(), subject, reason); err != nil {
+			t.Fatalf("unhide subject: %v", err)
+		}
+	}
+
+	isHidden := func(subject, reason string) bool {
+		hidden, err := store.IsHidden(t.Context(), subject, reason)
+		if err != nil {
+			t.Fatalf("is hidden: %v", err)
+		}
+		return hidden
+	}
+
+	hide(a.PostURI, "label:porn")
+	hide(a.PostURI, "label:porn")
+	hide("did:plc:b", "account_status")
+	hide("did:plc:b", "label:spam")
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{}), c)
+	if !isHidden(a.PostURI, "label:porn") || isHidden(a.PostURI, "label:spam") || isHidden(c.PostURI, "label:porn") {
+		t.Error("got hidden reasons that don't match the ones that were hidden")
+	}
+
+	unhide(a.PostURI, "label:porn")
+	unhide("did:plc:b", "account_status")
+	// b is still hidden for the other reason
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{}), c, a)
+
+	unhide("did:plc:b", "label:spam")
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{}), c, b, a)
+	if isHidden("did:plc:b", "label:spam") {
+		t.Error("got subject hidden after it was unhidden")
+	}
+}
+
+func testCursors(t *testing.T, store server.PostStore) {
+	value, err := store.GetCursor(t.Context(), "jetstream")
+	if err != nil || value != 0 {
+		t.Fatalf("got cursor %d %v, want 0 for a cursor that hasn't been stored", value, err)
+	}
+
+	for _, want := range []int64{1754000000000000, 1754000000000001} {
+		if err := store.SetCursor(t.Context(), "jetstream", want); err != nil {
+			t.Fatalf("set cursor: %v", err)
+		}
+		value, err = store.GetCursor(t.Context(), "jetstream")
+		if err != nil || value != want {
+			t.Fatalf("got cursor %d %v, want %d", value, err, want)
+		}
+	}
+
+	value, err = store.GetCursor(t.Context(), "labeler")
+	if err != nil || value != 0 {
+		t.Errorf("got cursor %d %v, want cursors to be stored by name", value, err)
+	}
+}
+
+func testLists(t *testing.T, store server.PostStore) {
+	list, err := store.GetList(t.Context(), "deny")
+	if err != nil {
+		t.Fatalf("get list: %v", err)
+	}
+	if list.Key != "deny" || list.URI != "" || len(list.Members) != 0 {
+		t.Fatalf("got %+v, want an empty list", list)
+	}
+
+	err = store.ReplaceList(t.Context(), server.StoredList{
+		Key:         "deny",
+		URI:         "at://did:plc:owner/app.bsky.graph.list/deny",
+		RefreshedAt: 100,
+		Members:     []server.ListMember{{RKey: "1", DID: "did:plc:a"}, {RKey: "2", DID: "did:plc:b"}},
+	})
+	if err != nil {
+		t.Fatalf("replace list: %v", err)
+	}
+	if err := store.AddListMember(t.Context(), "deny", server.ListMember{RKey: "3", DID: "did:plc:c"}); err != nil {
+		t.Fatalf("add list member: %v", err)
+	}
+	if err := store.RemoveListMember(t.Context(), "deny", "1"); err != nil {
+		t.Fatalf("remove list member: %v", err)
+	}
+
+	list, err = store.GetList(t.Context(), "deny")
+	if err != nil {
+		t.Fatalf("get list: %v", err)
+	}
+	slices.SortFunc(list.Members, func(a, b server.ListMember) int {
+		if a.RKey < b.RKey {
+			return -1
+		}
+		return 1
+	})
+	want := []server.ListMember{{RKey: "2", DID: "did:plc:b"}, {RKey: "3", DID: "did:plc:c"}}
+	if list.URI != "at://did:plc:owner/app.bsky.graph.list/deny" || list.RefreshedAt != 100 || !slices.Equal(list.Members, want) {
+		t.Errorf("got %+v, want members %+v", list, want)
+	}
+
+	// replacing a list replaces all of its members
+	err = store.ReplaceList(t.Context(), server.StoredList{Key: "deny", URI: list.URI, RefreshedAt: 200, Members: []server.ListMember{}})
+	if err != nil {
+		t.Fatalf("replace list: %v", err)
+	}
+	list, err = store.GetList(t.Context(), "deny")
+	if err != nil || list.RefreshedAt != 200 || len(list.Members) != 0 {
+		t.Errorf("got %+v %v, want an empty list refreshed at 200", list, err)
+	}
+}
+
+func testListFilters(t *testing.T, store server.PostStore) {
+	a, b, c := post("did:plc:a", 1, 100), post("did:plc:b", 1, 200), post("did:plc:c", 1, 300)
+	mustCreate(t, store, a, b, c)
+
+	// the lists have more members than a query can have parameters
+	replaceList := func(key string, dids ...string) {
+		t.Helper()
+		members := make([]server.ListMember, 0, len(dids)+40001)
+		for i := range 40001 {
+			members = append(members, server.ListMember{RKey: fmt.Sprintf("%d", i), DID: fmt.Sprintf("did:plc:other%d", i)})
+		}
+		for i, did := range dids {
+			members = append(members, server.ListMember{RKey: fmt.Sprintf("member%d", i), DID: did})
+		}
+		err := store.ReplaceList(t.Context(), server.StoredList{Key: key, URI: "at://did:plc:owner/app.bsky.graph.list/" + key, Members: members})
+		if err != nil {
+			t.Fatalf("replace list: %v", err)
+		}
+	}
+	replaceList("deny", "did:plc:a")
+	replaceList("allow", "did:plc:a", "did:plc:b")
+	replaceList("boost", "did:plc:a")
+
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{ExcludeLists: []string{"deny"}}), c, b)
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{OnlyLists: []string{"allow"}}), b, a)
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{OnlyLists: []string{"allow"}, ExcludeLists: []string{"deny"}}), b)
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{OnlyLists: []string{"unknown"}}))
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{BoostLists: []string{"boost"}, Boost: 1000}), a, c, b)
+	// users and lists are combined
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{BoostUsers: []string{"did:plc:b"}, BoostLists: []string{"boost"}, Boost: 1000}), b, a, c)
+
+	posts, err := store.GetExportPosts(t.Context(), server.ExportQuery{OnlyLists: []string{"allow"}, ExcludeLists: []string{"deny"}, Limit: 10})
+	if err != nil {
+		t.Fatalf("get export posts: %v", err)
+	}
+	if len(posts) != 1 || posts[0].PostURI != b.PostURI {
+		t.Errorf("got exported posts %+v, want only %s", posts, b.PostURI)
+	}
+}
+
+func testAuthors(t *testing.T, store server.PostStore) {
+	known, err := store.IsKnownAuthor(t.Context(), "did:plc:a")
+	if err != nil || known {
+		t.Fatalf("got known %t %v, want an unknown author", known, err)
+	}
+
+	mustCreate(t, store, post("did:plc:a", 1, 100))
+	known, err = store.IsKnownAuthor(t.Context(), "did:plc:a")
+	if err != nil || !known {
+		t.Errorf("got known %t %v, want an author with posts to be known", known, err)
+	}
+
+	if err := store.SetAuthorStatus(t.Context(), "did:plc:b", "deactivated"); err != nil {
+		t.Fatalf("set author status: %v", err)
+	}
+	if err := store.SetAuthorHandle(t.Context(), "did:plc:b", "b.example.com"); err != nil {
+		t.Fatalf("set author handle: %v", err)
+	}
+	known, err = store.IsKnownAuthor(t.Context(), "did:plc:b")
+	if err != nil || !known {
+		t.Errorf("got known %t %v, want an author with a status to be known", known, err)
+	}
+}
+
+func testStoredLookups(t *testing.T, store server.PostStore) {
+	root := post("did:plc:a", 1, 100)
+	reply := post("did:plc:b", 1, 200)
+	reply.ReplyRoot = root.PostURI
+	reply.ReplyParent = root.PostURI
+	mustCreate(t, store, root, reply)
+
+	for uri, want := range map[string]bool{root.PostURI: true, reply.PostURI: true, "at://did:plc:x/app.bsky.feed.post/1": false} {
+		stored, err := store.IsPostStored(t.Context(), uri)
+		if err != nil || stored != want {
+			t.Errorf("post %s: got stored %t %v, want %t", uri, stored, err, want)
+		}
+	}
+
+	// a thread is stored if either its root or any reply in it is stored
+	for uri, want := range map[string]bool{root.PostURI: true, "at://did:plc:x/app.bsky.feed.post/1": false} {
+		stored, err := store.IsThreadStored(t.Context(), uri)
+		if err != nil || stored != want {
+			t.Errorf("thread %s: got stored %t %v, want %t", uri, stored, err, want)
+		}
+	}
+	if err := store.DeletePostsFromURIs(t.Context(), []string{root.PostURI}); err != nil {
+		t.Fatalf("delete posts: %v", err)
+	}
+	stored, err := store.IsThreadStored(t.Context(), root.PostURI)
+	if err != nil || !stored {
+		t.Errorf("got thread stored %t %v, want a thread with a stored reply to be stored", stored, err)
+	}
+}
+
+func testPins(t *testing.T, store server.PostStore) {
+	pins := []server.Pin{
+		{PostURI: "at://did:plc:a/app.bsky.feed.post/1", UserDID: "did:plc:a", CreatedAt: 100},
+		{PostURI: "at://did:plc:b/app.bsky.feed.post/1", UserDID: "did:plc:b", Feed: "other", CreatedAt: 200},
+		{PostURI: "at://did:plc:c/app.bsky.feed.post/1", UserDID: "did:plc:c", CreatedAt: 300, ExpiresAt: 1000},
+		{PostURI: "at://did:plc:d/app.bsky.feed.post/1", UserDID: "did:plc:d", Feed: "feed", CreatedAt: 400},
+	}
+	for _, pin := range pins {
+		if err := store.CreatePin(t.Context(), pin); err != nil {
+			t.Fatalf("create pin: %v", err)
+		}
+	}
+
+	pinURIs := func(now int64) []string {
+		t.Helper()
+		active, err := store.GetPins(t.Context(), "feed", now)
+		if err != nil {
+			t.Fatalf("get pins: %v", err)
+		}
+		uris := make([]string, 0, len(active))
+		for _, pin := range active {
+			uris = append(uris, pin.PostURI)
+		}
+		return uris
+	}
+
+	if got, want := pinURIs(500), []string{pins[3].PostURI, pins[2].PostURI, pins[0].PostURI}; !slices.Equal(got, want) {
+		t.Errorf("got pins %v, want %v", got, want)
+	}
+	if got, want := pinURIs(1000), []string{pins[3].PostURI, pins[0].PostURI}; !slices.Equal(got, want) {
+		t.Errorf("got pins %v after one expired, want %v", got, want)
+	}
+
+	if err := store.HideSubject(t.Context(), "did:plc:d", "label:spam"); err != nil {
+		t.Fatalf("hide subject: %v", err)
+	}
+	if err := store.DeletePin(t.Context(), pins[0].PostURI, ""); err != nil {
+		t.Fatalf("delete pin: %v", err)
+	}
+	if got := pinURIs(500); !slices.Equal(got, []string{pins[2].PostURI}) {
+		t.Errorf("got pins %v, want hidden and deleted pins left out", got)
+	}
+
+	all, err := store.GetAllPins(t.Context())
+	if err != nil {
+		t.Fatalf("get all pins: %v", err)
+	}
+	if len(all) != 3 {
+		t.Errorf("got %d pins, want 3", len(all))
+	}
+}
+
+func testRejections(t *testing.T, store server.PostStore) {
+	for i := 0; i < 5; i++ {
+		did := "did:plc:a"
+		if i%2 == 1 {
+			did = "did:plc:b"
+		}
+		err := store.CreateRejection(t.Context(), server.Rejection{
+			PostURI:   fmt.Sprintf("at://%s/app.bsky.feed.post/%d", did, i),
+			AuthorDID: did,
+			Reason:    "spam",
+			Text:      fmt.Sprintf("post %d", i),
+			CreatedAt: int64(100 + i),
+		})
+		if err != nil {
+			t.Fatalf("create rejection: %v", err)
+		}
+	}
+
+	rejections, err := store.GetRejections(t.Context(), server.RejectionQuery{Limit: 2})
+	if err != nil {
+		t.Fatalf("get rejections: %v", err)
+	}
+	if len(rejections) != 2 || rejections[0].Text != "post 4" || rejections[1].Text != "post 3" {
+		t.Fatalf("got %+v, want the newest 2 rejections", rejections)
+	}
+
+	rejections, err = store.GetRejections(t.Context(), server.RejectionQuery{Limit: 10, Before: rejections[1].ID})
+	if err != nil {
+		t.Fatalf("get rejections: %v", err)
+	}
+	if len(rejections) != 3 || rejections[0].Text != "post 2" {
+		t.Errorf("got %+v, want the 3 rejections before the cursor", rejections)
+	}
+
+	rejections, err = store.GetRejections(t.Context(), server.RejectionQuery{Limit: 10, AuthorDID: "did:plc:b"})
+	if err != nil {
+		t.Fatalf("get rejections: %v", err)
+	}
+	if len(rejections) != 2 || rejections[0].AuthorDID != "did:plc:b" || rejections[0].Reason != "spam" || rejections[0].CreatedAt != 103 {
+		t.Errorf("got %+v, want the 2 rejections by did:plc:b", rejections)
+	}
+}
+
+func testAuditLog(t *testing.T, store server.PostStore) {
+	for i := 0; i < 3; i++ {
+		err := store.CreateAuditEntry(t.Context(), server.AuditEntry{
+			Actor:     "token",
+			Action:    fmt.Sprintf("action %d", i),
+			Subject:   "did:plc:a",
+			Detail:    "detail",
+			CreatedAt: int64(100 + i),
+		})
+		if err != nil {
+			t.Fatalf("create audit entry: %v", err)
+		}
+	}
+
+	entries, err := store.GetAuditLog(t.Context(), 2)
+	if err != nil {
+		t.Fatalf("get audit log: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Action != "action 2" || entries[1].Action != "action 1" ||
+		entries[0].Actor != "token" || entries[0].Subject != "did:plc:a" || entries[0].Detail != "detail" || entries[0].CreatedAt != 102 {
+		t.Errorf("got %+v, want the newest 2 entries", entries)
+	}
+}
+
+func testPendingPosts(t *testing.T, store server.PostStore) {
+	a1, a2, a3 := post("did:plc:a", 1, 100), post("did:plc:a", 2, 200), post("did:plc:a", 3, 300)
+	for _, p := range []server.Post{a2, a1} {
+		if err := store.HideSubject(t.Context(), p.PostURI, server.HiddenReasonPending); err != nil {
+			t.Fatalf("hide subject: %v", err)
+		}
+	}
+	mustCreate(t, store, a1, a2, a3)
+
+	pending, err := store.GetPendingPosts(t.Context(), 10)
+	if err != nil {
+		t.Fatalf("get pending posts: %v", err)
+	}
+	if len(pending) != 2 || pending[0].PostURI != a1.PostURI || pending[1].PostURI != a2.PostURI {
+		t.Errorf("got %+v, want the pending posts oldest first", pending)
+	}
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{}), a3)
+
+	count, err := store.CountApprovedPosts(t.Context(), "did:plc:a")
+	if err != nil || count != 1 {
+		t.Errorf("got %d approved posts %v, want 1", count, err)
+	}
+
+	if err := store.UnhideSubject(t.Context(), a1.PostURI, server.HiddenReasonPending); err != nil {
+		t.Fatalf("unhide subject: %v", err)
+	}
+	count, err = store.CountApprovedPosts(t.Context(), "did:plc:a")
+	if err != nil || count != 2 {
+		t.Errorf("got %d approved posts %v, want 2 after approving one", count, err)
+	}
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{}), a3, a1)
+}
+
+func testConcurrency(t *testing.T, store server.PostStore) {
+	const writers, postsPerWriter = 4, 25
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*postsPerWriter*2)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			did := fmt.Sprintf("did:plc:writer%d", w)
+			for i := 0; i < postsPerWriter; i++ {
+				if err := store.CreatePost(t.Context(), post(did, i, int64(w*postsPerWriter+i+1))); err != nil {
+					errs <- fmt.Errorf("create post: %w", err)
+				}
+				if _, err := store.GetFeedPosts(t.Context(), server.FeedQuery{Cursor: farFuture, Limit: 10}); err != nil {
+					errs <- fmt.Errorf("get feed posts: %w", err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	uris := feedURIs(t, store, server.FeedQuery{Limit: writers * postsPerWriter * 2})
+	if len(uris) != writers*postsPerWriter {
+		t.Errorf("got %d posts, want %d", len(uris), writers*postsPerWriter)
+	}
+}
+
+func testRecreateDeletedPost(t *testing.T, store server.PostStore) {
+	p := post("did:plc:a", 1, 100)
+	mustCreate(t, store, p)
+	if err := store.DeletePostsFromURIs(t.Context(), []string{p.PostURI}); err != nil {
+		t.Fatalf("delete posts: %v", err)
+	}
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{}))
+
+	mustCreate(t, store, p)
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{}), p)
+}
+
+func testApplyWrites(t *testing.T, store server.PostStore) {
+	a1, a2, b1, b2 := post("did:plc:a", 1, 100), post("did:plc:a", 2, 200), post("did:plc:b", 1, 300), post("did:plc:b", 2, 400)
+	mustCreate(t, store, a1)
+
+	batch := server.WriteBatch{
+		Writes: []server.Write{
+			{Kind: server.WriteCreatePost, Post: b1},
+			{Kind: server.WriteDeletePosts, Subjects: []string{b1.PostURI}},
+			// a post deleted and then created again is stored
+			{Kind: server.WriteDeletePosts, Subjects: []string{b2.PostURI}},
+			{Kind: server.WriteCreatePost, Post: b2},
+			{Kind: server.WriteDeleteUserPosts, Subjects: []string{"did:plc:a"}},
+			{Kind: server.WriteCreatePost, Post: a2},
+		},
+		CursorName: "jetstream",
+		Cursor:     1234,
+	}
+	if err := store.ApplyWrites(t.Context(), batch); err != nil {
+		t.Fatalf("apply writes: %v", err)
+	}
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{}), b2, a2)
+
+	cursor, err := store.GetCursor(t.Context(), "jetstream")
+	if err != nil {
+		t.Fatalf("get cursor: %v", err)
+	}
+	if cursor != 1234 {
+		t.Errorf("got cursor %d, want 1234", cursor)
+	}
+
+	// a batch with nothing but a cursor only moves the cursor
+	if err := store.ApplyWrites(t.Context(), server.WriteBatch{CursorName: "jetstream", Cursor: 5678}); err != nil {
+		t.Fatalf("apply cursor only batch: %v", err)
+	}
+	cursor, err = store.GetCursor(t.Context(), "jetstream")
+	if err != nil {
+		t.Fatalf("get cursor: %v", err)
+	}
+	if cursor != 5678 {
+		t.Errorf("got cursor %d, want 5678", cursor)
+	}
+
+	// nothing in a batch with an invalid write is applied
+	err = store.ApplyWrites(t.Context(), server.WriteBatch{
+		Writes: []server.Write{
+			{Kind: server.WriteDeletePosts, Subjects: []string{b2.PostURI}},
+			{Kind: server.WriteKind(99)},
+		},
+		CursorName: "jetstream",
+		Cursor:     9999,
+	})
+	var writeErr *server.WriteError
+	if !errors.As(err, &writeErr) || writeErr.Index != 1 {
+		t.Fatalf("got error %v, want the invalid write to be the one that failed", err)
+	}
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{}), b2, a2)
+	cursor, err = store.GetCursor(t.Context(), "jetstream")
+	if err != nil {
+		t.Fatalf("get cursor: %v", err)
+	}
+	if cursor != 5678 {
+		t.Errorf("got cursor %d after a failed batch, want 5678", cursor)
+	}
+}
+
+func testPrunablePosts(t *testing.T, store server.PostStore) {
+	a1, a2, a3, a4 := post("did:plc:a", 1, 100), post("did:plc:a", 2, 200), post("did:plc:a", 3, 300), post("did:plc:a", 4, 400)
+	mustCreate(t, store, a3, a1, a4, a2)
+
+	prunable := func(query server.PruneQuery) []string {
+		t.Helper()
+		posts, err := store.GetPrunablePosts(t.Context(), query)
+		if err != nil {
+			t.Fatalf("get prunable posts: %v", err)
+		}
+		uris := make([]string, 0, len(posts))
+		for _, p := range posts {
+			uris = append(uris, p.PostURI)
+		}
+		return uris
+	}
+
+	assertURIs(t, prunable(server.PruneQuery{Limit: 10}))
+	assertURIs(t, prunable(server.PruneQuery{Before: 300, Limit: 10}), a1, a2)
+	assertURIs(t, prunable(server.PruneQuery{Before: 300, Limit: 1}), a1)
+	assertURIs(t, prunable(server.PruneQuery{Before: 1000, Offset: 1, Limit: 2}), a2, a3)
+	assertURIs(t, prunable(server.PruneQuery{Before: 1000, Offset: 4, Limit: 10}))
+
+	// posts created at the same time are paged through in the order they were stored
+	b1, b2 := post("did:plc:b", 1, 50), post("did:plc:b", 2, 50)
+	mustCreate(t, store, b1, b2)
+	assertURIs(t, prunable(server.PruneQuery{Before: 100, Limit: 1}), b1)
+	assertURIs(t, prunable(server.PruneQuery{Before: 100, Offset: 1, Limit: 1}), b2)
+}
+
+func testPostMetadata(t *testing.T, store server.PostStore) {
+	p := post("did:plc:a", 1, 100)
+	p.Text = "paying for APIs with #x402 https://x402.org"
+	p.Langs = []string{"en"}
+	p.EmbedType = server.EmbedImages
+	p.LinkDomains = []string{"x402.org"}
+	p.Hashtags = []string{"x402"}
+	p.HasMedia = true
+	p.IndexedAt = 150
+	mustCreate(t, store, p)
+
+	posts, err := store.GetFeedPosts(t.Context(), server.FeedQuery{Cursor: farFuture, Limit: 10})
+	if err != nil {
+		t.Fatalf("get feed posts: %v", err)
+	}
+	if len(posts) != 1 {
+		t.Fatalf("got %d posts, want 1", len(posts))
+	}
+	got := posts[0]
+	if got.Text != p.Text || !slices.Equal(got.Langs, p.Langs) || got.EmbedType != p.EmbedType ||
+		!slices.Equal(got.LinkDomains, p.LinkDomains) || !slices.Equal(got.Hashtags, p.Hashtags) ||
+		!got.HasMedia || got.IndexedAt != 150 {
+		t.Errorf("got %+v, want the metadata of %+v", got, p)
+	}
+
+	// an edited post keeps its place and when it was indexed but has its metadata replaced
+	edited := p
+	edited.Text = "edited"
+	edited.Hashtags = nil
+	edited.HasMedia = false
+	edited.CreatedAt = 500
+	edited.IndexedAt = 600
+	mustCreate(t, store, edited)
+	// storing the post without its record leaves the metadata alone
+	bare := post("did:plc:a", 1, 700)
+	mustCreate(t, store, bare)
+
+	posts, err = store.GetFeedPosts(t.Context(), server.FeedQuery{Cursor: farFuture, Limit: 10})
+	if err != nil {
+		t.Fatalf("get feed posts: %v", err)
+	}
+	if len(posts) != 1 {
+		t.Fatalf("got %d posts, want 1", len(posts))
+	}
+	got = posts[0]
+	if got.Text != "edited" || len(got.Hashtags) != 0 || got.HasMedia || got.CreatedAt != 100 || got.IndexedAt != 150 {
+		t.Errorf("got %+v, want the edited metadata with the original createdAt and indexedAt", got)
+	}
+}
+
+func testSearch(t *testing.T, store server.PostStore) {
+	withText := func(p server.Post, text string) server.Post {
+		p.Text = text
+		p.IndexedAt = p.CreatedAt
+		return p
+	}
+	facilitator := withText(post("did:plc:a", 1, 100), "Running an x402 facilitator on Base")
+	usdc := withText(post("did:plc:b", 1, 200), "x402 settles in USDC")
+	scam := withText(post("did:plc:c", 1, 300), "free USDC airdrop, x402 scam")
+	phrase := withText(post("did:plc:d", 1, 400), "the payment required status code")
+	mustCreate(t, store, facilitator, usdc, scam, phrase)
+
+	search := func(q string, cursor int64) []string {
+		t.Helper()
+		return feedURIs(t, store, server.FeedQuery{Search: q, Cursor: cursor})
+	}
+
+	assertURIs(t, search("x402", 0), scam, usdc, facilitator)
+	assertURIs(t, search("FACILITATOR", 0), facilitator)
+	assertURIs(t, search("facilitator OR usdc", 0), scam, usdc, facilitator)
+	assertURIs(t, search("x402 usdc -scam", 0), usdc)
+	assertURIs(t, search(`"payment required"`, 0), phrase)
+	assertURIs(t, search(`"required payment"`, 0))
+	assertURIs(t, search("x402", 300), usdc, facilitator)
+
+	// search results follow the same rules as the rest of the feed
+	if err := store.HideSubject(t.Context(), usdc.PostURI, "test"); err != nil {
+		t.Fatalf("hide subject: %v", err)
+	}
+	assertURIs(t, search("usdc", 0), scam)
+	assertURIs(t, feedURIs(t, store, server.FeedQuery{Search: "x402", ExcludeUsers: []string{"did:plc:c"}}), facilitator)
+
+	// editing a post updates what it's found by and deleting it removes it
+	mustCreate(t, store, withText(facilitator, "Running a facilitator"))
+	assertURIs(t, search("x402 base", 0))
+	assertURIs(t, search("running", 0), facilitator)
+	if err := store.DeletePostsFromURIs(t.Context(), []string{facilitator.PostURI}); err != nil {
+		t.Fatalf("delete posts: %v", err)
+	}
+	assertURIs(t, search("running", 0))
+
+	if _, err := store.GetFeedPosts(t.Context(), server.FeedQuery{Search: "-scam", Cursor: farFuture, Limit: 10}); err == nil {
+		t.Error("expected an error for a search that only excludes words")
+	}
+}
+
+func testExportPosts(t *testing.T, store server.PostStore) {
+	a1, a2 := post("did:plc:a", 1, 300), post("did:plc:a", 2, 100)
+	b1, c1 := post("did:plc:b", 1, 200), post("did:plc:c", 1, 400)
+	b1.ReplyRoot = a1.PostURI
+	c1.Text = "x402 facilitator"
+	c1.IndexedAt = 400
+	mustCreate(t, store, a1, a2, b1, c1)
+
+	export := func(query server.ExportQuery) []server.Post {
+		t.Helper()
+		posts, err := store.GetExportPosts(t.Context(), query)
+		if err != nil {
+			t.Fatalf("get export posts: %v", err)
+		}
+		return posts
+	}
+	uris := func(posts []server.Post) []string {
+		uris := make([]string, 0, len(posts))
+		for _, p := range posts {
+			uris = append(uris, p.PostURI)
+		}
+		return uris
+	}
+
+	// posts are exported in the order they were stored, not when they were created
+	first := export(server.ExportQuery{Limit: 2})
+	assertURIs(t, uris(first), a1, a2)
+	assertURIs(t, uris(export(server.ExportQuery{AfterID: first[1].ID, Limit: 2})), b1, c1)
+
+	assertURIs(t, uris(export(server.ExportQuery{Since: 200, Until: 400, Limit: 10})), a1, b1)
+	assertURIs(t, uris(export(server.ExportQuery{RootsOnly: true, ExcludeUsers: []string{"did:plc:c"}, Limit: 10})), a1, a2)
+	assertURIs(t, uris(export(server.ExportQuery{OnlyUsers: []string{"did:plc:b"}, Limit: 10})), b1)
+	assertURIs(t, uris(export(server.ExportQuery{OnlyUsers: []string{}, Limit: 10})))
+
+	searched := export(server.ExportQuery{Search: "facilitator", Limit: 10})
+	assertURIs(t, uris(searched), c1)
+	if searched[0].Text != c1.Text || searched[0].IndexedAt != 400 {
+		t.Errorf("got %+v, want the post's metadata exported", searched[0])
+	}
+
+	if err := store.HideSubject(t.Context(), "did:plc:a", "test"); err != nil {
+		t.Fatalf("hide subject: %v", err)
+	}
+	assertURIs(t, uris(export(server.ExportQuery{Limit: 10})), b1, c1)
+}